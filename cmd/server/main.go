@@ -1,6 +1,7 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"dash2hlsd/internal/api"
 	"dash2hlsd/internal/channels"
@@ -9,9 +10,12 @@ import (
 	"dash2hlsd/internal/logger"
 	"dash2hlsd/internal/session"
 	"flag"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -20,11 +24,48 @@ func main() {
 	// 1. Parse command-line arguments
 	listenAddr := flag.String("l", ":8080", "HTTP listen address")
 	logLevel := flag.String("L", "info", "Log level (error, warn, info, debug)")
+	logFile := flag.String("log-file", "", "Write logs to this file instead of stdout (\"stderr\" for standard error)")
+	logMaxSize := flag.Int64("log-max-size", 100, "Size in MiB at which the -log-file is rotated (0 to disable rotation)")
 	configFile := flag.String("c", "channels.json", "Path to the channel config file")
+	keysFile := flag.String("keys-file", "", "JSON file mapping channel IDs to 'kid:key' strings, overriding their configured keys and reloaded when it changes")
+	keysPoll := flag.Duration("keys-poll", 5*time.Second, "How often the -keys-file is checked for changes")
+	corsOrigins := flag.String("cors-origins", "*", "Comma-separated list of allowed CORS origins (\"*\" for any, empty to disable)")
+	segmentBuffer := flag.Int("segment-buffer", 32*1024, "Chunk size in bytes used to stream segments to clients")
+	playlistGzipLevel := flag.Int("gzip-level", gzip.DefaultCompression, "Gzip level for playlist responses (-1 for the default, 1-9, 0 to disable)")
+	maxPlaylistWaiters := flag.Int("max-playlist-waiters", api.DefaultMaxPlaylistWaiters, "Maximum requests waiting at once for a playlist that is not ready, per representation")
+	adminToken := flag.String("admin-token", "", "Shared secret required as a bearer token by the /admin/ routes (empty disables them)")
+	dashRoutes := flag.Bool("dash-routes", false, "Also serve segments at their origin paths under /dash/{channelId}/ for DASH clients")
+	accessLog := flag.Bool("access-log", false, "Log every request with its status, size and duration")
+	accessLogSample := flag.Int("access-log-sample", 1, "Log only one in this many successful segment requests in the -access-log (playlists and errors are always logged)")
+	readyCheckOrigin := flag.Bool("ready-check-origin", false, "Make /readyz also require a channel's manifest to be fetchable")
+	maxManifestBytes := flag.Int64("max-manifest-bytes", dash.DefaultMaxManifestBytes, "Maximum size in bytes of a fetched MPD")
+	downloadRate := flag.Int64("download-rate", 0, "Aggregate bandwidth cap in bytes per second for segment downloads across all channels (0 for unlimited)")
+	originGuard := flag.Bool("origin-guard", false, "Refuse to fetch manifests and segments from private, loopback and link-local addresses")
+	originAllow := flag.String("origin-allow", "", "Comma-separated hostnames, IPs or CIDRs that are the only ones fetched from (enables -origin-guard)")
+	originDeny := flag.String("origin-deny", "", "Comma-separated hostnames, IPs or CIDRs never fetched from (enables -origin-guard)")
 	flag.Parse()
 
+	if *playlistGzipLevel < gzip.HuffmanOnly || *playlistGzipLevel > gzip.BestCompression {
+		fmt.Fprintf(os.Stderr, "Invalid -gzip-level %d: must be between %d and %d\n", *playlistGzipLevel, gzip.HuffmanOnly, gzip.BestCompression)
+		os.Exit(2)
+	}
+
 	// 2. Initialize logger
-	log := logger.NewLogger(*logLevel)
+	var logOutput io.Writer = os.Stdout
+	switch *logFile {
+	case "":
+	case "stderr":
+		logOutput = os.Stderr
+	default:
+		rotatingFile, err := logger.OpenRotatingFile(*logFile, *logMaxSize*1024*1024)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -log-file: %v\n", err)
+			os.Exit(2)
+		}
+		defer rotatingFile.Close()
+		logOutput = rotatingFile
+	}
+	log := logger.NewLoggerWithOutput(*logLevel, logOutput)
 	log.Infof("Starting DASH to HLS Proxy...")
 	log.Infof("Log level set to: %s", *logLevel)
 
@@ -38,12 +79,35 @@ func main() {
 
 	// 4. Initialize services and managers
 	dashClient := dash.NewClient(log)
+	dashClient.MaxManifestBytes = *maxManifestBytes
+	dashClient.DownloadRateLimiter = dash.NewRateLimiter(*downloadRate)
+	if *downloadRate > 0 {
+		log.Infof("Limiting segment downloads to %d bytes per second", *downloadRate)
+	}
+	if *originGuard || *originAllow != "" || *originDeny != "" {
+		policy, err := dash.NewHostPolicy(splitList(*originAllow), splitList(*originDeny))
+		if err != nil {
+			log.Errorf("Invalid origin host policy: %v", err)
+			os.Exit(2)
+		}
+		dashClient.HostPolicy = policy
+	}
 	keyService, err := key.NewService(cfg)
 	if err != nil {
 		log.Errorf("Failed to initialize key service: %v", err)
 		os.Exit(1)
 	}
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	if *keysFile != "" {
+		if err := keyService.LoadKeysFile(*keysFile); err != nil {
+			log.Errorf("Failed to load keys file: %v", err)
+			os.Exit(1)
+		}
+		go keyService.WatchKeysFile(watchCtx, *keysFile, *keysPoll, log)
+	}
 	sessionMgr := session.NewManager(log, cfg, dashClient)
+	sessionMgr.SetKeyStore(keyService)
 
 	// The segment cache is created inside the session manager, but we need to start it.
 	// This is a bit of a design smell. A better design might have the cache be external.
@@ -52,7 +116,12 @@ func main() {
 	sessionMgr.Start()
 
 	// 5. Set up API router with dependencies
-	router := api.New(sessionMgr, keyService)
+	apiOpts := api.Options{SegmentWriteBufferSize: *segmentBuffer, PlaylistGzipLevel: *playlistGzipLevel, MaxPlaylistWaiters: *maxPlaylistWaiters, AdminToken: *adminToken, DASHRoutes: *dashRoutes, ReadinessProbesOrigin: *readyCheckOrigin, AccessLog: *accessLog, AccessLogSampleRate: *accessLogSample, Logger: log}
+	apiOpts.CORSAllowedOrigins = splitList(*corsOrigins)
+	if *adminToken == "" {
+		log.Warnf("No -admin-token is set, so the /admin/ routes are disabled")
+	}
+	router := api.New(sessionMgr, keyService, apiOpts)
 
 	// 6. Set up and run the HTTP server with graceful shutdown
 	server := &http.Server{
@@ -68,6 +137,15 @@ func main() {
 		}
 	}()
 
+	// Reload the channel configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig(*configFile, log, keyService, sessionMgr)
+		}
+	}()
+
 	// Listen for shutdown signals
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
@@ -79,6 +157,7 @@ func main() {
 	defer cancel()
 
 	// Stop background services
+	stopWatching()
 	sessionMgr.Stop()
 
 	if err := server.Shutdown(ctx); err != nil {
@@ -88,3 +167,31 @@ func main() {
 
 	log.Infof("Server exited gracefully")
 }
+
+// reloadConfig loads the channel configuration file again and applies it to the running services.
+// An invalid file is reported and ignored, leaving the current configuration in place.
+func reloadConfig(path string, log logger.Logger, keyService *key.Service, sessionMgr *session.SessionManager) {
+	log.Infof("Reloading configuration from %s", path)
+	cfg, err := channels.LoadConfig(path)
+	if err != nil {
+		log.Errorf("Keeping the current configuration, failed to reload: %v", err)
+		return
+	}
+	// The key service also rejects duplicate channel IDs, so it is updated before any session changes.
+	if err := keyService.Update(cfg); err != nil {
+		log.Errorf("Keeping the current configuration, failed to reload: %v", err)
+		return
+	}
+	sessionMgr.Reload(cfg)
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
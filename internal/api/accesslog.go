@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// accessLog wraps a handler so that requests are logged once answered. Only one in
+// Options.AccessLogSampleRate successful segment requests is logged, since players fetch a segment
+// every few seconds; playlist, key and admin requests and every error response are always logged.
+func (a *API) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK // Nothing was written, which net/http answers with 200
+		}
+		if status < http.StatusBadRequest && isSegmentPath(r.URL.Path) && !a.sampleSegmentLog() {
+			return
+		}
+		a.opts.Logger.Infof("%s %s %s %d %dB %s", r.RemoteAddr, r.Method, r.URL.RequestURI(), status, rec.written, time.Since(start).Round(time.Microsecond))
+	})
+}
+
+// sampleSegmentLog reports whether the current successful segment request is one of those logged.
+// The first request is logged, then one in every AccessLogSampleRate.
+func (a *API) sampleSegmentLog() bool {
+	if a.opts.AccessLogSampleRate <= 1 {
+		return true
+	}
+	return (a.segmentRequests.Add(1)-1)%uint64(a.opts.AccessLogSampleRate) == 0
+}
+
+// isSegmentPath reports whether path is a segment route rather than a playlist or manifest.
+func isSegmentPath(path string) bool {
+	if strings.HasPrefix(path, "/dash/") {
+		return true
+	}
+	return strings.HasPrefix(path, "/live/") && !strings.HasSuffix(path, ".m3u8") && !strings.HasSuffix(path, ".json")
+}
+
+// statusRecorder records the status and body size of a response for the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.written += int64(n)
+	return n, err
+}
+
+// Flush keeps segment streaming progressive through the recorder.
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
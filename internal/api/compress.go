@@ -0,0 +1,112 @@
+package api
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// playlistContentType is the Content-Type of master and media playlists, the only responses compressed.
+const playlistContentType = "application/vnd.apple.mpegurl"
+
+// gzipPlaylists wraps a handler so that playlist responses are gzip-compressed at the given level
+// for clients that accept it. Segments are passed through untouched, as media is already compressed.
+func gzipPlaylists(next http.Handler, level int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gw := &gzipResponseWriter{
+			ResponseWriter: w,
+			level:          level,
+			acceptsGzip:    acceptsGzip(r.Header.Get("Accept-Encoding")),
+			head:           r.Method == http.MethodHead,
+		}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows a gzip-encoded response.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		// An explicit zero quality value means the coding is not acceptable.
+		if qValue, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			q, err := strconv.ParseFloat(qValue, 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter decides when the headers are written whether the response is a playlist,
+// and if so compresses the body written through it.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	level       int
+	acceptsGzip bool
+	head        bool
+
+	wroteHeader bool
+	gz          *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	compressible := status == http.StatusOK || status == http.StatusNotModified
+	if compressible && h.Get("Content-Type") == playlistContentType && h.Get("Content-Encoding") == "" {
+		h.Add("Vary", "Accept-Encoding")
+		if etag := h.Get("ETag"); w.acceptsGzip && etag != "" && !strings.HasPrefix(etag, "W/") {
+			// The compressed body differs byte for byte from the one the strong ETag was computed on.
+			h.Set("ETag", "W/"+etag)
+		}
+		if w.acceptsGzip && status == http.StatusOK {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length") // The compressed length is not known up front
+			if !w.head {
+				gz, err := gzip.NewWriterLevel(w.ResponseWriter, w.level)
+				if err != nil {
+					gz = gzip.NewWriter(w.ResponseWriter)
+				}
+				w.gz = gz
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush keeps segment streaming progressive through the wrapper.
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close finishes the gzip stream, if the response was compressed.
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
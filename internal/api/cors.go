@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsPathPrefixes are the routes fetched by browser players, which get CORS headers.
+// The admin, metrics and health routes are meant for operators and stay same-origin.
+var corsPathPrefixes = []string{"/live/", "/dash/", "/key/", "/license/"}
+
+const (
+	corsAllowMethods  = "GET, HEAD, POST, OPTIONS"
+	corsAllowHeaders  = "Content-Type, Range, If-None-Match, If-Modified-Since"
+	corsExposeHeaders = "Content-Length, Content-Range, Accept-Ranges, Retry-After"
+	corsMaxAge        = "86400"
+)
+
+// cors wraps a handler so that player routes carry CORS headers for the allowed origins, whatever
+// the status of the response, and answers their OPTIONS preflight requests itself.
+func (a *API) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isCORSPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		origin, ok := a.allowedOrigin(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Set("Access-Control-Allow-Origin", origin)
+		if origin != "*" {
+			header.Add("Vary", "Origin")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			header.Set("Access-Control-Allow-Methods", corsAllowMethods)
+			header.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			header.Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		header.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isCORSPath reports whether path is one of the routes fetched by browser players.
+func isCORSPath(path string) bool {
+	for _, prefix := range corsPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
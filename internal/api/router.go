@@ -1,59 +1,253 @@
 package api
 
 import (
+	"context"
+	"crypto/subtle"
+	"dash2hlsd/internal/dash"
+	"dash2hlsd/internal/hls"
 	"dash2hlsd/internal/key"
+	"dash2hlsd/internal/logger"
+	"dash2hlsd/internal/metrics"
 	"dash2hlsd/internal/session"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	playlistRetryInterval = 500 * time.Millisecond
-	playlistMaxRetries    = 65 // 32.5 seconds total wait time, to accommodate downloader retries
+	playlistWaitTimeout = 32500 * time.Millisecond // Long enough to accommodate downloader retries
+
+	defaultSegmentWriteBufferSize = 32 * 1024 // Bytes written to the client per chunk when streaming a segment
+
+	// maxLicenseRequestBytes caps the body of a clear-key license request, which only lists key IDs.
+	maxLicenseRequestBytes = 16 * 1024
+
+	// DefaultMaxPlaylistWaiters is the number of requests allowed to wait for the same playlist
+	// when Options.MaxPlaylistWaiters is zero.
+	DefaultMaxPlaylistWaiters = 64
 )
 
+// Options holds the server-level settings of the API.
+type Options struct {
+	// CORSAllowedOrigins lists the browser origins permitted to fetch playlists, segments and keys.
+	// "*" allows any origin; an empty list disables CORS.
+	CORSAllowedOrigins []string
+	// SegmentWriteBufferSize is the chunk size, in bytes, used to stream segments to clients.
+	// Each chunk is flushed as it is written. Zero selects a default of 32 KiB.
+	SegmentWriteBufferSize int
+	// PlaylistGzipLevel is the gzip level used to compress playlists for clients that accept it,
+	// from gzip.DefaultCompression (-1) to gzip.BestCompression (9). Zero disables compression.
+	PlaylistGzipLevel int
+	// MaxPlaylistWaiters caps the requests waiting at once for a playlist that is not ready yet, per
+	// representation. Excess requests are answered 503 at once. Zero selects DefaultMaxPlaylistWaiters.
+	MaxPlaylistWaiters int
+	// AdminToken, when set, is the shared secret that requests to the /admin/ routes must present as
+	// "Authorization: Bearer <token>". An empty AdminToken disables the admin routes, which would
+	// otherwise let anyone stop sessions and steer players.
+	AdminToken string
+	// DASHRoutes mirrors the origin's segment paths under /dash/{channelId}/, serving the cached bytes
+	// to DASH clients alongside the HLS routes.
+	DASHRoutes bool
+	// ReadinessProbesOrigin makes /readyz also require the manifest of at least one channel to be fetchable.
+	ReadinessProbesOrigin bool
+	// AccessLog logs every request to Logger once answered, with its status, size and duration.
+	AccessLog bool
+	// AccessLogSampleRate, when above one, logs only one in this many successful segment requests.
+	// Playlist requests and error responses are always logged.
+	AccessLogSampleRate int
+	// Logger receives server-level errors such as recovered handler panics.
+	// A nil Logger logs at the info level to stdout.
+	Logger logger.Logger
+}
+
 type API struct {
 	sessionMgr *session.SessionManager
 	keyService *key.Service
+	opts       Options
+
+	// waiters counts the requests waiting for each playlist, keyed by channel, media type and representation.
+	waitersMutex sync.Mutex
+	waiters      map[string]int
+
+	// segmentRequests counts the successful segment requests considered for the sampled access log.
+	segmentRequests atomic.Uint64
 }
 
-func New(sessionMgr *session.SessionManager, keyService *key.Service) http.Handler {
+func New(sessionMgr *session.SessionManager, keyService *key.Service, opts Options) http.Handler {
+	if opts.Logger == nil {
+		opts.Logger = logger.NewLogger("info")
+	}
+	if opts.MaxPlaylistWaiters <= 0 {
+		opts.MaxPlaylistWaiters = DefaultMaxPlaylistWaiters
+	}
 	api := &API{
 		sessionMgr: sessionMgr,
 		keyService: keyService,
+		opts:       opts,
+		waiters:    make(map[string]int),
 	}
 
 	mux := http.NewServeMux()
 
+	// GET patterns also match HEAD requests, which are answered with the same headers and no body.
 	mux.HandleFunc("GET /live/{channelId}/master.m3u8", api.handleMasterPlaylist)
+	mux.HandleFunc("GET /live/{channelId}/"+session.SteeringManifestName, api.handleSteeringManifest)
+	mux.HandleFunc("GET /live/{channelId}/drm.json", api.handleContentProtection)
 	mux.HandleFunc("GET /live/{channelId}/{mediaType}/{representationId}/playlist.m3u8", api.handleMediaPlaylist)
+	mux.HandleFunc("GET /live/{channelId}/video/{representationId}/iframes.m3u8", api.handleIFramePlaylist)
 	mux.HandleFunc("GET /live/{channelId}/{mediaType}/{representationId}/{segmentName}", api.handleSegment)
+	if opts.DASHRoutes {
+		mux.HandleFunc("GET /dash/{channelId}/{segmentPath...}", api.handleDASHSegment)
+	}
 	mux.HandleFunc("GET /key/{channelId}", api.handleKey)
+	mux.HandleFunc("POST /license/{channelId}", api.handleClearKeyLicense)
+	if opts.AdminToken != "" {
+		mux.Handle("GET /admin/sessions", api.requireAdmin(api.handleListSessions))
+		mux.Handle("DELETE /admin/sessions/{channelId}", api.requireAdmin(api.handleStopSession))
+		mux.Handle("GET /admin/sessions/{channelId}/window", api.requireAdmin(api.handleSessionWindow))
+		mux.Handle("GET /admin/sessions/{channelId}/mapping", api.requireAdmin(api.handleSessionMapping))
+		mux.Handle("PUT /admin/sessions/{channelId}/steering", api.requireAdmin(api.handleSetPathwayPriority))
+	}
+	mux.Handle("GET /metrics", metrics.Handler())
+	// Health checks live outside /live/ so they cannot be mistaken for a channel ID.
+	mux.HandleFunc("GET /healthz", api.handleHealthz)
+	mux.HandleFunc("GET /readyz", api.handleReadyz)
+
+	var handler http.Handler = mux
+	if opts.PlaylistGzipLevel != 0 {
+		handler = gzipPlaylists(handler, opts.PlaylistGzipLevel)
+	}
+	handler = api.recoverPanics(api.cors(handler))
+	if opts.AccessLog {
+		handler = api.accessLog(handler)
+	}
+	return handler
+}
 
-	return mux
+// recoverPanics wraps a handler so that a panic fails only its own request with a 500,
+// logging the panic value and stack trace instead of dropping the connection.
+func (a *API) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec) // Deliberate aborts are left to net/http
+			}
+			a.opts.Logger.Errorf("Panic while handling %s %s: %v\n%s", r.Method, r.URL.Path, rec, debug.Stack())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (a *API) handleMasterPlaylist(w http.ResponseWriter, r *http.Request) {
+	metrics.PlaylistRequests.WithLabel("master").Inc()
 	channelId := r.PathValue("channelId")
 	sess, err := a.sessionMgr.GetOrCreateSession(channelId)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to get session: %v", err), http.StatusInternalServerError)
 		return
 	}
+	if err := sess.WaitForWarmup(r.Context()); err != nil {
+		if r.Context().Err() == nil {
+			// Timed out, or the session stopped, in which case a retry starts a new one.
+			writeRetryLater(w, err)
+		}
+		return
+	}
 
-	playlist, err := sess.GetMasterPlaylist()
+	var playlist session.Playlist
+	if videoRepId := r.URL.Query().Get("video"); videoRepId != "" {
+		// Constrained devices can pin the master playlist to a single video variant.
+		var body string
+		body, err = sess.GetPinnedMasterPlaylist(videoRepId)
+		if errors.Is(err, session.ErrUnknownRepresentation) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		playlist = session.NewPlaylist(body)
+	} else {
+		playlist, err = sess.GetMasterPlaylistEntry()
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to generate master playlist: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
-	w.Write([]byte(playlist))
+	w.Header().Set("Cache-Control", masterPlaylistCacheControl(sess))
+	writePlaylist(w, r, playlist)
+}
+
+// handleSteeringManifest serves the content steering manifest that players poll to choose a pathway.
+func (a *API) handleSteeringManifest(w http.ResponseWriter, r *http.Request) {
+	metrics.PlaylistRequests.WithLabel("steering").Inc()
+	channelId := r.PathValue("channelId")
+	sess, err := a.sessionMgr.GetOrCreateSession(channelId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	manifest, err := sess.GetSteeringManifest()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode steering manifest: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Players reload the manifest after its TTL, so intermediaries must not serve it any longer.
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", manifest.TTL))
+	writeResponse(w, r, "application/json", body)
+}
+
+// handleContentProtection lists the DRM signalling of a channel's MPD, with the PSSH box of each
+// DRM system, so that players decrypting CENC segments can request licenses.
+func (a *API) handleContentProtection(w http.ResponseWriter, r *http.Request) {
+	channelId := r.PathValue("channelId")
+	sess, err := a.sessionMgr.GetOrCreateSession(channelId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		ChannelID          string                          `json:"channelId"`
+		ContentProtections []session.ContentProtectionInfo `json:"contentProtections"`
+	}{
+		ChannelID:          channelId,
+		ContentProtections: sess.GetContentProtection(),
+	}
+	if response.ContentProtections == nil {
+		response.ContentProtections = []session.ContentProtectionInfo{}
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode content protection: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The PSSH boxes change with the MPD, which is reloaded as often as the playlists.
+	w.Header().Set("Cache-Control", playlistCacheControl(sess))
+	writeResponse(w, r, "application/json", body)
 }
 
 func (a *API) handleMediaPlaylist(w http.ResponseWriter, r *http.Request) {
+	metrics.PlaylistRequests.WithLabel("media").Inc()
 	channelId := r.PathValue("channelId")
 	mediaType := r.PathValue("mediaType")
 	repId := r.PathValue("representationId")
@@ -64,24 +258,107 @@ func (a *API) handleMediaPlaylist(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var playlist string
-	for i := 0; i < playlistMaxRetries; i++ {
-		playlist, err = sess.GetMediaPlaylist(mediaType, repId)
-		if err == nil {
-			break // Success
-		}
-		sess.Logger.Debugf("Attempt %d: Media playlist for repId '%s' not ready, retrying in %v...", i+1, repId, playlistRetryInterval)
-		time.Sleep(playlistRetryInterval)
+	// Players that saw CAN-SKIP-UNTIL request delta updates with _HLS_skip=YES (or v2).
+	getPlaylist := sess.GetMediaPlaylistEntry
+	if skip := r.URL.Query().Get("_HLS_skip"); skip == "YES" || skip == "v2" {
+		getPlaylist = sess.GetDeltaMediaPlaylistEntry
 	}
 
+	playlist, err := a.waitForPlaylist(r.Context(), channelId+"/"+mediaType+"/"+repId, func(ctx context.Context) (session.Playlist, error) {
+		return sess.WaitForPlaylist(ctx, repId, func() (session.Playlist, error) { return getPlaylist(mediaType, repId) })
+	})
+	if errors.Is(err, errTooManyWaiters) {
+		writeRetryLater(w, err)
+		return
+	}
+	if errors.Is(err, session.ErrPlaylistWarmingUp) {
+		// The representation is valid but still downloading its first segments.
+		sess.Logger.Warnf("Media playlist for repId '%s' is still warming up after %s. Returning 503.", repId, playlistWaitTimeout)
+		writeRetryLater(w, err)
+		return
+	}
 	if err != nil {
-		sess.Logger.Errorf("Failed to generate media playlist for repId '%s' after %d attempts: %v. Returning 404.", repId, playlistMaxRetries, err)
+		sess.Logger.Errorf("Failed to generate media playlist for repId '%s': %v. Returning 404.", repId, err)
 		http.Error(w, fmt.Sprintf("Failed to generate media playlist: %v", err), http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
-	w.Write([]byte(playlist))
+	w.Header().Set("Cache-Control", mediaPlaylistCacheControl(sess, playlist.Body))
+	writePlaylist(w, r, playlist)
+}
+
+// handleIFramePlaylist serves the I-frame playlist of a trick mode representation, used by players to scrub.
+func (a *API) handleIFramePlaylist(w http.ResponseWriter, r *http.Request) {
+	metrics.PlaylistRequests.WithLabel("iframe").Inc()
+	channelId := r.PathValue("channelId")
+	repId := r.PathValue("representationId")
+
+	sess, err := a.sessionMgr.GetOrCreateSession(channelId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	playlist, err := a.waitForPlaylist(r.Context(), channelId+"/iframe/"+repId, func(ctx context.Context) (session.Playlist, error) {
+		return sess.WaitForPlaylist(ctx, repId, func() (session.Playlist, error) {
+			return sess.GetIFramePlaylist(repId)
+		})
+	})
+	if errors.Is(err, errTooManyWaiters) || errors.Is(err, session.ErrPlaylistWarmingUp) {
+		writeRetryLater(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to generate I-frame playlist: %v", err), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", mediaPlaylistCacheControl(sess, playlist.Body))
+	writePlaylist(w, r, playlist)
+}
+
+// errTooManyWaiters is returned by waitForPlaylist when MaxPlaylistWaiters requests already wait for the playlist.
+var errTooManyWaiters = errors.New("too many requests waiting for this playlist")
+
+// waitForPlaylist returns the playlist from wait, a session's WaitForPlaylist, letting it wait for a playlist
+// that is warming up for up to playlistWaitTimeout or until ctx, the client's request, is done. Only
+// MaxPlaylistWaiters requests may wait for the same key at once; beyond that, errTooManyWaiters is
+// returned without waiting.
+func (a *API) waitForPlaylist(ctx context.Context, key string, wait func(context.Context) (session.Playlist, error)) (session.Playlist, error) {
+	// Try without waiting first, so that only the requests that do wait count against the limit.
+	noWait, cancel := context.WithCancel(ctx)
+	cancel()
+	playlist, err := wait(noWait)
+	if !errors.Is(err, session.ErrPlaylistWarmingUp) {
+		return playlist, err
+	}
+
+	a.waitersMutex.Lock()
+	if a.waiters[key] >= a.opts.MaxPlaylistWaiters {
+		a.waitersMutex.Unlock()
+		return session.Playlist{}, errTooManyWaiters
+	}
+	a.waiters[key]++
+	a.waitersMutex.Unlock()
+	defer func() {
+		a.waitersMutex.Lock()
+		if a.waiters[key]--; a.waiters[key] == 0 {
+			delete(a.waiters, key)
+		}
+		a.waitersMutex.Unlock()
+	}()
+
+	waitCtx, cancel := context.WithTimeout(ctx, playlistWaitTimeout)
+	defer cancel()
+	return wait(waitCtx)
+}
+
+// writeRetryLater answers a request that cannot be served yet, such as for a playlist that is warming up
+// or that waitForPlaylist turned away, or for a segment beyond the on-demand fetch limit, asking the
+// client to retry shortly.
+func writeRetryLater(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
 }
 
 func (a *API) handleSegment(w http.ResponseWriter, r *http.Request) {
@@ -94,35 +371,495 @@ func (a *API) handleSegment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to get session", http.StatusInternalServerError)
 		return
 	}
+	sess.Touch()
 
-	// The logic is now extremely simple, as per your design.
-	// We just construct the standardized cache key and look it up.
-	segmentId := strings.TrimSuffix(segmentName, ".m4s")
-	if segmentId == "init" {
-		// This is the standardized name for init segments in the cache.
+	// A representation missing from the MPD will never be cached, unlike a segment that is not downloaded yet.
+	cacheKey, err := sess.SegmentCacheKey(repId, segmentName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
 	}
+	a.serveSegment(w, r, sess, cacheKey, segmentName)
+}
 
-	cacheKey := fmt.Sprintf("%s/%s/%s", channelId, repId, segmentId)
+// handleDASHSegment serves a segment or init segment at its path in the origin's URL structure,
+// relative to the channel's manifest, so that DASH clients can load them through the proxy's cache.
+// Their MPD must point its BaseURL at /dash/{channelId}/.
+func (a *API) handleDASHSegment(w http.ResponseWriter, r *http.Request) {
+	channelId := r.PathValue("channelId")
+	segmentPath := r.PathValue("segmentPath")
+	if r.URL.RawQuery != "" {
+		segmentPath += "?" + r.URL.RawQuery
+	}
 
+	sess, err := a.sessionMgr.GetOrCreateSession(channelId)
+	if err != nil {
+		http.Error(w, "Failed to get session", http.StatusInternalServerError)
+		return
+	}
+	sess.Touch()
+
+	cacheKey, err := sess.DASHSegmentCacheKey(segmentPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	a.serveSegment(w, r, sess, cacheKey, segmentPath)
+}
+
+// serveSegment writes the cached segment with the given cache key, honouring conditional and range requests.
+func (a *API) serveSegment(w http.ResponseWriter, r *http.Request, sess *session.StreamSession, cacheKey, segmentName string) {
 	sess.Logger.Debugf("Looking for segment in cache with key: %s", cacheKey)
-	data, found := sess.SegCache.Get(cacheKey)
+	entry, found := sess.SegCache.GetEntry(cacheKey)
 	if !found {
-		http.Error(w, fmt.Sprintf("Segment %s not found in cache with key %s", segmentName, cacheKey), http.StatusNotFound)
+		// Segments of a VOD presentation are only fetched once a player asks for them.
+		var err error
+		entry, err = sess.FetchSegment(cacheKey)
+		if errors.Is(err, session.ErrSegmentNotOnDemand) {
+			http.Error(w, fmt.Sprintf("Segment %s not found in cache with key %s", segmentName, cacheKey), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, session.ErrTooManyOnDemandFetches) {
+			writeRetryLater(w, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch segment %s: %v", segmentName, err), http.StatusBadGateway)
+			return
+		}
+	}
+	sess.PrefetchAfter(cacheKey)
+
+	contentType := entry.ContentType
+	if contentType == "" {
+		contentType = "video/mp4"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if strings.HasSuffix(cacheKey, "/init") {
+		// A live origin may replace the init segment, which is revalidated on MPD refreshes.
+		w.Header().Set("Cache-Control", playlistCacheControl(sess))
+	} else {
+		w.Header().Set("Cache-Control", segmentCacheControl)
+	}
+	if origin, ok := a.allowedOrigin(r); ok {
+		// Lets the Resource Timing API expose detailed timings of segment fetches to the player.
+		w.Header().Set("Timing-Allow-Origin", origin)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", entry.ContentETag)
+
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		// http.ServeContent handles ranges, but would answer a multi-range request with a multipart body
+		// and a malformed range without advertising the size, so those keep their previous answers.
+		start, _, ok := parseRange(rangeHeader, len(entry.Data))
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(entry.Data)))
+			http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if start < 0 {
+			r.Header.Del("Range")
+		}
+	}
+	// The segment is read in place from the cache, and ServeContent also answers conditional requests
+	// against the ETag and the time the segment was cached.
+	http.ServeContent(a.segmentWriter(w), r, segmentName, entry.CachedAt, entry.Reader())
+}
+
+// Cache-Control values of playlist and segment responses.
+const (
+	// livePlaylistCacheControl makes clients and CDNs revalidate live responses that change with the MPD,
+	// such as init segments.
+	livePlaylistCacheControl = "no-cache"
+	// finalPlaylistCacheControl is used once a playlist can no longer change, for VOD and ended streams.
+	finalPlaylistCacheControl = "public, max-age=86400"
+	// segmentCacheControl is used for media segments, whose content never changes for a given URL.
+	segmentCacheControl = "public, max-age=31536000, immutable"
+)
+
+// playlistCacheControl returns the Cache-Control of a session's responses that change with the MPD.
+func playlistCacheControl(sess *session.StreamSession) string {
+	if sess.IsVOD() || sess.IsEnded() {
+		return finalPlaylistCacheControl
+	}
+	return livePlaylistCacheControl
+}
+
+// masterPlaylistCacheControl returns the Cache-Control of a session's master playlist. A live master
+// playlist only changes when the MPD's representations do, so it is cached as long as the session
+// keeps a generated one.
+func masterPlaylistCacheControl(sess *session.StreamSession) string {
+	if sess.IsVOD() || sess.IsEnded() {
+		return finalPlaylistCacheControl
+	}
+	return fmt.Sprintf("public, max-age=%d", int(sess.MasterPlaylistMaxAge().Seconds()))
+}
+
+// mediaPlaylistCacheControl returns the Cache-Control of a media playlist. A live media playlist gains
+// a segment every target duration, so it is cached for half of it, letting players see new segments
+// in time while CDNs absorb the polling of many players.
+func mediaPlaylistCacheControl(sess *session.StreamSession, playlist string) string {
+	if sess.IsVOD() || sess.IsEnded() {
+		return finalPlaylistCacheControl
+	}
+	targetDuration, ok := hls.ParseTargetDuration(playlist)
+	if !ok {
+		return livePlaylistCacheControl
+	}
+	return fmt.Sprintf("public, max-age=%d", max(targetDuration/2, 1))
+}
+
+// parseRange parses a single-range "bytes=" Range header against a body of the given size and
+// returns the inclusive byte offsets to serve. A start of -1 means the full body should be served,
+// as for multi-range requests and units other than bytes. ok is false when the range is malformed
+// or cannot be satisfied.
+func parseRange(header string, size int) (start, end int, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return -1, -1, true
+	}
+	if strings.Contains(spec, ",") {
+		return -1, -1, true // Multi-range responses are not supported, so the full body is served instead
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+	if first == "" {
+		// A suffix range requests the final bytes of the body.
+		suffix, err := strconv.Atoi(last)
+		if err != nil || suffix <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		return max(size-suffix, 0), size - 1, true
+	}
+
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.Atoi(last)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+// segmentWriter wraps a segment response so that the body is written in fixed-size chunks, flushing after
+// each one, and large segments reach the client progressively instead of in a single write.
+func (a *API) segmentWriter(w http.ResponseWriter) http.ResponseWriter {
+	bufferSize := a.opts.SegmentWriteBufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultSegmentWriteBufferSize
+	}
+	flusher, _ := w.(http.Flusher)
+	return &chunkedWriter{ResponseWriter: w, flusher: flusher, chunkSize: bufferSize}
+}
+
+// chunkedWriter splits the writes of a response into chunks of at most chunkSize bytes, flushing after each one.
+type chunkedWriter struct {
+	http.ResponseWriter
+	flusher   http.Flusher
+	chunkSize int
+}
+
+func (cw *chunkedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := cw.ResponseWriter.Write(p[written:min(written+cw.chunkSize, len(p))])
+		written += n
+		if err != nil {
+			return written, err // The client went away
+		}
+		if cw.flusher != nil {
+			cw.flusher.Flush()
+		}
+	}
+	return written, nil
+}
+
+// writeResponse writes a small in-memory body with its Content-Type, Content-Length and ETag,
+// omitting the body for HEAD requests and answering 304 to requests that already have it.
+func writeResponse(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	writeResponseWithETag(w, r, contentType, body, session.ContentETag(body))
+}
+
+// writePlaylist writes a playlist with the ETag computed when it was generated.
+func writePlaylist(w http.ResponseWriter, r *http.Request, playlist session.Playlist) {
+	writeResponseWithETag(w, r, playlistContentType, []byte(playlist.Body), playlist.ETag)
+}
+
+// writeResponseWithETag is writeResponse with a precomputed ETag.
+func writeResponseWithETag(w http.ResponseWriter, r *http.Request, contentType string, body []byte, etag string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodHead {
+		// Writing the headers explicitly lets wrappers such as gzipPlaylists set them as they would for GET.
+		w.WriteHeader(http.StatusOK)
 		return
 	}
+	w.Write(body)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using the weak comparison
+// required for If-None-Match so that ETags weakened by compression still match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedOrigin returns the value to echo in CORS-related headers for the request's Origin,
+// and whether the origin is permitted at all.
+func (a *API) allowedOrigin(r *http.Request) (string, bool) {
+	origin := r.Header.Get("Origin")
+	for _, allowed := range a.opts.CORSAllowedOrigins {
+		if allowed == "*" {
+			return "*", true
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// handleHealthz is the liveness probe: it succeeds as long as the server answers requests.
+func (a *API) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, r, "text/plain; charset=utf-8", []byte("ok\n"))
+}
 
-	w.Header().Set("Content-Type", "video/mp4")
-	w.Write(data)
+// handleReadyz is the readiness probe: it succeeds once the session manager is running and,
+// if configured, a channel's manifest can be fetched.
+func (a *API) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if a.sessionMgr == nil || !a.sessionMgr.Ready() {
+		http.Error(w, "Session manager not started", http.StatusServiceUnavailable)
+		return
+	}
+	if a.opts.ReadinessProbesOrigin {
+		if err := a.sessionMgr.ProbeOrigins(); err != nil {
+			http.Error(w, fmt.Sprintf("No origin reachable: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	writeResponse(w, r, "text/plain; charset=utf-8", []byte("ok\n"))
 }
 
+// handleKey serves a channel's key. Playlists of channels with several keys select theirs with a kid
+// query parameter holding the key ID in hex.
 func (a *API) handleKey(w http.ResponseWriter, r *http.Request) {
 	channelId := r.PathValue("channelId")
 	key, found := a.keyService.GetKeyForChannel(channelId)
+	if kidHex := r.URL.Query().Get("kid"); kidHex != "" {
+		kid, err := dash.ParseKID(kidHex)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid key ID: %v", err), http.StatusBadRequest)
+			return
+		}
+		key, found = a.keyService.GetKeyForKID(channelId, kid)
+	}
 	if !found {
 		http.Error(w, "Key not found for the given channel", http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Write(key)
+	writeResponse(w, r, "application/octet-stream", key)
+}
+
+// clearKeyLicenseRequest is the license request of an EME clear-key CDM. Its session type is ignored,
+// as the licenses are always temporary.
+type clearKeyLicenseRequest struct {
+	KIDs []string `json:"kids"`
+}
+
+// clearKey is a JSON Web Key of a clear-key license, with the key and key ID in unpadded base64url.
+type clearKey struct {
+	Kty string `json:"kty"`
+	K   string `json:"k"`
+	KID string `json:"kid"`
+}
+
+// clearKeyLicense is the license response expected by an EME clear-key CDM.
+type clearKeyLicense struct {
+	Keys []clearKey `json:"keys"`
+	Type string     `json:"type"`
+}
+
+// handleClearKeyLicense answers an EME clear-key license request with the channel's keys for the
+// requested key IDs, so that players can decrypt the CENC segments themselves.
+// Key IDs the channel has no key for are left out; a request matching none of them gets a 404.
+func (a *API) handleClearKeyLicense(w http.ResponseWriter, r *http.Request) {
+	channelId := r.PathValue("channelId")
+	var request clearKeyLicenseRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLicenseRequestBytes)).Decode(&request); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("License request is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Invalid license request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(request.KIDs) == 0 {
+		http.Error(w, "License request has no key IDs", http.StatusBadRequest)
+		return
+	}
+
+	license := clearKeyLicense{Keys: []clearKey{}, Type: "temporary"}
+	for _, encodedKID := range request.KIDs {
+		kid, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encodedKID, "="))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid key ID '%s': %v", encodedKID, err), http.StatusBadRequest)
+			return
+		}
+		key, found := a.keyService.GetKeyForKID(channelId, kid)
+		if !found {
+			continue
+		}
+		license.Keys = append(license.Keys, clearKey{
+			Kty: "oct",
+			K:   base64.RawURLEncoding.EncodeToString(key),
+			KID: base64.RawURLEncoding.EncodeToString(kid),
+		})
+	}
+	if len(license.Keys) == 0 {
+		http.Error(w, "No key found for the requested key IDs", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(license); err != nil {
+		a.opts.Logger.Errorf("Failed to encode clear-key license for channel %s: %v", channelId, err)
+	}
+}
+
+// requireAdmin guards an admin handler with the AdminToken, answering 401 to requests without it.
+func (a *API) requireAdmin(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.opts.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// handleListSessions lists the active sessions with their timing and available segments.
+func (a *API) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	response := struct {
+		Sessions []session.SessionInfo `json:"sessions"`
+	}{
+		Sessions: a.sessionMgr.ListSessions(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		a.opts.Logger.Errorf("Failed to encode session list: %v", err)
+	}
+}
+
+// handleStopSession stops and removes a channel's session, e.g. one that is stuck.
+func (a *API) handleStopSession(w http.ResponseWriter, r *http.Request) {
+	channelId := r.PathValue("channelId")
+	if !a.sessionMgr.StopSession(channelId) {
+		http.Error(w, fmt.Sprintf("No active session for channel %s", channelId), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) handleSessionWindow(w http.ResponseWriter, r *http.Request) {
+	channelId := r.PathValue("channelId")
+	sess, found := a.sessionMgr.GetSession(channelId)
+	if !found {
+		http.Error(w, fmt.Sprintf("No active session for channel %s", channelId), http.StatusNotFound)
+		return
+	}
+
+	response := struct {
+		ChannelID       string                                  `json:"channelId"`
+		Representations map[string]session.RepresentationWindow `json:"representations"`
+	}{
+		ChannelID:       channelId,
+		Representations: sess.GetWindow(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		sess.Logger.Errorf("Failed to encode playlist window for channel %s: %v", channelId, err)
+	}
+}
+
+// handleSessionMapping reports how each representation's DASH addressing maps to the HLS URIs,
+// with an example segment resolved both ways, to troubleshoot URL building.
+func (a *API) handleSessionMapping(w http.ResponseWriter, r *http.Request) {
+	channelId := r.PathValue("channelId")
+	sess, found := a.sessionMgr.GetSession(channelId)
+	if !found {
+		http.Error(w, fmt.Sprintf("No active session for channel %s", channelId), http.StatusNotFound)
+		return
+	}
+
+	response := struct {
+		ChannelID       string                          `json:"channelId"`
+		BaseURL         string                          `json:"baseUrl"`
+		Representations []session.RepresentationMapping `json:"representations"`
+	}{
+		ChannelID:       channelId,
+		BaseURL:         sess.ActiveBaseURL(),
+		Representations: sess.GetMapping(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		sess.Logger.Errorf("Failed to encode URL mapping for channel %s: %v", channelId, err)
+	}
+}
+
+// handleSetPathwayPriority changes the steering pathway order of a session, e.g. to drain a failing CDN.
+// The body is a JSON object with a "pathwayPriority" array of pathway IDs; an empty array restores the config order.
+func (a *API) handleSetPathwayPriority(w http.ResponseWriter, r *http.Request) {
+	channelId := r.PathValue("channelId")
+	sess, found := a.sessionMgr.GetSession(channelId)
+	if !found {
+		http.Error(w, fmt.Sprintf("No active session for channel %s", channelId), http.StatusNotFound)
+		return
+	}
+
+	var request struct {
+		PathwayPriority []string `json:"pathwayPriority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := sess.SetPathwayPriority(request.PathwayPriority); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, session.ErrSteeringDisabled) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
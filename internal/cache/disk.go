@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"bytes"
+	"dash2hlsd/internal/metrics"
+	"encoding/gob"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// diskFile is a segment spilled to disk.
+type diskFile struct {
+	path string
+	size int64
+}
+
+// diskFileSuffix marks the files of the disk tier, so that purging the directory never touches anything else.
+const diskFileSuffix = ".seg"
+
+// SetDiskDir enables the disk tier: segments pushed out of memory by MaxBytes are spilled to files in dir
+// instead of being dropped. Segment files left in dir by a previous run are purged, as their sessions are gone.
+func (sc *SegmentCache) SetDiskDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory '%s': %w", dir, err)
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "*"+diskFileSuffix))
+	if err != nil {
+		return fmt.Errorf("failed to list cache directory '%s': %w", dir, err)
+	}
+	for _, file := range stale {
+		if err := os.Remove(file); err != nil {
+			return fmt.Errorf("failed to purge cache directory '%s': %w", dir, err)
+		}
+	}
+	if len(stale) > 0 {
+		sc.logger.Infof("Purged %d stale segments from cache directory %s", len(stale), dir)
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.diskDir = dir
+	return nil
+}
+
+// DiskBytes returns the total size of the segments spilled to disk.
+func (sc *SegmentCache) DiskBytes() int64 {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
+	return sc.diskBytes
+}
+
+// newDiskPath returns a new file to spill a segment to. Cache keys contain slashes, so they are escaped, and
+// each file is numbered, so that a file is never rewritten while an older copy of the segment is still read
+// or removed. The caller must hold the write lock.
+func (sc *SegmentCache) newDiskPath(key string) string {
+	sc.diskSeq++
+	return filepath.Join(sc.diskDir, fmt.Sprintf("%s.%d%s", url.PathEscape(key), sc.diskSeq, diskFileSuffix))
+}
+
+// writeDisk writes a segment being spilled to its file. It does I/O, so it is called without the lock.
+func writeDisk(key, path string, entry Entry) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return fmt.Errorf("failed to encode segment %s: %w", key, err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to spill segment %s to disk: %w", key, err)
+	}
+	return nil
+}
+
+// readDisk loads a spilled segment from its file. It does I/O, so it is called without the lock.
+func readDisk(key, path string) (Entry, error) {
+	var entry Entry
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return entry, fmt.Errorf("failed to read spilled segment %s: %w", key, err)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+		return entry, fmt.Errorf("failed to decode spilled segment %s: %w", key, err)
+	}
+	return entry, nil
+}
+
+// spilled records that a segment was written to path, moving it from memory to disk. The caller must hold
+// the write lock.
+func (sc *SegmentCache) spilled(key, path string) {
+	size := int64(len(sc.cache[key].Data))
+	lastAccess := sc.lastAccess[key]
+	sc.remove(key)
+	sc.lastAccess[key] = lastAccess
+	sc.onDisk[key] = diskFile{path: path, size: size}
+	sc.diskBytes += size
+	metrics.CacheDiskBytes.Add(float64(size))
+}
+
+// removeDisk forgets a spilled segment and returns its file, for the caller to delete with removeFiles once it
+// has released the lock, or "" if the segment was not spilled. The caller must hold the write lock.
+func (sc *SegmentCache) removeDisk(key string) string {
+	file, found := sc.onDisk[key]
+	if !found {
+		return ""
+	}
+	sc.diskBytes -= file.size
+	metrics.CacheDiskBytes.Add(-float64(file.size))
+	delete(sc.onDisk, key)
+	delete(sc.lastAccess, key)
+	return file.path
+}
+
+// removeFiles deletes the files of forgotten segments. It does I/O, so it is called without the lock.
+func (sc *SegmentCache) removeFiles(paths ...string) {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			sc.logger.Warnf("Failed to remove spilled segment file %s: %v", path, err)
+		}
+	}
+}
@@ -1,22 +1,76 @@
 package cache
 
 import (
+	"bytes"
 	"context"
 	"dash2hlsd/internal/logger"
+	"dash2hlsd/internal/metrics"
+	"fmt"
+	"hash/fnv"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // ActiveSegmentsProvider is a function type that provides a set of all currently active segment keys.
 type ActiveSegmentsProvider func() map[string]struct{}
 
-// SegmentCache provides a thread-safe, in-memory cache for media segments.
+// Entry is a cached segment together with metadata derived from its contents.
+type Entry struct {
+	Data []byte
+	// ContentType is the sniffed MIME type of the segment, or empty if it was not sniffed.
+	ContentType string
+	// ETag and LastModified are the origin's validators, used for conditional re-fetches.
+	ETag         string
+	LastModified string
+	// CachedAt is when the segment was cached, set by SetEntry unless already set.
+	CachedAt time.Time
+	// ContentETag is the strong ETag the segment is served with, set by SetEntry unless already set.
+	ContentETag string
+}
+
+// ContentETag returns a strong ETag derived from a hash of content.
+func ContentETag(content []byte) string {
+	hash := fnv.New64a()
+	hash.Write(content)
+	return fmt.Sprintf(`"%016x"`, hash.Sum64())
+}
+
+// Reader returns a reader over the segment's data in place, without copying it. It implements io.ReaderAt
+// and io.Seeker, so that segments can be served with http.ServeContent.
+func (e Entry) Reader() *bytes.Reader {
+	return bytes.NewReader(e.Data)
+}
+
+// SegmentCache provides a thread-safe cache for media segments, held in memory and,
+// once a disk directory is set, spilled to disk beyond MaxBytes.
 type SegmentCache struct {
 	mutex                  sync.RWMutex
-	cache                  map[string][]byte
+	cache                  map[string]Entry
+	lastAccess             map[string]*atomic.Int64 // When each segment was last set or read, for LRU eviction; see touch
+	totalBytes             int64
 	logger                 logger.Logger
 	activeSegmentsProvider ActiveSegmentsProvider
 
+	// MaxBytes caps the total size of the cached segments. Once it is exceeded, inactive segments are
+	// evicted immediately in least-recently-used order instead of waiting for the next eviction tick.
+	// Active segments are never evicted, so the cap can be exceeded while they alone are over it.
+	// Zero disables the cap.
+	// With a disk tier, segments over the cap are spilled to disk instead, least recently used first,
+	// whether they are active or not.
+	MaxBytes int64
+	evictNow chan struct{}
+
+	// Disk tier, enabled by SetDiskDir. Files are written and read without the lock; the segments
+	// with disk I/O in flight are marked so that the I/O is neither repeated nor applied once stale.
+	diskDir   string
+	onDisk    map[string]diskFile
+	diskBytes int64
+	diskSeq   uint64
+	spilling  map[string]struct{}      // Segments being written to disk; dropped when the segment is replaced or removed
+	reading   map[string]chan struct{} // Spilled segments being read back, closed once they are
+
 	// Control
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -26,9 +80,14 @@ type SegmentCache struct {
 func New(log logger.Logger, provider ActiveSegmentsProvider) *SegmentCache {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &SegmentCache{
-		cache:                  make(map[string][]byte),
+		cache:                  make(map[string]Entry),
+		lastAccess:             make(map[string]*atomic.Int64),
+		onDisk:                 make(map[string]diskFile),
+		spilling:               make(map[string]struct{}),
+		reading:                make(map[string]chan struct{}),
 		logger:                 log,
 		activeSegmentsProvider: provider,
+		evictNow:               make(chan struct{}, 1),
 		ctx:                    ctx,
 		cancel:                 cancel,
 	}
@@ -48,18 +107,142 @@ func (sc *SegmentCache) Stop() {
 
 // Set adds a segment to the cache.
 func (sc *SegmentCache) Set(key string, data []byte) {
+	sc.SetEntry(key, Entry{Data: data})
+}
+
+// SetEntry adds a segment and its metadata to the cache.
+func (sc *SegmentCache) SetEntry(key string, entry Entry) {
+	if entry.CachedAt.IsZero() {
+		entry.CachedAt = time.Now()
+	}
+	if entry.ContentETag == "" {
+		// Hashed once here rather than on every request for the segment.
+		entry.ContentETag = ContentETag(entry.Data)
+	}
 	sc.mutex.Lock()
-	defer sc.mutex.Unlock()
-	sc.cache[key] = data
-	sc.logger.Debugf("Cached segment: %s, size: %d bytes", key, len(data))
+	stale := sc.removeDisk(key) // A newer copy supersedes a spilled one
+	sc.store(key, entry)
+	sc.mutex.Unlock()
+	sc.removeFiles(stale)
+	sc.logger.Debugf("Cached segment: %s, size: %d bytes", key, len(entry.Data))
+}
+
+// store adds a segment to the in-memory tier. The caller must hold the write lock.
+func (sc *SegmentCache) store(key string, entry Entry) {
+	if old, found := sc.cache[key]; found {
+		sc.totalBytes -= int64(len(old.Data))
+		metrics.CacheBytes.Add(-float64(len(old.Data)))
+	} else {
+		metrics.CacheSegments.Inc()
+	}
+	sc.totalBytes += int64(len(entry.Data))
+	metrics.CacheBytes.Add(float64(len(entry.Data)))
+	sc.cache[key] = entry
+	delete(sc.spilling, key) // A spill of the replaced copy is stale
+	sc.lastAccess[key] = new(atomic.Int64)
+	sc.lastAccess[key].Store(time.Now().UnixNano())
+
+	if sc.MaxBytes > 0 && sc.totalBytes > sc.MaxBytes {
+		// The eviction worker asks the sessions for their active segments, which must not happen under the cache lock.
+		select {
+		case sc.evictNow <- struct{}{}:
+		default: // An eviction is already pending
+		}
+	}
+}
+
+// Bytes returns the total size of the cached segments.
+func (sc *SegmentCache) Bytes() int64 {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
+	return sc.totalBytes
+}
+
+// Size returns the size of a cached segment without counting as an access to it.
+func (sc *SegmentCache) Size(key string) (int, bool) {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
+	if entry, found := sc.cache[key]; found {
+		return len(entry.Data), true
+	}
+	file, found := sc.onDisk[key]
+	return int(file.size), found
 }
 
 // Get retrieves a segment from the cache.
 func (sc *SegmentCache) Get(key string) ([]byte, bool) {
+	entry, found := sc.GetEntry(key)
+	return entry.Data, found
+}
+
+// GetEntry retrieves a segment and its metadata from the cache. Segments in memory are read under the read
+// lock; only spilled segments take the write lock, to be promoted back to memory.
+func (sc *SegmentCache) GetEntry(key string) (Entry, bool) {
 	sc.mutex.RLock()
-	defer sc.mutex.RUnlock()
-	data, found := sc.cache[key]
-	return data, found
+	entry, found := sc.cache[key]
+	_, spilled := sc.onDisk[key]
+	if found || !spilled {
+		sc.touch(key, found)
+		sc.mutex.RUnlock()
+		return entry, found
+	}
+	sc.mutex.RUnlock()
+	return sc.promote(key)
+}
+
+// promote reads a spilled segment back into memory, as it is being played again.
+func (sc *SegmentCache) promote(key string) (Entry, bool) {
+	for {
+		sc.mutex.Lock()
+		entry, found := sc.cache[key]
+		file, spilled := sc.onDisk[key]
+		if found || !spilled {
+			sc.touch(key, found)
+			sc.mutex.Unlock()
+			return entry, found
+		}
+		if done, busy := sc.reading[key]; busy {
+			// Another request is already reading the segment back.
+			sc.mutex.Unlock()
+			<-done
+			continue
+		}
+		done := make(chan struct{})
+		sc.reading[key] = done
+		sc.mutex.Unlock()
+
+		entry, err := readDisk(key, file.path)
+
+		sc.mutex.Lock()
+		delete(sc.reading, key)
+		close(done)
+		if current, still := sc.onDisk[key]; !still || current.path != file.path {
+			sc.mutex.Unlock()
+			continue // Replaced or evicted while it was read
+		}
+		stale := sc.removeDisk(key)
+		found = err == nil
+		if found {
+			sc.store(key, entry)
+		} else {
+			sc.logger.Warnf("%v", err)
+		}
+		sc.touch(key, found)
+		sc.mutex.Unlock()
+		sc.removeFiles(stale)
+		return entry, found
+	}
+}
+
+// touch records a lookup of a segment, and marks it as recently used if it was found. The access time is
+// stored atomically, so the read lock is enough. The caller must hold the lock.
+func (sc *SegmentCache) touch(key string, found bool) {
+	if found {
+		sc.lastAccess[key].Store(time.Now().UnixNano())
+		metrics.CacheLookups.WithLabel("hit").Inc()
+	} else {
+		metrics.CacheLookups.WithLabel("miss").Inc()
+	}
 }
 
 // evictionWorker runs in the background to clean up expired segments.
@@ -74,21 +257,130 @@ func (sc *SegmentCache) evictionWorker() {
 			return
 		case <-ticker.C:
 			sc.runEviction()
+		case <-sc.evictNow:
+			sc.evictToLimit()
 		}
 	}
 }
 
+// remove deletes a segment from the cache. The caller must hold the write lock.
+func (sc *SegmentCache) remove(key string) {
+	size := len(sc.cache[key].Data)
+	sc.totalBytes -= int64(size)
+	metrics.CacheSegments.Dec()
+	metrics.CacheBytes.Add(-float64(size))
+	delete(sc.cache, key)
+	delete(sc.lastAccess, key)
+	delete(sc.spilling, key)
+}
+
+// pendingSpill is a segment chosen by evictToLimit to be written to disk.
+type pendingSpill struct {
+	key   string
+	path  string
+	entry Entry
+	err   error
+}
+
+// evictToLimit evicts inactive segments, least recently used first, until the cache is back under MaxBytes.
+// With a disk tier, segments are spilled instead: they are chosen under the lock, written to disk without
+// it, and only then moved out of memory, unless they were replaced or removed in the meantime.
+func (sc *SegmentCache) evictToLimit() {
+	activeKeys := sc.activeSegmentsProvider()
+
+	sc.mutex.Lock()
+	if sc.MaxBytes <= 0 || sc.totalBytes <= sc.MaxBytes {
+		sc.mutex.Unlock()
+		return
+	}
+	candidates := make([]string, 0, len(sc.cache))
+	for key := range sc.cache {
+		if _, isActive := activeKeys[key]; !isActive || sc.diskDir != "" {
+			candidates = append(candidates, key)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return sc.lastAccess[candidates[i]].Load() < sc.lastAccess[candidates[j]].Load()
+	})
+
+	evictedCount := 0
+	var spills []pendingSpill
+	remaining := sc.totalBytes
+	for _, key := range candidates {
+		if remaining <= sc.MaxBytes {
+			break
+		}
+		if sc.diskDir != "" {
+			sc.spilling[key] = struct{}{}
+			spills = append(spills, pendingSpill{key: key, path: sc.newDiskPath(key), entry: sc.cache[key]})
+			remaining -= int64(len(sc.cache[key].Data))
+			continue
+		}
+		remaining -= int64(len(sc.cache[key].Data))
+		sc.remove(key)
+		evictedCount++
+	}
+	sc.mutex.Unlock()
+
+	for i := range spills {
+		spills[i].err = writeDisk(spills[i].key, spills[i].path, spills[i].entry)
+	}
+
+	sc.mutex.Lock()
+	var stale []string
+	for _, spill := range spills {
+		if _, still := sc.spilling[spill.key]; !still {
+			// Replaced or removed while it was written, so the file holds a stale copy.
+			if spill.err == nil {
+				stale = append(stale, spill.path)
+			}
+			continue
+		}
+		delete(sc.spilling, spill.key)
+		if spill.err == nil {
+			sc.spilled(spill.key, spill.path)
+			evictedCount++
+			continue
+		}
+		sc.logger.Warnf("%v", spill.err)
+		stale = append(stale, spill.path) // The file may have been partly written
+		if _, isActive := activeKeys[spill.key]; isActive {
+			continue // Keep active segments in memory rather than lose them
+		}
+		sc.remove(spill.key)
+		evictedCount++
+	}
+	totalBytes := sc.totalBytes
+	sc.mutex.Unlock()
+	sc.removeFiles(stale...)
+
+	if totalBytes > sc.MaxBytes {
+		sc.logger.Warnf("Segment cache holds %d bytes of active segments, above its %d byte limit", totalBytes, sc.MaxBytes)
+	}
+	if evictedCount > 0 {
+		sc.logger.Infof("Evicted %d least recently used segments from memory to stay within %d bytes. Current cache size: %d bytes.", evictedCount, sc.MaxBytes, totalBytes)
+	}
+}
+
 func (sc *SegmentCache) runEviction() {
 	sc.logger.Debugf("Running cache eviction...")
 	activeKeys := sc.activeSegmentsProvider()
 
+	var stale []string
+	defer func() { sc.removeFiles(stale...) }() // Once the lock is released
 	sc.mutex.Lock()
 	defer sc.mutex.Unlock()
 
 	evictedCount := 0
 	for key := range sc.cache {
 		if _, isActive := activeKeys[key]; !isActive {
-			delete(sc.cache, key)
+			sc.remove(key)
+			evictedCount++
+		}
+	}
+	for key := range sc.onDisk {
+		if _, isActive := activeKeys[key]; !isActive {
+			stale = append(stale, sc.removeDisk(key))
 			evictedCount++
 		}
 	}
@@ -1,11 +1,77 @@
 package channels
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"regexp"
 	"strings"
+	"time"
+)
+
+// StartupPolicy selects a preset trading startup latency against playback reliability.
+type StartupPolicy string
+
+const (
+	// StartupPolicyDefault keeps the balanced default behaviour.
+	StartupPolicyDefault StartupPolicy = ""
+	// StartupPolicyLatency starts close to the live edge with a minimal buffer.
+	StartupPolicyLatency StartupPolicy = "latency"
+	// StartupPolicyReliability starts further from the live edge and buffers more before playback.
+	StartupPolicyReliability StartupPolicy = "reliability"
+)
+
+const (
+	// DefaultPlaylistWindowSegments is the live playlist window used when a channel does not set one.
+	DefaultPlaylistWindowSegments = 5
+	// DefaultMasterPlaylistMaxAge is the master playlist max age, in seconds, used when a channel does not set one.
+	DefaultMasterPlaylistMaxAge = 60
+	// DefaultSteeringTTL is the steering manifest TTL, in seconds, used when a channel does not set one.
+	DefaultSteeringTTL = 300
+	// DefaultMaxOnDemandFetches is the number of concurrent on-demand segment fetches a session allows
+	// when a channel does not set one.
+	DefaultMaxOnDemandFetches = 4
+	// MinPlaylistWindowSegments is the smallest live window allowed, since HLS requires live
+	// playlists to hold at least three target durations of media.
+	MinPlaylistWindowSegments = 3
+)
+
+// EncryptionMethod is the HLS encryption method advertised in a channel's media playlists.
+type EncryptionMethod string
+
+const (
+	// EncryptionSampleAES advertises METHOD=SAMPLE-AES. It is the default.
+	EncryptionSampleAES EncryptionMethod = "sample-aes"
+	// EncryptionAES128 advertises METHOD=AES-128 full-segment encryption. Without a configured IV, players
+	// use each segment's media sequence number as its IV.
+	EncryptionAES128 EncryptionMethod = "aes-128"
+	// EncryptionNone omits the EXT-X-KEY tag entirely.
+	EncryptionNone EncryptionMethod = "none"
+)
+
+// SteeringPathway is a content steering pathway, typically one CDN in front of the server.
+type SteeringPathway struct {
+	// ID is the pathway ID advertised to players.
+	ID string `json:"Id"`
+	// Host replaces the host of the master playlist's URIs on this pathway. It is empty only for
+	// the first pathway, which players reach through the master playlist's own host.
+	Host string `json:"Host"`
+}
+
+// VideoLadder selects which video representations a channel offers as HLS variants.
+type VideoLadder string
+
+const (
+	// VideoLadderSingleTop offers only the best video representation. It is the default.
+	VideoLadderSingleTop VideoLadder = "single-top"
+	// VideoLadderAll offers every video representation players can decode, up to MaxVideoVariants.
+	VideoLadderAll VideoLadder = "all"
+	// VideoLadderList offers the video representations listed in VideoRepresentations.
+	VideoLadderList VideoLadder = "list"
 )
 
 // Channel defines the final, processed structure for a single channel.
@@ -13,8 +79,153 @@ type Channel struct {
 	Name        string
 	Id          string
 	ManifestURL string
+	// ManifestURLs lists every origin for the channel in failover order, starting with ManifestURL.
+	ManifestURLs []string
 	// Key is the processed decryption key, decoded from a hex string.
 	Key []byte
+	// KID is the key ID paired with Key in the config, decoded from a hex string.
+	KID []byte
+	// Keys maps every key ID of the channel, as lowercase hex, to its key, e.g. for separate audio and
+	// video keys. Key and KID hold its first pair.
+	Keys map[string][]byte
+	// SniffContentType enables detecting each segment's Content-Type from its first bytes
+	// instead of always serving video/mp4.
+	SniffContentType bool
+	// ReplaceTimeline makes MPD refreshes replace each SegmentTimeline wholesale instead of merging
+	// it with the previous one, for origins that fully rewrite the timeline on every update.
+	ReplaceTimeline bool
+	// TimelineDurations makes playlists take each segment's duration from the current, merged timeline
+	// instead of the duration recorded when it was downloaded, which an MPD refresh may have corrected.
+	TimelineDurations bool
+	// ConditionalRequests makes re-fetches of cached segments send If-None-Match/If-Modified-Since,
+	// reusing the cached bytes when the origin answers 304 Not Modified.
+	ConditionalRequests bool
+	// StartupPolicy tunes the initial playhead offset, prefetch depth and minimum buffer together.
+	StartupPolicy StartupPolicy
+	// LiveDelaySeconds, when positive, is how far behind the live edge a new session starts, overriding
+	// the StartupPolicy's number of segments. It is clamped to the MPD's timeShiftBufferDepth.
+	LiveDelaySeconds int
+	// PlaylistWindowSegments is the number of segments in the live playlist window.
+	// Zero selects DefaultPlaylistWindowSegments.
+	PlaylistWindowSegments int
+	// EncryptionMethod selects the EXT-X-KEY method of the channel's media playlists.
+	EncryptionMethod EncryptionMethod
+	// IV is the optional 16-byte initialization vector advertised in EXT-X-KEY, decoded from a hex string.
+	IV []byte
+	// DeriveSegmentIV advertises a per-segment IV derived from each segment's media time.
+	DeriveSegmentIV bool
+	// KeyURITemplate, when set, replaces the /key/{channelId} URI advertised in EXT-X-KEY, so that keys can
+	// be served from another host or with a token. Its {channelId} and {kid} placeholders are replaced with
+	// the channel ID and the hex key ID of the representation or, for a single-key channel, the channel's KID.
+	// It is written into a quoted attribute, so it may not contain double quotes or line breaks.
+	KeyURITemplate string
+	// TargetDuration, in seconds, overrides the EXT-X-TARGETDURATION derived from the MPD.
+	// It is still raised to cover the longest segment. Zero keeps the derived value.
+	TargetDuration int
+	// MasterPlaylistMaxAge is how long, in seconds, a generated master playlist is served before it is
+	// regenerated. It is also regenerated as soon as an MPD refresh changes the representations.
+	// Zero selects DefaultMasterPlaylistMaxAge.
+	MasterPlaylistMaxAge int
+	// LegacyAllowCache adds the deprecated EXT-X-ALLOW-CACHE tag to media playlists for old players.
+	LegacyAllowCache bool
+	// DeclareNoClosedCaptions adds CLOSED-CAPTIONS=NONE to the video variants of a channel without
+	// embedded captions, which some Apple players expect.
+	DeclareNoClosedCaptions bool
+	// SteeringPathways enables content steering between CDNs, in default priority order. The master
+	// playlist's variants are on the first pathway; the others are clones of it with their own Host.
+	// Empty disables content steering.
+	SteeringPathways []SteeringPathway
+	// SteeringTTL is how long, in seconds, players keep a steering manifest before reloading it.
+	// Zero selects DefaultSteeringTTL.
+	SteeringTTL int
+	// VideoLadder selects the video variants of the master playlist, each downloaded and served with its own
+	// media playlist so players can adapt to their bandwidth.
+	VideoLadder VideoLadder
+	// VideoRepresentations lists the video representation IDs offered by VideoLadderList.
+	VideoRepresentations []string
+	// MaxVideoVariants caps the variants offered by VideoLadderAll, keeping the best ones. Zero means no cap.
+	MaxVideoVariants int
+	// MaxWidth, MaxHeight and MaxBandwidth cap the video representations offered, e.g. for low-power
+	// devices. Zero disables a cap. When every representation exceeds the caps, the one with the lowest
+	// bandwidth is offered.
+	MaxWidth     int
+	MaxHeight    int
+	MaxBandwidth int
+	// PrewarmSegments is the number of segments of the live window fetched at priority when a player first
+	// requests the media playlist of a video representation that is not downloaded yet, e.g. after an ABR
+	// switch, so that its playlist is complete at once. Zero disables the pre-warm.
+	PrewarmSegments int
+	// MaxOnDemandFetches caps the segments a session fetches from the origin at once because a player
+	// asked for them before they were cached. Further requests wait for a fetch to finish, and are turned
+	// away if none does in time. Zero selects DefaultMaxOnDemandFetches.
+	MaxOnDemandFetches int
+	// LookAheadSegments is how many segments after the playhead a session queues for each representation,
+	// or prefetches after one a VOD player requests, so that they are cached before players reach them.
+	// Zero keeps the StartupPolicy's prefetch depth; a negative value queues only the segment under the
+	// playhead.
+	LookAheadSegments int
+	// WarmupTimeoutSeconds, when positive, makes the master playlist of a new session wait up to this many
+	// seconds for every representation it lists to have a media playlist, answering 503 with Retry-After
+	// if they do not in time. Zero serves the master playlist at once.
+	WarmupTimeoutSeconds int
+	// ValidateInitSegments checks that downloaded init segments hold ftyp and moov boxes before caching them,
+	// fetching them again when they do not, so that a truncated response does not break playback.
+	ValidateInitSegments bool
+	// StripInitBoxes and ReplaceInitBoxes edit the init segments before they are cached, for players that
+	// reject some of their boxes. Boxes are addressed by slash-separated paths of box types, such as
+	// "moov/trak/edts"; stripped boxes are removed and replaced boxes get the given payload.
+	StripInitBoxes   []string
+	ReplaceInitBoxes map[string][]byte
+}
+
+// GetManifestURLs returns the channel's manifest URLs in failover order.
+// It falls back to ManifestURL for channels constructed without an explicit list.
+func (c *Channel) GetManifestURLs() []string {
+	if len(c.ManifestURLs) > 0 {
+		return c.ManifestURLs
+	}
+	if c.ManifestURL != "" {
+		return []string{c.ManifestURL}
+	}
+	return nil
+}
+
+// GetMasterPlaylistMaxAge returns the master playlist max age, falling back to the default when unset.
+func (c *Channel) GetMasterPlaylistMaxAge() time.Duration {
+	if c.MasterPlaylistMaxAge > 0 {
+		return time.Duration(c.MasterPlaylistMaxAge) * time.Second
+	}
+	return DefaultMasterPlaylistMaxAge * time.Second
+}
+
+// GetWarmupTimeout returns how long the master playlist waits for the media playlists it lists,
+// or zero when it does not wait.
+func (c *Channel) GetWarmupTimeout() time.Duration {
+	return time.Duration(c.WarmupTimeoutSeconds) * time.Second
+}
+
+// GetPlaylistWindowSegments returns the live playlist window size, falling back to the default when unset.
+func (c *Channel) GetPlaylistWindowSegments() int {
+	if c.PlaylistWindowSegments > 0 {
+		return c.PlaylistWindowSegments
+	}
+	return DefaultPlaylistWindowSegments
+}
+
+// GetSteeringTTL returns the steering manifest TTL in seconds, falling back to the default when unset.
+func (c *Channel) GetSteeringTTL() int {
+	if c.SteeringTTL > 0 {
+		return c.SteeringTTL
+	}
+	return DefaultSteeringTTL
+}
+
+// GetMaxOnDemandFetches returns the on-demand fetch limit, falling back to the default when unset.
+func (c *Channel) GetMaxOnDemandFetches() int {
+	if c.MaxOnDemandFetches > 0 {
+		return c.MaxOnDemandFetches
+	}
+	return DefaultMaxOnDemandFetches
 }
 
 // ChannelConfig holds the fully processed application configuration.
@@ -22,7 +233,41 @@ type ChannelConfig struct {
 	Name      string
 	Id        string
 	UserAgent string
-	Channels  []Channel
+	// SharedDownloadWorkers, when positive, makes all sessions submit to a single download
+	// worker pool of this size instead of each session starting its own workers.
+	SharedDownloadWorkers int
+	// CacheMaxBytes, when positive, caps the memory used by cached segments, evicting the least
+	// recently used inactive segments as soon as it is exceeded.
+	CacheMaxBytes int64
+	// CacheDiskDir, when set together with CacheMaxBytes, spills segments beyond the memory cap to this
+	// directory instead of evicting them, for large DVR windows. It is purged of segments on startup.
+	CacheDiskDir string
+	// SessionIdleTimeout, when positive, is the number of seconds without any playlist or segment request
+	// after which a channel's session is stopped and its segments are released. Zero keeps sessions forever.
+	SessionIdleTimeout int
+	Channels           []Channel
+}
+
+// GetKeyForKID returns the channel's key for a key ID, also for channels built with only Key and KID.
+func (c *Channel) GetKeyForKID(kid []byte) ([]byte, bool) {
+	if len(c.Keys) == 0 {
+		if len(kid) == 0 || !bytes.Equal(kid, c.KID) {
+			return nil, false
+		}
+		return c.Key, true
+	}
+	key, found := c.Keys[hex.EncodeToString(kid)]
+	return key, found
+}
+
+// FindChannel returns the channel with the given ID, or nil when there is none.
+func (c *ChannelConfig) FindChannel(channelId string) *Channel {
+	for i := range c.Channels {
+		if c.Channels[i].Id == channelId {
+			return &c.Channels[i]
+		}
+	}
+	return nil
 }
 
 // rawChannel is used for intermediate unmarshaling from the JSON file,
@@ -31,63 +276,394 @@ type rawChannel struct {
 	Name        string   `json:"Name"`
 	Id          string   `json:"Id"`
 	ManifestURL string   `json:"Manifest"`
-	Keys        []string `json:"Keys"` // Raw 'kid:key' string from JSON
+	Manifests   []string `json:"Manifests"` // Optional failover origins, tried in order after Manifest
+	Keys        []string `json:"Keys"`      // Raw 'kid:key' strings from JSON, which may hold ${ENV_VAR} references
+
+	SniffContentType  bool `json:"SniffContentType"`
+	ReplaceTimeline   bool `json:"ReplaceTimeline"`
+	TimelineDurations bool `json:"TimelineDurations"`
+
+	ConditionalRequests bool   `json:"ConditionalRequests"`
+	StartupPolicy       string `json:"StartupPolicy"`    // "latency", "reliability", or empty for the default
+	LiveDelaySeconds    int    `json:"LiveDelaySeconds"` // Seconds; 0 uses the StartupPolicy's delay
+
+	PlaylistWindowSegments  int    `json:"PlaylistWindowSegments"`
+	EncryptionMethod        string `json:"EncryptionMethod"` // "sample-aes" (default), "aes-128", or "none"
+	IV                      string `json:"IV"`               // Optional hex IV, with or without a 0x prefix
+	DeriveSegmentIV         bool   `json:"DeriveSegmentIV"`
+	KeyURITemplate          string `json:"KeyURITemplate"`       // Placeholders {channelId} and {kid}
+	TargetDuration          int    `json:"TargetDuration"`       // Seconds; 0 derives it from the MPD
+	MasterPlaylistMaxAge    int    `json:"MasterPlaylistMaxAge"` // Seconds; 0 selects the default
+	LegacyAllowCache        bool   `json:"LegacyAllowCache"`
+	DeclareNoClosedCaptions bool   `json:"DeclareNoClosedCaptions"`
+
+	SteeringPathways     []SteeringPathway `json:"SteeringPathways"`
+	SteeringTTL          int               `json:"SteeringTTL"` // Seconds; 0 selects the default
+	PrewarmSegments      int               `json:"PrewarmSegments"`
+	MaxOnDemandFetches   int               `json:"MaxOnDemandFetches"`   // 0 selects the default
+	LookAheadSegments    int               `json:"LookAheadSegments"`    // 0 keeps the startup policy's depth, negative disables
+	WarmupTimeoutSeconds int               `json:"WarmupTimeoutSeconds"` // Seconds; 0 disables the warm-up wait
+
+	VideoLadder          string   `json:"VideoLadder"` // "single-top" (default), "all", or "list"
+	VideoRepresentations []string `json:"VideoRepresentations"`
+	MaxVideoVariants     int      `json:"MaxVideoVariants"`
+
+	MaxWidth     int `json:"MaxWidth"`
+	MaxHeight    int `json:"MaxHeight"`
+	MaxBandwidth int `json:"MaxBandwidth"` // Bits per second
+
+	ValidateInitSegments bool              `json:"ValidateInitSegments"`
+	StripInitBoxes       []string          `json:"StripInitBoxes"`
+	ReplaceInitBoxes     map[string]string `json:"ReplaceInitBoxes"` // Box path to hex payload
 }
 
 // rawConfig is the intermediate structure that maps directly to the JSON file.
 type rawConfig struct {
-	Name      string       `json:"Name"`
-	Id        string       `json:"Id"`
-	UserAgent string       `json:"UserAgent"`
-	Channels  []rawChannel `json:"Channels"`
+	Name                  string       `json:"Name"`
+	Id                    string       `json:"Id"`
+	UserAgent             string       `json:"UserAgent"`
+	SharedDownloadWorkers int          `json:"SharedDownloadWorkers"`
+	CacheMaxBytes         int64        `json:"CacheMaxBytes"`
+	CacheDiskDir          string       `json:"CacheDiskDir"`
+	SessionIdleTimeout    int          `json:"SessionIdleTimeout"` // Seconds; 0 never stops idle sessions
+	Channels              []rawChannel `json:"Channels"`
+}
+
+// gzipMagic is the header that starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompressConfig inflates a gzip-compressed config file.
+func decompressConfig(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// validateSteeringPathways checks that pathway IDs are unique and well-formed, and that every pathway
+// but the first, which the master playlist lists, has a Host to be cloned onto.
+func validateSteeringPathways(pathways []SteeringPathway) error {
+	seen := make(map[string]bool, len(pathways))
+	for i, p := range pathways {
+		if p.ID == "" || strings.Trim(p.ID, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-._") != "" {
+			return fmt.Errorf("pathway ID '%s' must only contain letters, digits, '-', '.' and '_'", p.ID)
+		}
+		if seen[p.ID] {
+			return fmt.Errorf("duplicate pathway ID '%s'", p.ID)
+		}
+		seen[p.ID] = true
+		if i > 0 && p.Host == "" {
+			return fmt.Errorf("pathway '%s' has no Host", p.ID)
+		}
+	}
+	return nil
+}
+
+// envReference matches the ${ENV_VAR} references expanded by expandEnv.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${ENV_VAR} references in a config value with the values of the environment
+// variables. Referencing an unset variable is an error, so that a missing secret is not silently empty.
+func expandEnv(value string) (string, error) {
+	var missing []string
+	expanded := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		envValue, found := os.LookupEnv(name)
+		if !found {
+			missing = append(missing, name)
+		}
+		return envValue
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// validateBoxPath checks that a box path is made of four-character box types separated by slashes.
+func validateBoxPath(path string) error {
+	for _, boxType := range strings.Split(path, "/") {
+		if len(boxType) != 4 {
+			return fmt.Errorf("box path '%s' must be made of four-character box types separated by '/'", path)
+		}
+	}
+	return nil
+}
+
+// parseKeys decodes a channel's 'kid:key' strings, which may hold ${ENV_VAR} references, into its keys by
+// lowercase hex key ID, and returns the first pair as key and kid. Empty strings are skipped.
+func parseKeys(channelId string, rawKeys []string) (key, kid []byte, keys map[string][]byte, err error) {
+	for _, rawKey := range rawKeys {
+		if rawKey, err = expandEnv(rawKey); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid key for channel '%s': %w", channelId, err)
+		}
+		if rawKey == "" {
+			continue
+		}
+		// Split by ':' into the key ID and the key.
+		keyParts := strings.Split(rawKey, ":")
+		if len(keyParts) != 2 {
+			return nil, nil, nil, fmt.Errorf("invalid key format for channel '%s': expected 'kid:key', got '%s'", channelId, rawKey)
+		}
+
+		pairKID, err := hex.DecodeString(strings.ReplaceAll(keyParts[0], "-", ""))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to decode hex key ID for channel '%s': %w", channelId, err)
+		}
+		pairKey, err := hex.DecodeString(keyParts[1])
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to decode hex key for channel '%s': %w", channelId, err)
+		}
+
+		if keys == nil {
+			keys = make(map[string][]byte, len(rawKeys))
+			key, kid = pairKey, pairKID
+		}
+		if _, exists := keys[hex.EncodeToString(pairKID)]; exists {
+			return nil, nil, nil, fmt.Errorf("duplicate key ID %x for channel '%s'", pairKID, channelId)
+		}
+		keys[hex.EncodeToString(pairKID)] = pairKey
+	}
+	return key, kid, keys, nil
+}
+
+// LoadKeys reads a keys file, a JSON object mapping channel IDs to 'kid:key' strings in the format of a
+// channel's Keys, so that keys can be rotated without touching the channel configuration. The returned
+// channels only carry their ID and keys.
+func LoadKeys(path string) ([]Channel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys file at %s: %w", path, err)
+	}
+	var rawKeys map[string][]string
+	if err := json.Unmarshal(data, &rawKeys); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal keys JSON: %w", err)
+	}
+
+	keyed := make([]Channel, 0, len(rawKeys))
+	for channelId, channelKeys := range rawKeys {
+		key, kid, keys, err := parseKeys(channelId, channelKeys)
+		if err != nil {
+			return nil, err
+		}
+		keyed = append(keyed, Channel{Id: channelId, Key: key, KID: kid, Keys: keys})
+	}
+	return keyed, nil
 }
 
 // LoadConfig reads and parses the configuration file from the given path.
 // It performs the crucial step of processing the raw key strings into byte slices.
+// Gzip-compressed files (e.g. channels.json.gz) are decompressed transparently.
 func LoadConfig(path string) (*ChannelConfig, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file at %s: %w", path, err)
 	}
 
+	// Large channel lists may be shipped gzip-compressed, detected by extension or magic bytes.
+	if strings.HasSuffix(path, ".gz") || bytes.HasPrefix(data, gzipMagic) {
+		data, err = decompressConfig(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress config file at %s: %w", path, err)
+		}
+	}
+
 	var rawCfg rawConfig
 	if err := json.Unmarshal(data, &rawCfg); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config JSON: %w", err)
 	}
 
+	if rawCfg.SessionIdleTimeout < 0 {
+		return nil, fmt.Errorf("invalid session idle timeout: must not be negative, got %d", rawCfg.SessionIdleTimeout)
+	}
+
 	// Process the raw channels into the final, clean Channel structs.
 	processedChannels := make([]Channel, 0, len(rawCfg.Channels))
 	for _, rc := range rawCfg.Channels {
-		var keyBytes []byte
+		// Secrets and per-environment origins may be kept out of the file as ${ENV_VAR} references.
+		if rc.ManifestURL, err = expandEnv(rc.ManifestURL); err != nil {
+			return nil, fmt.Errorf("invalid manifest for channel '%s': %w", rc.Id, err)
+		}
+		for i := range rc.Manifests {
+			if rc.Manifests[i], err = expandEnv(rc.Manifests[i]); err != nil {
+				return nil, fmt.Errorf("invalid manifest for channel '%s': %w", rc.Id, err)
+			}
+		}
+
 		// As per the spec, a channel may not be encrypted.
-		if len(rc.Keys) > 0 && rc.Keys[0] != "" {
-			// Take the first key, split by ':', and decode the second part (the key).
-			keyParts := strings.Split(rc.Keys[0], ":")
-			if len(keyParts) != 2 {
-				return nil, fmt.Errorf("invalid key format for channel '%s': expected 'kid:key', got '%s'", rc.Id, rc.Keys[0])
+		keyBytes, kidBytes, keys, err := parseKeys(rc.Id, rc.Keys)
+		if err != nil {
+			return nil, err
+		}
+
+		startupPolicy := StartupPolicy(rc.StartupPolicy)
+		switch startupPolicy {
+		case StartupPolicyDefault, StartupPolicyLatency, StartupPolicyReliability:
+		default:
+			return nil, fmt.Errorf("invalid startup policy for channel '%s': expected 'latency' or 'reliability', got '%s'", rc.Id, rc.StartupPolicy)
+		}
+
+		if rc.PlaylistWindowSegments != 0 && rc.PlaylistWindowSegments < MinPlaylistWindowSegments {
+			return nil, fmt.Errorf("invalid playlist window for channel '%s': must be at least %d segments, got %d", rc.Id, MinPlaylistWindowSegments, rc.PlaylistWindowSegments)
+		}
+
+		if rc.MasterPlaylistMaxAge < 0 {
+			return nil, fmt.Errorf("invalid master playlist max age for channel '%s': must not be negative, got %d", rc.Id, rc.MasterPlaylistMaxAge)
+		}
+		if rc.WarmupTimeoutSeconds < 0 {
+			return nil, fmt.Errorf("invalid warm-up timeout for channel '%s': must not be negative, got %d", rc.Id, rc.WarmupTimeoutSeconds)
+		}
+		if rc.MaxOnDemandFetches < 0 {
+			return nil, fmt.Errorf("invalid on-demand fetch limit for channel '%s': must not be negative, got %d", rc.Id, rc.MaxOnDemandFetches)
+		}
+		if rc.TargetDuration < 0 {
+			return nil, fmt.Errorf("invalid target duration for channel '%s': must not be negative, got %d", rc.Id, rc.TargetDuration)
+		}
+
+		videoLadder := VideoLadder(strings.ToLower(rc.VideoLadder))
+		switch videoLadder {
+		case "":
+			videoLadder = VideoLadderSingleTop
+		case VideoLadderSingleTop, VideoLadderAll:
+		case VideoLadderList:
+			if len(rc.VideoRepresentations) == 0 {
+				return nil, fmt.Errorf("invalid video ladder for channel '%s': 'list' requires VideoRepresentations", rc.Id)
+			}
+		default:
+			return nil, fmt.Errorf("invalid video ladder for channel '%s': expected 'single-top', 'all' or 'list', got '%s'", rc.Id, rc.VideoLadder)
+		}
+		if rc.MaxVideoVariants < 0 {
+			return nil, fmt.Errorf("invalid max video variants for channel '%s': must not be negative, got %d", rc.Id, rc.MaxVideoVariants)
+		}
+
+		if rc.MaxWidth < 0 || rc.MaxHeight < 0 || rc.MaxBandwidth < 0 {
+			return nil, fmt.Errorf("invalid quality caps for channel '%s': MaxWidth, MaxHeight and MaxBandwidth must not be negative", rc.Id)
+		}
+
+		if rc.LiveDelaySeconds < 0 {
+			return nil, fmt.Errorf("invalid live delay for channel '%s': must not be negative, got %d", rc.Id, rc.LiveDelaySeconds)
+		}
+		if rc.PrewarmSegments < 0 {
+			return nil, fmt.Errorf("invalid prewarm segments for channel '%s': must not be negative, got %d", rc.Id, rc.PrewarmSegments)
+		}
+		if rc.SteeringTTL < 0 {
+			return nil, fmt.Errorf("invalid steering TTL for channel '%s': must not be negative, got %d", rc.Id, rc.SteeringTTL)
+		}
+		if err := validateSteeringPathways(rc.SteeringPathways); err != nil {
+			return nil, fmt.Errorf("invalid steering pathways for channel '%s': %w", rc.Id, err)
+		}
+		for _, path := range rc.StripInitBoxes {
+			if err := validateBoxPath(path); err != nil {
+				return nil, fmt.Errorf("invalid init box to strip for channel '%s': %w", rc.Id, err)
+			}
+		}
+		var replaceInitBoxes map[string][]byte
+		for path, payloadHex := range rc.ReplaceInitBoxes {
+			if err := validateBoxPath(path); err != nil {
+				return nil, fmt.Errorf("invalid init box to replace for channel '%s': %w", rc.Id, err)
+			}
+			payload, err := hex.DecodeString(payloadHex)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode hex payload of init box '%s' for channel '%s': %w", path, rc.Id, err)
 			}
+			if replaceInitBoxes == nil {
+				replaceInitBoxes = make(map[string][]byte, len(rc.ReplaceInitBoxes))
+			}
+			replaceInitBoxes[path] = payload
+		}
 
-			keyHex := keyParts[1]
-			keyBytes, err = hex.DecodeString(keyHex)
+		var ivBytes []byte
+		if rc.IV != "" {
+			ivHex := strings.TrimPrefix(strings.TrimPrefix(rc.IV, "0x"), "0X")
+			ivBytes, err = hex.DecodeString(ivHex)
 			if err != nil {
-				return nil, fmt.Errorf("failed to decode hex key for channel '%s': %w", rc.Id, err)
+				return nil, fmt.Errorf("failed to decode hex IV for channel '%s': %w", rc.Id, err)
+			}
+			if len(ivBytes) != 16 {
+				return nil, fmt.Errorf("invalid IV for channel '%s': expected 16 bytes, got %d", rc.Id, len(ivBytes))
+			}
+		}
+
+		if strings.ContainsAny(rc.KeyURITemplate, "\"\r\n") {
+			return nil, fmt.Errorf("invalid key URI template for channel '%s': must not contain double quotes or line breaks", rc.Id)
+		}
+
+		encryptionMethod := EncryptionMethod(strings.ToLower(rc.EncryptionMethod))
+		switch encryptionMethod {
+		case "":
+			encryptionMethod = EncryptionSampleAES
+		case EncryptionSampleAES, EncryptionAES128, EncryptionNone:
+		default:
+			return nil, fmt.Errorf("invalid encryption method for channel '%s': expected 'sample-aes', 'aes-128' or 'none', got '%s'", rc.Id, rc.EncryptionMethod)
+		}
+
+		manifestURLs := make([]string, 0, len(rc.Manifests)+1)
+		for _, u := range append([]string{rc.ManifestURL}, rc.Manifests...) {
+			if u != "" {
+				manifestURLs = append(manifestURLs, u)
 			}
 		}
 
 		processedChannels = append(processedChannels, Channel{
-			Name:        rc.Name,
-			Id:          rc.Id,
-			ManifestURL: rc.ManifestURL,
-			Key:         keyBytes,
+			Name:         rc.Name,
+			Id:           rc.Id,
+			ManifestURL:  rc.ManifestURL,
+			ManifestURLs: manifestURLs,
+			Key:          keyBytes,
+			KID:          kidBytes,
+			Keys:         keys,
+
+			SniffContentType:  rc.SniffContentType,
+			ReplaceTimeline:   rc.ReplaceTimeline,
+			TimelineDurations: rc.TimelineDurations,
+
+			ConditionalRequests: rc.ConditionalRequests,
+			StartupPolicy:       startupPolicy,
+			LiveDelaySeconds:    rc.LiveDelaySeconds,
+
+			PlaylistWindowSegments:  rc.PlaylistWindowSegments,
+			EncryptionMethod:        encryptionMethod,
+			IV:                      ivBytes,
+			DeriveSegmentIV:         rc.DeriveSegmentIV,
+			KeyURITemplate:          rc.KeyURITemplate,
+			TargetDuration:          rc.TargetDuration,
+			MasterPlaylistMaxAge:    rc.MasterPlaylistMaxAge,
+			LegacyAllowCache:        rc.LegacyAllowCache,
+			DeclareNoClosedCaptions: rc.DeclareNoClosedCaptions,
+
+			SteeringPathways:     rc.SteeringPathways,
+			SteeringTTL:          rc.SteeringTTL,
+			PrewarmSegments:      rc.PrewarmSegments,
+			MaxOnDemandFetches:   rc.MaxOnDemandFetches,
+			LookAheadSegments:    rc.LookAheadSegments,
+			WarmupTimeoutSeconds: rc.WarmupTimeoutSeconds,
+
+			VideoLadder:          videoLadder,
+			VideoRepresentations: rc.VideoRepresentations,
+			MaxVideoVariants:     rc.MaxVideoVariants,
+
+			MaxWidth:     rc.MaxWidth,
+			MaxHeight:    rc.MaxHeight,
+			MaxBandwidth: rc.MaxBandwidth,
+
+			ValidateInitSegments: rc.ValidateInitSegments,
+			StripInitBoxes:       rc.StripInitBoxes,
+			ReplaceInitBoxes:     replaceInitBoxes,
 		})
 	}
 
 	// Assemble the final, clean configuration object.
 	finalConfig := &ChannelConfig{
-		Name:      rawCfg.Name,
-		Id:        rawCfg.Id,
-		UserAgent: rawCfg.UserAgent,
-		Channels:  processedChannels,
+		Name:                  rawCfg.Name,
+		Id:                    rawCfg.Id,
+		UserAgent:             rawCfg.UserAgent,
+		SharedDownloadWorkers: rawCfg.SharedDownloadWorkers,
+		CacheMaxBytes:         rawCfg.CacheMaxBytes,
+		CacheDiskDir:          rawCfg.CacheDiskDir,
+		SessionIdleTimeout:    rawCfg.SessionIdleTimeout,
+		Channels:              processedChannels,
 	}
 
 	return finalConfig, nil
@@ -1,37 +1,91 @@
 package dash
 
 import (
+	"context"
 	"dash2hlsd/internal/logger"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
+// StatusError is returned when the origin answers with an unexpected HTTP status code.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	// RetryAfter is the wait asked for by the response's Retry-After header, or zero.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("received status code %d from %s", e.StatusCode, e.URL)
+}
+
+// Temporary reports whether the status may clear on a later attempt: server errors and 429 do,
+// while statuses such as 404, 403 and 410 mean the origin will not serve the resource.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// DefaultMaxManifestBytes is the default cap on the size of a fetched MPD.
+const DefaultMaxManifestBytes = 4 << 20
+
+// ErrManifestTooLarge is returned when an MPD exceeds the client's MaxManifestBytes.
+var ErrManifestTooLarge = errors.New("manifest exceeds the maximum allowed size")
+
 // Client is the DASH client responsible for all communication with the origin server.
 type Client struct {
 	httpClient *http.Client
 	logger     logger.Logger
+	// MaxManifestBytes caps the size of a fetched MPD to protect against broken or malicious origins.
+	MaxManifestBytes int64
+	// HostPolicy, when set, restricts the hosts that manifests and segments are fetched from.
+	// It applies to every request made through HttpClient, including the downloader's.
+	// Set it before the first request: connections that are already open are not checked again.
+	HostPolicy *HostPolicy
+	// DownloadRateLimiter, when set, caps the aggregate bandwidth of the segment downloaders created
+	// for the client's sessions. Nil does not limit.
+	DownloadRateLimiter *RateLimiter
+
+	// clockClient queries UTCTiming sources. Unlike httpClient, it follows redirects, as a time source
+	// that moved is still the server's clock.
+	clockClient *http.Client
+	// clockOffsets caches the clock offsets measured from UTCTiming sources. Guarded by clockMutex.
+	clockMutex   sync.Mutex
+	clockOffsets map[string]clockSample
 }
 
 // NewClient creates a new DASH client.
 func NewClient(log logger.Logger) *Client {
+	c := &Client{
+		logger:           log,
+		MaxManifestBytes: DefaultMaxManifestBytes,
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
 	transport := &http.Transport{
 		ResponseHeaderTimeout: 3 * time.Second,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if c.HostPolicy == nil {
+				return dialer.DialContext(ctx, network, addr)
+			}
+			return c.HostPolicy.dialContext(ctx, dialer, network, addr)
+		},
 	}
-
-	return &Client{
-		httpClient: &http.Client{
-			Transport: transport,
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
+	c.httpClient = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
 		},
-		logger: log,
 	}
+	c.clockClient = &http.Client{Transport: transport}
+	return c
 }
 
 // FetchAndParseMPD fetches the MPD from a given URL and parses it into the MPD struct.
@@ -78,13 +132,17 @@ func (c *Client) FetchAndParseMPD(initialUrl, userAgent string) (*MPD, string, e
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("failed to fetch MPD: received status code %d from %s", resp.StatusCode, finalUrl)
+		return nil, "", fmt.Errorf("failed to fetch MPD: %w", &StatusError{URL: finalUrl, StatusCode: resp.StatusCode})
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	// Read one byte past the limit to tell an oversized manifest from one of exactly the maximum size.
+	data, err := io.ReadAll(io.LimitReader(resp.Body, c.MaxManifestBytes+1))
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to read MPD response body: %w", err)
 	}
+	if int64(len(data)) > c.MaxManifestBytes {
+		return nil, "", fmt.Errorf("MPD from %s is larger than %d bytes: %w", finalUrl, c.MaxManifestBytes, ErrManifestTooLarge)
+	}
 
 	var mpd MPD
 	if err := xml.Unmarshal(data, &mpd); err != nil {
@@ -92,6 +150,12 @@ func (c *Client) FetchAndParseMPD(initialUrl, userAgent string) (*MPD, string, e
 		return nil, "", fmt.Errorf("failed to unmarshal MPD XML: %w", err)
 	}
 
+	// The live edge is computed from the server clock when the MPD says how to read it.
+	if mpd.Type == "dynamic" {
+		mpd.ClockOffset, _ = c.syncClock(&mpd, finalUrl, userAgent)
+	}
+	mpd.ResolveOpenRepeats(mpd.Now())
+
 	c.logger.Debugf("Successfully fetched and parsed MPD for profile %s from %s", mpd.Profiles, finalUrl)
 	return &mpd, finalUrl, nil
 }
@@ -110,53 +174,184 @@ func resolveURL(base *url.URL, path string) (*url.URL, error) {
 	return base.ResolveReference(resolvedPath), nil
 }
 
-// BuildInitSegmentURL constructs the full URL for an initialization segment.
-// It correctly resolves against the MPD location and the Period's BaseURL tag.
-func BuildInitSegmentURL(mpdLocationURL string, period *Period, as *AdaptationSet, rep *Representation) (string, error) {
+// resolveBaseURLs resolves the BaseURL elements of the MPD, Period, AdaptationSet and Representation
+// against the MPD location and returns every resulting base in failover order, primary first.
+// A level without BaseURL elements inherits the bases of the level above it. An absolute BaseURL
+// replaces the bases above it, so the duplicates it would produce for each of them are dropped.
+func resolveBaseURLs(mpdLocationURL string, mpd *MPD, period *Period, as *AdaptationSet, rep *Representation) ([]*url.URL, error) {
 	mpdURL, err := url.Parse(mpdLocationURL)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse mpdLocationURL '%s': %w", mpdLocationURL, err)
+		return nil, fmt.Errorf("failed to parse mpdLocationURL '%s': %w", mpdLocationURL, err)
+	}
+
+	bases := []*url.URL{mpdURL}
+	levels := []struct {
+		name     string
+		baseURLs []string
+	}{
+		{"MPD", nil},
+		{"period", period.BaseURL},
+		{"AdaptationSet", as.BaseURL},
+		{"Representation", nil},
+	}
+	if mpd != nil {
+		levels[0].baseURLs = mpd.BaseURL
+	}
+	if rep != nil {
+		levels[3].baseURLs = rep.BaseURL
+	}
+
+	for _, level := range levels {
+		if len(level.baseURLs) == 0 {
+			continue
+		}
+		var resolved []*url.URL
+		for _, base := range bases {
+			for _, baseURL := range level.baseURLs {
+				u, err := resolveURL(base, strings.TrimSpace(baseURL))
+				if err != nil {
+					return nil, fmt.Errorf("failed to resolve %s BaseURL: %w", level.name, err)
+				}
+				if !slices.ContainsFunc(resolved, func(r *url.URL) bool { return r.String() == u.String() }) {
+					resolved = append(resolved, u)
+				}
+			}
+		}
+		bases = resolved
 	}
+	return bases, nil
+}
 
-	currentBase := mpdURL
-	if period.BaseURL != "" {
-		currentBase, err = resolveURL(mpdURL, period.BaseURL)
+// resolveCandidates resolves a path against every base, returning the URLs in the same order.
+func resolveCandidates(bases []*url.URL, path string) ([]string, error) {
+	urls := make([]string, 0, len(bases))
+	for _, base := range bases {
+		u, err := resolveURL(base, path)
 		if err != nil {
-			return "", fmt.Errorf("failed to resolve period BaseURL: %w", err)
+			return nil, err
 		}
+		urls = append(urls, u.String())
+	}
+	return urls, nil
+}
+
+// BuildInitSegmentURL constructs the full URL for an initialization segment.
+// It correctly resolves against the MPD location and the Period's BaseURL tag,
+// returning the primary candidate when several BaseURLs are declared.
+func BuildInitSegmentURL(mpdLocationURL string, period *Period, as *AdaptationSet, rep *Representation) (string, error) {
+	urls, err := BuildInitSegmentURLs(mpdLocationURL, nil, period, as, rep)
+	if err != nil {
+		return "", err
 	}
+	return urls[0], nil
+}
 
-	initPath := strings.Replace(as.SegmentTemplate.Initialization, "$RepresentationID$", rep.ID, 1)
-	finalURL, err := resolveURL(currentBase, initPath)
+// BuildInitSegmentURLs constructs every candidate URL for an initialization segment,
+// one per combination of MPD, Period and AdaptationSet BaseURLs, in failover order.
+// mpd may be nil when MPD-level BaseURLs should not be considered.
+func BuildInitSegmentURLs(mpdLocationURL string, mpd *MPD, period *Period, as *AdaptationSet, rep *Representation) ([]string, error) {
+	bases, err := resolveBaseURLs(mpdLocationURL, mpd, period, as, rep)
 	if err != nil {
-		return "", fmt.Errorf("failed to resolve init path: %w", err)
+		return nil, err
 	}
 
-	return finalURL.String(), nil
+	initialization := as.GetInitialization(rep)
+	if initialization == "" && InitSegmentRange(as, rep) == "" {
+		return nil, fmt.Errorf("representation '%s' has no initialization segment", rep.ID)
+	}
+	initPath := ExpandTemplate(initialization, TemplateValues{RepresentationID: rep.ID, Bandwidth: uint64(rep.Bandwidth)})
+	urls, err := resolveCandidates(bases, initPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve init path: %w", err)
+	}
+	return urls, nil
+}
+
+// BuildMediaFileURLs constructs every candidate URL of a single-file representation's media file,
+// in failover order. Its segments, including the sidx box of a SegmentBase representation, are byte ranges of it.
+func BuildMediaFileURLs(mpdLocationURL string, mpd *MPD, period *Period, as *AdaptationSet, rep *Representation) ([]string, error) {
+	bases, err := resolveBaseURLs(mpdLocationURL, mpd, period, as, rep)
+	if err != nil {
+		return nil, err
+	}
+	return resolveCandidates(bases, "")
+}
+
+// segmentListMedia returns the media path of the SegmentList entry with the given segment number.
+func segmentListMedia(list *SegmentList, number uint64) (string, error) {
+	startNumber := list.GetStartNumber()
+	if number < startNumber || number-startNumber >= uint64(len(list.SegmentURLs)) {
+		return "", fmt.Errorf("segment number %d is outside the SegmentList (start %d, %d entries)", number, startNumber, len(list.SegmentURLs))
+	}
+	return list.SegmentURLs[number-startNumber].Media, nil
+}
+
+// InitSegmentRange returns the byte range of a representation's initialization segment within
+// its resource, or an empty string when the initialization segment is a resource of its own.
+func InitSegmentRange(as *AdaptationSet, rep *Representation) string {
+	if list := as.GetSegmentList(rep); list != nil && list.Initialization != nil {
+		return list.Initialization.Range
+	}
+	if base := as.GetSegmentBase(rep); base != nil && base.Initialization != nil {
+		return base.Initialization.Range
+	}
+	return ""
+}
+
+// SegmentMediaRange returns the byte range of the SegmentList entry with the given segment number,
+// or an empty string when the segment is a whole resource.
+func SegmentMediaRange(as *AdaptationSet, rep *Representation, number uint64) string {
+	list := as.GetSegmentList(rep)
+	if list == nil || as.GetSegmentTemplate(rep).Media != "" {
+		return ""
+	}
+	startNumber := list.GetStartNumber()
+	if number < startNumber || number-startNumber >= uint64(len(list.SegmentURLs)) {
+		return ""
+	}
+	return list.SegmentURLs[number-startNumber].MediaRange
 }
 
 // BuildSegmentURL constructs the full URL for a media segment.
-// It correctly resolves against the MPD location and the Period's BaseURL tag.
-func BuildSegmentURL(mpdLocationURL string, period *Period, as *AdaptationSet, rep *Representation, time uint64) (string, error) {
-	mpdURL, err := url.Parse(mpdLocationURL)
+// It correctly resolves against the MPD location and the Period's BaseURL tag,
+// returning the primary candidate when several BaseURLs are declared.
+// Both $Time$ and $Number$ addressing are supported; number is ignored by time-based templates.
+// For SegmentList addressing, number selects the SegmentURL entry.
+func BuildSegmentURL(mpdLocationURL string, period *Period, as *AdaptationSet, rep *Representation, time, number uint64) (string, error) {
+	urls, err := BuildSegmentURLs(mpdLocationURL, nil, period, as, rep, time, number)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse mpdLocationURL '%s': %w", mpdLocationURL, err)
+		return "", err
 	}
+	return urls[0], nil
+}
 
-	currentBase := mpdURL
-	if period.BaseURL != "" {
-		currentBase, err = resolveURL(mpdURL, period.BaseURL)
+// BuildSegmentURLs constructs every candidate URL for a media segment,
+// one per combination of MPD, Period and AdaptationSet BaseURLs, in failover order.
+// mpd may be nil when MPD-level BaseURLs should not be considered.
+func BuildSegmentURLs(mpdLocationURL string, mpd *MPD, period *Period, as *AdaptationSet, rep *Representation, time, number uint64) ([]string, error) {
+	bases, err := resolveBaseURLs(mpdLocationURL, mpd, period, as, rep)
+	if err != nil {
+		return nil, err
+	}
+
+	template := as.GetSegmentTemplate(rep)
+	var mediaPath string
+	if template.Media == "" && as.GetSegmentList(rep) != nil {
+		mediaPath, err = segmentListMedia(as.GetSegmentList(rep), number)
 		if err != nil {
-			return "", fmt.Errorf("failed to resolve period BaseURL: %w", err)
+			return nil, err
 		}
+	} else {
+		mediaPath = ExpandTemplate(template.Media, TemplateValues{
+			RepresentationID: rep.ID,
+			Bandwidth:        uint64(rep.Bandwidth),
+			Time:             time,
+			Number:           number,
+		})
 	}
-
-	mediaPath := strings.Replace(as.SegmentTemplate.Media, "$RepresentationID$", rep.ID, 1)
-	mediaPath = strings.Replace(mediaPath, "$Time$", fmt.Sprintf("%d", time), 1)
-	finalURL, err := resolveURL(currentBase, mediaPath)
+	urls, err := resolveCandidates(bases, mediaPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to resolve media path: %w", err)
+		return nil, fmt.Errorf("failed to resolve media path: %w", err)
 	}
-
-	return finalURL.String(), nil
+	return urls, nil
 }
@@ -0,0 +1,151 @@
+package dash
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// UTCTiming schemes supported for clock synchronization. NTP-based schemes are not supported and skipped.
+const (
+	UTCTimingHTTPISO    = "urn:mpeg:dash:utc:http-iso:2014"
+	UTCTimingHTTPXSDate = "urn:mpeg:dash:utc:http-xsdate:2014"
+	UTCTimingHTTPHead   = "urn:mpeg:dash:utc:http-head:2014"
+	UTCTimingDirect     = "urn:mpeg:dash:utc:direct:2014"
+)
+
+const (
+	// clockSyncInterval is how long a measured clock offset is reused before its source is queried again.
+	clockSyncInterval = 10 * time.Minute
+	// maxTimeResponseBytes caps the body of an http-iso or http-xsdate time response.
+	maxTimeResponseBytes = 1024
+)
+
+// clockSample is a measured offset of a timing source's clock from the local clock.
+type clockSample struct {
+	offset     time.Duration
+	measuredAt time.Time
+}
+
+// syncClock returns the offset of the server clock from the local clock, from the first of the MPD's
+// UTCTiming sources that can be queried. Offsets are cached per source for clockSyncInterval.
+// ok is false when the MPD has no usable UTCTiming element.
+func (c *Client) syncClock(mpd *MPD, mpdURL, userAgent string) (offset time.Duration, ok bool) {
+	for _, timing := range mpd.UTCTimings {
+		key := timing.SchemeIdUri + " " + timing.Value
+		c.clockMutex.Lock()
+		sample, found := c.clockOffsets[key]
+		c.clockMutex.Unlock()
+		if found && time.Since(sample.measuredAt) < clockSyncInterval {
+			return sample.offset, true
+		}
+
+		offset, err := c.measureClockOffset(timing, mpdURL, userAgent)
+		if err != nil {
+			c.logger.Warnf("Failed to synchronize clock with UTCTiming %s: %v", timing.SchemeIdUri, err)
+			continue
+		}
+		c.logger.Debugf("Server clock offset from UTCTiming %s is %v", timing.SchemeIdUri, offset)
+		c.clockMutex.Lock()
+		if c.clockOffsets == nil {
+			c.clockOffsets = make(map[string]clockSample)
+		}
+		c.clockOffsets[key] = clockSample{offset: offset, measuredAt: time.Now()}
+		c.clockMutex.Unlock()
+		return offset, true
+	}
+	return 0, false
+}
+
+// measureClockOffset queries a single UTCTiming source. HTTP sources may list several space-separated URLs,
+// which are tried in order.
+func (c *Client) measureClockOffset(timing Descriptor, mpdURL, userAgent string) (time.Duration, error) {
+	switch timing.SchemeIdUri {
+	case UTCTimingDirect:
+		serverTime, err := parseServerTime(timing.Value)
+		if err != nil {
+			return 0, err
+		}
+		return time.Until(serverTime), nil
+	case UTCTimingHTTPISO, UTCTimingHTTPXSDate, UTCTimingHTTPHead:
+		base, err := url.Parse(mpdURL)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse MPD URL '%s': %w", mpdURL, err)
+		}
+		var lastErr error
+		for _, source := range strings.Fields(timing.Value) {
+			timeURL, err := resolveURL(base, source)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			offset, err := c.fetchClockOffset(timing.SchemeIdUri, timeURL.String(), userAgent)
+			if err == nil {
+				return offset, nil
+			}
+			lastErr = err
+		}
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no time source URL")
+		}
+		return 0, lastErr
+	default:
+		return 0, fmt.Errorf("unsupported scheme")
+	}
+}
+
+// fetchClockOffset reads the time of an HTTP timing source, from the body or, for http-head, the Date header.
+// The server time is compared with the local time halfway through the request to cancel out the network delay.
+func (c *Client) fetchClockOffset(scheme, timeURL, userAgent string) (time.Duration, error) {
+	method := http.MethodGet
+	if scheme == UTCTimingHTTPHead {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequest(method, timeURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request for %s: %w", timeURL, err)
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	sent := time.Now()
+	resp, err := c.clockClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch time from %s: %w", timeURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, &StatusError{URL: timeURL, StatusCode: resp.StatusCode}
+	}
+
+	var serverTime time.Time
+	if scheme == UTCTimingHTTPHead {
+		serverTime, err = http.ParseTime(resp.Header.Get("Date"))
+	} else {
+		var body []byte
+		body, err = io.ReadAll(io.LimitReader(resp.Body, maxTimeResponseBytes))
+		if err == nil {
+			serverTime, err = parseServerTime(string(body))
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid time from %s: %w", timeURL, err)
+	}
+	received := time.Now()
+	return serverTime.Sub(sent.Add(received.Sub(sent) / 2)), nil
+}
+
+// parseServerTime parses an ISO 8601 / xs:dateTime timestamp. A timestamp without a zone is taken as UTC.
+func parseServerTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time '%s'", value)
+}
@@ -0,0 +1,36 @@
+package dash
+
+import "strings"
+
+// supportedCodecs lists the sample entry types (the part of an RFC 6381 codec string before
+// the first dot) that HLS players can decode from fMP4 segments.
+var supportedCodecs = map[string]struct{}{
+	// Video
+	"avc1": {}, "avc3": {}, "hvc1": {}, "hev1": {}, "dvh1": {}, "dvhe": {}, "av01": {},
+	// Audio
+	"mp4a": {}, "ac-3": {}, "ec-3": {}, "ac-4": {}, "opus": {}, "flac": {}, "alac": {},
+	// Subtitles
+	"wvtt": {}, "stpp": {},
+}
+
+// UnsupportedCodecs returns the codecs of a comma-separated codecs attribute that cannot be
+// served to HLS players. An empty attribute is treated as supported, since there is nothing to check.
+func UnsupportedCodecs(codecs string) []string {
+	var unsupported []string
+	for _, codec := range strings.Split(codecs, ",") {
+		codec = strings.TrimSpace(codec)
+		if codec == "" {
+			continue
+		}
+		fourCC, _, _ := strings.Cut(codec, ".")
+		if _, ok := supportedCodecs[strings.ToLower(fourCC)]; !ok {
+			unsupported = append(unsupported, codec)
+		}
+	}
+	return unsupported
+}
+
+// IsSupportedCodec reports whether every codec in a comma-separated codecs attribute can be served.
+func IsSupportedCodec(codecs string) bool {
+	return len(UnsupportedCodecs(codecs)) == 0
+}
@@ -3,10 +3,16 @@ package dash
 import (
 	"context"
 	"dash2hlsd/internal/logger"
+	"dash2hlsd/internal/metrics"
 	"dash2hlsd/internal/models"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand/v2"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,6 +21,30 @@ import (
 type DownloadTask struct {
 	Segment models.Segment
 	Result  chan<- DownloadResult
+	// Cached, when set, makes the request conditional on the copy having changed.
+	Cached *CachedCopy
+	// Priority tasks, such as init segments that block playback start, are picked up before queued media segments.
+	Priority bool
+	// QueuedAt is when the task was queued, set by QueueDownload unless already set.
+	QueuedAt time.Time
+	// Ctx, when set, is the context of whoever queued the task. Once it is done the task is abandoned:
+	// it is skipped if not started yet, its requests are cancelled and its result is not delivered.
+	Ctx context.Context
+}
+
+// context returns the task's context, or the background context when it has none.
+func (t DownloadTask) context() context.Context {
+	if t.Ctx == nil {
+		return context.Background()
+	}
+	return t.Ctx
+}
+
+// CachedCopy is a previously downloaded copy of a segment along with its HTTP validators.
+type CachedCopy struct {
+	Data         []byte
+	ETag         string
+	LastModified string
 }
 
 // DownloadResult holds the result of a download attempt.
@@ -22,30 +52,98 @@ type DownloadResult struct {
 	Task  DownloadTask
 	Data  []byte
 	Error error
+	// ETag and LastModified are the validators returned by the origin, if any.
+	ETag         string
+	LastModified string
+	// NotModified is true when the origin answered 304 and Data is the cached copy.
+	NotModified bool
+	// QueueWait is how long the task waited in the queue before a worker picked it up, and TransferTime
+	// how long the download itself took, including retries and failover.
+	QueueWait    time.Duration
+	TransferTime time.Duration
 }
 
 // Downloader is responsible for managing concurrent segment downloads.
 type Downloader struct {
-	httpClient     *http.Client
-	logger         logger.Logger
-	userAgent      string
-	taskQueue      chan DownloadTask
-	workerWG       sync.WaitGroup
-	maxRetries     int
-	retryDelay     time.Duration
-	RequestTimeout time.Duration
+	httpClient    *http.Client
+	logger        logger.Logger
+	userAgent     string
+	taskQueue     chan DownloadTask
+	priorityQueue chan DownloadTask
+	workerWG      sync.WaitGroup
+	// stopMutex guards stopped, so that tasks queued while or after the downloader stops are dropped
+	// instead of being sent on a closed queue.
+	stopMutex sync.RWMutex
+	stopped   bool
+	// MaxRetries is the number of attempts made on each candidate URL of a segment.
+	MaxRetries int
+	// RetryDelay is the wait after the first failed attempt. Each further failure multiplies it by
+	// RetryMultiplier, and up to retryJitter of random jitter is added so that workers retrying an
+	// overloaded origin do not all hit it at once.
+	RetryDelay      time.Duration
+	RetryMultiplier float64
+	RequestTimeout  time.Duration
+	// RateLimiter, when set, throttles the reading of segment bodies. Share one limiter between
+	// downloaders to cap their aggregate bandwidth. Throttled reads count towards RequestTimeout.
+	RateLimiter *RateLimiter
+}
+
+// retryJitter is the largest fraction of the backoff added to it as random jitter.
+const retryJitter = 0.2
+
+// maxRetryAfter caps the wait asked for by an origin's Retry-After header, so that a worker is not held
+// for longer than a live segment stays useful.
+const maxRetryAfter = 10 * time.Second
+
+// IsPermanent reports whether a download error will not clear by downloading the segment again: every
+// candidate URL was answered with a status that is not Temporary, or is a host the client may not contact.
+// Network errors and timeouts are not permanent.
+func IsPermanent(err error) bool {
+	var joined interface{ Unwrap() []error }
+	if errors.As(err, &joined) {
+		errs := joined.Unwrap()
+		for _, e := range errs {
+			if !IsPermanent(e) {
+				return false
+			}
+		}
+		return len(errs) > 0
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return !statusErr.Temporary()
+	}
+	return errors.Is(err, ErrHostNotAllowed)
 }
 
-// NewDownloader creates a new downloader with a worker pool.
+// maxSegmentRedirects bounds the redirects followed for a single segment request.
+const maxSegmentRedirects = 5
+
+// followSegmentRedirects lets segment requests follow CDN redirects, up to maxSegmentRedirects.
+func followSegmentRedirects(req *http.Request, via []*http.Request) error {
+	if len(via) > maxSegmentRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxSegmentRedirects)
+	}
+	return nil
+}
+
+// NewDownloader creates a new downloader with a worker pool. The downloader uses its own copy of client,
+// sharing its transport, that follows redirects: the MPD client handles them manually to learn the final
+// manifest URL, but a redirected segment is only useful once its media is fetched.
 func NewDownloader(client *http.Client, log logger.Logger, userAgent string, numWorkers int) *Downloader {
+	segmentClient := *client
+	segmentClient.CheckRedirect = followSegmentRedirects
+
 	d := &Downloader{
-		httpClient:     client,
-		logger:         log,
-		userAgent:      userAgent,
-		taskQueue:      make(chan DownloadTask, 100), // Buffered channel
-		maxRetries:     3,
-		retryDelay:     200 * time.Millisecond,
-		RequestTimeout: 10 * time.Second,
+		httpClient:      &segmentClient,
+		logger:          log,
+		userAgent:       userAgent,
+		taskQueue:       make(chan DownloadTask, 100), // Buffered channel
+		priorityQueue:   make(chan DownloadTask, 100),
+		MaxRetries:      3,
+		RetryDelay:      200 * time.Millisecond,
+		RetryMultiplier: 2,
+		RequestTimeout:  10 * time.Second,
 	}
 
 	d.workerWG.Add(numWorkers)
@@ -56,78 +154,294 @@ func NewDownloader(client *http.Client, log logger.Logger, userAgent string, num
 	return d
 }
 
-// QueueDownload adds a segment to the download queue.
+// QueueDownload adds a segment to the download queue. Tasks queued once the downloader is stopped are dropped.
 func (d *Downloader) QueueDownload(task DownloadTask) {
+	d.stopMutex.RLock()
+	defer d.stopMutex.RUnlock()
+	if d.stopped {
+		d.logger.Debugf("Dropping download of segment %s queued after the downloader stopped", task.Segment.ID)
+		return
+	}
+	if task.QueuedAt.IsZero() {
+		task.QueuedAt = time.Now()
+	}
+	if task.Priority {
+		d.priorityQueue <- task
+		return
+	}
 	d.taskQueue <- task
 }
 
 // Stop gracefully shuts down the downloader and its workers.
 func (d *Downloader) Stop() {
+	d.stopMutex.Lock()
+	if d.stopped {
+		d.stopMutex.Unlock()
+		return
+	}
+	d.stopped = true
 	close(d.taskQueue)
+	close(d.priorityQueue)
+	d.stopMutex.Unlock()
 	d.workerWG.Wait()
 }
 
+// nextTask returns the next task to download, preferring priority tasks.
+// It returns false once both queues are closed and drained.
+func (d *Downloader) nextTask() (DownloadTask, bool) {
+	select {
+	case task, ok := <-d.priorityQueue:
+		if ok {
+			return task, true
+		}
+	default:
+	}
+
+	select {
+	case task, ok := <-d.priorityQueue:
+		if ok {
+			return task, true
+		}
+		task, ok = <-d.taskQueue
+		return task, ok
+	case task, ok := <-d.taskQueue:
+		if ok {
+			return task, true
+		}
+		task, ok = <-d.priorityQueue
+		return task, ok
+	}
+}
+
 func (d *Downloader) worker(id int) {
 	defer d.workerWG.Done()
 	d.logger.Debugf("Worker %d started", id)
 
-	for task := range d.taskQueue {
-		data, err := d.download(task.Segment)
-		task.Result <- DownloadResult{
-			Task:  task,
-			Data:  data,
-			Error: err,
+	for {
+		task, ok := d.nextTask()
+		if !ok {
+			break
+		}
+		ctx := task.context()
+		if ctx.Err() != nil {
+			d.logger.Debugf("Skipping download of segment %s, which is no longer wanted", task.Segment.ID)
+			continue
+		}
+		start := time.Now()
+		result := d.download(task)
+		result.Task = task
+		result.QueueWait = start.Sub(task.QueuedAt)
+		result.TransferTime = time.Since(start)
+		// A session that stopped no longer reads its results, so they must not block the worker.
+		select {
+		case task.Result <- result:
+		case <-ctx.Done():
 		}
 	}
 
 	d.logger.Debugf("Worker %d finished", id)
 }
 
-func (d *Downloader) download(segment models.Segment) ([]byte, error) {
+// download fetches a segment, trying each of its candidate URLs in order until one succeeds.
+func (d *Downloader) download(task DownloadTask) DownloadResult {
+	start := time.Now()
+	defer func() {
+		metrics.SegmentDownloadSeconds.Observe(time.Since(start).Seconds())
+	}()
+
+	urls := append([]string{task.Segment.URL}, task.Segment.FallbackURLs...)
+	var errs []error
+	for i, segmentURL := range urls {
+		result := d.downloadFrom(task, segmentURL)
+		if result.Error == nil {
+			metrics.SegmentDownloads.WithLabel("success").Inc()
+			return result
+		}
+		errs = append(errs, result.Error)
+		if i+1 < len(urls) {
+			d.logger.Warnf("Segment %s failed on %s, failing over to %s", task.Segment.ID, segmentURL, urls[i+1])
+		}
+	}
+	metrics.SegmentDownloads.WithLabel("failure").Inc()
+	return DownloadResult{Error: errors.Join(errs...)}
+}
+
+// downloadFrom fetches a segment from a single URL, retrying transient failures.
+func (d *Downloader) downloadFrom(task DownloadTask, segmentURL string) DownloadResult {
+	segment := task.Segment
 	var lastErr error
 
-	for attempt := 1; attempt <= d.maxRetries; attempt++ {
-		ctx, cancel := context.WithTimeout(context.Background(), d.RequestTimeout)
+	for attempt := 1; attempt <= d.MaxRetries; attempt++ {
+		ctx, cancel := context.WithTimeout(task.context(), d.RequestTimeout)
 		defer cancel()
 
-		req, err := http.NewRequestWithContext(ctx, "GET", segment.URL, nil)
+		req, err := http.NewRequestWithContext(ctx, "GET", segmentURL, nil)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create request for segment %s: %w", segment.ID, err)
+			return DownloadResult{Error: fmt.Errorf("failed to create request for segment %s: %w", segment.ID, err)}
 		}
 
 		if d.userAgent != "" {
 			req.Header.Set("User-Agent", d.userAgent)
 		}
+		if segment.ByteRange != "" {
+			req.Header.Set("Range", "bytes="+segment.ByteRange)
+		}
+		if task.Cached != nil {
+			if task.Cached.ETag != "" {
+				req.Header.Set("If-None-Match", task.Cached.ETag)
+			}
+			if task.Cached.LastModified != "" {
+				req.Header.Set("If-Modified-Since", task.Cached.LastModified)
+			}
+		}
 
-		d.logger.Debugf("Downloading segment %s from %s (Attempt %d/%d)", segment.ID, segment.URL, attempt, d.maxRetries)
+		d.logger.Debugf("Downloading segment %s from %s (Attempt %d/%d)", segment.ID, segmentURL, attempt, d.MaxRetries)
 		resp, err := d.httpClient.Do(req)
+		if errors.Is(err, ErrHostNotAllowed) {
+			return DownloadResult{Error: fmt.Errorf("segment %s (%s): %w", segment.ID, segmentURL, err)}
+		}
 		if err != nil {
-			lastErr = fmt.Errorf("download attempt %d for segment %s (%s) failed: %w", attempt, segment.ID, segment.URL, err)
+			lastErr = fmt.Errorf("download attempt %d for segment %s (%s) failed: %w", attempt, segment.ID, segmentURL, err)
 			d.logger.Warnf(lastErr.Error())
-			time.Sleep(d.retryDelay)
+			if !d.waitBeforeRetry(task.context(), attempt, 0) {
+				break
+			}
 			continue
 		}
 
-		if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusNotModified && task.Cached != nil {
+			resp.Body.Close()
+			d.logger.Debugf("Segment %s not modified, reusing cached copy", segment.ID)
+			return DownloadResult{
+				Data:         task.Cached.Data,
+				ETag:         task.Cached.ETag,
+				LastModified: task.Cached.LastModified,
+				NotModified:  true,
+			}
+		}
+
+		partial := resp.StatusCode == http.StatusPartialContent && segment.ByteRange != ""
+		if resp.StatusCode != http.StatusOK && !partial {
 			resp.Body.Close()
-			lastErr = fmt.Errorf("download attempt %d for segment %s (%s) received non-200 status: %d", attempt, segment.ID, segment.URL, resp.StatusCode)
+			statusErr := &StatusError{URL: segmentURL, StatusCode: resp.StatusCode}
+			if !statusErr.Temporary() {
+				// Retrying a segment the origin does not serve only delays the failover and the session.
+				return DownloadResult{Error: fmt.Errorf("segment %s: %w", segment.ID, statusErr)}
+			}
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+				statusErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			}
+			lastErr = fmt.Errorf("download attempt %d for segment %s: %w", attempt, segment.ID, statusErr)
 			d.logger.Warnf(lastErr.Error())
-			time.Sleep(d.retryDelay)
+			if !d.waitBeforeRetry(task.context(), attempt, statusErr.RetryAfter) {
+				break
+			}
 			continue
 		}
 
-		data, err := io.ReadAll(resp.Body)
+		data, err := io.ReadAll(d.RateLimiter.Reader(ctx, resp.Body))
 		resp.Body.Close()
 		if err != nil {
-			lastErr = fmt.Errorf("download attempt %d for segment %s (%s) failed while reading body: %w", attempt, segment.ID, segment.URL, err)
+			lastErr = fmt.Errorf("download attempt %d for segment %s (%s) failed while reading body: %w", attempt, segment.ID, segmentURL, err)
 			d.logger.Warnf(lastErr.Error())
-			time.Sleep(d.retryDelay)
+			if !d.waitBeforeRetry(task.context(), attempt, 0) {
+				break
+			}
 			continue
 		}
 
+		if segment.ByteRange != "" && !partial {
+			// The origin ignored the Range header and sent the whole resource.
+			if data, err = sliceByteRange(data, segment.ByteRange); err != nil {
+				return DownloadResult{Error: fmt.Errorf("segment %s (%s): %w", segment.ID, segmentURL, err)}
+			}
+		}
+
 		d.logger.Debugf("Successfully downloaded segment %s", segment.ID)
-		return data, nil
+		return DownloadResult{
+			Data:         data,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
 	}
 
-	return nil, fmt.Errorf("failed to download segment %s after %d attempts: %w", segment.ID, d.maxRetries, lastErr)
+	if err := task.context().Err(); err != nil {
+		return DownloadResult{Error: fmt.Errorf("gave up on segment %s: %w", segment.ID, err)}
+	}
+	return DownloadResult{Error: fmt.Errorf("failed to download segment %s after %d attempts: %w", segment.ID, d.MaxRetries, lastErr)}
+}
+
+// waitBeforeRetry sleeps after a failed attempt, unless it was the last one. The origin's Retry-After,
+// when it sent one, replaces the backoff. It returns false without waiting out the delay once ctx is done,
+// so that a worker is not held by a segment nobody wants any more.
+func (d *Downloader) waitBeforeRetry(ctx context.Context, attempt int, retryAfter time.Duration) bool {
+	if attempt >= d.MaxRetries {
+		return true
+	}
+	delay := d.retryBackoff(attempt)
+	if retryAfter > 0 {
+		delay = min(retryAfter, maxRetryAfter)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// parseRetryAfter returns the wait asked for by a Retry-After header, given either as a number of
+// seconds or as an HTTP date. It returns zero for a missing or invalid header.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// retryBackoff returns the wait after the given failed attempt, counting from 1: RetryDelay multiplied
+// by RetryMultiplier for every earlier failure, plus random jitter.
+func (d *Downloader) retryBackoff(attempt int) time.Duration {
+	delay := float64(d.RetryDelay) * math.Pow(max(d.RetryMultiplier, 1), float64(attempt-1))
+	return time.Duration(delay * (1 + retryJitter*rand.Float64()))
+}
+
+// ParseByteRange parses an inclusive "first-last" byte range as used by MPD range attributes.
+func ParseByteRange(byteRange string) (first, last uint64, err error) {
+	firstStr, lastStr, found := strings.Cut(byteRange, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid byte range '%s'", byteRange)
+	}
+	first, err = strconv.ParseUint(firstStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid byte range '%s': %w", byteRange, err)
+	}
+	last, err = strconv.ParseUint(lastStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid byte range '%s': %w", byteRange, err)
+	}
+	if last < first {
+		return 0, 0, fmt.Errorf("invalid byte range '%s': last byte precedes first", byteRange)
+	}
+	return first, last, nil
+}
+
+// sliceByteRange extracts a byte range from a whole resource.
+func sliceByteRange(data []byte, byteRange string) ([]byte, error) {
+	first, last, err := ParseByteRange(byteRange)
+	if err != nil {
+		return nil, err
+	}
+	if last >= uint64(len(data)) {
+		return nil, fmt.Errorf("byte range '%s' exceeds resource of %d bytes", byteRange, len(data))
+	}
+	return data[first : last+1], nil
 }
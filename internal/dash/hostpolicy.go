@@ -0,0 +1,154 @@
+package dash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ErrHostNotAllowed is returned when a fetch targets a host that the client's HostPolicy rejects.
+var ErrHostNotAllowed = errors.New("host is not allowed")
+
+// HostPolicy restricts the hosts the client fetches manifests and segments from, so that a malicious
+// manifest cannot make the proxy reach internal services. It is checked when connecting, against both
+// the hostname and every address it resolves to, so DNS answers pointing at blocked addresses are refused.
+//
+// Entries are hostnames, IP addresses or CIDR prefixes. A hostname starting with "*." or "." matches
+// its subdomains. Denied entries always win. Once an allowlist is given, only allowed hosts are fetched;
+// otherwise private, loopback and link-local addresses are refused unless AllowPrivate is set.
+type HostPolicy struct {
+	// AllowPrivate permits private, loopback and link-local addresses that no allow entry names.
+	AllowPrivate bool
+
+	allowHosts    []string
+	allowPrefixes []netip.Prefix
+	denyHosts     []string
+	denyPrefixes  []netip.Prefix
+}
+
+// NewHostPolicy parses allow and deny entries into a HostPolicy.
+func NewHostPolicy(allow, deny []string) (*HostPolicy, error) {
+	policy := &HostPolicy{}
+	var err error
+	if policy.allowHosts, policy.allowPrefixes, err = parseHostEntries(allow); err != nil {
+		return nil, fmt.Errorf("invalid allowed host: %w", err)
+	}
+	if policy.denyHosts, policy.denyPrefixes, err = parseHostEntries(deny); err != nil {
+		return nil, fmt.Errorf("invalid denied host: %w", err)
+	}
+	return policy, nil
+}
+
+// parseHostEntries splits entries into lowercase hostname patterns and address prefixes.
+func parseHostEntries(entries []string) ([]string, []netip.Prefix, error) {
+	var hosts []string
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		default:
+			if addr, err := netip.ParseAddr(entry); err == nil {
+				prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+				continue
+			}
+			hosts = append(hosts, strings.TrimPrefix(entry, "*"))
+		}
+	}
+	return hosts, prefixes, nil
+}
+
+// matchHost reports whether host equals a pattern, or is a subdomain of a pattern starting with a dot.
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if host == pattern || (strings.HasPrefix(pattern, ".") && strings.HasSuffix(host, pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddr reports whether addr lies in one of the prefixes.
+func matchAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateAddr reports whether addr is only reachable from a local network or the host itself.
+func isPrivateAddr(addr netip.Addr) bool {
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsUnspecified()
+}
+
+// Resolve returns the addresses of host that the policy permits connecting to,
+// or an error wrapping ErrHostNotAllowed when there are none.
+func (p *HostPolicy) Resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchHost(p.denyHosts, host) {
+		return nil, fmt.Errorf("%s is denied: %w", host, ErrHostNotAllowed)
+	}
+	hostAllowed := matchHost(p.allowHosts, host)
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		resolved, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		addrs = resolved
+	}
+
+	var permitted []netip.Addr
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		switch {
+		case matchAddr(p.denyPrefixes, addr):
+		case hostAllowed || matchAddr(p.allowPrefixes, addr):
+			permitted = append(permitted, addr)
+		case len(p.allowHosts) > 0 || len(p.allowPrefixes) > 0:
+		case isPrivateAddr(addr) && !p.AllowPrivate:
+		default:
+			permitted = append(permitted, addr)
+		}
+	}
+	if len(permitted) == 0 {
+		return nil, fmt.Errorf("%s (%v) is not permitted by the host policy: %w", host, addrs, ErrHostNotAllowed)
+	}
+	return permitted, nil
+}
+
+// dialContext connects to the first reachable address of addr's host that the policy permits.
+func (p *HostPolicy) dialContext(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := p.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
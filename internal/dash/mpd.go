@@ -1,10 +1,15 @@
 package dash
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"math/bits"
 	"path"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -21,7 +26,21 @@ type MPD struct {
 	PublishTime           string   `xml:"publishTime,attr"`
 	MaxSegmentDuration    string   `xml:"maxSegmentDuration,attr"`
 	MinBufferTime         string   `xml:"minBufferTime,attr"`
-	Periods               []Period `xml:"Period"`
+	// MediaPresentationDuration is the total duration of a static presentation.
+	MediaPresentationDuration string `xml:"mediaPresentationDuration,attr,omitempty"`
+	// BaseURL lists the MPD-level base URLs in order of preference.
+	BaseURL []string `xml:"BaseURL"`
+	Periods []Period `xml:"Period"`
+	// UTCTimings lists the sources of the server clock, in order of preference.
+	UTCTimings []Descriptor `xml:"UTCTiming"`
+	// ClockOffset is the offset of the server clock from the local clock, measured from UTCTimings
+	// when the MPD was fetched. It is zero when the MPD has no usable UTCTiming.
+	ClockOffset time.Duration `xml:"-"`
+}
+
+// Now returns the current time on the server clock.
+func (m *MPD) Now() time.Time {
+	return time.Now().Add(m.ClockOffset)
 }
 
 // GetMinimumUpdatePeriod returns the MinimumUpdatePeriod as a time.Duration.
@@ -29,6 +48,33 @@ func (m *MPD) GetMinimumUpdatePeriod() (time.Duration, error) {
 	return parseDuration(m.MinimumUpdatePeriod)
 }
 
+// GetTimeShiftBufferDepth returns the TimeShiftBufferDepth as a time.Duration.
+func (m *MPD) GetTimeShiftBufferDepth() (time.Duration, error) {
+	return parseDuration(m.TimeShiftBufferDepth)
+}
+
+// GetDefaultKIDs returns the distinct CENC default_KIDs declared anywhere in the MPD.
+func (m *MPD) GetDefaultKIDs() [][]byte {
+	var kids [][]byte
+	seen := make(map[string]struct{})
+	for _, period := range m.Periods {
+		for i := range period.Sets {
+			as := &period.Sets[i]
+			for j := range as.Representations {
+				kid, err := ParseKID(as.GetDefaultKID(&as.Representations[j]))
+				if err != nil {
+					continue
+				}
+				if _, ok := seen[string(kid)]; !ok {
+					seen[string(kid)] = struct{}{}
+					kids = append(kids, kid)
+				}
+			}
+		}
+	}
+	return kids
+}
+
 // parseDuration parses an ISO 8601 duration string like "PT8S".
 func parseDuration(duration string) (time.Duration, error) {
 	if !strings.HasPrefix(duration, "PT") {
@@ -75,10 +121,11 @@ func parseDuration(duration string) (time.Duration, error) {
 
 // Period represents a media content period.
 type Period struct {
-	ID      string          `xml:"id,attr"`
-	Start   string          `xml:"start,attr"`
-	BaseURL string          `xml:"BaseURL"`
-	Sets    []AdaptationSet `xml:"AdaptationSet"`
+	ID       string          `xml:"id,attr"`
+	Start    string          `xml:"start,attr"`
+	Duration string          `xml:"duration,attr,omitempty"`
+	BaseURL  []string        `xml:"BaseURL"` // In order of preference
+	Sets     []AdaptationSet `xml:"AdaptationSet"`
 }
 
 // GetStart returns the Period's start time as a time.Duration.
@@ -95,14 +142,393 @@ type AdaptationSet struct {
 	ContentType      string           `xml:"contentType,attr"`
 	Lang             string           `xml:"lang,attr,omitempty"`
 	MimeType         string           `xml:"mimeType,attr"`
+	Codecs           string           `xml:"codecs,attr,omitempty"`
+	SegmentProfiles  string           `xml:"segmentProfiles,attr,omitempty"`
 	SegmentAlignment bool             `xml:"segmentAlignment,attr"`
 	StartWithSAP     int              `xml:"startWithSAP,attr"`
 	MaxWidth         int              `xml:"maxWidth,attr,omitempty"`
 	MaxHeight        int              `xml:"maxHeight,attr,omitempty"`
 	Par              string           `xml:"par,attr,omitempty"`
 	CodingDependency bool             `xml:"codingDependency,attr,omitempty"`
+	BaseURL          []string         `xml:"BaseURL"` // In order of preference
 	Representations  []Representation `xml:"Representation"`
 	SegmentTemplate  SegmentTemplate  `xml:"SegmentTemplate"`
+	SegmentList      *SegmentList     `xml:"SegmentList"`
+	SegmentBase      *SegmentBase     `xml:"SegmentBase"`
+	// ContentProtections holds the DRM descriptors of the set, e.g. the CENC default_KID and PSSH boxes.
+	ContentProtections []ContentProtection `xml:"ContentProtection"`
+	// Roles and Accessibility describe the purpose of the set, e.g. main, commentary or captions.
+	Roles         []Descriptor `xml:"Role"`
+	Accessibility []Descriptor `xml:"Accessibility"`
+	// Labels are human-readable names of the set, possibly one per language.
+	Labels []string `xml:"Label"`
+	// AudioChannelConfigurations describe the channel layout of an audio set.
+	AudioChannelConfigurations []Descriptor `xml:"AudioChannelConfiguration"`
+}
+
+// Role and accessibility scheme URIs.
+const (
+	// RoleScheme is the DASH role scheme, whose values include main, alternate, commentary, caption and description.
+	RoleScheme = "urn:mpeg:dash:role:2011"
+	// AudioPurposeScheme is the DVB audio purpose scheme, where 1 is audio description for the visually impaired.
+	AudioPurposeScheme = "urn:tva:metadata:cs:AudioPurposeCS:2007"
+	// CEA608Scheme and CEA708Scheme signal closed captions embedded in the video, with a value such as
+	// "CC1=eng;CC3=deu" for CEA-608 or "1=lang:eng;2=lang:deu" for CEA-708 services.
+	CEA608Scheme = "urn:scte:dash:cc:cea-608:2015"
+	CEA708Scheme = "urn:scte:dash:cc:cea-708:2015"
+)
+
+// Descriptor is a generic DASH descriptor, such as a Role or Accessibility element.
+type Descriptor struct {
+	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr,omitempty"`
+}
+
+// HasRole reports whether the set carries the given value of the DASH role scheme.
+func (as *AdaptationSet) HasRole(value string) bool {
+	return hasDescriptor(as.Roles, RoleScheme, value)
+}
+
+// IsCaptions reports whether the set holds captions for the deaf and hard of hearing,
+// which also transcribe non-dialog sounds, rather than plain subtitles.
+func (as *AdaptationSet) IsCaptions() bool {
+	return as.HasRole("caption") || hasDescriptor(as.Accessibility, RoleScheme, "caption")
+}
+
+// IsAudioDescription reports whether the set is an audio description of the video for the visually impaired.
+func (as *AdaptationSet) IsAudioDescription() bool {
+	return as.HasRole("description") || hasDescriptor(as.Accessibility, RoleScheme, "description") ||
+		hasDescriptor(as.Accessibility, AudioPurposeScheme, "1")
+}
+
+// CaptionService is a closed-caption service carried in a video set's SEI messages.
+type CaptionService struct {
+	// InstreamID identifies the service in HLS: CC1 to CC4 for CEA-608, SERVICE1 to SERVICE63 for CEA-708.
+	InstreamID string
+	Lang       string
+}
+
+// CaptionServices returns the CEA-608 and CEA-708 caption services the set's Accessibility descriptors
+// signal. CEA-608 languages listed without a channel are assigned CC1, CC2 and so on in order, and a
+// descriptor without a value signals CC1 or SERVICE1 in an unknown language. Invalid entries are skipped.
+func (as *AdaptationSet) CaptionServices() []CaptionService {
+	var services []CaptionService
+	seen := make(map[string]bool)
+	for _, d := range as.Accessibility {
+		if d.SchemeIdUri != CEA608Scheme && d.SchemeIdUri != CEA708Scheme {
+			continue
+		}
+		cea608 := d.SchemeIdUri == CEA608Scheme
+		entries := strings.Split(d.Value, ";")
+		for i, entry := range entries {
+			channel, lang, found := strings.Cut(strings.TrimSpace(entry), "=")
+			if !found {
+				channel, lang = strconv.Itoa(i+1), channel
+			}
+			service, ok := captionService(channel, lang, cea608)
+			if ok && !seen[service.InstreamID] {
+				seen[service.InstreamID] = true
+				services = append(services, service)
+			}
+		}
+	}
+	return services
+}
+
+// captionService builds the service of a caption descriptor entry. The CEA-608 channel is "CC1" to "CC4" or
+// its number, the CEA-708 one a service number, whose language may be given as "lang:eng" among other
+// comma-separated properties.
+func captionService(channel, lang string, cea608 bool) (CaptionService, bool) {
+	channel = strings.TrimSpace(channel)
+	if cea608 {
+		channel = strings.TrimPrefix(strings.ToUpper(channel), "CC")
+	}
+	number, err := strconv.Atoi(channel)
+	if err != nil || number < 1 || (cea608 && number > 4) || number > 63 {
+		return CaptionService{}, false
+	}
+	if !cea608 && strings.Contains(lang, ":") {
+		properties := strings.Split(lang, ",")
+		lang = ""
+		for _, property := range properties {
+			if value, found := strings.CutPrefix(strings.TrimSpace(property), "lang:"); found {
+				lang = value
+			}
+		}
+	}
+	prefix := "SERVICE"
+	if cea608 {
+		prefix = "CC"
+	}
+	return CaptionService{InstreamID: fmt.Sprintf("%s%d", prefix, number), Lang: strings.TrimSpace(lang)}, true
+}
+
+// GetLabel returns the first non-empty label of the set, or an empty string.
+func (as *AdaptationSet) GetLabel() string {
+	for _, label := range as.Labels {
+		if label = strings.TrimSpace(label); label != "" {
+			return label
+		}
+	}
+	return ""
+}
+
+func hasDescriptor(descriptors []Descriptor, scheme, value string) bool {
+	for _, d := range descriptors {
+		if d.SchemeIdUri == scheme && d.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSegmentTemplate returns the effective SegmentTemplate for a representation.
+// Attributes set on the representation's own template take precedence over those
+// inherited from the AdaptationSet, as described by the DASH inheritance rules.
+// For SegmentList addressing, the returned template carries the list's timescale,
+// start number and timeline so that timing is computed the same way for both schemes.
+func (as *AdaptationSet) GetSegmentTemplate(rep *Representation) SegmentTemplate {
+	template := as.SegmentTemplate
+	if rep != nil && rep.SegmentTemplate != nil {
+		template = mergeSegmentTemplate(template, rep.SegmentTemplate)
+	}
+
+	if template.Media == "" {
+		if list := as.GetSegmentList(rep); list != nil {
+			template.Timescale = list.GetTimescale()
+			template.StartNumber = list.StartNumber
+			template.Timeline = list.GetTimeline()
+		}
+	}
+	return template
+}
+
+// GetSegmentList returns the effective SegmentList for a representation, or nil if
+// neither the representation nor the AdaptationSet uses SegmentList addressing.
+func (as *AdaptationSet) GetSegmentList(rep *Representation) *SegmentList {
+	if rep != nil && rep.SegmentList != nil {
+		return rep.SegmentList
+	}
+	return as.SegmentList
+}
+
+// GetSegmentBase returns the effective SegmentBase for a representation, or nil if
+// neither the representation nor the AdaptationSet uses SegmentBase addressing.
+func (as *AdaptationSet) GetSegmentBase(rep *Representation) *SegmentBase {
+	if rep != nil && rep.SegmentBase != nil {
+		return rep.SegmentBase
+	}
+	return as.SegmentBase
+}
+
+// GetInitialization returns the initialization path of a representation, from either
+// its SegmentTemplate or its SegmentList.
+func (as *AdaptationSet) GetInitialization(rep *Representation) string {
+	if init := as.GetSegmentTemplate(rep).Initialization; init != "" {
+		return init
+	}
+	if list := as.GetSegmentList(rep); list != nil && list.Initialization != nil {
+		return list.Initialization.SourceURL
+	}
+	return ""
+}
+
+// mergeSegmentTemplate applies the attributes set on override on top of template.
+func mergeSegmentTemplate(template SegmentTemplate, override *SegmentTemplate) SegmentTemplate {
+	if override.Timescale > 0 {
+		template.Timescale = override.Timescale
+	}
+	if override.Initialization != "" {
+		template.Initialization = override.Initialization
+	}
+	if override.Media != "" {
+		template.Media = override.Media
+	}
+	if override.StartNumber != nil {
+		template.StartNumber = override.StartNumber
+	}
+	if len(override.Timeline.Segments) > 0 {
+		template.Timeline = override.Timeline
+	}
+	return template
+}
+
+// GetCodecs returns the representation's codecs, inherited from the AdaptationSet when not set.
+func (as *AdaptationSet) GetCodecs(rep *Representation) string {
+	if rep.Codecs != "" {
+		return rep.Codecs
+	}
+	return as.Codecs
+}
+
+// Audio channel configuration scheme URIs.
+const (
+	// ChannelCountScheme gives the number of channels as a decimal value.
+	ChannelCountScheme = "urn:mpeg:dash:23003:3:audio_channel_configuration:2011"
+	// CICPChannelScheme gives a ChannelConfiguration index of ISO/IEC 23001-8.
+	CICPChannelScheme = "urn:mpeg:mpegB:cicp:ChannelConfiguration"
+	// DolbyChannelScheme gives a 16-bit hexadecimal speaker mask, as does its legacy URN variant.
+	DolbyChannelScheme       = "tag:dolby.com,2014:dash:audio_channel_configuration:2011"
+	legacyDolbyChannelScheme = "urn:dolby:dash:audio_channel_configuration:2011"
+)
+
+// cicpChannelCounts maps the CICP ChannelConfiguration indexes to their number of channels.
+var cicpChannelCounts = map[int]int{
+	1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6, 7: 8, 9: 3, 10: 4, 11: 7, 12: 8, 13: 24, 14: 8,
+	15: 12, 16: 10, 17: 12, 18: 14, 19: 12, 20: 14,
+}
+
+// dolbyPairMask marks the bits of a Dolby channel mask, from L (0x8000) down to LFE (0x0001), that stand for
+// a pair of speakers: Lc/Rc, Lrs/Rrs, Lsd/Rsd, Lw/Rw, Vhl/Vhr and Lts/Rts.
+const dolbyPairMask = 0x0400 | 0x0200 | 0x0040 | 0x0020 | 0x0010 | 0x0004
+
+// GetAudioChannels returns the number of audio channels of a representation, from its own
+// AudioChannelConfiguration or the set's. Without a recognised descriptor, AAC is assumed to be stereo,
+// since surround AAC streams declare their layout; zero is returned when the count is unknown.
+func (as *AdaptationSet) GetAudioChannels(rep *Representation) int {
+	descriptors := rep.AudioChannelConfigurations
+	if len(descriptors) == 0 {
+		descriptors = as.AudioChannelConfigurations
+	}
+	for _, d := range descriptors {
+		if channels := parseChannelCount(d); channels > 0 {
+			return channels
+		}
+	}
+	if strings.HasPrefix(as.GetCodecs(rep), "mp4a.40.") {
+		return 2
+	}
+	return 0
+}
+
+// parseChannelCount returns the number of channels described by an AudioChannelConfiguration,
+// or zero for an unknown scheme or malformed value.
+func parseChannelCount(d Descriptor) int {
+	value := strings.TrimSpace(d.Value)
+	switch d.SchemeIdUri {
+	case ChannelCountScheme:
+		channels, err := strconv.Atoi(value)
+		if err != nil || channels < 0 {
+			return 0
+		}
+		return channels
+	case CICPChannelScheme:
+		index, err := strconv.Atoi(value)
+		if err != nil {
+			return 0
+		}
+		return cicpChannelCounts[index]
+	case DolbyChannelScheme, legacyDolbyChannelScheme:
+		mask, err := strconv.ParseUint(value, 16, 16)
+		if err != nil {
+			return 0
+		}
+		return bits.OnesCount16(uint16(mask)) + bits.OnesCount16(uint16(mask)&dolbyPairMask)
+	}
+	return 0
+}
+
+// GetSegmentProfiles returns the representation's segment profiles, inherited from the AdaptationSet when not set.
+func (as *AdaptationSet) GetSegmentProfiles(rep *Representation) string {
+	if rep.SegmentProfiles != "" {
+		return rep.SegmentProfiles
+	}
+	return as.SegmentProfiles
+}
+
+// GetDefaultKID returns the CENC default_KID that applies to a representation, preferring
+// the representation's own ContentProtection descriptors over the AdaptationSet's.
+func (as *AdaptationSet) GetDefaultKID(rep *Representation) string {
+	if rep != nil {
+		for _, cp := range rep.ContentProtections {
+			if cp.DefaultKID != "" {
+				return cp.DefaultKID
+			}
+		}
+	}
+	for _, cp := range as.ContentProtections {
+		if cp.DefaultKID != "" {
+			return cp.DefaultKID
+		}
+	}
+	return ""
+}
+
+// GetPSSHs returns the base64 PSSH boxes that apply to a representation, keyed by DRM system name
+// (see ContentProtection.SystemName). The representation's descriptors override the AdaptationSet's
+// for the same system.
+func (as *AdaptationSet) GetPSSHs(rep *Representation) map[string]string {
+	psshs := make(map[string]string)
+	descriptors := as.ContentProtections
+	if rep != nil {
+		descriptors = append(slices.Clip(descriptors), rep.ContentProtections...)
+	}
+	for _, cp := range descriptors {
+		if pssh := strings.TrimSpace(cp.PSSH); pssh != "" {
+			psshs[cp.SystemName()] = pssh
+		}
+	}
+	return psshs
+}
+
+// DRM schemes of ContentProtection descriptors. SchemeCENC announces the common encryption and its
+// default_KID, while the others identify a DRM system by its system ID.
+const (
+	SchemeCENC      = "urn:mpeg:dash:mp4protection:2011"
+	SchemeWidevine  = "urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"
+	SchemePlayReady = "urn:uuid:9a04f079-9840-4286-ab92-e65be0885f95"
+	SchemeClearKey  = "urn:uuid:e2719d58-a985-b3c9-781a-b030af78d30e"
+	SchemeW3CCommon = "urn:uuid:1077efec-c0b2-4d02-ace3-3c1e52e2fb4b"
+)
+
+// drmSystemNames are the short names of the well-known DRM schemes.
+var drmSystemNames = map[string]string{
+	SchemeCENC:      "cenc",
+	SchemeWidevine:  "widevine",
+	SchemePlayReady: "playready",
+	SchemeClearKey:  "clearkey",
+	SchemeW3CCommon: "w3c-common",
+}
+
+// ContentProtection is a DRM descriptor. Namespaces are not matched, so both the
+// cenc:default_KID attribute and the cenc:pssh element are found regardless of prefix.
+type ContentProtection struct {
+	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr,omitempty"`
+	DefaultKID  string `xml:"default_KID,attr,omitempty"`
+	PSSH        string `xml:"pssh,omitempty"` // Base64-encoded PSSH box
+}
+
+// SystemName returns the short name of the descriptor's DRM scheme, such as "widevine",
+// or the lowercased schemeIdUri for schemes that are not well known.
+func (cp *ContentProtection) SystemName() string {
+	scheme := strings.ToLower(strings.TrimSpace(cp.SchemeIdUri))
+	if name, found := drmSystemNames[scheme]; found {
+		return name
+	}
+	return scheme
+}
+
+// GetKID decodes the default_KID UUID into its 16 raw bytes.
+func (cp *ContentProtection) GetKID() ([]byte, error) {
+	return ParseKID(cp.DefaultKID)
+}
+
+// GetPSSH decodes the base64 PSSH box.
+func (cp *ContentProtection) GetPSSH() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(cp.PSSH))
+}
+
+// ParseKID decodes a key ID written either as a UUID or as plain hex into its 16 raw bytes.
+func ParseKID(kid string) ([]byte, error) {
+	raw, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(kid), "-", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key ID '%s': %w", kid, err)
+	}
+	if len(raw) != 16 {
+		return nil, fmt.Errorf("invalid key ID '%s': expected 16 bytes, got %d", kid, len(raw))
+	}
+	return raw, nil
 }
 
 // Representation represents a specific media stream.
@@ -110,11 +536,58 @@ type Representation struct {
 	ID                     string `xml:"id,attr"`
 	Bandwidth              int    `xml:"bandwidth,attr"`
 	Codecs                 string `xml:"codecs,attr"`
+	SegmentProfiles        string `xml:"segmentProfiles,attr,omitempty"`
 	Width                  int    `xml:"width,attr,omitempty"`
 	Height                 int    `xml:"height,attr,omitempty"`
 	FrameRate              string `xml:"frameRate,attr,omitempty"`
+	Sar                    string `xml:"sar,attr,omitempty"` // Sample aspect ratio, e.g. "4:3"
 	AudioSamplingRate      int    `xml:"audioSamplingRate,attr,omitempty"`
 	PresentationTimeOffset uint64 `xml:"presentationTimeOffset,attr,omitempty"`
+	// QualityRanking orders representations by quality independently of bandwidth; lower values are better.
+	// Nil means the attribute is absent, as zero is a valid ranking.
+	QualityRanking *int `xml:"qualityRanking,attr,omitempty"`
+	// SegmentTemplate is set when the representation overrides its AdaptationSet's template.
+	SegmentTemplate *SegmentTemplate `xml:"SegmentTemplate"`
+	// SegmentList is set when the representation lists its segment URLs explicitly.
+	SegmentList *SegmentList `xml:"SegmentList"`
+	// SegmentBase is set when the representation is a single file indexed by a sidx box.
+	SegmentBase *SegmentBase `xml:"SegmentBase"`
+	// BaseURL locates the representation's media, typically the single file of a SegmentBase representation.
+	BaseURL []string `xml:"BaseURL"`
+	// ContentProtections overrides the AdaptationSet's DRM descriptors when present.
+	ContentProtections []ContentProtection `xml:"ContentProtection"`
+	// AudioChannelConfigurations overrides the AdaptationSet's channel layout descriptors when present.
+	AudioChannelConfigurations []Descriptor `xml:"AudioChannelConfiguration"`
+}
+
+// HasQualityRanking reports whether the representation declares a qualityRanking.
+func (r *Representation) HasQualityRanking() bool {
+	return r.QualityRanking != nil
+}
+
+// RanksBefore reports whether the representation's qualityRanking says it is better than other's.
+// Representations that declare a qualityRanking rank before those that do not, so that sorting by it
+// is consistent when only some representations are ranked.
+func (r *Representation) RanksBefore(other *Representation) bool {
+	if r.HasQualityRanking() != other.HasQualityRanking() {
+		return r.HasQualityRanking()
+	}
+	return r.HasQualityRanking() && *r.QualityRanking < *other.QualityRanking
+}
+
+// GetSAR returns the representation's sample aspect ratio as width and height.
+// ok is false when sar is absent or malformed.
+func (r *Representation) GetSAR() (width, height int, ok bool) {
+	w, h, found := strings.Cut(r.Sar, ":")
+	if !found {
+		return 0, 0, false
+	}
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if errW != nil || errH != nil || width <= 0 || height <= 0 {
+		return 0, 0, false
+	}
+	return width, height, true
 }
 
 // SegmentTemplate defines the URL structure for segments.
@@ -122,14 +595,79 @@ type SegmentTemplate struct {
 	Timescale      int             `xml:"timescale,attr"`
 	Initialization string          `xml:"initialization,attr"`
 	Media          string          `xml:"media,attr"`
+	StartNumber    *uint64         `xml:"startNumber,attr"`
 	Timeline       SegmentTimeline `xml:"SegmentTimeline"`
 }
 
+// GetStartNumber returns the number of the first segment in the timeline, which defaults to 1 when absent.
+func (st *SegmentTemplate) GetStartNumber() uint64 {
+	if st.StartNumber == nil {
+		return 1
+	}
+	return *st.StartNumber
+}
+
 // GetInitializationFilename extracts the filename from the Initialization attribute.
 func (st *SegmentTemplate) GetInitializationFilename() string {
 	return path.Base(st.Initialization)
 }
 
+// SegmentList enumerates segment URLs explicitly instead of deriving them from a template.
+type SegmentList struct {
+	Timescale      int             `xml:"timescale,attr"`
+	Duration       uint64          `xml:"duration,attr"`
+	StartNumber    *uint64         `xml:"startNumber,attr"`
+	Initialization *URLType        `xml:"Initialization"`
+	Timeline       SegmentTimeline `xml:"SegmentTimeline"`
+	SegmentURLs    []SegmentURL    `xml:"SegmentURL"`
+}
+
+// SegmentBase describes a single-file representation whose segments are located through
+// the segment index (sidx) box at IndexRange.
+type SegmentBase struct {
+	Timescale              int      `xml:"timescale,attr"`
+	PresentationTimeOffset uint64   `xml:"presentationTimeOffset,attr,omitempty"`
+	IndexRange             string   `xml:"indexRange,attr"`
+	Initialization         *URLType `xml:"Initialization"`
+}
+
+// URLType references a resource such as an initialization segment.
+type URLType struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr,omitempty"`
+}
+
+// SegmentURL is a single entry of a SegmentList.
+type SegmentURL struct {
+	Media      string `xml:"media,attr"`
+	MediaRange string `xml:"mediaRange,attr,omitempty"`
+}
+
+// GetTimescale returns the list's timescale, which defaults to 1 when absent.
+func (sl *SegmentList) GetTimescale() int {
+	if sl.Timescale == 0 {
+		return 1
+	}
+	return sl.Timescale
+}
+
+// GetStartNumber returns the number of the first entry in the list, which defaults to 1 when absent.
+func (sl *SegmentList) GetStartNumber() uint64 {
+	if sl.StartNumber == nil {
+		return 1
+	}
+	return *sl.StartNumber
+}
+
+// GetTimeline returns the list's SegmentTimeline, or one synthesized from the constant
+// segment duration when the list only specifies @duration.
+func (sl *SegmentList) GetTimeline() SegmentTimeline {
+	if len(sl.Timeline.Segments) > 0 || sl.Duration == 0 || len(sl.SegmentURLs) == 0 {
+		return sl.Timeline
+	}
+	return SegmentTimeline{Segments: []S{{T: 0, D: sl.Duration, R: len(sl.SegmentURLs) - 1}}}
+}
+
 // SegmentTimeline defines the timeline of segments.
 type SegmentTimeline struct {
 	Segments []S `xml:"S"`
@@ -137,7 +675,29 @@ type SegmentTimeline struct {
 
 // S represents a single segment or a series of segments.
 type S struct {
-	T uint64 `xml:"t,attr"`           // Start time
-	D uint64 `xml:"d,attr"`           // Duration
-	R int    `xml:"r,attr,omitempty"` // Repeat count
+	T    uint64 `xml:"t,attr"`           // Start time
+	HasT bool   `xml:"-"`                // Whether the t attribute is present, so that an explicit t="0" is not mistaken for a missing one
+	D    uint64 `xml:"d,attr"`           // Duration
+	R    int    `xml:"r,attr,omitempty"` // Repeat count
+}
+
+// UnmarshalXML decodes an S element, recording whether it has a t attribute.
+func (s *S) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plainS S // Without the method, so that decoding it does not recurse
+	if err := d.DecodeElement((*plainS)(s), &start); err != nil {
+		return err
+	}
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "t" {
+			s.HasT = true
+		}
+	}
+	return nil
+}
+
+// Start returns the start time of the element and whether it is explicit. Without one, the element
+// continues from the end of the previous one. An element built in code with a non-zero T is explicit
+// even if HasT is not set.
+func (s S) Start() (uint64, bool) {
+	return s.T, s.HasT || s.T > 0
 }
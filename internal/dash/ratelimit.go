@@ -0,0 +1,95 @@
+package dash
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimitBurst caps the bytes a RateLimiter lets through at once, so that a large segment is spread
+// over its transfer rather than read in one burst.
+const rateLimitBurst = 32 * 1024
+
+// RateLimiter is a token bucket capping the aggregate bandwidth of segment downloads. A single limiter
+// is shared by every worker that downloads through it, so sessions starting at once cannot saturate the
+// upstream link. A nil RateLimiter does not limit.
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // Bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSecond bytes per second, or nil, which does not limit,
+// when bytesPerSecond is zero or negative.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := float64(min(bytesPerSecond, rateLimitBurst))
+	return &RateLimiter{rate: float64(bytesPerSecond), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait blocks until n bytes may be transferred or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	wait := l.reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes n tokens, running into debt if there are not enough, and returns how long the caller
+// must wait for the debt to be refilled. Later callers queue behind the debt, so waiters are served in order.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Reader wraps r so that reads from it are throttled by the limiter. A nil limiter returns r unchanged.
+func (l *RateLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, reader: r, limiter: l}
+}
+
+// rateLimitedReader reads at most a burst at a time, waiting for the limiter after every read.
+type rateLimitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > int(r.limiter.burst) {
+		p = p[:int(r.limiter.burst)]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.Wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
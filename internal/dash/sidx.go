@@ -0,0 +1,116 @@
+package dash
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ParseSegmentIndex converts the sidx box of a SegmentBase representation into an equivalent
+// SegmentList, whose entries address each subsegment as a byte range of the media file.
+// data is the content of the representation's index range.
+func ParseSegmentIndex(base *SegmentBase, data []byte) (*SegmentList, error) {
+	indexFirst, _, err := ParseByteRange(base.IndexRange)
+	if err != nil {
+		return nil, fmt.Errorf("invalid indexRange: %w", err)
+	}
+
+	// The sidx box is normally the first box of the index range, but skip any that precede it.
+	offset := uint64(0)
+	for {
+		if uint64(len(data))-offset < 8 {
+			return nil, fmt.Errorf("no sidx box found in index range %s", base.IndexRange)
+		}
+		size := uint64(binary.BigEndian.Uint32(data[offset:]))
+		boxType := string(data[offset+4 : offset+8])
+		headerSize := uint64(8)
+		if size == 1 {
+			if uint64(len(data))-offset < 16 {
+				return nil, fmt.Errorf("truncated %s box in index range", boxType)
+			}
+			size = binary.BigEndian.Uint64(data[offset+8:])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data))-offset {
+			return nil, fmt.Errorf("truncated %s box in index range", boxType)
+		}
+		if boxType == "sidx" {
+			// Byte offsets in the sidx are relative to the first byte after the box.
+			anchor := indexFirst + offset + size
+			return parseSidx(base, data[offset+headerSize:offset+size], anchor)
+		}
+		offset += size
+	}
+}
+
+// parseSidx parses the payload of a sidx box.
+func parseSidx(base *SegmentBase, payload []byte, anchor uint64) (*SegmentList, error) {
+	errTruncated := fmt.Errorf("truncated sidx box")
+	if len(payload) < 12 {
+		return nil, errTruncated
+	}
+	version := payload[0]
+	timescale := binary.BigEndian.Uint32(payload[8:])
+	pos := 12
+
+	var earliestTime, firstOffset uint64
+	if version == 0 {
+		if len(payload) < pos+8 {
+			return nil, errTruncated
+		}
+		earliestTime = uint64(binary.BigEndian.Uint32(payload[pos:]))
+		firstOffset = uint64(binary.BigEndian.Uint32(payload[pos+4:]))
+		pos += 8
+	} else {
+		if len(payload) < pos+16 {
+			return nil, errTruncated
+		}
+		earliestTime = binary.BigEndian.Uint64(payload[pos:])
+		firstOffset = binary.BigEndian.Uint64(payload[pos+8:])
+		pos += 16
+	}
+	if len(payload) < pos+4 {
+		return nil, errTruncated
+	}
+	referenceCount := int(binary.BigEndian.Uint16(payload[pos+2:]))
+	pos += 4
+	if len(payload) < pos+12*referenceCount {
+		return nil, errTruncated
+	}
+	if timescale == 0 {
+		return nil, fmt.Errorf("sidx box has a zero timescale")
+	}
+
+	list := &SegmentList{Timescale: int(timescale)}
+	if base.Initialization != nil {
+		list.Initialization = &URLType{SourceURL: base.Initialization.SourceURL, Range: base.Initialization.Range}
+	} else if indexFirst, _, _ := ParseByteRange(base.IndexRange); indexFirst > 0 {
+		// Without an explicit Initialization, the init segment is everything before the index.
+		list.Initialization = &URLType{Range: fmt.Sprintf("0-%d", indexFirst-1)}
+	}
+
+	segmentTime := earliestTime
+	segmentOffset := anchor + firstOffset
+	for i := 0; i < referenceCount; i++ {
+		reference := binary.BigEndian.Uint32(payload[pos:])
+		duration := uint64(binary.BigEndian.Uint32(payload[pos+4:]))
+		pos += 12
+		if reference&0x80000000 != 0 {
+			return nil, fmt.Errorf("hierarchical sidx references are not supported")
+		}
+		size := uint64(reference & 0x7fffffff)
+		if size == 0 {
+			return nil, fmt.Errorf("sidx reference %d has a zero size", i)
+		}
+
+		// Runs of equal durations are folded into a single S element with a repeat count.
+		if n := len(list.Timeline.Segments); n > 0 && list.Timeline.Segments[n-1].D == duration {
+			list.Timeline.Segments[n-1].R++
+		} else {
+			list.Timeline.Segments = append(list.Timeline.Segments, S{T: segmentTime, HasT: true, D: duration})
+		}
+		list.SegmentURLs = append(list.SegmentURLs, SegmentURL{MediaRange: fmt.Sprintf("%d-%d", segmentOffset, segmentOffset+size-1)})
+		segmentTime += duration
+		segmentOffset += size
+	}
+	return list, nil
+}
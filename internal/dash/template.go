@@ -0,0 +1,49 @@
+package dash
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// TemplateValues holds the values substituted for the identifiers of a SegmentTemplate.
+type TemplateValues struct {
+	RepresentationID string
+	Bandwidth        uint64
+	Time             uint64
+	Number           uint64
+}
+
+// templateTokenRegex matches a $Identifier$ token with an optional printf-style width, e.g. $Number%05d$,
+// as well as the $$ escape sequence.
+var templateTokenRegex = regexp.MustCompile(`\$([A-Za-z]*)(%0[0-9]+d)?\$`)
+
+// ExpandTemplate substitutes every known identifier in a SegmentTemplate string, honouring
+// its width format, and replaces each $$ with a literal $. Unknown identifiers are left untouched.
+func ExpandTemplate(template string, values TemplateValues) string {
+	return templateTokenRegex.ReplaceAllStringFunc(template, func(token string) string {
+		match := templateTokenRegex.FindStringSubmatch(token)
+		identifier, format := match[1], match[2]
+		if format == "" {
+			format = "%d"
+		}
+
+		switch identifier {
+		case "":
+			if match[2] != "" {
+				return token
+			}
+			return "$"
+		case "RepresentationID":
+			// The width format is not allowed for $RepresentationID$, so it is substituted verbatim.
+			return values.RepresentationID
+		case "Bandwidth":
+			return fmt.Sprintf(format, values.Bandwidth)
+		case "Time":
+			return fmt.Sprintf(format, values.Time)
+		case "Number":
+			return fmt.Sprintf(format, values.Number)
+		default:
+			return token
+		}
+	})
+}
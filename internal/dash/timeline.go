@@ -7,13 +7,13 @@ import (
 	"net/url"
 	"sort"
 	"strconv"
-	"strings"
+	"time"
 )
 
 // ConvertTimeline processes the SegmentTimeline from an AdaptationSet and returns a flat list of all segments.
 // BuildSegment constructs a single segment's metadata, including its URL.
 func BuildSegment(baseURL string, period *Period, as *AdaptationSet, rep *Representation, time, duration uint64, log logger.Logger) (models.Segment, error) {
-	template := as.SegmentTemplate
+	template := as.GetSegmentTemplate(rep)
 	mediaURLTemplate := template.Media
 
 	// Resolve the base URL for segments
@@ -22,9 +22,9 @@ func BuildSegment(baseURL string, period *Period, as *AdaptationSet, rep *Repres
 		return models.Segment{}, fmt.Errorf("invalid base URL: %w", err)
 	}
 
-	// If the period has its own BaseURL, resolve it against the main base URL
-	if period.BaseURL != "" {
-		periodBase, err := url.Parse(period.BaseURL)
+	// If the period has its own BaseURL, resolve the primary one against the main base URL
+	if len(period.BaseURL) > 0 {
+		periodBase, err := url.Parse(period.BaseURL[0])
 		if err != nil {
 			return models.Segment{}, fmt.Errorf("invalid period BaseURL: %w", err)
 		}
@@ -32,8 +32,7 @@ func BuildSegment(baseURL string, period *Period, as *AdaptationSet, rep *Repres
 	}
 
 	// Replace placeholders in the media template
-	mediaPath := strings.Replace(mediaURLTemplate, "$RepresentationID$", rep.ID, 1)
-	mediaPath = strings.Replace(mediaPath, "$Time$", strconv.FormatUint(time, 10), 1)
+	mediaPath := ExpandTemplate(mediaURLTemplate, TemplateValues{RepresentationID: rep.ID, Bandwidth: uint64(rep.Bandwidth), Time: time})
 
 	// Resolve the segment path against the base URL
 	segmentURL := segmentBaseURL.ResolveReference(&url.URL{Path: mediaPath})
@@ -53,13 +52,13 @@ func MergeTimelines(oldTimeline, newTimeline SegmentTimeline) SegmentTimeline {
 	seen := make(map[uint64]S)
 
 	// Add all segments from the old timeline
-	for _, s := range oldTimeline.Segments {
+	for _, s := range withExplicitStarts(oldTimeline) {
 		seen[s.T] = s
 	}
 
 	// Add all segments from the new timeline, overwriting duplicates
 	// This assumes the new timeline is more up-to-date for any overlapping segments
-	for _, s := range newTimeline.Segments {
+	for _, s := range withExplicitStarts(newTimeline) {
 		seen[s.T] = s
 	}
 
@@ -76,3 +75,267 @@ func MergeTimelines(oldTimeline, newTimeline SegmentTimeline) SegmentTimeline {
 
 	return SegmentTimeline{Segments: merged}
 }
+
+// MergeSegmentLists combines a SegmentList with its refreshed copy the way MergeTimelines combines
+// timelines. Entries are matched by segment number, those of the refreshed list replacing the ones they
+// share a number with, and the merged list keeps the earliest start number. A refreshed list that starts
+// before the current one, leaves a gap after it, or whose timeline cannot be lined up with its entries
+// cannot be numbered consistently with the current list, so it is returned as is.
+func MergeSegmentLists(current, refreshed *SegmentList) *SegmentList {
+	if current == nil || refreshed == nil {
+		return refreshed
+	}
+	currentStart, refreshedStart := current.GetStartNumber(), refreshed.GetStartNumber()
+	currentEnd := currentStart + uint64(len(current.SegmentURLs))
+	refreshedEnd := refreshedStart + uint64(len(refreshed.SegmentURLs))
+	if refreshedStart < currentStart || refreshedStart > currentEnd || current.GetTimescale() != refreshed.GetTimescale() {
+		return refreshed
+	}
+	hasTimeline := len(refreshed.Timeline.Segments) > 0
+	if hasTimeline != (len(current.Timeline.Segments) > 0) {
+		return refreshed
+	}
+
+	merged := *refreshed
+	merged.StartNumber = &currentStart
+	merged.SegmentURLs = append([]SegmentURL(nil), current.SegmentURLs[:refreshedStart-currentStart]...)
+	merged.SegmentURLs = append(merged.SegmentURLs, refreshed.SegmentURLs...)
+	if currentEnd > refreshedEnd {
+		merged.SegmentURLs = append(merged.SegmentURLs, current.SegmentURLs[refreshedEnd-currentStart:]...)
+	}
+	if hasTimeline {
+		merged.Timeline = MergeTimelines(current.Timeline, refreshed.Timeline)
+		if len(ExpandTimeline(merged.Timeline)) != len(merged.SegmentURLs) {
+			return refreshed
+		}
+	}
+	return &merged
+}
+
+// withExplicitStarts returns the S entries of a timeline with the start time of those that continue
+// from the previous entry filled in, so that entries can be told apart by their start.
+func withExplicitStarts(timeline SegmentTimeline) []S {
+	segments := make([]S, len(timeline.Segments))
+	var timeCursor uint64
+	for i, s := range timeline.Segments {
+		if t, ok := s.Start(); ok {
+			timeCursor = t
+		}
+		s.T, s.HasT = timeCursor, true
+		segments[i] = s
+		timeCursor += uint64(s.R+1) * s.D
+	}
+	return segments
+}
+
+// ExpandTimeline returns every distinct segment of a timeline as its own S entry with an
+// explicit start time and no repeats. Overlapping entries, as left by MergeTimelines, are skipped.
+func ExpandTimeline(timeline SegmentTimeline) []S {
+	var segments []S
+	var timeCursor uint64
+	for _, s := range timeline.Segments {
+		start := timeCursor
+		if t, ok := s.Start(); ok {
+			start = t
+		}
+
+		for i := 0; i <= s.R; i++ {
+			if start >= timeCursor || len(segments) == 0 {
+				segments = append(segments, S{T: start, HasT: true, D: s.D})
+				timeCursor = start + s.D
+			}
+			start += s.D
+		}
+	}
+	return segments
+}
+
+// TimelineEnd returns the end time of the last segment of a timeline, or zero for an empty timeline.
+// Each S entry ends at t + (r+1)*d, so the repeats are not expanded; where entries overlap, as they can
+// after MergeTimelines, the latest end wins, as it does in ExpandTimeline.
+func TimelineEnd(timeline SegmentTimeline) uint64 {
+	var end uint64
+	for _, s := range timeline.Segments {
+		start := end
+		if t, ok := s.Start(); ok {
+			start = t
+		}
+		if s.R >= 0 {
+			end = max(end, start+uint64(s.R+1)*s.D)
+		}
+	}
+	return end
+}
+
+// FindSegment returns the start time and duration of the segment that contains t.
+// Where entries overlap, as they can after MergeTimelines, the later entry wins because it comes
+// from the more recent manifest, so each segment gets its true duration even when d varies.
+// If t falls before the timeline or in a gap, the next segment is returned, and if it is past
+// the end of the timeline, the last segment is returned.
+func FindSegment(timeline SegmentTimeline, t uint64) (start, duration uint64, ok bool) {
+	var timeCursor, nextStart, nextDuration uint64
+	for _, s := range timeline.Segments {
+		// If a 't' attribute is present, the timeline resets to this value.
+		if t, ok := s.Start(); ok {
+			timeCursor = t
+		}
+
+		// There are s.R repeats, so s.R+1 segments in this block
+		for i := 0; i <= s.R; i++ {
+			if t >= timeCursor && t < timeCursor+s.D {
+				start, duration, ok = timeCursor, s.D, true
+			} else if t < timeCursor && nextDuration == 0 {
+				nextStart, nextDuration = timeCursor, s.D
+			}
+			timeCursor += s.D
+		}
+	}
+	if ok {
+		return start, duration, true
+	}
+	if nextDuration > 0 {
+		return nextStart, nextDuration, true
+	}
+
+	// If t is past the known timeline, we are at the live edge.
+	// The timeCursor is now at the end of the timeline, so the last segment started one duration ago.
+	if len(timeline.Segments) > 0 {
+		lastDuration := timeline.Segments[len(timeline.Segments)-1].D
+		if t >= timeCursor && timeCursor > lastDuration {
+			return timeCursor - lastDuration, lastDuration, true
+		}
+	}
+	return 0, 0, false
+}
+
+// SegmentNumber returns the $Number$ of the segment that starts at segmentTime in the template's timeline.
+// Numbering begins at the template's startNumber and counts each distinct segment in order, so
+// overlapping entries left behind by MergeTimelines are not counted twice.
+func SegmentNumber(template *SegmentTemplate, segmentTime uint64) (uint64, bool) {
+	var timeCursor, index uint64
+	for _, s := range template.Timeline.Segments {
+		start := timeCursor
+		if t, ok := s.Start(); ok {
+			start = t
+		}
+
+		for i := 0; i <= s.R; i++ {
+			if start >= timeCursor || index == 0 {
+				if start == segmentTime {
+					return template.GetStartNumber() + index, true
+				}
+				index++
+				timeCursor = start + s.D
+			}
+			start += s.D
+		}
+	}
+	return 0, false
+}
+
+// ResolveOpenRepeats materializes every S element with a negative repeat count, which means "repeat until
+// the next S element or the end of the period", into an explicit count, so that the rest of the timeline
+// code only ever deals with plain counts. The end of the last period of a live presentation is the live
+// edge at now, and only segments complete by then are counted.
+func (m *MPD) ResolveOpenRepeats(now time.Time) {
+	for i := range m.Periods {
+		period := &m.Periods[i]
+		end, liveEdge, known := m.periodEnd(i, now)
+		for j := range period.Sets {
+			as := &period.Sets[j]
+			var setPTO uint64
+			if len(as.Representations) > 0 {
+				setPTO = as.Representations[0].PresentationTimeOffset
+			}
+			resolveTemplateRepeats(&as.SegmentTemplate, as.SegmentList, setPTO, end, liveEdge, known)
+			for k := range as.Representations {
+				rep := &as.Representations[k]
+				resolveTemplateRepeats(rep.SegmentTemplate, rep.SegmentList, rep.PresentationTimeOffset, end, liveEdge, known)
+			}
+		}
+	}
+}
+
+// resolveTemplateRepeats resolves the open repeats of a SegmentTemplate's and a SegmentList's timelines.
+// periodDuration is the time from the period start to its end.
+func resolveTemplateRepeats(template *SegmentTemplate, list *SegmentList, pto uint64, periodDuration time.Duration, liveEdge, known bool) {
+	endFor := func(timescale int) uint64 {
+		if !known || timescale <= 0 {
+			return 0
+		}
+		return pto + uint64(periodDuration.Seconds()*float64(timescale))
+	}
+	if template != nil {
+		template.Timeline.resolveOpenRepeats(endFor(template.Timescale), liveEdge)
+	}
+	if list != nil {
+		list.Timeline.resolveOpenRepeats(endFor(list.GetTimescale()), liveEdge)
+	}
+}
+
+// resolveOpenRepeats replaces negative repeat counts with the number of repeats that reach the next
+// S element's start time or, for the last element, end. An end of zero means the end is unknown and the
+// segment is not repeated. With liveEdge, only segments that have completed by end are counted.
+func (tl *SegmentTimeline) resolveOpenRepeats(end uint64, liveEdge bool) {
+	var timeCursor uint64
+	for i := range tl.Segments {
+		s := &tl.Segments[i]
+		start := timeCursor
+		if t, ok := s.Start(); ok {
+			start = t
+		}
+		if s.R < 0 {
+			until, live := end, liveEdge
+			if i+1 < len(tl.Segments) {
+				if next, ok := tl.Segments[i+1].Start(); ok {
+					until, live = next, false
+				}
+			}
+			s.R = 0
+			if s.D > 0 && until > start {
+				count := (until - start + s.D - 1) / s.D // Every segment starting before until
+				if live {
+					count = (until - start) / s.D // Every segment ending by until
+				}
+				if count > 0 {
+					s.R = int(count - 1)
+				}
+			}
+		}
+		timeCursor = start + uint64(s.R+1)*s.D
+	}
+}
+
+// periodEnd returns the duration of the i-th period: from its duration attribute, the start of the next
+// period or the presentation duration. For the last period of a live presentation without a known end,
+// it is the time from the period start to now, and liveEdge is set.
+func (m *MPD) periodEnd(i int, now time.Time) (duration time.Duration, liveEdge, known bool) {
+	period := &m.Periods[i]
+	start, err := period.GetStart()
+	if err != nil {
+		return 0, false, false
+	}
+	if period.Duration != "" {
+		if d, err := parseDuration(period.Duration); err == nil {
+			return d, false, true
+		}
+	}
+	if i+1 < len(m.Periods) && m.Periods[i+1].Start != "" {
+		if next, err := m.Periods[i+1].GetStart(); err == nil && next > start {
+			return next - start, false, true
+		}
+	}
+	if m.MediaPresentationDuration != "" {
+		if total, err := parseDuration(m.MediaPresentationDuration); err == nil && total > start {
+			return total - start, false, true
+		}
+	}
+	if m.Type == "dynamic" {
+		if ast, err := time.Parse(time.RFC3339, m.AvailabilityStartTime); err == nil {
+			if elapsed := now.Sub(ast) - start; elapsed > 0 {
+				return elapsed, true, true
+			}
+		}
+	}
+	return 0, false, false
+}
@@ -0,0 +1,83 @@
+package hls
+
+import (
+	"dash2hlsd/internal/dash"
+	"dash2hlsd/internal/models"
+	"fmt"
+	"strings"
+)
+
+// IFrameMediaType is the key under which GenerateMasterPlaylist expects trick-mode video representations,
+// which are advertised as I-frame playlists rather than as variants.
+const IFrameMediaType = "iframe"
+
+// IFramePlaylistName is the name of a trick-mode representation's I-frame playlist, next to its segments.
+const IFramePlaylistName = "iframes.m3u8"
+
+// writeIFrameStreams writes an EXT-X-I-FRAME-STREAM-INF tag for each trick-mode representation.
+func writeIFrameStreams(sb *strings.Builder, reps []*dash.Representation, steering *ContentSteering) {
+	for _, rep := range reps {
+		sb.WriteString(fmt.Sprintf("#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"", rep.Bandwidth, rep.Codecs))
+		if rep.Width > 0 && rep.Height > 0 {
+			sb.WriteString(fmt.Sprintf(",RESOLUTION=%dx%d", displayWidth(rep), rep.Height))
+		}
+		sb.WriteString(pathwayAttribute(steering))
+		sb.WriteString(fmt.Sprintf(",URI=\"video/%s/%s\"\n", rep.ID, IFramePlaylistName))
+	}
+}
+
+// GenerateIFramePlaylist creates the I-frame playlist of a trick-mode video representation, whose segments
+// each hold the I-frames players show while scrubbing. segmentSizes maps segment IDs to their size in bytes;
+// each known size is advertised with EXT-X-BYTERANGE so players can fetch the I-frame without probing it.
+// The other parameters behave as for GenerateMediaPlaylist.
+func GenerateIFramePlaylist(mpd *dash.MPD, channelId, repId string, keyInfo KeyInfo, targetDuration int, mediaSequence, discontinuitySequence int, ended bool, availableSegments []*models.Segment, segmentSizes map[string]int) (string, error) {
+	_, as, rep := findRepresentation(mpd, "video", repId)
+	if rep == nil {
+		return "", fmt.Errorf("representation '%s' of type 'video' not found", repId)
+	}
+	initURL := dash.ExpandTemplate(as.GetInitialization(rep), dash.TemplateValues{RepresentationID: rep.ID, Bandwidth: uint64(rep.Bandwidth)})
+	timescale := float64(as.GetSegmentTemplate(rep).Timescale)
+	if timescale == 0 {
+		timescale = 1
+	}
+	isVOD := mpd.Type == "static"
+
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n")
+	sb.WriteString("#EXT-X-VERSION:7\n")
+	sb.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", playlistTargetDuration(mpd, targetDuration, availableSegments, timescale)))
+	sb.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence))
+	if discontinuitySequence > 0 {
+		sb.WriteString(fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySequence))
+	}
+	if isVOD {
+		sb.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	}
+	sb.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+	if !keyInfo.PerSegmentIV {
+		writeKey(&sb, keyInfo, channelId, keyInfo.IV)
+	}
+	sb.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", InitSegmentFilename(initURL)))
+
+	for i, seg := range availableSegments {
+		if i > 0 {
+			writeGaps(&sb, availableSegments[i-1], seg, timescale)
+		}
+		if i > 0 && IsDiscontinuous(availableSegments[i-1], seg) {
+			sb.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if keyInfo.PerSegmentIV {
+			writeKey(&sb, keyInfo, channelId, uint64IV(seg.Time))
+		}
+		sb.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", float64(seg.Duration)/timescale))
+		if size, found := segmentSizes[seg.ID]; found {
+			// The segment is served as a resource of its own, so the I-frame range starts at its first byte.
+			sb.WriteString(fmt.Sprintf("#EXT-X-BYTERANGE:%d@0\n", size))
+		}
+		sb.WriteString(fmt.Sprintf("%s.m4s\n", seg.ID))
+	}
+	if isVOD || ended {
+		sb.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return sb.String(), nil
+}
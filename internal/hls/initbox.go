@@ -0,0 +1,133 @@
+package hls
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// containerBoxes are the ISO BMFF boxes whose payload is made only of child boxes, which box paths may descend into.
+var containerBoxes = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true, "dinf": true,
+	"edts": true, "mvex": true, "udta": true, "sinf": true, "schi": true,
+}
+
+// TransformInitSegment edits the boxes of an fMP4 init segment for players that reject some of them.
+// Boxes are addressed by paths of box types separated by slashes, such as "sidx" or "moov/trak/edts",
+// and every box matching a path is affected. Boxes matching a path in strip are removed, and the
+// payload of boxes matching a path in replace is substituted with the given bytes. The sizes of the
+// enclosing boxes are updated accordingly.
+func TransformInitSegment(data []byte, strip []string, replace map[string][]byte) ([]byte, error) {
+	edits := make(map[string][]byte, len(strip)+len(replace))
+	for path, payload := range replace {
+		edits[path] = payload
+	}
+	for _, path := range strip {
+		edits[path] = nil // A nil payload removes the box
+	}
+	return editBoxes(data, "", edits)
+}
+
+// editBoxes applies edits to the sequence of boxes in data, whose parent box is at path parent.
+func editBoxes(data []byte, parent string, edits map[string][]byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	for offset := 0; offset < len(data); {
+		boxType, size, headerSize, err := readBoxHeader(data, offset)
+		if err != nil {
+			return nil, fmt.Errorf("%w in %q", err, parent)
+		}
+		box := data[offset : offset+size]
+		offset += size
+
+		path := boxType
+		if parent != "" {
+			path = parent + "/" + boxType
+		}
+		payload, edited := edits[path]
+		switch {
+		case edited && payload == nil:
+			continue
+		case edited:
+			out = appendBox(out, boxType, payload)
+		case containerBoxes[boxType] && hasEditsBelow(edits, path):
+			children, err := editBoxes(box[headerSize:], path, edits)
+			if err != nil {
+				return nil, err
+			}
+			out = appendBox(out, boxType, children)
+		default:
+			out = append(out, box...)
+		}
+	}
+	return out, nil
+}
+
+// readBoxHeader reads the header of the box at offset in data, returning its type, its total size and
+// the size of its header. The box must fit in data.
+func readBoxHeader(data []byte, offset int) (boxType string, size, headerSize int, err error) {
+	if len(data)-offset < 8 {
+		return "", 0, 0, fmt.Errorf("truncated box header at offset %d", offset)
+	}
+	boxSize := uint64(binary.BigEndian.Uint32(data[offset:]))
+	boxType = string(data[offset+4 : offset+8])
+	headerSize = 8
+	switch boxSize {
+	case 0:
+		boxSize = uint64(len(data) - offset) // The box extends to the end of its parent
+	case 1:
+		if len(data)-offset < 16 {
+			return "", 0, 0, fmt.Errorf("truncated %s box header", boxType)
+		}
+		boxSize = binary.BigEndian.Uint64(data[offset+8:])
+		headerSize = 16
+	}
+	if boxSize < uint64(headerSize) || boxSize > uint64(len(data)-offset) {
+		return "", 0, 0, fmt.Errorf("invalid size %d of %s box", boxSize, boxType)
+	}
+	return boxType, int(boxSize), headerSize, nil
+}
+
+// ValidateInitSegment checks that data is a complete fMP4 init segment: a sequence of well-formed boxes
+// that includes ftyp and moov. It catches truncated or error bodies that an origin served with a 200.
+func ValidateInitSegment(data []byte) error {
+	var hasFtyp, hasMoov bool
+	for offset := 0; offset < len(data); {
+		boxType, size, _, err := readBoxHeader(data, offset)
+		if err != nil {
+			return fmt.Errorf("malformed init segment: %w", err)
+		}
+		hasFtyp = hasFtyp || boxType == "ftyp"
+		hasMoov = hasMoov || boxType == "moov"
+		offset += size
+	}
+	switch {
+	case !hasFtyp:
+		return fmt.Errorf("malformed init segment: no ftyp box")
+	case !hasMoov:
+		return fmt.Errorf("malformed init segment: no moov box")
+	}
+	return nil
+}
+
+// hasEditsBelow reports whether any edit addresses a box nested in the box at path.
+func hasEditsBelow(edits map[string][]byte, path string) bool {
+	for editPath := range edits {
+		if strings.HasPrefix(editPath, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// appendBox appends a box of the given type and payload, using a 64-bit size only when needed.
+func appendBox(out []byte, boxType string, payload []byte) []byte {
+	if size := uint64(len(payload)) + 8; size <= 0xFFFFFFFF {
+		out = binary.BigEndian.AppendUint32(out, uint32(size))
+		out = append(out, boxType...)
+	} else {
+		out = binary.BigEndian.AppendUint32(out, 1)
+		out = append(out, boxType...)
+		out = binary.BigEndian.AppendUint64(out, size+8)
+	}
+	return append(out, payload...)
+}
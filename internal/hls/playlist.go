@@ -1,44 +1,77 @@
 package hls
 
 import (
+	"dash2hlsd/internal/channels"
 	"dash2hlsd/internal/dash"
 	"dash2hlsd/internal/models"
+	"encoding/binary"
 	"fmt"
+	"math"
 	"path"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// GenerateMasterPlaylist creates the HLS master playlist string from the selected representations.
-func GenerateMasterPlaylist(mpd *dash.MPD, selectedReps map[string][]*dash.Representation) (string, error) {
+// KeyInfo describes how a media playlist advertises its encryption key.
+type KeyInfo struct {
+	// Method selects the EXT-X-KEY method; an empty method is treated as SAMPLE-AES.
+	Method channels.EncryptionMethod
+	// IV, when set, is advertised explicitly in EXT-X-KEY.
+	IV []byte
+	// PerSegmentIV emits an EXT-X-KEY before every segment with an IV derived from its media time.
+	PerSegmentIV bool
+	// KID, when set, selects the key by key ID in the key URI, for channels with several keys.
+	KID []byte
+	// URITemplate, when set, replaces the default key URI, with {channelId} and {kid} placeholders.
+	URITemplate string
+	// ChannelKID fills the template's {kid} placeholder when KID is not set, as for single-key channels.
+	ChannelKID []byte
+}
+
+// MasterPlaylistOptions holds the optional settings of a master playlist.
+type MasterPlaylistOptions struct {
+	// Steering, when set, adds the EXT-X-CONTENT-STEERING tag and places every variant on its pathway.
+	Steering *ContentSteering
+	// DeclareNoCaptions makes video variants without caption services carry CLOSED-CAPTIONS=NONE.
+	DeclareNoCaptions bool
+}
+
+// GenerateMasterPlaylist creates the HLS master playlist string from the selected representations,
+// keyed by content type. Trick-mode video representations under IFrameMediaType are advertised as I-frame playlists.
+// An audio-only selection advertises its audio representations as the variant streams.
+func GenerateMasterPlaylist(mpd *dash.MPD, selectedReps map[string][]*dash.Representation, opts MasterPlaylistOptions) (string, error) {
+	steering := opts.Steering
 	var sb strings.Builder
 	sb.WriteString("#EXTM3U\n")
 	sb.WriteString("#EXT-X-VERSION:7\n")
+	if steering != nil {
+		writeContentSteering(&sb, steering)
+	}
 
 	// Audio and Subtitle renditions
 	audioGroupID := "audio"
 	subtitleGroupID := "subtitles"
+	closedCaptionsGroupID := "cc"
+
+	// Without video, the audio representations are also the variant streams, so that players have something to play.
+	audioOnly := len(selectedReps["video"]) == 0 && len(selectedReps["audio"]) > 0
 
 	if reps, ok := selectedReps["audio"]; ok {
-		for _, rep := range reps {
-			sb.WriteString(fmt.Sprintf("#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"%s\",DEFAULT=YES,AUTOSELECT=YES,LANGUAGE=\"%s\",URI=\"audio/%s/playlist.m3u8\"\n",
-				audioGroupID, rep.ID, rep.ID, rep.ID))
-		}
+		writeRenditions(&sb, mpd, "AUDIO", "audio", audioGroupID, reps)
 	}
 	if reps, ok := selectedReps["text"]; ok {
-		for _, rep := range reps {
-			sb.WriteString(fmt.Sprintf("#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"%s\",NAME=\"%s\",DEFAULT=NO,AUTOSELECT=YES,LANGUAGE=\"%s\",URI=\"text/%s/playlist.m3u8\"\n",
-				subtitleGroupID, rep.ID, rep.ID, rep.ID))
-		}
+		writeRenditions(&sb, mpd, "SUBTITLES", "text", subtitleGroupID, reps)
 	}
+	captions := captionServices(mpd, selectedReps["video"])
+	writeClosedCaptions(&sb, closedCaptionsGroupID, captions)
 
 	// Video renditions
 	if reps, ok := selectedReps["video"]; ok {
 		for _, rep := range reps {
 			sb.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"", rep.Bandwidth, rep.Codecs))
 			if rep.Width > 0 && rep.Height > 0 {
-				sb.WriteString(fmt.Sprintf(",RESOLUTION=%dx%d", rep.Width, rep.Height))
+				sb.WriteString(fmt.Sprintf(",RESOLUTION=%dx%d", displayWidth(rep), rep.Height))
 			}
 			if rep.FrameRate != "" {
 				sb.WriteString(fmt.Sprintf(",FRAME-RATE=%.3f", parseFrameRate(rep.FrameRate)))
@@ -50,64 +83,260 @@ func GenerateMasterPlaylist(mpd *dash.MPD, selectedReps map[string][]*dash.Repre
 			if _, ok := selectedReps["text"]; ok {
 				sb.WriteString(fmt.Sprintf(",SUBTITLES=\"%s\"", subtitleGroupID))
 			}
+			if len(captions) > 0 {
+				sb.WriteString(fmt.Sprintf(",CLOSED-CAPTIONS=\"%s\"", closedCaptionsGroupID))
+			} else if opts.DeclareNoCaptions {
+				// Some Apple players warn about variants that do not say whether they carry captions.
+				sb.WriteString(",CLOSED-CAPTIONS=NONE")
+			}
+			sb.WriteString(pathwayAttribute(steering))
 			sb.WriteString("\n")
 			sb.WriteString(fmt.Sprintf("video/%s/playlist.m3u8\n", rep.ID))
 		}
 	}
+	if audioOnly {
+		for _, rep := range selectedReps["audio"] {
+			codecs := rep.Codecs
+			if _, as, _ := findRepresentation(mpd, "audio", rep.ID); as != nil {
+				codecs = as.GetCodecs(rep)
+			}
+			sb.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\",AUDIO=\"%s\"", rep.Bandwidth, codecs, audioGroupID))
+			if _, ok := selectedReps["text"]; ok {
+				sb.WriteString(fmt.Sprintf(",SUBTITLES=\"%s\"", subtitleGroupID))
+			}
+			sb.WriteString(pathwayAttribute(steering))
+			sb.WriteString("\n")
+			sb.WriteString(fmt.Sprintf("audio/%s/playlist.m3u8\n", rep.ID))
+		}
+	}
+	writeIFrameStreams(&sb, selectedReps[IFrameMediaType], steering)
 
 	return sb.String(), nil
 }
 
-// GenerateMediaPlaylist creates the HLS media playlist string.
-// Note: availableSegments would be provided by the session's download loop.
-func GenerateMediaPlaylist(mpd *dash.MPD, channelId, mediaType, repId string, mediaSequence int, availableSegments []*models.Segment) (string, error) {
-	var sb strings.Builder
+// HLS characteristics of accessibility renditions.
+const (
+	describesVideoCharacteristic = "public.accessibility.describes-video"
+	captionsCharacteristics      = "public.accessibility.transcribes-spoken-dialog,public.accessibility.describes-music-and-sound"
+)
 
-	// Find the target representation
-	var targetRep *dash.Representation
-	var initURL string
-	for _, p := range mpd.Periods {
-		for _, as := range p.Sets {
-			if as.ContentType == mediaType {
-				for _, r := range as.Representations {
-					if r.ID == repId {
-						targetRep = &r
-						initURL = strings.Replace(as.SegmentTemplate.Initialization, "$RepresentationID$", r.ID, 1)
-						break
-					}
-				}
+// writeRenditions writes the EXT-X-MEDIA tags of a rendition group, labelled from each rendition's adaptation set:
+// NAME is its Label, falling back to its language and then to the representation ID, and LANGUAGE is its lang.
+// Audio renditions also advertise their channel count as CHANNELS when it is known.
+// The first rendition whose set has the main role is the group's default. Without one, the first audio
+// rendition is still the default, since players need an audio track, while subtitles stay off.
+func writeRenditions(sb *strings.Builder, mpd *dash.MPD, hlsType, mediaType, groupID string, reps []*dash.Representation) {
+	sets := make([]*dash.AdaptationSet, len(reps))
+	defaultIndex := -1
+	for i, rep := range reps {
+		if _, sets[i], _ = findRepresentation(mpd, mediaType, rep.ID); sets[i] == nil {
+			sets[i] = &dash.AdaptationSet{}
+		}
+		if defaultIndex < 0 && sets[i].HasRole("main") {
+			defaultIndex = i
+		}
+	}
+	if defaultIndex < 0 && mediaType == "audio" {
+		defaultIndex = 0
+	}
+
+	names := make(map[string]bool, len(reps))
+	for i, rep := range reps {
+		as := sets[i]
+		name := as.GetLabel()
+		if name == "" {
+			name = as.Lang
+		}
+		// Names must be unique within the group, e.g. for several bitrates of one language.
+		if name == "" {
+			name = rep.ID
+		} else if names[name] {
+			name = fmt.Sprintf("%s (%s)", name, rep.ID)
+		}
+		names[name] = true
+
+		isDefault, autoSelect := "NO", "YES"
+		if i == defaultIndex {
+			isDefault = "YES"
+		} else if as.HasRole("commentary") {
+			autoSelect = "NO" // Commentary is only played when chosen explicitly
+		}
+
+		sb.WriteString(fmt.Sprintf("#EXT-X-MEDIA:TYPE=%s,GROUP-ID=\"%s\",NAME=\"%s\",DEFAULT=%s,AUTOSELECT=%s",
+			hlsType, groupID, strings.ReplaceAll(name, "\"", "'"), isDefault, autoSelect))
+		if as.Lang != "" {
+			sb.WriteString(fmt.Sprintf(",LANGUAGE=\"%s\"", as.Lang))
+		}
+		switch {
+		case mediaType == "audio" && as.IsAudioDescription():
+			sb.WriteString(fmt.Sprintf(",CHARACTERISTICS=\"%s\"", describesVideoCharacteristic))
+		case mediaType == "text" && as.IsCaptions():
+			sb.WriteString(fmt.Sprintf(",CHARACTERISTICS=\"%s\"", captionsCharacteristics))
+		}
+		if mediaType == "audio" {
+			if channels := as.GetAudioChannels(rep); channels > 0 {
+				sb.WriteString(fmt.Sprintf(",CHANNELS=\"%d\"", channels))
 			}
-			if targetRep != nil {
-				break
+		}
+		sb.WriteString(fmt.Sprintf(",URI=\"%s/%s/playlist.m3u8\"\n", mediaType, rep.ID))
+	}
+}
+
+// captionServices returns the caption services embedded in the sets of the given video representations,
+// each once.
+func captionServices(mpd *dash.MPD, videoReps []*dash.Representation) []dash.CaptionService {
+	var services []dash.CaptionService
+	seen := make(map[string]bool)
+	for _, rep := range videoReps {
+		_, as, _ := findRepresentation(mpd, "video", rep.ID)
+		if as == nil {
+			continue
+		}
+		for _, service := range as.CaptionServices() {
+			if !seen[service.InstreamID] {
+				seen[service.InstreamID] = true
+				services = append(services, service)
 			}
 		}
-		if targetRep != nil {
-			break
+	}
+	return services
+}
+
+// writeClosedCaptions writes an EXT-X-MEDIA tag of type CLOSED-CAPTIONS for every caption service, named
+// after its language and falling back to its INSTREAM-ID. Like subtitles, captions are off by default.
+func writeClosedCaptions(sb *strings.Builder, groupID string, services []dash.CaptionService) {
+	names := make(map[string]bool, len(services))
+	for _, service := range services {
+		name := service.Lang
+		if name == "" {
+			name = service.InstreamID
+		} else if names[name] {
+			name = fmt.Sprintf("%s (%s)", name, service.InstreamID)
+		}
+		names[name] = true
+
+		sb.WriteString(fmt.Sprintf("#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID=\"%s\",NAME=\"%s\",DEFAULT=NO,AUTOSELECT=YES",
+			groupID, strings.ReplaceAll(name, "\"", "'")))
+		if service.Lang != "" {
+			sb.WriteString(fmt.Sprintf(",LANGUAGE=\"%s\"", service.Lang))
 		}
+		sb.WriteString(fmt.Sprintf(",INSTREAM-ID=\"%s\"\n", service.InstreamID))
 	}
+}
 
+// MediaPlaylistOptions holds the window position and optional settings of a media playlist.
+type MediaPlaylistOptions struct {
+	// TargetDuration, when positive, overrides the EXT-X-TARGETDURATION derived from the MPD's
+	// maxSegmentDuration. Either way the target duration is raised to cover the longest segment, as HLS requires.
+	TargetDuration int
+	// MediaSequence is the media sequence number of the first segment.
+	MediaSequence int
+	// DiscontinuitySequence is the number of discontinuities that preceded the first segment.
+	DiscontinuitySequence int
+	// Ended terminates a live playlist with EXT-X-ENDLIST once the stream is over.
+	Ended bool
+	// DeltaUpdate generates a delta update, replacing the segments older than CAN-SKIP-UNTIL with an
+	// EXT-X-SKIP tag.
+	DeltaUpdate bool
+	// AllowCache adds the legacy EXT-X-ALLOW-CACHE tag.
+	AllowCache bool
+}
+
+// GenerateMediaPlaylist creates the HLS media playlist string.
+// Note: availableSegments would be provided by the session's download loop.
+// A discontinuity is marked wherever consecutive segments belong to different periods.
+// For a static MPD the playlist is marked as VOD and terminated with EXT-X-ENDLIST.
+// keyInfo selects the EXT-X-KEY method and IV.
+// Live playlists long enough to benefit from delta updates advertise them through CAN-SKIP-UNTIL.
+func GenerateMediaPlaylist(mpd *dash.MPD, channelId, mediaType, repId string, keyInfo KeyInfo, availableSegments []*models.Segment, opts MediaPlaylistOptions) (string, error) {
+	var sb strings.Builder
+
+	// Find the target representation
+	targetPeriod, targetAS, targetRep := findRepresentation(mpd, mediaType, repId)
 	if targetRep == nil {
 		return "", fmt.Errorf("representation '%s' of type '%s' not found", repId, mediaType)
 	}
+	initURL := dash.ExpandTemplate(targetAS.GetInitialization(targetRep), dash.TemplateValues{RepresentationID: targetRep.ID, Bandwidth: uint64(targetRep.Bandwidth)})
+	repTimescale := uint64(targetAS.GetSegmentTemplate(targetRep).Timescale)
 
-	durationStr := strings.ToLower(strings.TrimPrefix(mpd.MaxSegmentDuration, "PT"))
-	targetDuration, _ := time.ParseDuration(durationStr)
+	// The duration in MPD is in timescale units of the representation's own template or list.
+	// We need to convert it to seconds for EXTINF.
+	if repTimescale == 0 {
+		repTimescale = 1 // The DASH default when @timescale is absent
+	}
+	timescale := float64(repTimescale)
+
+	targetDuration := playlistTargetDuration(mpd, opts.TargetDuration, availableSegments, timescale)
+
+	isVOD := mpd.Type == "static"
+	canSkipUntil := float64(canSkipTargetDurations * targetDuration)
+	skippable := 0
+	if !isVOD {
+		skippable = skippableSegments(availableSegments, timescale, canSkipUntil)
+	}
+	skipped := 0
+	if opts.DeltaUpdate {
+		skipped = skippable
+	}
 
 	sb.WriteString("#EXTM3U\n")
-	sb.WriteString("#EXT-X-VERSION:7\n")
-	sb.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(targetDuration.Seconds())))
-	sb.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence))
-	// Assuming SAMPLE-AES for fMP4, key URI needs to be constructed based on channelId
-	sb.WriteString(fmt.Sprintf("#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"/key/%s\"\n", channelId))
-	base := path.Base(initURL)
-	hlsInitFilename := strings.TrimSuffix(base, path.Ext(base)) + ".m4s"
+	if skipped > 0 {
+		sb.WriteString("#EXT-X-VERSION:9\n") // Required by EXT-X-SKIP
+	} else {
+		sb.WriteString("#EXT-X-VERSION:7\n")
+	}
+	sb.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", targetDuration))
+	sb.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", opts.MediaSequence))
+	if opts.DiscontinuitySequence > 0 {
+		sb.WriteString(fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", opts.DiscontinuitySequence))
+	}
+	if isVOD {
+		sb.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	}
+	if opts.AllowCache {
+		// Removed from the HLS spec, but some legacy players only keep segments of finished playlists when told to.
+		if isVOD || opts.Ended {
+			sb.WriteString("#EXT-X-ALLOW-CACHE:YES\n")
+		} else {
+			sb.WriteString("#EXT-X-ALLOW-CACHE:NO\n")
+		}
+	}
+	if skippable > 0 {
+		sb.WriteString(fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-SKIP-UNTIL=%.1f\n", canSkipUntil))
+	}
+	if !keyInfo.PerSegmentIV {
+		// Without a configured IV, AES-128 players use each segment's media sequence number as its IV.
+		writeKey(&sb, keyInfo, channelId, keyInfo.IV)
+	}
 	// The URI in the playlist should be relative to the playlist itself.
-	sb.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", hlsInitFilename))
+	sb.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", InitSegmentFilename(initURL)))
+
+	availabilityStart, astErr := time.Parse(time.RFC3339, mpd.AvailabilityStartTime)
 
 	// This part is illustrative. The actual segment list will come from the session manager.
-	for _, seg := range availableSegments {
-		// The duration in MPD is in timescale units. We need to convert it to seconds for EXTINF.
-		timescale := float64(mpd.Periods[0].Sets[0].SegmentTemplate.Timescale) // Simplified assumption
+	if skipped > 0 {
+		// Missing segments between the skipped ones were listed as gaps, which count as segments too.
+		sb.WriteString(fmt.Sprintf("#EXT-X-SKIP:SKIPPED-SEGMENTS=%d\n", skipped+CountMissingSegments(availableSegments[:skipped])))
+	}
+	for i, seg := range availableSegments {
+		if i < skipped {
+			continue
+		}
+		if i > 0 {
+			writeGaps(&sb, availableSegments[i-1], seg, timescale)
+		}
+		discontinuity := i > 0 && IsDiscontinuous(availableSegments[i-1], seg)
+		if discontinuity {
+			sb.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if keyInfo.PerSegmentIV {
+			writeKey(&sb, keyInfo, channelId, uint64IV(seg.Time))
+		}
+		// Anchor the first segment, and the first after each discontinuity, to wall-clock time.
+		if (i == skipped || discontinuity) && astErr == nil {
+			pdt := programDateTime(availabilityStart, segmentPeriod(mpd, seg, targetPeriod), seg.Time, targetRep.PresentationTimeOffset, repTimescale)
+			sb.WriteString(fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n", pdt.UTC().Format(programDateTimeLayout)))
+		}
 		durationInSeconds := float64(seg.Duration) / timescale
 		sb.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", durationInSeconds))
 		// Segment URL should also be relative to the master playlist.
@@ -115,10 +344,226 @@ func GenerateMediaPlaylist(mpd *dash.MPD, channelId, mediaType, repId string, me
 		segmentURI := fmt.Sprintf("%s.m4s", seg.ID)
 		sb.WriteString(fmt.Sprintf("%s\n", segmentURI))
 	}
+	if isVOD || opts.Ended {
+		// No more segments will be added, so players stop reloading the playlist.
+		sb.WriteString("#EXT-X-ENDLIST\n")
+	}
 
 	return sb.String(), nil
 }
 
+// IsDiscontinuous reports whether seg does not continue prev in the playlist, which then needs an
+// EXT-X-DISCONTINUITY between them because a new period starts. Segments missing in between are
+// listed as gaps instead, see MissingSegments.
+func IsDiscontinuous(prev, seg *models.Segment) bool {
+	return seg.PeriodID != prev.PeriodID
+}
+
+// MissingSegments returns how many segments are missing between prev and seg of the same period, e.g.
+// because their download failed. Playlists list each as an EXT-X-GAP, so that the media sequence
+// numbers of the segments around them stay aligned across representations. Differences of less than
+// half a segment are timeline jitter.
+func MissingSegments(prev, seg *models.Segment) int {
+	if seg.PeriodID != prev.PeriodID || prev.Duration == 0 {
+		return 0
+	}
+	end := prev.Time + prev.Duration
+	if seg.Time < end+prev.Duration/2 {
+		return 0
+	}
+	return int((seg.Time - end + prev.Duration/2) / prev.Duration)
+}
+
+// CountMissingSegments returns the number of segments missing between consecutive segments.
+func CountMissingSegments(segments []*models.Segment) int {
+	count := 0
+	for i := 1; i < len(segments); i++ {
+		count += MissingSegments(segments[i-1], segments[i])
+	}
+	return count
+}
+
+// writeGaps writes an EXT-X-GAP entry for each segment missing between prev and seg, each as long as
+// prev except the last, which lasts until seg starts.
+func writeGaps(sb *strings.Builder, prev, seg *models.Segment, timescale float64) {
+	missing := MissingSegments(prev, seg)
+	for k := range missing {
+		start := prev.Time + prev.Duration*uint64(k+1)
+		duration := prev.Duration
+		if k == missing-1 {
+			duration = seg.Time - start
+		}
+		sb.WriteString("#EXT-X-GAP\n")
+		sb.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", float64(duration)/timescale))
+		sb.WriteString(fmt.Sprintf("%d.m4s\n", start))
+	}
+}
+
+// findRepresentation locates a representation of the given content type in the MPD.
+// The returned representation is nil if there is none.
+func findRepresentation(mpd *dash.MPD, mediaType, repId string) (*dash.Period, *dash.AdaptationSet, *dash.Representation) {
+	for i := range mpd.Periods {
+		p := &mpd.Periods[i]
+		for j := range p.Sets {
+			as := &p.Sets[j]
+			if as.ContentType != mediaType {
+				continue
+			}
+			for k := range as.Representations {
+				if as.Representations[k].ID == repId {
+					return p, as, &as.Representations[k]
+				}
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+// ParseTargetDuration returns the EXT-X-TARGETDURATION of a generated playlist.
+func ParseTargetDuration(playlist string) (int, bool) {
+	for _, line := range strings.Split(playlist, "\n") {
+		if value, found := strings.CutPrefix(line, "#EXT-X-TARGETDURATION:"); found {
+			targetDuration, err := strconv.Atoi(strings.TrimSpace(value))
+			return targetDuration, err == nil
+		}
+	}
+	return 0, false
+}
+
+// playlistTargetDuration returns the EXT-X-TARGETDURATION of a playlist: the override when positive,
+// otherwise the MPD's maxSegmentDuration, raised if needed to cover the longest segment.
+func playlistTargetDuration(mpd *dash.MPD, targetDuration int, segments []*models.Segment, timescale float64) int {
+	if targetDuration <= 0 {
+		durationStr := strings.ToLower(strings.TrimPrefix(mpd.MaxSegmentDuration, "PT"))
+		maxSegmentDuration, _ := time.ParseDuration(durationStr)
+		targetDuration = int(maxSegmentDuration.Seconds())
+	}
+	for _, seg := range segments {
+		// Each EXTINF, rounded to the nearest integer, must not exceed the target duration.
+		if rounded := int(math.Round(float64(seg.Duration) / timescale)); rounded > targetDuration {
+			targetDuration = rounded
+		}
+	}
+	return targetDuration
+}
+
+// InitSegmentFilename returns the name under which media playlists reference an init segment,
+// given its expanded initialization path: the base name with an .m4s extension.
+// An init segment that is a byte range of the media file has no path of its own and is named "init.m4s".
+func InitSegmentFilename(initPath string) string {
+	if initPath == "" {
+		return "init.m4s"
+	}
+	base := path.Base(initPath)
+	return strings.TrimSuffix(base, path.Ext(base)) + ".m4s"
+}
+
+// canSkipTargetDurations is the CAN-SKIP-UNTIL advertised by live playlists, in target durations.
+// HLS requires it to be at least six.
+const canSkipTargetDurations = 6
+
+// skippableSegments returns how many leading segments start more than canSkipUntil seconds
+// before the end of the playlist and may therefore be skipped by a delta update.
+func skippableSegments(segments []*models.Segment, timescale, canSkipUntil float64) int {
+	remaining := 0.0
+	for _, seg := range segments {
+		remaining += float64(seg.Duration) / timescale
+	}
+	skipped := 0
+	for _, seg := range segments {
+		if remaining <= canSkipUntil {
+			break
+		}
+		remaining -= float64(seg.Duration) / timescale
+		skipped++
+	}
+	return skipped
+}
+
+// writeKey writes the EXT-X-KEY tag for the key's method, with an IV attribute when iv is set.
+// The key URI needs to be constructed based on channelId, and on the key ID when one is set,
+// unless the key's URI template is set.
+func writeKey(sb *strings.Builder, keyInfo KeyInfo, channelId string, iv []byte) {
+	hlsMethod := "SAMPLE-AES"
+	switch keyInfo.Method {
+	case channels.EncryptionNone:
+		return
+	case channels.EncryptionAES128:
+		hlsMethod = "AES-128"
+	}
+
+	sb.WriteString(fmt.Sprintf("#EXT-X-KEY:METHOD=%s,URI=\"%s\"", hlsMethod, keyURI(keyInfo, channelId)))
+	if iv != nil {
+		sb.WriteString(fmt.Sprintf(",IV=0x%x", iv))
+	}
+	sb.WriteString("\n")
+}
+
+// keyURI returns the URI of the key, rendered from the key's URI template when one is set.
+func keyURI(keyInfo KeyInfo, channelId string) string {
+	if keyInfo.URITemplate != "" {
+		kid := keyInfo.KID
+		if kid == nil {
+			kid = keyInfo.ChannelKID
+		}
+		return strings.NewReplacer("{channelId}", channelId, "{kid}", fmt.Sprintf("%x", kid)).Replace(keyInfo.URITemplate)
+	}
+	uri := "/key/" + channelId
+	if keyInfo.KID != nil {
+		uri += fmt.Sprintf("?kid=%x", keyInfo.KID)
+	}
+	return uri
+}
+
+// uint64IV returns a 16-byte IV holding v as a big-endian integer.
+func uint64IV(v uint64) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint64(iv[8:], v)
+	return iv
+}
+
+// programDateTimeLayout is RFC 3339 with millisecond precision, as used by EXT-X-PROGRAM-DATE-TIME.
+const programDateTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// segmentPeriod returns the period a segment belongs to, falling back to the given period
+// for segments without a known PeriodID.
+func segmentPeriod(mpd *dash.MPD, seg *models.Segment, fallback *dash.Period) *dash.Period {
+	if seg.PeriodID != "" {
+		for i := range mpd.Periods {
+			if mpd.Periods[i].ID == seg.PeriodID {
+				return &mpd.Periods[i]
+			}
+		}
+	}
+	return fallback
+}
+
+// programDateTime returns the wall-clock time at which a segment starts: the MPD's availabilityStartTime,
+// plus the start of the segment's period, plus its media time past the presentationTimeOffset.
+// An availabilityStartTime of the Unix epoch is common for origins whose media time is itself epoch-based.
+func programDateTime(availabilityStart time.Time, period *dash.Period, segmentTime, presentationTimeOffset, timescale uint64) time.Time {
+	start := availabilityStart
+	if periodStart, err := period.GetStart(); err == nil {
+		start = start.Add(periodStart)
+	}
+
+	mediaTime := int64(segmentTime) - int64(presentationTimeOffset)
+	ts := int64(timescale)
+	// Split into whole seconds and a remainder to avoid overflowing time.Duration with large media times.
+	offset := time.Duration(mediaTime/ts)*time.Second + time.Duration(mediaTime%ts)*time.Second/time.Duration(ts)
+	return start.Add(offset)
+}
+
+// displayWidth returns the width at which a representation is displayed, applying its
+// sample aspect ratio so that non-square-pixel content reports its true RESOLUTION.
+func displayWidth(rep *dash.Representation) int {
+	sarWidth, sarHeight, ok := rep.GetSAR()
+	if !ok || sarWidth == sarHeight {
+		return rep.Width
+	}
+	return int(math.Round(float64(rep.Width) * float64(sarWidth) / float64(sarHeight)))
+}
+
 func parseFrameRate(fr string) float64 {
 	parts := strings.Split(fr, "/")
 	if len(parts) == 2 {
@@ -0,0 +1,34 @@
+package hls
+
+import "bytes"
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+)
+
+// SniffSegmentContentType inspects the first bytes of a segment and returns its MIME type.
+// It recognizes fragmented MP4 (ftyp, styp, moof or sidx as the first box), MPEG-TS
+// (sync byte at each packet boundary) and WebVTT. An empty string is returned if the
+// format cannot be determined.
+func SniffSegmentContentType(data []byte) string {
+	if len(data) >= 8 {
+		switch string(data[4:8]) {
+		case "ftyp", "styp", "moof", "sidx":
+			return "video/mp4"
+		}
+	}
+
+	if len(data) > 0 && data[0] == tsSyncByte {
+		// A single sync byte is weak evidence, so check the next packet boundary when available.
+		if len(data) <= tsPacketSize || data[tsPacketSize] == tsSyncByte {
+			return "video/mp2t"
+		}
+	}
+
+	if bytes.HasPrefix(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), []byte("WEBVTT")) {
+		return "text/vtt"
+	}
+
+	return ""
+}
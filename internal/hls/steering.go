@@ -0,0 +1,51 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SteeringManifestVersion is the version of the content steering manifest format.
+const SteeringManifestVersion = 1
+
+// ContentSteering describes the EXT-X-CONTENT-STEERING tag of a master playlist.
+type ContentSteering struct {
+	// ServerURI is the steering manifest URI, resolved by players against the master playlist URI.
+	ServerURI string
+	// PathwayID is the pathway of the master playlist's variants, which players start on.
+	PathwayID string
+}
+
+// SteeringManifest is the JSON document served from a steering server URI.
+type SteeringManifest struct {
+	Version         int            `json:"VERSION"`
+	TTL             int            `json:"TTL"`
+	ReloadURI       string         `json:"RELOAD-URI,omitempty"`
+	PathwayPriority []string       `json:"PATHWAY-PRIORITY"`
+	PathwayClones   []PathwayClone `json:"PATHWAY-CLONES,omitempty"`
+}
+
+// PathwayClone defines a pathway derived from another one by replacing the host of its URIs.
+type PathwayClone struct {
+	BaseID         string         `json:"BASE-ID"`
+	ID             string         `json:"ID"`
+	URIReplacement URIReplacement `json:"URI-REPLACEMENT"`
+}
+
+// URIReplacement lists the URI changes applied to a cloned pathway.
+type URIReplacement struct {
+	Host string `json:"HOST,omitempty"`
+}
+
+// writeContentSteering writes the EXT-X-CONTENT-STEERING tag.
+func writeContentSteering(sb *strings.Builder, steering *ContentSteering) {
+	sb.WriteString(fmt.Sprintf("#EXT-X-CONTENT-STEERING:SERVER-URI=\"%s\",PATHWAY-ID=\"%s\"\n", steering.ServerURI, steering.PathwayID))
+}
+
+// pathwayAttribute returns the PATHWAY-ID attribute of variant streams, empty without content steering.
+func pathwayAttribute(steering *ContentSteering) string {
+	if steering == nil {
+		return ""
+	}
+	return fmt.Sprintf(",PATHWAY-ID=\"%s\"", steering.PathwayID)
+}
@@ -3,36 +3,107 @@ package key
 import (
 	"dash2hlsd/internal/channels"
 	"fmt"
+	"sync"
 )
 
 // Service provides decryption keys based on channel configuration.
-// It is initialized once at startup and is safe for concurrent reads.
+// It is safe for concurrent use; Update replaces its keys when the configuration is reloaded, and
+// UpdateKeys when a keys file changes.
 type Service struct {
-	channelKeyMap map[string][]byte
+	mutex    sync.RWMutex
+	channels map[string]channels.Channel // Keyed by channel ID
+	// fileKeys holds the keys loaded from a keys file, which override the configured keys of their
+	// channels across configuration reloads. Keyed by channel ID.
+	fileKeys map[string]channels.Channel
 }
 
 // NewService creates and initializes a new key service from the given configuration.
 // It extracts all channel keys and stores them in an internal map for fast lookups.
 func NewService(cfg *channels.ChannelConfig) (*Service, error) {
-	keyMap := make(map[string][]byte)
+	channelMap, err := buildChannelMap(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Service{channels: channelMap}, nil
+}
+
+// Update replaces the keys with those of a new configuration. The current keys are kept when the
+// new configuration is invalid.
+func (s *Service) Update(cfg *channels.ChannelConfig) error {
+	channelMap, err := buildChannelMap(cfg)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.channels = channelMap
+	return nil
+}
+
+// UpdateKeys replaces the keys of the given channels, e.g. from a keys file, leaving the other channels
+// with their configured keys. The keys take precedence over the configured ones, also once the configuration
+// is reloaded, until the next UpdateKeys. Channels that are not configured are ignored.
+func (s *Service) UpdateKeys(keyed []channels.Channel) {
+	fileKeys := make(map[string]channels.Channel, len(keyed))
+	for _, channel := range keyed {
+		fileKeys[channel.Id] = channels.Channel{Id: channel.Id, Key: channel.Key, KID: channel.KID, Keys: channel.Keys}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fileKeys = fileKeys
+}
+
+// lookup returns the keys of a configured channel, from the keys file if it has them. The caller must hold the lock.
+func (s *Service) lookup(channelId string) (channels.Channel, bool) {
+	channel, found := s.channels[channelId]
+	if !found {
+		return channels.Channel{}, false
+	}
+	if keyed, found := s.fileKeys[channelId]; found {
+		return keyed, true
+	}
+	return channel, true
+}
+
+// buildChannelMap maps the key configuration of every channel by channel ID.
+func buildChannelMap(cfg *channels.ChannelConfig) (map[string]channels.Channel, error) {
+	channelMap := make(map[string]channels.Channel, len(cfg.Channels))
 	for _, channel := range cfg.Channels {
-		// The key has already been decoded in the config loader.
-		// We map it directly by the channel ID.
-		if _, exists := keyMap[channel.Id]; exists {
+		// The keys have already been decoded in the config loader.
+		// We map them directly by the channel ID.
+		if _, exists := channelMap[channel.Id]; exists {
 			return nil, fmt.Errorf("duplicate channel ID found in config: %s", channel.Id)
 		}
-		keyMap[channel.Id] = channel.Key
+		channelMap[channel.Id] = channels.Channel{Id: channel.Id, Key: channel.Key, KID: channel.KID, Keys: channel.Keys}
 	}
+	return channelMap, nil
+}
 
-	return &Service{
-		channelKeyMap: keyMap,
-	}, nil
+// ChannelKeys returns the current keys of a configured channel: its key, key ID and keys by key ID.
+func (s *Service) ChannelKeys(channelId string) (channels.Channel, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.lookup(channelId)
 }
 
-// GetKeyForChannel retrieves a key for a given channel ID.
+// GetKeyForChannel retrieves the first key of a given channel ID.
 // It returns the key and a boolean indicating if the key was found.
 func (s *Service) GetKeyForChannel(channelId string) ([]byte, bool) {
-	// No lock needed as the map is read-only after initialization.
-	key, found := s.channelKeyMap[channelId]
-	return key, found
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	channel, found := s.lookup(channelId)
+	return channel.Key, found
+}
+
+// GetKeyForKID retrieves a channel's key only if it was configured for the given key ID,
+// e.g. the default_KID announced in the channel's manifest. Channels with several keys return
+// the key paired with that key ID.
+func (s *Service) GetKeyForKID(channelId string, kid []byte) ([]byte, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	channel, found := s.lookup(channelId)
+	if !found {
+		return nil, false
+	}
+	return channel.GetKeyForKID(kid)
 }
@@ -0,0 +1,55 @@
+package key
+
+import (
+	"context"
+	"dash2hlsd/internal/channels"
+	"dash2hlsd/internal/logger"
+	"os"
+	"time"
+)
+
+// LoadKeysFile reads a keys file, as described by channels.LoadKeys, and applies it with UpdateKeys.
+// The current keys are kept when the file is invalid.
+func (s *Service) LoadKeysFile(path string) error {
+	keyed, err := channels.LoadKeys(path)
+	if err != nil {
+		return err
+	}
+	s.UpdateKeys(keyed)
+	return nil
+}
+
+// WatchKeysFile polls a keys file every interval and loads it again whenever its modification time or size
+// changes, until ctx is done, so that keys are rotated without a restart or a configuration reload.
+// The first poll loads the file too, so that a change made since LoadKeysFile is not missed.
+// A file that fails to load is reported and the current keys are kept.
+func (s *Service) WatchKeysFile(ctx context.Context, path string, interval time.Duration, log logger.Logger) {
+	var last os.FileInfo
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			if last != nil {
+				log.Warnf("Keeping the current keys, cannot read keys file: %v", err)
+			}
+			last = nil
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		if err := s.LoadKeysFile(path); err != nil {
+			log.Errorf("Keeping the current keys, failed to reload %s: %v", path, err)
+			continue
+		}
+		log.Infof("Reloaded keys from %s", path)
+	}
+}
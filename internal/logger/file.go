@@ -0,0 +1,79 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an io.WriteCloser appending to a log file. Once the file would grow past MaxBytes,
+// it is renamed with a ".1" suffix, replacing any previous rotation, and a new file is started.
+type RotatingFile struct {
+	path     string
+	maxBytes int64
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// OpenRotatingFile opens, or creates, the log file at path. A maxBytes of zero or less disables rotation.
+func OpenRotatingFile(path string, maxBytes int64) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxBytes: maxBytes}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file '%s': %w", rf.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file '%s': %w", rf.path, err)
+	}
+	rf.file, rf.size = file, info.Size()
+	return nil
+}
+
+// Write appends p to the log file, rotating it first if p would take it past the size limit.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.maxBytes > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file '%s': %w", rf.path, err)
+	}
+	renameErr := os.Rename(rf.path, rf.path+".1")
+	// Reopen even if the rename failed, so that logging carries on in the oversized file.
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		rf.size = 0 // Do not retry the rotation on every write
+		return fmt.Errorf("failed to rotate log file '%s': %w", rf.path, renameErr)
+	}
+	return nil
+}
+
+// Close closes the log file.
+func (rf *RotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	return rf.file.Close()
+}
@@ -2,6 +2,7 @@ package logger
 
 import (
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
@@ -20,8 +21,13 @@ type SlogLogger struct {
 	*slog.Logger
 }
 
-// NewLogger creates a new logger instance based on the specified level.
+// NewLogger creates a new logger instance based on the specified level, writing to stdout.
 func NewLogger(level string) Logger {
+	return NewLoggerWithOutput(level, os.Stdout)
+}
+
+// NewLoggerWithOutput is like NewLogger but writes the log records to out.
+func NewLoggerWithOutput(level string, out io.Writer) Logger {
 	var lvl slog.Level
 	switch strings.ToLower(level) {
 	case "debug":
@@ -36,7 +42,7 @@ func NewLogger(level string) Logger {
 		lvl = slog.LevelInfo
 	}
 
-	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+	handler := slog.NewJSONHandler(out, &slog.HandlerOptions{
 		Level: lvl,
 	})
 
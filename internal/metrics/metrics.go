@@ -0,0 +1,298 @@
+// Package metrics holds the process-wide counters and gauges exported in the Prometheus text format.
+// Instrumented packages update the package-level metrics directly; the API serves them on /metrics.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics exported by the proxy.
+var (
+	ActiveSessions = NewGauge("dash2hlsd_active_sessions", "Number of active stream sessions.")
+
+	CacheSegments  = NewGauge("dash2hlsd_cache_segments", "Number of segments held in the segment cache.")
+	CacheBytes     = NewGauge("dash2hlsd_cache_bytes", "Total size in bytes of the segments held in the segment cache.")
+	CacheDiskBytes = NewGauge("dash2hlsd_cache_disk_bytes", "Total size in bytes of the segments spilled to the disk cache tier.")
+	CacheLookups   = NewCounterVec("dash2hlsd_cache_lookups_total", "Segment cache lookups by result.", "result")
+
+	SegmentDownloads       = NewCounterVec("dash2hlsd_segment_downloads_total", "Segment downloads by result.", "result")
+	SegmentDownloadSeconds = NewSummary("dash2hlsd_segment_download_seconds", "Time spent downloading segments, including retries and failover.")
+
+	SegmentQueueWaitSeconds = NewHistogramVec("dash2hlsd_segment_queue_wait_seconds",
+		"Time segments waited in the download queue before a worker picked them up, by channel.", "channel", LatencyBuckets)
+	SegmentTransferSeconds = NewHistogramVec("dash2hlsd_segment_transfer_seconds",
+		"Time spent fetching segments from the origin, including retries and failover, by channel.", "channel", LatencyBuckets)
+	SegmentLatencySeconds = NewHistogramVec("dash2hlsd_segment_latency_seconds",
+		"Time from queueing a segment to the completion of its download, by channel.", "channel", LatencyBuckets)
+
+	MPDRefreshErrors = NewCounter("dash2hlsd_mpd_refresh_errors_total", "Failed MPD refreshes.")
+	PlaylistRequests = NewCounterVec("dash2hlsd_playlist_requests_total", "Playlist requests by playlist type.", "type")
+)
+
+// value is a float64 updated atomically.
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) { v.bits.Store(math.Float64bits(f)) }
+func (v *value) get() float64  { return math.Float64frombits(v.bits.Load()) }
+
+// Counter is a value that only goes up.
+type Counter struct{ v value }
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() { c.v.add(1) }
+
+// Add increases the counter by delta, which must not be negative.
+func (c *Counter) Add(delta float64) { c.v.add(delta) }
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 { return c.v.get() }
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ v value }
+
+// Set sets the gauge to f.
+func (g *Gauge) Set(f float64) { g.v.set(f) }
+
+// Add adds delta, which may be negative, to the gauge.
+func (g *Gauge) Add(delta float64) { g.v.add(delta) }
+
+// Inc increments the gauge by one.
+func (g *Gauge) Inc() { g.v.add(1) }
+
+// Dec decrements the gauge by one.
+func (g *Gauge) Dec() { g.v.add(-1) }
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 { return g.v.get() }
+
+// Summary tracks the count and sum of observations, such as latencies.
+type Summary struct {
+	count value
+	sum   value
+}
+
+// Observe records a single observation.
+func (s *Summary) Observe(f float64) {
+	s.count.add(1)
+	s.sum.add(f)
+}
+
+// Count returns the number of observations.
+func (s *Summary) Count() float64 { return s.count.get() }
+
+// LatencyBuckets are the upper bounds, in seconds, of the buckets of latency histograms.
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in buckets of increasing upper bounds, along with their count and sum.
+type Histogram struct {
+	upperBounds []float64
+	buckets     []value // Observations per bucket, not cumulative; the last one is the +Inf bucket
+	count       value
+	sum         value
+}
+
+func newHistogram(upperBounds []float64) *Histogram {
+	return &Histogram{upperBounds: upperBounds, buckets: make([]value, len(upperBounds)+1)}
+}
+
+// Observe records a single observation.
+func (h *Histogram) Observe(f float64) {
+	h.buckets[sort.SearchFloat64s(h.upperBounds, f)].add(1)
+	h.count.add(1)
+	h.sum.add(f)
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() float64 { return h.count.get() }
+
+// Sum returns the sum of the observations.
+func (h *Histogram) Sum() float64 { return h.sum.get() }
+
+// CumulativeCounts returns, for each upper bound, the number of observations less than or equal to it.
+func (h *Histogram) CumulativeCounts() []float64 {
+	counts := make([]float64, len(h.upperBounds))
+	var total float64
+	for i := range h.upperBounds {
+		total += h.buckets[i].get()
+		counts[i] = total
+	}
+	return counts
+}
+
+// write writes the histogram's series, with labels prepended to the le label of every bucket.
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	for i, count := range h.CumulativeCounts() {
+		fmt.Fprintf(w, "%s_bucket{%sle=%q} %s\n", name, labels, formatValue(h.upperBounds[i]), formatValue(count))
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %s\n", name, labels, formatValue(h.Count()))
+	if labels != "" {
+		labels = "{" + strings.TrimSuffix(labels, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatValue(h.Sum()))
+	fmt.Fprintf(w, "%s_count%s %s\n", name, labels, formatValue(h.Count()))
+}
+
+// CounterVec is a family of counters distinguished by the value of a single label.
+type CounterVec struct {
+	label   string
+	mutex   sync.Mutex
+	members map[string]*Counter
+}
+
+// WithLabel returns the counter for the given label value, creating it on first use.
+func (cv *CounterVec) WithLabel(labelValue string) *Counter {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	c, found := cv.members[labelValue]
+	if !found {
+		c = &Counter{}
+		cv.members[labelValue] = c
+	}
+	return c
+}
+
+// HistogramVec is a family of histograms sharing their buckets, distinguished by the value of a single label.
+type HistogramVec struct {
+	label       string
+	upperBounds []float64
+	mutex       sync.Mutex
+	members     map[string]*Histogram
+}
+
+// WithLabel returns the histogram for the given label value, creating it on first use.
+func (hv *HistogramVec) WithLabel(labelValue string) *Histogram {
+	hv.mutex.Lock()
+	defer hv.mutex.Unlock()
+	h, found := hv.members[labelValue]
+	if !found {
+		h = newHistogram(hv.upperBounds)
+		hv.members[labelValue] = h
+	}
+	return h
+}
+
+// family is a registered metric together with what is needed to expose it.
+type family struct {
+	name, help, kind string
+	write            func(w io.Writer, name string)
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      []family
+)
+
+func register(name, help, kind string, write func(w io.Writer, name string)) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry = append(registry, family{name: name, help: help, kind: kind, write: write})
+}
+
+// NewCounter creates and registers a counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	register(name, help, "counter", func(w io.Writer, name string) {
+		fmt.Fprintf(w, "%s %s\n", name, formatValue(c.Value()))
+	})
+	return c
+}
+
+// NewGauge creates and registers a gauge.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	register(name, help, "gauge", func(w io.Writer, name string) {
+		fmt.Fprintf(w, "%s %s\n", name, formatValue(g.Value()))
+	})
+	return g
+}
+
+// NewSummary creates and registers a summary exposing the sum and count of its observations.
+func NewSummary(name, help string) *Summary {
+	s := &Summary{}
+	register(name, help, "summary", func(w io.Writer, name string) {
+		fmt.Fprintf(w, "%s_sum %s\n", name, formatValue(s.sum.get()))
+		fmt.Fprintf(w, "%s_count %s\n", name, formatValue(s.count.get()))
+	})
+	return s
+}
+
+// NewCounterVec creates and registers a family of counters keyed by one label.
+func NewCounterVec(name, help, label string) *CounterVec {
+	cv := &CounterVec{label: label, members: make(map[string]*Counter)}
+	register(name, help, "counter", func(w io.Writer, name string) {
+		cv.mutex.Lock()
+		labelValues := make([]string, 0, len(cv.members))
+		for labelValue := range cv.members {
+			labelValues = append(labelValues, labelValue)
+		}
+		cv.mutex.Unlock()
+		sort.Strings(labelValues)
+		for _, labelValue := range labelValues {
+			fmt.Fprintf(w, "%s{%s=%s} %s\n", name, cv.label, strconv.Quote(labelValue), formatValue(cv.WithLabel(labelValue).Value()))
+		}
+	})
+	return cv
+}
+
+// NewHistogramVec creates and registers a family of histograms keyed by one label, with the given
+// bucket upper bounds in increasing order.
+func NewHistogramVec(name, help, label string, upperBounds []float64) *HistogramVec {
+	hv := &HistogramVec{label: label, upperBounds: upperBounds, members: make(map[string]*Histogram)}
+	register(name, help, "histogram", func(w io.Writer, name string) {
+		hv.mutex.Lock()
+		labelValues := make([]string, 0, len(hv.members))
+		for labelValue := range hv.members {
+			labelValues = append(labelValues, labelValue)
+		}
+		hv.mutex.Unlock()
+		sort.Strings(labelValues)
+		for _, labelValue := range labelValues {
+			hv.WithLabel(labelValue).write(w, name, fmt.Sprintf("%s=%s,", hv.label, strconv.Quote(labelValue)))
+		}
+	})
+	return hv
+}
+
+// WriteText writes every registered metric in the Prometheus text exposition format.
+func WriteText(w io.Writer) {
+	registryMutex.Lock()
+	families := append([]family(nil), registry...)
+	registryMutex.Unlock()
+
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+		f.write(w, f.name)
+	}
+}
+
+// Handler serves the registered metrics to Prometheus scrapers.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteText(w)
+	})
+}
+
+func formatValue(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
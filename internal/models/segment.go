@@ -5,6 +5,8 @@ package models
 type Segment struct {
 	// URL is the fully-qualified URL to fetch the segment from.
 	URL string
+	// FallbackURLs are alternative locations of the same segment, tried in order when URL fails.
+	FallbackURLs []string
 	// ID is a unique identifier for the segment, often derived from its start time or sequence number.
 	// For media segments, this is the cache key.
 	ID string
@@ -14,6 +16,12 @@ type Segment struct {
 	Duration uint64
 	// RepID is the ID of the representation this segment belongs to.
 	RepID string
+	// PeriodID is the ID of the Period this segment belongs to. A change of period between
+	// consecutive segments is a discontinuity in the HLS playlist.
+	PeriodID string
 	// IsInit indicates if this is an initialization segment.
 	IsInit bool
+	// ByteRange, when set, restricts the segment to an inclusive "first-last" byte range of the resource at URL,
+	// as for segments of a single-file representation.
+	ByteRange string
 }
@@ -0,0 +1,124 @@
+package session
+
+import (
+	"dash2hlsd/internal/dash"
+	"dash2hlsd/internal/hls"
+	"fmt"
+	"slices"
+)
+
+// RepresentationMapping shows how a representation's DASH addressing maps to the HLS URIs the proxy serves,
+// with an example segment resolved both ways, to troubleshoot URL building.
+type RepresentationMapping struct {
+	PeriodID         string `json:"periodId"`
+	AdaptationSetID  string `json:"adaptationSetId,omitempty"`
+	RepresentationID string `json:"representationId"`
+	ContentType      string `json:"contentType"`
+	// Downloaded reports whether the session downloads the representation's segments.
+	Downloaded bool `json:"downloaded"`
+
+	// InitializationTemplate and MediaTemplate are the DASH templates, or the SegmentList's
+	// initialization source for list addressing.
+	InitializationTemplate string `json:"initializationTemplate,omitempty"`
+	MediaTemplate          string `json:"mediaTemplate,omitempty"`
+	// InitURL and SegmentURL are the resolved origin URLs of the init segment and the example segment,
+	// with any failover URLs after the first.
+	InitURL    []string `json:"initUrl,omitempty"`
+	SegmentURL []string `json:"segmentUrl,omitempty"`
+	// SegmentTime and SegmentNumber identify the example segment: the first of the session's window,
+	// or the last of the timeline when none is downloaded.
+	SegmentTime   uint64 `json:"segmentTime"`
+	SegmentNumber uint64 `json:"segmentNumber"`
+	// ByteRange is the example segment's range of a single-file representation.
+	ByteRange string `json:"byteRange,omitempty"`
+
+	// PlaylistURI, InitURI and SegmentURI are the HLS URIs serving the representation.
+	PlaylistURI string `json:"playlistUri"`
+	InitURI     string `json:"initUri"`
+	SegmentURI  string `json:"segmentUri,omitempty"`
+
+	// Errors lists the URLs that could not be built.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// GetMapping reports, for every representation of the current MPD, its DASH templates, the origin URLs
+// they resolve to and the corresponding HLS URIs.
+func (s *StreamSession) GetMapping() []RepresentationMapping {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var mappings []RepresentationMapping
+	for i := range s.MPD.Periods {
+		period := &s.MPD.Periods[i]
+		for j := range period.Sets {
+			as := &period.Sets[j]
+			downloaded := s.representationsToDownload(as)
+			for k := range as.Representations {
+				rep := &as.Representations[k]
+				mappings = append(mappings, s.mapRepresentation(period, as, rep, slices.Contains(downloaded, rep)))
+			}
+		}
+	}
+	return mappings
+}
+
+// mapRepresentation builds the mapping of a single representation. The caller must hold the lock.
+func (s *StreamSession) mapRepresentation(period *dash.Period, as *dash.AdaptationSet, rep *dash.Representation, downloaded bool) RepresentationMapping {
+	template := as.GetSegmentTemplate(rep)
+	mediaType := as.ContentType
+	playlistName := "playlist.m3u8"
+	if isTrickMode(rep) {
+		playlistName = hls.IFramePlaylistName
+	}
+	hlsBase := fmt.Sprintf("/live/%s/%s/%s/", s.ChannelID, mediaType, rep.ID)
+
+	initPath := dash.ExpandTemplate(as.GetInitialization(rep), dash.TemplateValues{RepresentationID: rep.ID, Bandwidth: uint64(rep.Bandwidth)})
+	mapping := RepresentationMapping{
+		PeriodID:               period.ID,
+		AdaptationSetID:        as.ID,
+		RepresentationID:       rep.ID,
+		ContentType:            mediaType,
+		Downloaded:             downloaded,
+		InitializationTemplate: as.GetInitialization(rep),
+		MediaTemplate:          template.Media,
+		PlaylistURI:            hlsBase + playlistName,
+		InitURI:                hlsBase + hls.InitSegmentFilename(initPath),
+	}
+
+	initURLs, err := dash.BuildInitSegmentURLs(s.BaseURL, s.MPD, period, as, rep)
+	if err != nil {
+		mapping.Errors = append(mapping.Errors, fmt.Sprintf("init segment: %v", err))
+	}
+	mapping.InitURL = initURLs
+
+	segmentTime, ok := s.exampleSegmentTime(period, rep, template.Timeline)
+	if !ok {
+		mapping.Errors = append(mapping.Errors, "segment: the timeline is empty")
+		return mapping
+	}
+	segmentNumber, _ := dash.SegmentNumber(&template, segmentTime)
+	mapping.SegmentTime, mapping.SegmentNumber = segmentTime, segmentNumber
+	mapping.ByteRange = dash.SegmentMediaRange(as, rep, segmentNumber)
+	mapping.SegmentURI = fmt.Sprintf("%s%d.m4s", hlsBase, segmentTime)
+	segmentURLs, err := dash.BuildSegmentURLs(s.BaseURL, s.MPD, period, as, rep, segmentTime, segmentNumber)
+	if err != nil {
+		mapping.Errors = append(mapping.Errors, fmt.Sprintf("segment: %v", err))
+	}
+	mapping.SegmentURL = segmentURLs
+	return mapping
+}
+
+// exampleSegmentTime returns the time of the first segment of a representation's window in the period,
+// or else of the last segment of its timeline. The caller must hold the lock.
+func (s *StreamSession) exampleSegmentTime(period *dash.Period, rep *dash.Representation, timeline dash.SegmentTimeline) (uint64, bool) {
+	for _, seg := range s.availableSegments[rep.ID] {
+		if seg.PeriodID == period.ID {
+			return seg.Time, true
+		}
+	}
+	segments := dash.ExpandTimeline(timeline)
+	if len(segments) == 0 {
+		return 0, false
+	}
+	return segments[len(segments)-1].T, true
+}
@@ -1,90 +1,489 @@
 package session
 
 import (
+	"cmp"
 	"context"
 	"dash2hlsd/internal/cache"
 	"dash2hlsd/internal/channels"
 	"dash2hlsd/internal/dash"
 	"dash2hlsd/internal/hls"
 	"dash2hlsd/internal/logger"
+	"dash2hlsd/internal/metrics"
 	"dash2hlsd/internal/models"
+	"errors"
 	"fmt"
+	"math"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	playlistLiveSegments = 5 // Number of segments to include in the live playlist
+	sessionDownloadWorkers = 10 // Number of workers started by a session that does not use the shared pool
+
+	initSegmentWait = 3 * time.Second // Maximum time a new session waits for its init segments before fetching media
+
+	maxInitSegmentRefetches = 3 // Times a malformed or failed init segment is fetched again before giving up
+
+	manifestGoneRefreshes = 3 // Consecutive refreshes that must find the manifest gone before the stream is treated as ended
+
+	maxPinnedReps  = 4           // Video representations clients may pin in a session at once, beyond those selected automatically
+	pinIdleTimeout = time.Minute // How long a pin lasts without client requests for its representation
 )
 
+// startupPreset groups the settings tuned together by a channel's StartupPolicy.
+type startupPreset struct {
+	liveDelaySegments int // How many segments behind the live edge a new session starts
+	prefetchSegments  int // Segments queued ahead from the playhead for each representation on every tick
+	minBufferSegments int // Segments a representation must have before its playlist is served
+}
+
+// startupPresets maps each policy to its preset. The default preset matches the historical behaviour.
+var startupPresets = map[channels.StartupPolicy]startupPreset{
+	channels.StartupPolicyDefault:     {liveDelaySegments: 4, prefetchSegments: 1, minBufferSegments: 1},
+	channels.StartupPolicyLatency:     {liveDelaySegments: 2, prefetchSegments: 1, minBufferSegments: 1},
+	channels.StartupPolicyReliability: {liveDelaySegments: 6, prefetchSegments: 3, minBufferSegments: 3},
+}
+
+// Downloader downloads the segments queued by a session, delivering every result on the task's Result
+// channel. *dash.Downloader implements it; tests may substitute a fake through SetDownloaderFactory.
+type Downloader interface {
+	QueueDownload(task dash.DownloadTask)
+	Stop()
+}
+
+// KeyStore provides the current keys of a channel, which may change while its session runs, e.g. when a
+// keys file is rotated. *key.Service implements it.
+type KeyStore interface {
+	ChannelKeys(channelId string) (channels.Channel, bool)
+}
+
 // StreamSession holds all context for a single live stream.
 type StreamSession struct {
 	ChannelID   string
-	ManifestURL string
+	ManifestURL string // The manifest URL of the currently active origin
 	BaseURL     string // The final URL after any redirects
 	Logger      logger.Logger
 	MPD         *dash.MPD
-	Downloader  *dash.Downloader
+	Downloader  Downloader
 	SegCache    *cache.SegmentCache
 
 	// Thread-safe state
-	mutex             sync.RWMutex
-	availableSegments map[string][]*models.Segment // Keyed by Representation ID
-	playlistCache     map[string]string            // Keyed by Representation ID
-	mediaSequence     map[string]int               // Keyed by Representation ID
-	resultsChan       chan dash.DownloadResult     // Channel for download results
+	mutex               sync.RWMutex
+	availableSegments   map[string][]*models.Segment // Keyed by Representation ID
+	playlistCache       map[string]Playlist          // Keyed by Representation ID
+	deltaPlaylistCache  map[string]Playlist          // Delta updates of live playlists, keyed by Representation ID
+	iframePlaylistCache map[string]Playlist          // I-frame playlists of trick mode tracks, keyed by Representation ID
+	mediaSequence       map[string]int               // Keyed by Representation ID
+	discontinuitySeq    map[string]int               // Discontinuities dropped from the window, keyed by Representation ID
+	resultsChan         chan dash.DownloadResult     // Channel for download results
+	manifestURLs        []string                     // All origins in failover order
+	manifestIndex       int                          // Index of the active origin in manifestURLs
+	pendingInits        atomic.Int32                 // Init segments queued but not yet downloaded or failed
+	lastAccess          atomic.Int64                 // Unix nanoseconds of the last client request, for idle teardown
+	createdAt           time.Time                    // When the session was created; set once before it is shared
+	started             chan struct{}                // Closed once Start returns, so that requests wait for the init segments
+	masterPlaylist      Playlist                     // Last generated master playlist
+	masterGeneratedAt   time.Time                    // When masterPlaylist was generated; zero when it must be regenerated
+	onDemandSegments    map[string]models.Segment    // VOD segments fetched when first requested or prefetched, keyed by cache key
+	onDemandSlots       chan struct{}                // Semaphore bounding concurrent on-demand fetches
+	onDemandFetches     map[string]*onDemandFetch    // On-demand fetches in flight, keyed by cache key
+	initRefetches       map[string]int               // Refetches of malformed or failed init segments, keyed by cache key
+	failedReps          map[string]bool              // Representations whose segments the origin does not serve, until one downloads
+	queuedSegments      map[string]bool              // Media segments queued but not yet downloaded or failed, keyed by cache key
+	pathwayPriority     []string                     // Steering pathway order set through SetPathwayPriority; nil uses the config order
+	playlistUpdated     map[string]chan struct{}     // Closed when a representation's playlist is regenerated, keyed by Representation ID
+	playlistGenerations map[string]uint64            // How often a representation's playlists were regenerated, keyed by Representation ID
+	segmentPaths        map[string]string            // Cache keys of the whole-file segments in availableSegments, keyed by origin URL
+
+	// pinnedReps holds video representations requested by clients through a selection hint,
+	// downloaded in addition to the ones selected automatically, with when a client last requested
+	// each. Guarded by pinMutex.
+	pinMutex   sync.Mutex
+	pinnedReps map[string]time.Time
+	// unpinnedReps holds the representations whose pins were dropped to make room for others, whose
+	// playlists are discarded on the next update. Guarded by pinMutex.
+	unpinnedReps []string
+	// prewarmedReps holds the video representations whose window was pre-warmed. Guarded by pinMutex.
+	prewarmedReps map[string]bool
 
 	// Playback state
-	sessionTimescale  uint64 // The timescale of the primary (video) content, used for the main playhead
-	currentTargetTime uint64 // Media time in sessionTimescale units, the "virtual playhead"
+	sessionTimescale  uint64 // The timescale of the primary content, used for the main playhead
+	clockContentType  string // Content type of the adaptation set driving the playhead: video, or audio for audio-only channels
+	currentTargetTime uint64 // Presentation time in sessionTimescale units, the "virtual playhead"
+	ended             bool   // Set once the origin stops serving the manifest of a finished live stream
+	goneRefreshes     int    // Consecutive MPD refreshes that found the manifest gone; only used by the refresh loop
+	// retire removes the session from its manager once it has ended, so that the next request for the
+	// channel creates a new session. Set before the session starts.
+	retire func()
 
 	// Control
 	ctx        context.Context
 	cancel     context.CancelFunc
 	dashClient *dash.Client
+	channelCfg channels.Channel
+	// keys, when set, provides the channel's current keys in place of those in channelCfg.
+	keys   KeyStore
+	preset startupPreset
+	// windowSegments is the number of segments in each live playlist.
+	windowSegments int
+	// ownsDownloader is false when Downloader is the manager's shared pool, which outlives the session.
+	ownsDownloader bool
+}
+
+// WindowSegment describes a single segment in a representation's playlist window.
+type WindowSegment struct {
+	Time          uint64 `json:"time"`
+	Duration      uint64 `json:"duration"`
+	MediaSequence int    `json:"mediaSequence"`
+}
+
+// Playlist is a generated playlist with the ETag of its content, computed once when the playlist is
+// generated so that conditional requests are answered without hashing it again.
+type Playlist struct {
+	Body string
+	ETag string
+}
+
+// NewPlaylist returns a generated playlist with its ETag.
+func NewPlaylist(body string) Playlist {
+	return Playlist{Body: body, ETag: ContentETag([]byte(body))}
+}
+
+// ContentETag returns a strong ETag derived from a hash of content, the same ETag cached segments carry.
+func ContentETag(content []byte) string {
+	return cache.ContentETag(content)
+}
+
+// RepresentationWindow is a snapshot of the segments currently available for a representation.
+type RepresentationWindow struct {
+	MediaSequence int             `json:"mediaSequence"`
+	Segments      []WindowSegment `json:"segments"`
+}
+
+// ContentProtectionInfo describes the DRM signalling of an AdaptationSet, for players that decrypt
+// the CENC segments themselves.
+type ContentProtectionInfo struct {
+	PeriodID        string `json:"periodId,omitempty"`
+	AdaptationSetID string `json:"adaptationSetId,omitempty"`
+	ContentType     string `json:"contentType"`
+	DefaultKID      string `json:"defaultKid,omitempty"`
+	// PSSH maps DRM system names, such as "widevine" or "playready", to base64 PSSH boxes.
+	PSSH map[string]string `json:"pssh"`
+}
+
+// SessionInfo summarizes an active session for operators.
+type SessionInfo struct {
+	ChannelID  string    `json:"channelId"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastAccess time.Time `json:"lastAccess"`
+	// Playhead is the session's virtual playhead, in seconds of media time.
+	Playhead float64 `json:"playhead"`
+	// Segments is the number of available segments of each downloaded representation.
+	Segments map[string]int `json:"segments"`
 }
 
 // SessionManager manages all active live stream sessions.
 type SessionManager struct {
 	mutex      sync.RWMutex
 	sessions   map[string]*StreamSession
+	creating   map[string]*sessionCreation // Sessions being created, keyed by channel ID
 	logger     logger.Logger
 	cfg        *channels.ChannelConfig
 	dashClient *dash.Client
 	segCache   *cache.SegmentCache
+	// sharedDownloader is the worker pool used by every session when SharedDownloadWorkers is set.
+	sharedDownloader *dash.Downloader
+	// downloaderFactory, when set, builds the downloader of each new session. Guarded by mutex.
+	downloaderFactory func() Downloader
+	// keyStore, when set, provides the keys of new sessions. Guarded by mutex.
+	keyStore KeyStore
+	// started is set while the manager's background workers are running.
+	started atomic.Bool
+
+	// Control of the idle session reaper
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// sessionCreation is a session being created for a channel, which concurrent requests for the channel
+// wait for instead of creating their own.
+type sessionCreation struct {
+	done    chan struct{} // Closed once session or err is set
+	session *StreamSession
+	err     error
 }
 
 // NewManager creates a new session manager.
 func NewManager(log logger.Logger, cfg *channels.ChannelConfig, dashClient *dash.Client) *SessionManager {
+	ctx, cancel := context.WithCancel(context.Background())
 	sm := &SessionManager{
 		sessions:   make(map[string]*StreamSession),
+		creating:   make(map[string]*sessionCreation),
 		logger:     log,
 		cfg:        cfg,
 		dashClient: dashClient,
+		ctx:        ctx,
+		cancel:     cancel,
 	}
 	sm.segCache = cache.New(log, sm.GetAllActiveSegmentKeys)
+	sm.segCache.MaxBytes = cfg.CacheMaxBytes
+	if cfg.CacheDiskDir != "" {
+		if cfg.CacheMaxBytes <= 0 {
+			log.Warnf("CacheDiskDir is set without CacheMaxBytes, so no segments will be spilled to disk")
+		}
+		if err := sm.segCache.SetDiskDir(cfg.CacheDiskDir); err != nil {
+			log.Errorf("Disabling the disk cache tier: %v", err)
+		}
+	}
+	if cfg.SharedDownloadWorkers > 0 {
+		log.Infof("Using a shared download pool of %d workers for all sessions", cfg.SharedDownloadWorkers)
+		sm.sharedDownloader = dash.NewDownloader(dashClient.HttpClient(), log, cfg.UserAgent, cfg.SharedDownloadWorkers)
+		sm.sharedDownloader.RateLimiter = dashClient.DownloadRateLimiter
+	}
 	return sm
 }
 
+// SetDownloaderFactory makes new sessions download through the downloaders built by factory instead of
+// starting their own dash.Downloader, e.g. to inject a fake in tests. Each session stops its downloader
+// when it ends. The factory is not used when SharedDownloadWorkers is set.
+func (sm *SessionManager) SetDownloaderFactory(factory func() Downloader) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.downloaderFactory = factory
+}
+
+// SetKeyStore makes new sessions resolve their channel's key IDs through store, so their playlists follow
+// key updates such as a rotated keys file. Without a store, sessions use the keys of their channel configuration.
+func (sm *SessionManager) SetKeyStore(store KeyStore) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.keyStore = store
+}
+
 // Start begins the background workers for the manager's components.
 func (sm *SessionManager) Start() {
 	sm.segCache.Start()
+	if sm.cfg.SessionIdleTimeout > 0 {
+		go sm.idleSessionLoop(time.Duration(sm.cfg.SessionIdleTimeout) * time.Second)
+	}
+	sm.started.Store(true)
+}
+
+// idleSessionLoop is a background goroutine that stops the sessions no client has requested for idleTimeout.
+func (sm *SessionManager) idleSessionLoop(idleTimeout time.Duration) {
+	ticker := time.NewTicker(idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sm.ctx.Done():
+			return
+		case <-ticker.C:
+			sm.stopIdleSessions(idleTimeout)
+		}
+	}
+}
+
+// stopIdleSessions stops and removes the sessions last accessed more than idleTimeout ago. Once removed,
+// a session's segments are no longer reported as active, so the cache evicts them on its next run.
+// A later request for the channel creates a new session.
+func (sm *SessionManager) stopIdleSessions(idleTimeout time.Duration) {
+	var idle []*StreamSession
+	sm.mutex.Lock()
+	for channelId, session := range sm.sessions {
+		if time.Since(session.LastAccess()) >= idleTimeout {
+			idle = append(idle, sm.removeSession(channelId))
+		}
+	}
+	sm.mutex.Unlock()
+
+	// Stopping waits for the session's downloads, so it happens outside the manager's lock.
+	for _, session := range idle {
+		sm.logger.Infof("Stopping session for channel %s after %s without requests", session.ChannelID, idleTimeout)
+		session.Stop()
+	}
+}
+
+// Ready reports whether the manager has started its background workers and can serve sessions.
+func (sm *SessionManager) Ready() bool {
+	return sm.started.Load()
+}
+
+// ProbeOrigins checks that the manifest of at least one configured channel can be fetched.
+// It returns nil on the first success, or the errors of every channel otherwise.
+func (sm *SessionManager) ProbeOrigins() error {
+	cfg := sm.config()
+	if len(cfg.Channels) == 0 {
+		return errors.New("no channels configured")
+	}
+	var errs []error
+	for i := range cfg.Channels {
+		manifestURLs := cfg.Channels[i].GetManifestURLs()
+		if len(manifestURLs) == 0 {
+			continue
+		}
+		if _, _, err := sm.dashClient.FetchAndParseMPD(manifestURLs[0], cfg.UserAgent); err != nil {
+			errs = append(errs, fmt.Errorf("channel '%s': %w", cfg.Channels[i].Id, err))
+			continue
+		}
+		return nil
+	}
+	if len(errs) == 0 {
+		return errors.New("no channel has a manifest URL")
+	}
+	return errors.Join(errs...)
 }
 
 // Stop gracefully shuts down all sessions and background workers.
 func (sm *SessionManager) Stop() {
 	sm.logger.Infof("Stopping session manager and all active sessions...")
+	sm.started.Store(false)
+	sm.cancel()
+	var active []*StreamSession
 	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
+	for channelId := range sm.sessions {
+		active = append(active, sm.removeSession(channelId))
+	}
+	sm.mutex.Unlock()
 
-	for _, session := range sm.sessions {
+	// The sessions are stopped once the lock is released, as each one waits for its downloads.
+	for _, session := range active {
 		session.Stop()
 	}
+	if sm.sharedDownloader != nil {
+		sm.sharedDownloader.Stop()
+	}
 	sm.segCache.Stop()
 	sm.logger.Infof("Session manager stopped.")
 }
 
+// ListSessions returns a summary of every active session, ordered by channel ID.
+func (sm *SessionManager) ListSessions() []SessionInfo {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	infos := make([]SessionInfo, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		session.mutex.RLock()
+		info := SessionInfo{
+			ChannelID:  session.ChannelID,
+			CreatedAt:  session.createdAt,
+			LastAccess: session.LastAccess(),
+			Segments:   make(map[string]int, len(session.availableSegments)),
+		}
+		if session.sessionTimescale > 0 {
+			info.Playhead = float64(session.currentTargetTime) / float64(session.sessionTimescale)
+		}
+		for repId, segments := range session.availableSegments {
+			info.Segments[repId] = len(segments)
+		}
+		session.mutex.RUnlock()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ChannelID < infos[j].ChannelID })
+	return infos
+}
+
+// StopSession stops a channel's session and removes it, releasing its segments. A later request for
+// the channel creates a new session. It returns false when the channel has no active session.
+func (sm *SessionManager) StopSession(channelId string) bool {
+	sm.mutex.Lock()
+	session := sm.removeSession(channelId)
+	sm.mutex.Unlock()
+
+	if session == nil {
+		return false
+	}
+	sm.logger.Infof("Stopping session for channel %s on request", channelId)
+	session.Stop()
+	return true
+}
+
+// removeSession removes a channel's session from the manager without stopping it, returning nil when
+// the channel has no session. The caller must hold the write lock.
+func (sm *SessionManager) removeSession(channelId string) *StreamSession {
+	session, found := sm.sessions[channelId]
+	if !found {
+		return nil
+	}
+	delete(sm.sessions, channelId)
+	metrics.ActiveSessions.Dec()
+	return session
+}
+
+// retireSession removes and stops a channel's session that has ended, unless the channel already has
+// another session.
+func (sm *SessionManager) retireSession(channelId string, session *StreamSession) {
+	sm.mutex.Lock()
+	if sm.sessions[channelId] == session {
+		sm.removeSession(channelId)
+	}
+	sm.mutex.Unlock()
+	sm.logger.Infof("Retiring the ended session for channel %s", channelId)
+	session.Stop()
+}
+
+// Reload swaps in a new configuration, which must already be validated. Channels added to it can be
+// played at once. The sessions of removed channels, and of channels whose settings changed, are stopped,
+// so that the next request for a changed channel creates a session with its new settings. Server-wide
+// settings that are only read at startup keep their current values until a restart.
+func (sm *SessionManager) Reload(cfg *channels.ChannelConfig) {
+	sm.mutex.Lock()
+	newCfg := *cfg
+	if newCfg.SharedDownloadWorkers != sm.cfg.SharedDownloadWorkers || newCfg.CacheMaxBytes != sm.cfg.CacheMaxBytes ||
+		newCfg.CacheDiskDir != sm.cfg.CacheDiskDir || newCfg.SessionIdleTimeout != sm.cfg.SessionIdleTimeout {
+		sm.logger.Warnf("SharedDownloadWorkers, CacheMaxBytes, CacheDiskDir and SessionIdleTimeout only change on restart")
+		newCfg.SharedDownloadWorkers = sm.cfg.SharedDownloadWorkers
+		newCfg.CacheMaxBytes = sm.cfg.CacheMaxBytes
+		newCfg.CacheDiskDir = sm.cfg.CacheDiskDir
+		newCfg.SessionIdleTimeout = sm.cfg.SessionIdleTimeout
+	}
+
+	var stale []*StreamSession
+	for channelId, session := range sm.sessions {
+		channelCfg := newCfg.FindChannel(channelId)
+		switch {
+		case channelCfg == nil:
+			sm.logger.Infof("Channel %s was removed from the configuration", channelId)
+		case !reflect.DeepEqual(*channelCfg, session.channelCfg):
+			sm.logger.Infof("Channel %s changed in the configuration", channelId)
+		default:
+			continue
+		}
+		stale = append(stale, sm.removeSession(channelId))
+	}
+	sm.cfg = &newCfg
+	sm.mutex.Unlock()
+
+	for _, session := range stale {
+		session.Stop()
+	}
+	sm.logger.Infof("Reloaded configuration with %d channels, stopping %d sessions", len(newCfg.Channels), len(stale))
+}
+
+// config returns the current configuration, which Reload may replace.
+func (sm *SessionManager) config() *channels.ChannelConfig {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	return sm.cfg
+}
+
+// GetSession returns an existing session without creating one.
+func (sm *SessionManager) GetSession(channelId string) (*StreamSession, bool) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	session, found := sm.sessions[channelId]
+	return session, found
+}
+
 // GetOrCreateSession retrieves an existing session or creates a new one.
 func (sm *SessionManager) GetOrCreateSession(channelId string) (*StreamSession, error) {
 	sm.mutex.RLock()
@@ -92,435 +491,2043 @@ func (sm *SessionManager) GetOrCreateSession(channelId string) (*StreamSession,
 	sm.mutex.RUnlock()
 
 	if found {
+		<-session.started
 		return session, nil
 	}
 
 	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
 	if session, found = sm.sessions[channelId]; found {
+		sm.mutex.Unlock()
+		<-session.started
 		return session, nil
 	}
 
-	sm.logger.Infof("No session found for channel ID: %s. Creating a new one.", channelId)
-
-	var channelCfg *channels.Channel
-	for i := range sm.cfg.Channels {
-		if sm.cfg.Channels[i].Id == channelId {
-			channelCfg = &sm.cfg.Channels[i]
-			break
+	if creation, found := sm.creating[channelId]; found {
+		sm.mutex.Unlock()
+		<-creation.done
+		if creation.err != nil {
+			return nil, creation.err
 		}
+		<-creation.session.started
+		return creation.session, nil
 	}
 
+	channelCfg := sm.cfg.FindChannel(channelId)
 	if channelCfg == nil {
+		sm.mutex.Unlock()
 		return nil, fmt.Errorf("configuration for channel ID '%s' not found", channelId)
 	}
+	sm.logger.Infof("No session found for channel ID: %s. Creating a new one.", channelId)
+
+	// Creating a session fetches the manifest and any segment indexes from the origin, so it happens
+	// outside the manager's lock. Concurrent requests for the channel wait for this creation.
+	creation := &sessionCreation{done: make(chan struct{})}
+	sm.creating[channelId] = creation
+	userAgent, factory, keys := sm.cfg.UserAgent, sm.downloaderFactory, sm.keyStore
+	sm.mutex.Unlock()
+
+	creation.session, creation.err = sm.newSession(*channelCfg, userAgent, factory, keys)
+
+	sm.mutex.Lock()
+	delete(sm.creating, channelId)
+	if creation.err == nil && sm.ctx.Err() != nil {
+		creation.session.Stop()
+		creation.session, creation.err = nil, fmt.Errorf("session manager stopped while creating the session for channel '%s'", channelId)
+	}
+	if creation.err == nil {
+		sm.sessions[channelId] = creation.session
+		metrics.ActiveSessions.Inc()
+		session := creation.session
+		session.retire = func() { sm.retireSession(channelId, session) }
+	}
+	sm.mutex.Unlock()
+	close(creation.done)
+	if creation.err != nil {
+		return nil, creation.err
+	}
+
+	// Starting waits for the init segments, so it happens outside the manager's lock too. Requests for
+	// the channel meanwhile find the session and wait for it to start.
+	creation.session.Start()
+	sm.logger.Infof("Successfully created and started new session for channel: %s (%s)", channelCfg.Name, channelId)
+	return creation.session, nil
+}
 
-	mpd, finalUrl, err := sm.dashClient.FetchAndParseMPD(channelCfg.ManifestURL, sm.cfg.UserAgent)
+// newSession creates the session of a channel from its manifest, ready to be started. Its downloader is
+// the manager's shared pool when there is one, or else built by factory, or else a new dash.Downloader.
+func (sm *SessionManager) newSession(channelCfg channels.Channel, userAgent string, factory func() Downloader, keys KeyStore) (*StreamSession, error) {
+	channelId := channelCfg.Id
+	manifestURLs := channelCfg.GetManifestURLs()
+	mpd, finalUrl, manifestIndex, err := fetchMPDWithFailover(sm.dashClient, sm.logger, manifestURLs, 0, userAgent)
 	if err != nil {
 		return nil, fmt.Errorf("failed to perform initial MPD fetch for channel '%s': %w", channelId, err)
 	}
 
+	var downloader Downloader
+	ownsDownloader := true
+	switch {
+	case sm.sharedDownloader != nil:
+		downloader, ownsDownloader = sm.sharedDownloader, false
+	case factory != nil:
+		downloader = factory()
+	default:
+		sessionDownloader := dash.NewDownloader(sm.dashClient.HttpClient(), sm.logger, userAgent, sessionDownloadWorkers)
+		sessionDownloader.RateLimiter = sm.dashClient.DownloadRateLimiter
+		downloader = sessionDownloader
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	newSession := &StreamSession{
-		ChannelID:         channelId,
-		ManifestURL:       channelCfg.ManifestURL,
-		BaseURL:           finalUrl,
-		Logger:            sm.logger,
-		MPD:               mpd,
-		Downloader:        dash.NewDownloader(sm.dashClient.HttpClient(), sm.logger, sm.cfg.UserAgent, 10), // 10 concurrent workers
-		SegCache:          sm.segCache,
-		dashClient:        sm.dashClient, // Pass the client to the session
-		availableSegments: make(map[string][]*models.Segment),
-		playlistCache:     make(map[string]string),
-		mediaSequence:     make(map[string]int),
-		resultsChan:       make(chan dash.DownloadResult, 100),
-		ctx:               ctx,
-		cancel:            cancel,
-	}
-
-	if err := newSession.initializeState(); err != nil {
-		return nil, fmt.Errorf("failed to initialize session state for channel '%s': %w", channelId, err)
+		ChannelID:           channelId,
+		ManifestURL:         manifestURLs[manifestIndex],
+		BaseURL:             finalUrl,
+		Logger:              sm.logger,
+		MPD:                 mpd,
+		Downloader:          downloader,
+		SegCache:            sm.segCache,
+		dashClient:          sm.dashClient, // Pass the client to the session
+		channelCfg:          channelCfg,
+		keys:                keys,
+		preset:              startupPresets[channelCfg.StartupPolicy],
+		windowSegments:      channelCfg.GetPlaylistWindowSegments(),
+		ownsDownloader:      ownsDownloader,
+		availableSegments:   make(map[string][]*models.Segment),
+		playlistCache:       make(map[string]Playlist),
+		deltaPlaylistCache:  make(map[string]Playlist),
+		iframePlaylistCache: make(map[string]Playlist),
+		onDemandSegments:    make(map[string]models.Segment),
+		onDemandSlots:       make(chan struct{}, channelCfg.GetMaxOnDemandFetches()),
+		onDemandFetches:     make(map[string]*onDemandFetch),
+		initRefetches:       make(map[string]int),
+		failedReps:          make(map[string]bool),
+		queuedSegments:      make(map[string]bool),
+		playlistUpdated:     make(map[string]chan struct{}),
+		playlistGenerations: make(map[string]uint64),
+		segmentPaths:        make(map[string]string),
+		mediaSequence:       make(map[string]int),
+		discontinuitySeq:    make(map[string]int),
+		resultsChan:         make(chan dash.DownloadResult, 100),
+		manifestURLs:        manifestURLs,
+		manifestIndex:       manifestIndex,
+		started:             make(chan struct{}),
+		ctx:                 ctx,
+		cancel:              cancel,
 	}
 
-	sm.sessions[channelId] = newSession
-	newSession.Start()
-	sm.logger.Infof("Successfully created and started new session for channel: %s (%s)", channelCfg.Name, channelId)
+	err = newSession.resolveSegmentBases()
+	if err == nil {
+		err = newSession.initializeState()
+	}
+	if err != nil {
+		cancel()
+		if ownsDownloader {
+			downloader.Stop()
+		}
+		return nil, fmt.Errorf("failed to initialize session state for channel '%s': %w", channelId, err)
+	}
 
+	newSession.createdAt = time.Now()
+	newSession.Touch()
 	return newSession, nil
 }
 
+// fetchMPDWithFailover fetches the MPD from each manifest URL in turn, beginning with the one at index start,
+// and returns the index of the origin that succeeded.
+func fetchMPDWithFailover(client *dash.Client, log logger.Logger, manifestURLs []string, start int, userAgent string) (*dash.MPD, string, int, error) {
+	if len(manifestURLs) == 0 {
+		return nil, "", 0, fmt.Errorf("no manifest URLs configured")
+	}
+
+	var errs []error
+	for i := 0; i < len(manifestURLs); i++ {
+		idx := (start + i) % len(manifestURLs)
+		mpd, finalUrl, err := client.FetchAndParseMPD(manifestURLs[idx], userAgent)
+		if err == nil {
+			if idx != start {
+				log.Warnf("Failed over to manifest origin %d/%d: %s", idx+1, len(manifestURLs), manifestURLs[idx])
+			}
+			return mpd, finalUrl, idx, nil
+		}
+		log.Warnf("Manifest origin %d/%d (%s) failed: %v", idx+1, len(manifestURLs), manifestURLs[idx], err)
+		errs = append(errs, err)
+	}
+	return nil, "", start, fmt.Errorf("all %d manifest origins failed: %w", len(manifestURLs), errors.Join(errs...))
+}
+
+// ActiveManifestURL returns the manifest URL of the origin the session is currently using.
+func (s *StreamSession) ActiveManifestURL() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.ManifestURL
+}
+
+// ActiveBaseURL returns the URL the active origin's manifest was finally served from, after any
+// redirects, against which segment URLs are resolved.
+func (s *StreamSession) ActiveBaseURL() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.BaseURL
+}
+
 // downloadInitialSegments queues the download for the initialization segment for all selected representations.
 func (s *StreamSession) downloadInitialSegments() {
 	s.Logger.Infof("Queueing initialization segments for session %s...", s.ChannelID)
 
+	var initSegs []models.Segment
+	s.mutex.RLock()
 	for i := range s.MPD.Periods {
 		period := &s.MPD.Periods[i]
 		for j := range period.Sets {
 			as := &period.Sets[j]
-			repsToDownload := selectRepresentations(as)
+			repsToDownload := s.representationsToDownload(as)
 
 			for _, rep := range repsToDownload {
-				initURL, err := dash.BuildInitSegmentURL(s.BaseURL, period, as, rep)
-				if err != nil {
-					s.Logger.Warnf("Failed to build init segment URL for rep %s: %v", rep.ID, err)
-					continue
-				}
-
-				cacheKey := fmt.Sprintf("%s/%s/init", s.ChannelID, rep.ID)
-				if _, found := s.SegCache.Get(cacheKey); found {
-					s.Logger.Debugf("Init segment for rep %s already in cache.", rep.ID)
-					continue
+				if initSeg, ok := s.initSegment(period, as, rep); ok {
+					initSegs = append(initSegs, initSeg)
 				}
-
-				s.Logger.Debugf("Queueing init segment for rep %s from %s", rep.ID, initURL)
-				initSeg := models.Segment{URL: initURL, ID: cacheKey, RepID: rep.ID, IsInit: true}
-				s.Downloader.QueueDownload(dash.DownloadTask{
-					Segment: initSeg,
-					Result:  s.resultsChan,
-				})
 			}
 		}
 	}
-}
+	s.mutex.RUnlock()
 
-// Start kicks off the background goroutines for the session.
-func (s *StreamSession) Start() {
-	s.Logger.Infof("Starting background loops for session %s", s.ChannelID)
-	s.downloadInitialSegments() // Queue init segments before starting loops
-	go s.downloadLoop()
-	go s.playlistLoop()
-	go s.mpdRefreshLoop()
-	go s.resultLoop()
+	for _, initSeg := range initSegs {
+		s.queueInitSegment(initSeg)
+	}
 }
 
-// Stop terminates the background goroutines for the session.
-func (s *StreamSession) Stop() {
-	s.Logger.Infof("Stopping background loops for session %s", s.ChannelID)
-	s.cancel()
-	s.Downloader.Stop()
+// initSegment builds the download of a representation's initialization segment. The caller must hold the lock.
+func (s *StreamSession) initSegment(period *dash.Period, as *dash.AdaptationSet, rep *dash.Representation) (models.Segment, bool) {
+	initURLs, err := dash.BuildInitSegmentURLs(s.BaseURL, s.MPD, period, as, rep)
+	if err != nil {
+		s.Logger.Warnf("Failed to build init segment URL for rep %s: %v", rep.ID, err)
+		return models.Segment{}, false
+	}
+	cacheKey := fmt.Sprintf("%s/%s/init", s.ChannelID, rep.ID)
+	return models.Segment{URL: initURLs[0], FallbackURLs: initURLs[1:], ID: cacheKey, RepID: rep.ID, IsInit: true, ByteRange: dash.InitSegmentRange(as, rep)}, true
 }
 
-// downloadLoop is the "producer" goroutine.
-func (s *StreamSession) downloadLoop() {
-	ticker := time.NewTicker(2 * time.Second) // Check for new segments every 2s
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-s.ctx.Done():
-			s.Logger.Infof("Download loop for %s stopped.", s.ChannelID)
+// queueInitSegment queues the download of an initialization segment built by initSegment, unless a usable
+// copy is already cached. It is called without the lock, as it reads the cache and may block on a full
+// download queue.
+func (s *StreamSession) queueInitSegment(initSeg models.Segment) {
+	cacheKey := initSeg.ID
+	var cached *dash.CachedCopy
+	if entry, found := s.SegCache.GetEntry(cacheKey); found && s.validInitSegment(cacheKey, entry.Data) {
+		if !s.channelCfg.ConditionalRequests || (entry.ETag == "" && entry.LastModified == "") {
+			s.Logger.Debugf("Init segment for rep %s already in cache.", initSeg.RepID)
 			return
-		case <-ticker.C:
-			s.downloadNextSegments()
 		}
+		// Revalidate the cached copy so a changed init segment is picked up.
+		cached = &dash.CachedCopy{Data: entry.Data, ETag: entry.ETag, LastModified: entry.LastModified}
 	}
-}
 
-func (s *StreamSession) initializeState() error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	s.Logger.Debugf("Queueing init segment for rep %s from %s", initSeg.RepID, initSeg.URL)
+	s.pendingInits.Add(1)
+	s.Downloader.QueueDownload(dash.DownloadTask{
+		Segment:  initSeg,
+		Result:   s.resultsChan,
+		Cached:   cached,
+		Priority: true,
+		Ctx:      s.ctx,
+	})
+}
 
-	var videoAS *dash.AdaptationSet
-	// Find the primary video adaptation set to use as the master clock
-	if len(s.MPD.Periods) > 0 {
-		for i, as := range s.MPD.Periods[0].Sets {
-			// Heuristic to find the main video content, excluding trick mode tracks
-			if as.ContentType == "video" {
-				isTrickMode := false
-				for _, rep := range as.Representations {
-					if strings.Contains(rep.ID, "TrickMode") {
-						isTrickMode = true
-						break
-					}
+// resolveSegmentBases reads the segment index of every SegmentBase representation from the origin
+// and records it as the representation's SegmentList, so that its segments are addressed as byte ranges
+// of the single media file like any other SegmentList entries.
+func (s *StreamSession) resolveSegmentBases() error {
+	for i := range s.MPD.Periods {
+		period := &s.MPD.Periods[i]
+		for j := range period.Sets {
+			as := &period.Sets[j]
+			for k := range as.Representations {
+				rep := &as.Representations[k]
+				base := as.GetSegmentBase(rep)
+				if base == nil || as.GetSegmentList(rep) != nil || as.GetSegmentTemplate(rep).Media != "" {
+					continue
 				}
-				if !isTrickMode {
-					videoAS = &s.MPD.Periods[0].Sets[i]
-					break
+				list, err := s.fetchSegmentIndex(period, as, rep, base)
+				if err != nil {
+					return fmt.Errorf("failed to read segment index of rep %s: %w", rep.ID, err)
 				}
+				rep.SegmentList = list
 			}
 		}
 	}
+	return nil
+}
 
-	if videoAS == nil {
-		// Fallback to the first adaptation set if no suitable video is found
-		if len(s.MPD.Periods) > 0 && len(s.MPD.Periods[0].Sets) > 0 {
-			videoAS = &s.MPD.Periods[0].Sets[0]
-			s.Logger.Warnf("No primary video adaptation set found, using first available set ('%s') for timing.", videoAS.ID)
-		} else {
-			return fmt.Errorf("no adaptation sets found in MPD")
-		}
+// fetchSegmentIndex downloads and parses the sidx box of a SegmentBase representation.
+func (s *StreamSession) fetchSegmentIndex(period *dash.Period, as *dash.AdaptationSet, rep *dash.Representation, base *dash.SegmentBase) (*dash.SegmentList, error) {
+	if base.IndexRange == "" {
+		return nil, fmt.Errorf("SegmentBase has no indexRange")
 	}
-
-	s.sessionTimescale = uint64(videoAS.SegmentTemplate.Timescale)
-	if s.sessionTimescale == 0 {
-		return fmt.Errorf("primary adaptation set has a timescale of 0")
+	fileURLs, err := dash.BuildMediaFileURLs(s.BaseURL, s.MPD, period, as, rep)
+	if err != nil {
+		return nil, err
 	}
-
-	timeline := videoAS.SegmentTemplate.Timeline.Segments
-	if len(timeline) == 0 {
-		return fmt.Errorf("primary adaptation set has no timeline information")
+	result, err := s.downloadNow(models.Segment{
+		URL:          fileURLs[0],
+		FallbackURLs: fileURLs[1:],
+		ID:           fmt.Sprintf("%s/%s/index", s.ChannelID, rep.ID),
+		RepID:        rep.ID,
+		ByteRange:    base.IndexRange,
+	})
+	if err != nil {
+		return nil, err
 	}
+	return dash.ParseSegmentIndex(base, result.Data)
+}
 
-	var maxTime uint64 = 0
-	var timeCursor uint64 = 0
-	for _, seg := range timeline {
-		if seg.T > 0 {
-			timeCursor = seg.T
-		}
-		timeCursor += uint64(seg.R+1) * seg.D
+// downloadNow downloads a segment ahead of any queued media segments and waits for the result.
+func (s *StreamSession) downloadNow(segment models.Segment) (dash.DownloadResult, error) {
+	results := make(chan dash.DownloadResult, 1)
+	s.Downloader.QueueDownload(dash.DownloadTask{Segment: segment, Result: results, Priority: true, Ctx: s.ctx})
+
+	timeout := time.NewTimer(onDemandTimeout)
+	defer timeout.Stop()
+	select {
+	case result := <-results:
+		return result, result.Error
+	case <-s.ctx.Done():
+		return dash.DownloadResult{}, s.ctx.Err()
+	case <-timeout.C:
+		return dash.DownloadResult{}, fmt.Errorf("timed out downloading segment %s", segment.ID)
 	}
-	maxTime = timeCursor
-	lastSegmentDuration := timeline[len(timeline)-1].D
+}
 
-	// Use a conservative live delay
-	liveDelay := lastSegmentDuration * 4
-	playhead := maxTime
-	if playhead > liveDelay {
-		playhead -= liveDelay
-	} else {
-		playhead = 0
-	}
-	s.currentTargetTime = playhead
+// onDemandFetch is an on-demand fetch in flight, whose result concurrent requests for the segment share.
+type onDemandFetch struct {
+	done  chan struct{} // Closed once entry or err is set
+	entry cache.Entry
+	err   error
+}
 
-	s.Logger.Infof("Initialized session state. Session timescale: %d (from AdaptationSet %s). Initial playhead time: %d", s.sessionTimescale, videoAS.ID, s.currentTargetTime)
-	return nil
+// FetchSegment downloads an on-demand segment that is not cached yet, caches it and returns it.
+// Concurrent requests for the same segment share a single fetch. It returns ErrSegmentNotOnDemand for
+// any other segment.
+func (s *StreamSession) FetchSegment(cacheKey string) (cache.Entry, error) {
+	segment, fetch, leader, err := s.joinOnDemandFetch(cacheKey)
+	if err != nil {
+		return cache.Entry{}, err
+	}
+	if !leader {
+		<-fetch.done
+		return fetch.entry, fetch.err
+	}
+	fetch.entry, fetch.err = s.fetchOnDemand(cacheKey, segment)
+	s.finishOnDemandFetch(cacheKey, fetch)
+	return fetch.entry, fetch.err
 }
 
-func (s *StreamSession) downloadNextSegments() {
+// joinOnDemandFetch returns the fetch in flight for an on-demand segment, or registers a new one, which
+// the caller leads and must finish with finishOnDemandFetch. It returns ErrSegmentNotOnDemand for any
+// other segment.
+func (s *StreamSession) joinOnDemandFetch(cacheKey string) (models.Segment, *onDemandFetch, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	segment, found := s.onDemandSegments[cacheKey]
+	if !found {
+		return models.Segment{}, nil, false, ErrSegmentNotOnDemand
+	}
+	if fetch, inFlight := s.onDemandFetches[cacheKey]; inFlight {
+		return segment, fetch, false, nil
+	}
+	fetch := &onDemandFetch{done: make(chan struct{})}
+	s.onDemandFetches[cacheKey] = fetch
+	return segment, fetch, true, nil
+}
+
+// finishOnDemandFetch hands the result of a fetch led by the caller to the requests that joined it.
+func (s *StreamSession) finishOnDemandFetch(cacheKey string, fetch *onDemandFetch) {
+	s.mutex.Lock()
+	delete(s.onDemandFetches, cacheKey)
+	s.mutex.Unlock()
+	close(fetch.done)
+}
+
+// PrefetchAfter fetches the look-ahead on-demand segments that follow one a player requested, so
+// that they are cached before the player reaches them. Prefetches only take on-demand fetch slots that
+// are free, leaving the others to player requests.
+func (s *StreamSession) PrefetchAfter(cacheKey string) {
+	var following []string
+	s.mutex.RLock()
+	if segment, found := s.onDemandSegments[cacheKey]; found {
+		listed := s.availableSegments[segment.RepID]
+		index := sort.Search(len(listed), func(i int) bool { return listed[i].Time >= segment.Time })
+		for i := index + 1; i < len(listed) && i <= index+s.lookAheadSegments(); i++ {
+			following = append(following, fmt.Sprintf("%s/%s/%s", s.ChannelID, segment.RepID, listed[i].ID))
+		}
+	}
+	s.mutex.RUnlock()
+
+	for _, key := range following {
+		if _, cached := s.SegCache.Size(key); !cached {
+			go s.prefetch(key)
+		}
+	}
+}
+
+// prefetch fetches and caches an on-demand segment if an on-demand fetch slot is free and no fetch of
+// the segment is in flight.
+func (s *StreamSession) prefetch(cacheKey string) {
+	select {
+	case s.onDemandSlots <- struct{}{}:
+	default:
+		return
+	}
+	segment, fetch, leader, err := s.joinOnDemandFetch(cacheKey)
+	if err != nil || !leader {
+		s.releaseOnDemandSlot()
+		return
+	}
+	fetch.entry, fetch.err = s.downloadOnDemand(cacheKey, segment)
+	s.finishOnDemandFetch(cacheKey, fetch)
+	if fetch.err != nil {
+		s.Logger.Debugf("Failed to prefetch segment %s: %v", cacheKey, fetch.err)
+	}
+}
+
+// fetchOnDemand downloads and caches an on-demand segment within the session's on-demand fetch limit.
+func (s *StreamSession) fetchOnDemand(cacheKey string, segment models.Segment) (cache.Entry, error) {
+	// Players asking for many uncached segments at once must not flood the origin, so fetches beyond the
+	// channel's limit wait for a slot, and are turned away if none frees up in time.
+	timeout := time.NewTimer(onDemandTimeout)
+	defer timeout.Stop()
+	select {
+	case s.onDemandSlots <- struct{}{}:
+	case <-s.ctx.Done():
+		return cache.Entry{}, s.ctx.Err()
+	case <-timeout.C:
+		return cache.Entry{}, ErrTooManyOnDemandFetches
+	}
+	return s.downloadOnDemand(cacheKey, segment)
+}
+
+// releaseOnDemandSlot frees an on-demand fetch slot.
+func (s *StreamSession) releaseOnDemandSlot() {
+	<-s.onDemandSlots
+}
+
+// downloadOnDemand downloads and caches an on-demand segment. It takes over the on-demand fetch slot the
+// caller holds, and frees it once the download is over, which may be after it stopped waiting for it.
+func (s *StreamSession) downloadOnDemand(cacheKey string, segment models.Segment) (cache.Entry, error) {
+	// A fetch that finished while the caller waited for a slot has already cached the segment.
+	if entry, cached := s.SegCache.GetEntry(cacheKey); cached {
+		s.releaseOnDemandSlot()
+		return entry, nil
+	}
+	s.Logger.Debugf("Fetching on-demand segment %s (bytes %s)", cacheKey, segment.ByteRange)
+	results := make(chan dash.DownloadResult, 1)
+	s.Downloader.QueueDownload(dash.DownloadTask{Segment: segment, Result: results, Priority: true, Ctx: s.ctx})
+
+	// The download keeps its slot until a worker is done with it, so that downloads players gave up on
+	// still count against the channel's limit, and it is cached even if nobody waits for it any more.
+	download := &onDemandFetch{done: make(chan struct{})}
+	go func() {
+		defer s.releaseOnDemandSlot()
+		defer close(download.done)
+		select {
+		case result := <-results:
+			if download.err = result.Error; download.err == nil {
+				download.entry = s.cacheEntry(result)
+				s.SegCache.SetEntry(cacheKey, download.entry)
+			}
+		case <-s.ctx.Done():
+			download.err = s.ctx.Err()
+		}
+	}()
+
+	timeout := time.NewTimer(onDemandTimeout)
+	defer timeout.Stop()
+	select {
+	case <-download.done:
+		return download.entry, download.err
+	case <-timeout.C:
+		return cache.Entry{}, fmt.Errorf("timed out downloading segment %s", segment.ID)
+	}
+}
+
+// Start kicks off the background goroutines for the session.
+func (s *StreamSession) Start() {
+	defer close(s.started)
+	s.Logger.Infof("Starting background loops for session %s", s.ChannelID)
+	s.downloadInitialSegments() // Queue init segments before starting loops
+	go s.resultLoop()
+	s.waitForInitSegments(initSegmentWait)
+	if s.IsVOD() {
+		// A static presentation never changes, so its playlists are built once and the MPD is not refreshed.
+		go s.listAllSegments()
+		return
+	}
+	go s.downloadLoop()
+	go s.playlistLoop()
+	go s.mpdRefreshLoop()
+}
+
+// Touch records a client request, which keeps the session from being stopped as idle.
+func (s *StreamSession) Touch() {
+	s.lastAccess.Store(time.Now().UnixNano())
+}
+
+// LastAccess returns when a client last requested one of the session's playlists or segments.
+func (s *StreamSession) LastAccess() time.Time {
+	return time.Unix(0, s.lastAccess.Load())
+}
+
+// MasterPlaylistMaxAge returns how long the session serves a generated master playlist before
+// generating it again.
+func (s *StreamSession) MasterPlaylistMaxAge() time.Duration {
+	return s.channelCfg.GetMasterPlaylistMaxAge()
+}
+
+// IsVOD reports whether the session proxies a static, on-demand presentation rather than a live one.
+func (s *StreamSession) IsVOD() bool {
+	return s.MPD.Type == "static"
+}
+
+// listAllSegments lists every segment of a static presentation in the playlists at once. The segments
+// are fetched when players ask for them, and prefetched a few at a time after those, rather than all
+// downloaded up front.
+func (s *StreamSession) listAllSegments() {
+	s.mutex.Lock()
+	for i := range s.MPD.Periods {
+		period := &s.MPD.Periods[i]
+		for j := range period.Sets {
+			as := &period.Sets[j]
+			for _, rep := range s.representationsToDownload(as) {
+				template := as.GetSegmentTemplate(rep)
+				for _, entry := range dash.ExpandTimeline(template.Timeline) {
+					segmentNumber, _ := dash.SegmentNumber(&template, entry.T)
+					segmentURLs, err := dash.BuildSegmentURLs(s.BaseURL, s.MPD, period, as, rep, entry.T, segmentNumber)
+					if err != nil {
+						s.Logger.Warnf("Failed to build segment URL for time %d: %v", entry.T, err)
+						continue
+					}
+
+					segment := models.Segment{
+						URL:          segmentURLs[0],
+						FallbackURLs: segmentURLs[1:],
+						ID:           fmt.Sprintf("%s/%s/%d", s.ChannelID, rep.ID, entry.T),
+						Time:         entry.T,
+						Duration:     entry.D,
+						RepID:        rep.ID,
+						PeriodID:     period.ID,
+						ByteRange:    dash.SegmentMediaRange(as, rep, segmentNumber),
+					}
+					s.onDemandSegments[segment.ID] = segment
+
+					// The ID for availableSegments should be the time, not the cache key
+					listed := segment
+					listed.ID = fmt.Sprintf("%d", entry.T)
+					s.availableSegments[rep.ID] = append(s.availableSegments[rep.ID], &listed)
+					s.listSegmentPaths(&listed)
+				}
+			}
+		}
+	}
+	segmentCount := len(s.onDemandSegments)
+	s.mutex.Unlock()
+	s.updatePlaylists()
+	s.Logger.Infof("Listed %d segments of VOD session %s", segmentCount, s.ChannelID)
+}
+
+// waitForInitSegments blocks until every queued init segment has been downloaded or has failed,
+// or until the timeout expires, so that playback can start as soon as the first playlist is served.
+func (s *StreamSession) waitForInitSegments(timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(10 * time.Millisecond)
+	defer poll.Stop()
+
+	for s.pendingInits.Load() > 0 {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-deadline.C:
+			s.Logger.Warnf("Timed out waiting for %d init segment(s) for session %s", s.pendingInits.Load(), s.ChannelID)
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+// WaitForWarmup blocks until every representation the master playlist lists in the period under the
+// playhead has a media playlist, so that players fetching the master playlist of a new session do not
+// stall on playlists that are still warming up. It returns ErrPlaylistWarmingUp if the channel's
+// warm-up timeout expires first, or ctx's error once ctx is done. Channels without a warm-up timeout
+// and VOD sessions, whose playlists are listed up front, do not wait, and neither is any representation
+// whose segments the origin does not serve.
+func (s *StreamSession) WaitForWarmup(ctx context.Context) error {
+	timeout := s.channelCfg.GetWarmupTimeout()
+	if timeout <= 0 || s.IsVOD() {
+		return nil
+	}
+	pending := s.warmupSignal()
+	if pending == nil {
+		return nil
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for ; pending != nil; pending = s.warmupSignal() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		case <-deadline.C:
+			return fmt.Errorf("%w: media playlists of channel %s are not ready after %s", ErrPlaylistWarmingUp, s.ChannelID, timeout)
+		case <-pending:
+		}
+	}
+	return nil
+}
+
+// warmupSignal returns nil once every representation selected in the period under the playhead has a media
+// playlist or has failed, and otherwise the update signal of one that is still warming up.
+func (s *StreamSession) warmupSignal() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	presentationTime := float64(s.currentTargetTime) / float64(s.sessionTimescale)
+	for i := range s.MPD.Periods {
+		if !periodActiveAt(s.MPD, i, presentationTime) {
+			continue
+		}
+		for j := range s.MPD.Periods[i].Sets {
+			for _, rep := range selectRepresentations(&s.MPD.Periods[i].Sets[j], &s.channelCfg) {
+				if _, found := s.playlistCache[rep.ID]; !found && !s.failedReps[rep.ID] {
+					return s.playlistSignal(rep.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Stop terminates the background goroutines for the session.
+func (s *StreamSession) Stop() {
+	s.Logger.Infof("Stopping background loops for session %s", s.ChannelID)
+	s.cancel()
+	if s.ownsDownloader {
+		s.Downloader.Stop()
+	}
+}
+
+// downloadLoop is the "producer" goroutine.
+func (s *StreamSession) downloadLoop() {
+	ticker := time.NewTicker(2 * time.Second) // Check for new segments every 2s
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.Logger.Infof("Download loop for %s stopped.", s.ChannelID)
+			return
+		case <-ticker.C:
+			if s.IsEnded() {
+				s.Logger.Infof("Download loop for %s stopped because the stream ended.", s.ChannelID)
+				return
+			}
+			s.downloadNextSegments()
+		}
+	}
+}
+
+func (s *StreamSession) initializeState() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var videoAS *dash.AdaptationSet
+	// Find the primary video adaptation set to use as the master clock
+	if len(s.MPD.Periods) > 0 {
+		for i, as := range s.MPD.Periods[0].Sets {
+			// Heuristic to find the main video content, excluding trick mode tracks
+			if as.ContentType == "video" {
+				isTrickModeSet := false
+				for k := range as.Representations {
+					if isTrickMode(&as.Representations[k]) {
+						isTrickModeSet = true
+						break
+					}
+				}
+				if !isTrickModeSet {
+					videoAS = &s.MPD.Periods[0].Sets[i]
+					break
+				}
+			}
+		}
+	}
+
+	if videoAS == nil && len(s.MPD.Periods) > 0 {
+		// Audio-only channels (radio) are clocked by their first audio adaptation set
+		for i, as := range s.MPD.Periods[0].Sets {
+			if as.ContentType == "audio" {
+				videoAS = &s.MPD.Periods[0].Sets[i]
+				s.Logger.Infof("No video adaptation set found, treating the stream as audio-only and using AdaptationSet '%s' for timing.", videoAS.ID)
+				break
+			}
+		}
+	}
+
+	if videoAS == nil {
+		// Fallback to the first adaptation set if no suitable video or audio is found
+		if len(s.MPD.Periods) > 0 && len(s.MPD.Periods[0].Sets) > 0 {
+			videoAS = &s.MPD.Periods[0].Sets[0]
+			s.Logger.Warnf("No primary video adaptation set found, using first available set ('%s') for timing.", videoAS.ID)
+		} else {
+			return fmt.Errorf("no adaptation sets found in MPD")
+		}
+	}
+	s.clockContentType = videoAS.ContentType
+
+	// Resolve the clock from the most specific template: the representation we will actually download.
+	var clockRep *dash.Representation
+	if reps := selectRepresentations(videoAS, &s.channelCfg); len(reps) > 0 {
+		clockRep = reps[0]
+	} else if len(videoAS.Representations) > 0 {
+		clockRep = &videoAS.Representations[0]
+	}
+	template := videoAS.GetSegmentTemplate(clockRep)
+
+	s.sessionTimescale = uint64(template.Timescale)
+	if s.sessionTimescale == 0 {
+		return fmt.Errorf("primary adaptation set has a timescale of 0")
+	}
+
+	timeline := template.Timeline.Segments
+	if len(timeline) == 0 {
+		return fmt.Errorf("primary adaptation set has no timeline information")
+	}
+
+	var maxTime uint64 = 0
+	var timeCursor uint64 = 0
+	for _, seg := range timeline {
+		if t, ok := seg.Start(); ok {
+			timeCursor = t
+		}
+		timeCursor += uint64(seg.R+1) * seg.D
+	}
+	maxTime = timeCursor
+	lastSegmentDuration := timeline[len(timeline)-1].D
+
+	// The playhead is a presentation time, which downloadNextSegments maps back to each representation's
+	// media time, so the clock's media time is shifted by its presentationTimeOffset and its period's start
+	// the opposite way. Otherwise a period starting later than the presentation would start the playhead early.
+	periodStart, err := s.MPD.Periods[0].GetStart()
+	if err != nil {
+		return fmt.Errorf("invalid start time for period %s: %w", s.MPD.Periods[0].ID, err)
+	}
+	if clockRep != nil {
+		maxTime -= min(clockRep.PresentationTimeOffset, maxTime)
+	}
+	maxTime += rescaleTime(uint64(periodStart), uint64(time.Second), s.sessionTimescale)
+
+	liveDelay := s.liveDelay(lastSegmentDuration)
+	playhead := maxTime
+	if playhead > liveDelay {
+		playhead -= liveDelay
+	} else {
+		playhead = 0
+	}
+	s.currentTargetTime = playhead
+
+	s.warnUnsupportedRepresentations()
+	s.validateKeyID()
+	s.Logger.Infof("Initialized session state. Session timescale: %d (from AdaptationSet %s). Initial playhead time: %d", s.sessionTimescale, videoAS.ID, s.currentTargetTime)
+	return nil
+}
+
+// liveDelay returns how far behind the live edge a new session starts, in the session timescale:
+// the channel's LiveDelaySeconds, or else the startup policy's number of segments of the given duration.
+// The delay is clamped so that the first segment is still within the MPD's timeShiftBufferDepth.
+func (s *StreamSession) liveDelay(lastSegmentDuration uint64) uint64 {
+	delay := lastSegmentDuration * uint64(s.preset.liveDelaySegments)
+	if s.channelCfg.LiveDelaySeconds > 0 {
+		delay = uint64(s.channelCfg.LiveDelaySeconds) * s.sessionTimescale
+	}
+	if depth, err := s.MPD.GetTimeShiftBufferDepth(); err == nil && depth > 0 {
+		maxDelay := uint64(depth.Seconds() * float64(s.sessionTimescale))
+		maxDelay -= min(lastSegmentDuration, maxDelay)
+		if delay > maxDelay {
+			s.Logger.Warnf("Live delay of %.3fs for channel %s exceeds the time shift buffer of %s, clamping it to %.3fs",
+				float64(delay)/float64(s.sessionTimescale), s.ChannelID, depth, float64(maxDelay)/float64(s.sessionTimescale))
+			delay = maxDelay
+		}
+	}
+	s.Logger.Infof("Starting channel %s %.3fs behind the live edge", s.ChannelID, float64(delay)/float64(s.sessionTimescale))
+	return delay
+}
+
+func (s *StreamSession) downloadNextSegments() {
+	// The MPD is walked under the read lock, since refreshMPD merges into it in place, and the
+	// segments found are queued once the lock is released, since queueing may block.
+	var segments []models.Segment
+	defer func() {
+		for _, segment := range segments {
+			s.queueMediaSegment(segment, false)
+		}
+	}()
+
 	s.mutex.RLock()
 	targetTime := s.currentTargetTime
 	sessionTimescale := s.sessionTimescale
+	clockContentType := s.clockContentType
 	mpd := s.MPD
-	s.mutex.RUnlock()
+	bufferDepth := s.timeShiftBufferDepth()
 
 	if sessionTimescale == 0 {
+		s.mutex.RUnlock()
 		s.Logger.Errorf("Session timescale is 0, cannot download segments.")
 		time.Sleep(2 * time.Second) // Avoid busy-looping if state is bad
 		return
 	}
 
-	var videoSegmentDuration uint64
+	var clockSegmentDuration, clockSkip uint64
 
 	for i := range mpd.Periods {
 		period := &mpd.Periods[i]
+		if !periodActiveAt(mpd, i, float64(targetTime)/float64(sessionTimescale)) {
+			continue
+		}
 		for j := range period.Sets {
 			as := &period.Sets[j]
-			repsToDownload := selectRepresentations(as)
+			repsToDownload := s.representationsToDownload(as)
 
-			repTimescale := uint64(as.SegmentTemplate.Timescale)
-			if repTimescale == 0 {
-				s.Logger.Warnf("Skipping AdaptationSet with ID %s because its timescale is 0", as.ID)
+			if len(repsToDownload) == 0 {
 				continue
 			}
 
-			if len(repsToDownload) == 0 {
+			periodStart, err := period.GetStart()
+			if err != nil {
+				s.Logger.Warnf("Invalid period start time for period %s: %v", period.ID, err)
 				continue
 			}
 
-			periodStart, err := period.GetStart()
-			if err != nil {
-				s.Logger.Warnf("Invalid period start time for period %s: %v", period.ID, err)
-				continue
-			}
+			for _, rep := range repsToDownload {
+				// Representations may carry their own template, so timing is resolved per representation.
+				template := as.GetSegmentTemplate(rep)
+				repTimescale := uint64(template.Timescale)
+				if repTimescale == 0 {
+					s.Logger.Warnf("Skipping representation %s in AdaptationSet %s because its timescale is 0", rep.ID, as.ID)
+					continue
+				}
+
+				// Convert the playhead to the representation's own timescale in integer arithmetic, so that
+				// a playhead on a segment boundary does not round down into the previous segment.
+				targetTimeForRep := rescaleTime(targetTime, sessionTimescale, repTimescale) + rep.PresentationTimeOffset
+				if periodStartForRep := rescaleTime(uint64(periodStart), uint64(time.Second), repTimescale); targetTimeForRep > periodStartForRep {
+					targetTimeForRep -= periodStartForRep
+				} else {
+					targetTimeForRep = 0
+				}
+
+				// Segments that fell out of the origin's time shift buffer are no longer served, so a
+				// lagging playhead skips ahead to the oldest segment still available.
+				if oldest := oldestAvailableTime(template.Timeline, bufferDepth, repTimescale); targetTimeForRep < oldest {
+					s.Logger.Warnf("Playhead of rep %s in session %s is %.3fs behind the time shift buffer, skipping ahead",
+						rep.ID, s.ChannelID, float64(oldest-targetTimeForRep)/float64(repTimescale))
+					if as.ContentType == clockContentType && !isTrickMode(rep) {
+						clockSkip = rescaleTime(oldest-targetTimeForRep, repTimescale, sessionTimescale)
+					}
+					targetTimeForRep = oldest
+				}
+
+				targetSegmentTime, targetSegmentDuration := findSegmentTimeForPlayhead(template.Timeline, targetTimeForRep)
+				if targetSegmentDuration == 0 {
+					s.Logger.Debugf("No segment found for time %d in representation %s", targetTimeForRep, rep.ID)
+					continue
+				}
+
+				if as.ContentType == clockContentType && !isTrickMode(rep) {
+					// The playhead advances in session timescale units.
+					clockSegmentDuration = rescaleTime(targetSegmentDuration, repTimescale, sessionTimescale)
+				}
+
+				// Queue the segment under the playhead and the look-ahead after it.
+				segmentTime, segmentDuration := targetSegmentTime, targetSegmentDuration
+				for k := 0; k <= s.lookAheadSegments(); k++ {
+					if k > 0 {
+						nextTime := segmentTime + segmentDuration
+						var ok bool
+						segmentTime, segmentDuration, ok = dash.FindSegment(template.Timeline, nextTime)
+						if !ok || segmentTime < nextTime {
+							break // Reached the live edge
+						}
+					}
+					segment, err := s.mediaSegment(mpd, period, as, rep, &template, segmentTime, segmentDuration)
+					if err != nil {
+						s.Logger.Warnf("%v", err)
+						continue
+					}
+					segments = append(segments, segment)
+				}
+			}
+		}
+	}
+	s.mutex.RUnlock()
+
+	if advance := clockSkip + clockSegmentDuration; advance > 0 {
+		s.mutex.Lock()
+		s.currentTargetTime += advance
+		s.mutex.Unlock()
+		s.Logger.Debugf("Advanced session playhead by %d to %d", advance, s.currentTargetTime)
+	}
+}
+
+// timeShiftBufferDepth returns how far back from the live edge the origin serves segments, or zero when
+// the MPD does not bound it, as for VOD. The caller must hold the lock.
+func (s *StreamSession) timeShiftBufferDepth() time.Duration {
+	if s.IsVOD() {
+		return 0
+	}
+	depth, err := s.MPD.GetTimeShiftBufferDepth()
+	if err != nil || depth < 0 {
+		return 0
+	}
+	return depth
+}
+
+// lookAheadSegments returns how many segments after the playhead a session queues for each representation:
+// the channel's LookAheadSegments or, when it is unset, the StartupPolicy's prefetch depth.
+func (s *StreamSession) lookAheadSegments() int {
+	if s.channelCfg.LookAheadSegments == 0 {
+		return s.preset.prefetchSegments - 1 // The preset counts the segment under the playhead
+	}
+	return max(s.channelCfg.LookAheadSegments, 0)
+}
+
+// oldestAvailableTime returns the earliest media time of a timeline that is still within a time shift
+// buffer of the given depth, measured back from the end of the timeline, or zero for an unbounded buffer.
+func oldestAvailableTime(timeline dash.SegmentTimeline, depth time.Duration, timescale uint64) uint64 {
+	if depth <= 0 {
+		return 0
+	}
+	end := dash.TimelineEnd(timeline)
+	depthInTimescale := rescaleTime(uint64(depth), uint64(time.Second), timescale)
+	if end <= depthInTimescale {
+		return 0
+	}
+	return end - depthInTimescale
+}
+
+// expireSegments drops the leading segments of a representation in a period that ended before oldest,
+// since the origin no longer serves them, advancing the media sequence past them. The caller must hold the lock.
+func (s *StreamSession) expireSegments(repId, periodId string, oldest uint64) {
+	segs := s.availableSegments[repId]
+	expired := 0
+	for expired < len(segs) && segs[expired].PeriodID == periodId && segs[expired].Time+segs[expired].Duration <= oldest {
+		expired++
+	}
+	if expired == 0 {
+		return
+	}
+	s.discontinuitySeq[repId] += countDiscontinuities(segs[:min(expired+1, len(segs))])
+	s.unlistSegmentPaths(segs[:expired])
+	s.availableSegments[repId] = segs[expired:]
+	s.mediaSequence[repId] += expired + hls.CountMissingSegments(segs[:min(expired+1, len(segs))])
+	s.Logger.Debugf("Dropped %d segments of rep %s that left the time shift buffer", expired, repId)
+}
+
+// mediaSegment returns the media segment of rep starting at segmentTime, with its origin URLs.
+// The caller must hold the lock, since the URLs are resolved against the session's MPD and BaseURL.
+func (s *StreamSession) mediaSegment(mpd *dash.MPD, period *dash.Period, as *dash.AdaptationSet, rep *dash.Representation, template *dash.SegmentTemplate, segmentTime, segmentDuration uint64) (models.Segment, error) {
+	// Only needed by $Number$ templates, but cheap enough to always compute.
+	segmentNumber, _ := dash.SegmentNumber(template, segmentTime)
+
+	segmentURLs, err := dash.BuildSegmentURLs(s.BaseURL, mpd, period, as, rep, segmentTime, segmentNumber)
+	if err != nil {
+		return models.Segment{}, fmt.Errorf("failed to build segment URL for time %d: %w", segmentTime, err)
+	}
+	return models.Segment{
+		URL:          segmentURLs[0],
+		FallbackURLs: segmentURLs[1:],
+		ID:           fmt.Sprintf("%s/%s/%d", s.ChannelID, rep.ID, segmentTime),
+		Time:         segmentTime,
+		Duration:     segmentDuration,
+		RepID:        rep.ID,
+		PeriodID:     period.ID,
+		ByteRange:    dash.SegmentMediaRange(as, rep, segmentNumber),
+	}, nil
+}
+
+// queueMediaSegment queues a media segment for download unless it is already cached or queued.
+// A priority segment is downloaded ahead of the regular queue. The caller must not hold the lock.
+func (s *StreamSession) queueMediaSegment(segment models.Segment, priority bool) {
+	cacheKey := segment.ID
+	if _, found := s.SegCache.Get(cacheKey); found {
+		return // Already downloaded
+	}
+
+	s.mutex.Lock()
+	if s.queuedSegments[cacheKey] {
+		s.mutex.Unlock()
+		return // Already on its way
+	}
+	s.queuedSegments[cacheKey] = true
+	s.mutex.Unlock()
+
+	s.Logger.Debugf("Queueing media segment for rep %s, time %d", segment.RepID, segment.Time)
+	s.Downloader.QueueDownload(dash.DownloadTask{
+		Segment:  segment,
+		Result:   s.resultsChan,
+		Priority: priority,
+		Ctx:      s.ctx,
+	})
+}
+
+// warnUnsupportedRepresentations logs every representation that selectRepresentations will exclude
+// because of its codecs, so the omission from the master playlist is explained once per session.
+func (s *StreamSession) warnUnsupportedRepresentations() {
+	for _, period := range s.MPD.Periods {
+		for j := range period.Sets {
+			as := &period.Sets[j]
+			for i := range as.Representations {
+				rep := &as.Representations[i]
+				if unsupported := dash.UnsupportedCodecs(as.GetCodecs(rep)); len(unsupported) > 0 {
+					s.Logger.Warnf("Excluding representation %s (%s) of session %s: unsupported codecs %v (segment profiles: %q)",
+						rep.ID, as.ContentType, s.ChannelID, unsupported, as.GetSegmentProfiles(rep))
+				}
+			}
+		}
+	}
+}
+
+// channelKeys returns the channel's current keys, from the key store when one is set.
+func (s *StreamSession) channelKeys() channels.Channel {
+	if s.keys != nil {
+		if keyed, found := s.keys.ChannelKeys(s.ChannelID); found {
+			return keyed
+		}
+	}
+	return s.channelCfg
+}
+
+// validateKeyID warns when none of the channel's configured key IDs is one the manifest says the stream is encrypted with.
+func (s *StreamSession) validateKeyID() {
+	keyed := s.channelKeys()
+	manifestKIDs := s.MPD.GetDefaultKIDs()
+	if len(keyed.KID) == 0 || len(manifestKIDs) == 0 {
+		return
+	}
+	for _, kid := range manifestKIDs {
+		if _, found := keyed.GetKeyForKID(kid); found {
+			return
+		}
+	}
+	s.Logger.Warnf("Configured key ID %x for session %s does not match any default_KID in the manifest (%x); playback will likely fail",
+		keyed.KID, s.ChannelID, manifestKIDs)
+}
+
+// keyIDFor returns the key ID that playlists of a representation request their key with. It is only set
+// for channels with several keys, to the representation's default_KID when a key is configured for it.
+func (s *StreamSession) keyIDFor(as *dash.AdaptationSet, rep *dash.Representation) []byte {
+	keyed := s.channelKeys()
+	if len(keyed.Keys) < 2 {
+		return nil
+	}
+	kid, err := dash.ParseKID(as.GetDefaultKID(rep))
+	if err != nil {
+		return nil
+	}
+	if _, found := keyed.GetKeyForKID(kid); !found {
+		return nil
+	}
+	return kid
+}
+
+// selectRepresentations applies the stream selection logic from the design document.
+// Representations whose codecs cannot be served to HLS players are never selected. Video representations
+// follow the channel's VideoLadder and are returned best first.
+func selectRepresentations(as *dash.AdaptationSet, channelCfg *channels.Channel) []*dash.Representation {
+	var selected []*dash.Representation
+
+	switch as.ContentType {
+	case "video":
+		for i := range as.Representations {
+			rep := &as.Representations[i]
+			// Trick mode tracks are served as I-frame playlists, see selectTrickModeRepresentations.
+			if isTrickMode(rep) {
+				continue
+			}
+			if !dash.IsSupportedCodec(as.GetCodecs(rep)) {
+				continue
+			}
+			selected = append(selected, rep)
+		}
+		sort.SliceStable(selected, func(i, j int) bool {
+			return betterQuality(selected[i], selected[j])
+		})
+		selected = selectVideoLadder(applyQualityCaps(selected, channelCfg), channelCfg)
+	case "audio", "text":
+		// Select all available audio and text tracks that players can decode
+		for i := range as.Representations {
+			if dash.IsSupportedCodec(as.GetCodecs(&as.Representations[i])) {
+				selected = append(selected, &as.Representations[i])
+			}
+		}
+		// Keep manifest order unless qualityRanking says otherwise.
+		sort.SliceStable(selected, func(i, j int) bool {
+			return selected[i].RanksBefore(selected[j])
+		})
+	}
+	return selected
+}
+
+// applyQualityCaps drops the video representations, sorted best first, that exceed the channel's
+// MaxWidth, MaxHeight or MaxBandwidth. A representation without dimensions is never dropped for them.
+// When every representation exceeds the caps, the one with the lowest bandwidth is kept so the channel
+// still plays.
+func applyQualityCaps(candidates []*dash.Representation, channelCfg *channels.Channel) []*dash.Representation {
+	if len(candidates) == 0 {
+		return nil
+	}
+	var capped []*dash.Representation
+	for _, rep := range candidates {
+		if channelCfg.MaxWidth > 0 && rep.Width > channelCfg.MaxWidth ||
+			channelCfg.MaxHeight > 0 && rep.Height > channelCfg.MaxHeight ||
+			channelCfg.MaxBandwidth > 0 && rep.Bandwidth > channelCfg.MaxBandwidth {
+			continue
+		}
+		capped = append(capped, rep)
+	}
+	if len(capped) == 0 {
+		// The best-first order follows qualityRanking where the MPD has one, so the last representation
+		// is not necessarily the lightest.
+		lowest := slices.MinFunc(candidates, func(a, b *dash.Representation) int {
+			return cmp.Compare(a.Bandwidth, b.Bandwidth)
+		})
+		return []*dash.Representation{lowest}
+	}
+	return capped
+}
+
+// selectVideoLadder narrows the decodable video representations of a set, sorted best first, to the
+// channel's ladder. A list matching none of the set's representations falls back to the best one.
+func selectVideoLadder(candidates []*dash.Representation, channelCfg *channels.Channel) []*dash.Representation {
+	if len(candidates) == 0 {
+		return nil
+	}
+	switch channelCfg.VideoLadder {
+	case channels.VideoLadderAll:
+		if channelCfg.MaxVideoVariants > 0 && len(candidates) > channelCfg.MaxVideoVariants {
+			return candidates[:channelCfg.MaxVideoVariants]
+		}
+		return candidates
+	case channels.VideoLadderList:
+		var listed []*dash.Representation
+		for _, rep := range candidates {
+			if slices.Contains(channelCfg.VideoRepresentations, rep.ID) {
+				listed = append(listed, rep)
+			}
+		}
+		if len(listed) > 0 {
+			return listed
+		}
+	}
+	return candidates[:1]
+}
+
+// isTrickMode reports whether a representation is a trick mode track, holding only the I-frames
+// used for scrubbing. A simple way to identify them; a more robust method might check for specific
+// roles or other metadata.
+func isTrickMode(rep *dash.Representation) bool {
+	return strings.Contains(rep.ID, "TrickMode")
+}
+
+// selectTrickModeRepresentations returns the trick mode track of a video AdaptationSet to serve as an
+// I-frame playlist: the best one players can decode, or none.
+func selectTrickModeRepresentations(as *dash.AdaptationSet) []*dash.Representation {
+	if as.ContentType != "video" {
+		return nil
+	}
+	var bestRep *dash.Representation
+	for i := range as.Representations {
+		rep := &as.Representations[i]
+		if !isTrickMode(rep) || !dash.IsSupportedCodec(as.GetCodecs(rep)) {
+			continue
+		}
+		if bestRep == nil || betterQuality(rep, bestRep) {
+			bestRep = rep
+		}
+	}
+	if bestRep == nil {
+		return nil
+	}
+	return []*dash.Representation{bestRep}
+}
+
+// betterQuality reports whether a should be preferred over b. qualityRanking decides first, ranked
+// representations coming before unranked ones, with bandwidth as the tiebreaker.
+func betterQuality(a, b *dash.Representation) bool {
+	if a.RanksBefore(b) || b.RanksBefore(a) {
+		return a.RanksBefore(b)
+	}
+	return a.Bandwidth > b.Bandwidth
+}
+
+// representationsToDownload returns the representations of an AdaptationSet the session downloads:
+// those picked by selectRepresentations and selectTrickModeRepresentations, plus any video
+// representation pinned by a client.
+func (s *StreamSession) representationsToDownload(as *dash.AdaptationSet) []*dash.Representation {
+	selected := append(selectRepresentations(as, &s.channelCfg), selectTrickModeRepresentations(as)...)
+
+	s.pinMutex.Lock()
+	defer s.pinMutex.Unlock()
+	if len(s.pinnedReps) == 0 {
+		return selected
+	}
+	for i := range as.Representations {
+		rep := &as.Representations[i]
+		if _, pinned := s.pinnedReps[rep.ID]; !pinned || slices.Contains(selected, rep) {
+			continue
+		}
+		selected = append(selected, rep)
+	}
+	return selected
+}
+
+// periodActiveAt reports whether the i-th period is the one playing at the given presentation time in seconds.
+// The first period is always considered started, and a period ends once the next one begins.
+func periodActiveAt(mpd *dash.MPD, i int, presentationTime float64) bool {
+	start, err := mpd.Periods[i].GetStart()
+	if err != nil {
+		return true // Reported by the caller
+	}
+	if i > 0 && presentationTime < start.Seconds() {
+		return false
+	}
+	if i+1 < len(mpd.Periods) {
+		next, err := mpd.Periods[i+1].GetStart()
+		if err == nil && next > start && presentationTime >= next.Seconds() {
+			return false
+		}
+	}
+	return true
+}
+
+// countDiscontinuities returns the number of period boundaries between consecutive segments.
+func countDiscontinuities(segments []*models.Segment) int {
+	count := 0
+	for i := 1; i < len(segments); i++ {
+		if hls.IsDiscontinuous(segments[i-1], segments[i]) {
+			count++
+		}
+	}
+	return count
+}
+
+// rescaleTime converts t from one timescale to another, rounding down, without overflowing
+// for large media times at large timescales.
+func rescaleTime(t, from, to uint64) uint64 {
+	hi, lo := bits.Mul64(t, to)
+	if hi >= from {
+		return math.MaxUint64 // The result does not fit in 64 bits
+	}
+	quotient, _ := bits.Div64(hi, lo, from)
+	return quotient
+}
+
+// findSegmentTimeForPlayhead finds the time and duration of the segment for the current playhead.
+func findSegmentTimeForPlayhead(timeline dash.SegmentTimeline, playheadTime uint64) (uint64, uint64) {
+	start, duration, _ := dash.FindSegment(timeline, playheadTime)
+	return start, duration
+}
+
+// playlistLoop is the "publisher" goroutine.
+func (s *StreamSession) playlistLoop() {
+	ticker := time.NewTicker(1 * time.Second) // Regenerate playlist every second
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.Logger.Infof("Playlist loop for %s stopped.", s.ChannelID)
+			return
+		case <-ticker.C:
+			s.updatePlaylists()
+		}
+	}
+}
+
+func (s *StreamSession) updatePlaylists() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, repId := range s.expirePins() {
+		s.forgetPinnedRepresentation(repId)
+	}
+
+	bufferDepth := s.timeShiftBufferDepth()
+	for i := range s.MPD.Periods {
+		period := &s.MPD.Periods[i]
+		for j := range period.Sets {
+			as := &period.Sets[j]
+			for k := range as.Representations {
+				rep := &as.Representations[k]
+				if bufferDepth > 0 {
+					template := as.GetSegmentTemplate(rep)
+					s.expireSegments(rep.ID, period.ID, oldestAvailableTime(template.Timeline, bufferDepth, uint64(template.Timescale)))
+				}
+				availableSegs := s.availableSegments[rep.ID]
+				if len(availableSegs) == 0 {
+					continue
+				}
+				if _, served := s.playlistCache[rep.ID]; !served && len(availableSegs) < s.preset.minBufferSegments && !s.IsVOD() {
+					continue // Still buffering before the first playlist
+				}
+
+				// Keep only the last few segments for the live playlist, counting the
+				// segments, gaps and discontinuities that fall before the window.
+				mediaSequence, discontinuitySeq := s.mediaSequence[rep.ID], s.discontinuitySeq[rep.ID]
+				if len(availableSegs) > s.windowSegments && !s.IsVOD() {
+					trimmed := len(availableSegs) - s.windowSegments
+					mediaSequence += trimmed + hls.CountMissingSegments(availableSegs[:trimmed+1])
+					discontinuitySeq += countDiscontinuities(availableSegs[:trimmed+1])
+					availableSegs = availableSegs[trimmed:]
+				}
+				if s.channelCfg.TimelineDurations {
+					availableSegs = s.withTimelineDurations(rep.ID, availableSegs)
+				}
+
+				keyInfo := hls.KeyInfo{
+					Method:       s.channelCfg.EncryptionMethod,
+					IV:           s.channelCfg.IV,
+					PerSegmentIV: s.channelCfg.DeriveSegmentIV,
+					KID:          s.keyIDFor(as, rep),
+					URITemplate:  s.channelCfg.KeyURITemplate,
+					ChannelKID:   s.channelKeys().KID,
+				}
+				if isTrickMode(rep) {
+					s.updateIFramePlaylist(rep, keyInfo, mediaSequence, discontinuitySeq, availableSegs)
+					continue
+				}
+				opts := hls.MediaPlaylistOptions{
+					TargetDuration:        s.channelCfg.TargetDuration,
+					MediaSequence:         mediaSequence,
+					DiscontinuitySequence: discontinuitySeq,
+					Ended:                 s.ended,
+					AllowCache:            s.channelCfg.LegacyAllowCache,
+				}
+				playlist, err := hls.GenerateMediaPlaylist(s.MPD, s.ChannelID, as.ContentType, rep.ID, keyInfo, availableSegs, opts)
+				if err != nil {
+					s.Logger.Warnf("Failed to generate media playlist for rep %s: %v", rep.ID, err)
+					continue
+				}
+				s.playlistCache[rep.ID] = NewPlaylist(playlist)
+				s.notifyPlaylistUpdated(rep.ID)
+
+				if !s.IsVOD() {
+					opts.DeltaUpdate = true
+					delta, err := hls.GenerateMediaPlaylist(s.MPD, s.ChannelID, as.ContentType, rep.ID, keyInfo, availableSegs, opts)
+					if err != nil {
+						s.Logger.Warnf("Failed to generate delta media playlist for rep %s: %v", rep.ID, err)
+						continue
+					}
+					s.deltaPlaylistCache[rep.ID] = NewPlaylist(delta)
+				}
+			}
+		}
+	}
+}
+
+// WaitForPlaylist returns the playlist from get, one of the session's getters for a playlist of repId. While
+// get reports ErrPlaylistWarmingUp, it waits for the representation's playlists to be regenerated and tries
+// again, until ctx is done or the session stops, when the last error is returned. get is always tried
+// once, even if ctx is already done.
+func (s *StreamSession) WaitForPlaylist(ctx context.Context, repId string, get func() (Playlist, error)) (Playlist, error) {
+	for {
+		// Note the generation before trying, so that a regeneration in between is not missed.
+		s.mutex.RLock()
+		generation := s.playlistGenerations[repId]
+		s.mutex.RUnlock()
+		playlist, err := get()
+		if !errors.Is(err, ErrPlaylistWarmingUp) || ctx.Err() != nil {
+			return playlist, err
+		}
+		updated := s.playlistUpdatedSignal(repId, generation)
+		if updated == nil {
+			return playlist, err
+		}
+		select {
+		case <-ctx.Done():
+			return playlist, err
+		case <-s.ctx.Done():
+			return playlist, err
+		case <-updated:
+		}
+	}
+}
+
+// closedSignal is an already closed channel, for signals that have already fired.
+var closedSignal = func() chan struct{} {
+	signal := make(chan struct{})
+	close(signal)
+	return signal
+}()
+
+// playlistUpdatedSignal returns a channel that is closed the next time a playlist of repId is regenerated,
+// or that is already closed if it was regenerated since generation. It returns nil for a representation
+// the MPD does not have, which would never be signalled.
+func (s *StreamSession) playlistUpdatedSignal(repId string, generation uint64) <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.playlistGenerations[repId] != generation {
+		return closedSignal
+	}
+	if !s.representationExists(repId) {
+		return nil
+	}
+	return s.playlistSignal(repId)
+}
+
+// playlistSignal returns the channel closed the next time the requests waiting for a playlist of repId are
+// woken. The caller must hold the write lock.
+func (s *StreamSession) playlistSignal(repId string) <-chan struct{} {
+	updated, found := s.playlistUpdated[repId]
+	if !found {
+		updated = make(chan struct{})
+		s.playlistUpdated[repId] = updated
+	}
+	return updated
+}
+
+// notifyPlaylistUpdated wakes the requests waiting for a playlist of repId. The caller must hold the lock.
+func (s *StreamSession) notifyPlaylistUpdated(repId string) {
+	s.playlistGenerations[repId]++
+	s.wakePlaylistWaiters(repId)
+}
+
+// wakePlaylistWaiters wakes the requests waiting for a playlist of repId, which check again whether it is
+// ready. The caller must hold the write lock.
+func (s *StreamSession) wakePlaylistWaiters(repId string) {
+	if updated, found := s.playlistUpdated[repId]; found {
+		close(updated)
+		delete(s.playlistUpdated, repId)
+	}
+}
+
+// markRepresentationFailed records that the origin does not serve a representation's segments, so that
+// warm-up stops waiting for its playlist.
+func (s *StreamSession) markRepresentationFailed(repId string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.failedReps[repId] {
+		s.failedReps[repId] = true
+		s.wakePlaylistWaiters(repId)
+	}
+}
+
+// withTimelineDurations returns copies of a representation's segments with their durations looked up in
+// the current timeline of their period. A segment the timeline no longer lists keeps its recorded
+// duration. The caller must hold the lock.
+func (s *StreamSession) withTimelineDurations(repId string, segments []*models.Segment) []*models.Segment {
+	corrected := make([]*models.Segment, len(segments))
+	for i, seg := range segments {
+		corrected[i] = seg
+		template, found := s.segmentTemplate(seg.PeriodID, repId)
+		if !found {
+			continue
+		}
+		start, duration, ok := dash.FindSegment(template.Timeline, seg.Time)
+		if !ok || start != seg.Time || duration == seg.Duration {
+			continue
+		}
+		segCopy := *seg
+		segCopy.Duration = duration
+		corrected[i] = &segCopy
+	}
+	return corrected
+}
+
+// segmentTemplate returns the effective segment template of a representation in a period.
+// The caller must hold the lock.
+func (s *StreamSession) segmentTemplate(periodId, repId string) (dash.SegmentTemplate, bool) {
+	for i := range s.MPD.Periods {
+		period := &s.MPD.Periods[i]
+		if period.ID != periodId {
+			continue
+		}
+		for j := range period.Sets {
+			as := &period.Sets[j]
+			for k := range as.Representations {
+				if as.Representations[k].ID == repId {
+					return as.GetSegmentTemplate(&as.Representations[k]), true
+				}
+			}
+		}
+	}
+	return dash.SegmentTemplate{}, false
+}
+
+// updateIFramePlaylist regenerates the I-frame playlist of a trick mode representation. The caller must hold the lock.
+func (s *StreamSession) updateIFramePlaylist(rep *dash.Representation, keyInfo hls.KeyInfo, mediaSequence, discontinuitySeq int, availableSegs []*models.Segment) {
+	sizes := make(map[string]int, len(availableSegs))
+	for _, seg := range availableSegs {
+		if size, found := s.SegCache.Size(fmt.Sprintf("%s/%s/%s", s.ChannelID, rep.ID, seg.ID)); found {
+			sizes[seg.ID] = size
+		}
+	}
+	playlist, err := hls.GenerateIFramePlaylist(s.MPD, s.ChannelID, rep.ID, keyInfo,
+		s.channelCfg.TargetDuration, mediaSequence, discontinuitySeq, s.ended, availableSegs, sizes)
+	if err != nil {
+		s.Logger.Warnf("Failed to generate I-frame playlist for rep %s: %v", rep.ID, err)
+		return
+	}
+	s.iframePlaylistCache[rep.ID] = NewPlaylist(playlist)
+	s.notifyPlaylistUpdated(rep.ID)
+}
+
+// GetMasterPlaylist returns the master playlist. The generated playlist is reused until it is older than
+// the channel's MasterPlaylistMaxAge or an MPD refresh changes the set of representations.
+func (s *StreamSession) GetMasterPlaylist() (string, error) {
+	playlist, err := s.GetMasterPlaylistEntry()
+	return playlist.Body, err
+}
+
+// GetMasterPlaylistEntry is GetMasterPlaylist with the ETag of the playlist.
+func (s *StreamSession) GetMasterPlaylistEntry() (Playlist, error) {
+	s.Touch()
+	s.mutex.RLock()
+	playlist, generatedAt := s.masterPlaylist, s.masterGeneratedAt
+	s.mutex.RUnlock()
+	if !generatedAt.IsZero() && time.Since(generatedAt) < s.channelCfg.GetMasterPlaylistMaxAge() {
+		return playlist, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	body, err := s.generateMasterPlaylist()
+	if err != nil {
+		return Playlist{}, err
+	}
+	s.masterPlaylist, s.masterGeneratedAt = NewPlaylist(body), time.Now()
+	return s.masterPlaylist, nil
+}
+
+// generateMasterPlaylist builds the master playlist from the current MPD. The caller must hold the lock.
+func (s *StreamSession) generateMasterPlaylist() (string, error) {
+	selectedReps := make(map[string][]*dash.Representation)
+	for i := range s.MPD.Periods {
+		period := &s.MPD.Periods[i]
+		for j := range period.Sets {
+			as := &period.Sets[j]
+			reps := selectRepresentations(as, &s.channelCfg)
+			if len(reps) > 0 {
+				if _, ok := selectedReps[as.ContentType]; !ok {
+					selectedReps[as.ContentType] = make([]*dash.Representation, 0)
+				}
+				selectedReps[as.ContentType] = append(selectedReps[as.ContentType], reps...)
+			}
+			if trickModeReps := selectTrickModeRepresentations(as); len(trickModeReps) > 0 {
+				selectedReps[hls.IFrameMediaType] = append(selectedReps[hls.IFrameMediaType], trickModeReps...)
+			}
+		}
+	}
+	return hls.GenerateMasterPlaylist(s.MPD, selectedReps, s.masterPlaylistOptions())
+}
+
+// ErrUnknownRepresentation is returned when a client asks for a representation the session cannot serve.
+var ErrUnknownRepresentation = errors.New("unknown representation")
+
+// ErrPlaylistWarmingUp is returned for the playlist of a representation in the presentation that has no
+// segments downloaded yet, so that clients can tell a stream that is starting from a missing one.
+var ErrPlaylistWarmingUp = errors.New("playlist is warming up")
+
+// ErrSegmentNotOnDemand is returned by FetchSegment for a segment that is not fetched on demand,
+// either because it is downloaded in the background or because it is not in the presentation.
+var ErrSegmentNotOnDemand = errors.New("segment is not fetched on demand")
+
+// ErrTooManyOnDemandFetches is returned by FetchSegment when the session's on-demand fetch limit stays
+// reached for longer than a player request waits.
+var ErrTooManyOnDemandFetches = errors.New("too many on-demand segment fetches")
+
+// ErrUnknownSegmentPath is returned when a DASH segment path matches none of the session's segments.
+var ErrUnknownSegmentPath = errors.New("unknown segment path")
+
+// onDemandTimeout bounds how long a player request waits for an on-demand segment.
+const onDemandTimeout = 10 * time.Second
+
+// GetPinnedMasterPlaylist returns a master playlist with a single video variant, pinned to the given
+// representation. The representation is downloaded from then on even if it would not be selected
+// automatically, for constrained devices that need a specific rendition, until clients stop requesting
+// it for pinIdleTimeout or maxPinnedReps newer pins replace it.
+func (s *StreamSession) GetPinnedMasterPlaylist(videoRepId string) (string, error) {
+	// The representation is pinned once the lock is released, since queueing its init segment may block
+	// on a full download queue. Its init segment is built under the lock, from the MPD as it is now.
+	var pins []models.Segment
+	defer func() {
+		for _, initSeg := range pins {
+			s.pinRepresentation(initSeg)
+		}
+	}()
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var pinned *dash.Representation
+	selectedReps := make(map[string][]*dash.Representation)
+	for i := range s.MPD.Periods {
+		period := &s.MPD.Periods[i]
+		for j := range period.Sets {
+			as := &period.Sets[j]
+			if as.ContentType != "video" {
+				selectedReps[as.ContentType] = append(selectedReps[as.ContentType], selectRepresentations(as, &s.channelCfg)...)
+				continue
+			}
+			selectedReps[hls.IFrameMediaType] = append(selectedReps[hls.IFrameMediaType], selectTrickModeRepresentations(as)...)
+			for k := range as.Representations {
+				rep := &as.Representations[k]
+				// A trick mode track only holds I-frames, so it cannot be the variant players are pinned to.
+				if rep.ID != videoRepId || isTrickMode(rep) || !dash.IsSupportedCodec(as.GetCodecs(rep)) {
+					continue
+				}
+				if pinned == nil {
+					pinned = rep
+				}
+				if slices.Contains(selectRepresentations(as, &s.channelCfg), rep) {
+					continue // Already downloaded
+				}
+				if initSeg, ok := s.initSegment(period, as, rep); ok {
+					pins = append(pins, initSeg)
+				}
+			}
+		}
+	}
+	if pinned == nil {
+		return "", fmt.Errorf("%w: no video representation '%s'", ErrUnknownRepresentation, videoRepId)
+	}
+	selectedReps["video"] = []*dash.Representation{pinned}
+	return hls.GenerateMasterPlaylist(s.MPD, selectedReps, s.masterPlaylistOptions())
+}
+
+// masterPlaylistOptions returns the channel's settings for its master playlists.
+func (s *StreamSession) masterPlaylistOptions() hls.MasterPlaylistOptions {
+	return hls.MasterPlaylistOptions{
+		Steering:          s.contentSteering(),
+		DeclareNoCaptions: s.channelCfg.DeclareNoClosedCaptions,
+	}
+}
+
+// SegmentCacheKey maps a segment name requested by a player to the segment's cache key.
+// Both "init.m4s" and the init segment name used in the media playlist's EXT-X-MAP map to the
+// representation's init segment. It returns ErrUnknownRepresentation for a representation that is
+// not in the session's MPD, whose segments will never be cached.
+func (s *StreamSession) SegmentCacheKey(repId, segmentName string) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, period := range s.MPD.Periods {
+		for i := range period.Sets {
+			as := &period.Sets[i]
+			for j := range as.Representations {
+				rep := &as.Representations[j]
+				if rep.ID != repId {
+					continue
+				}
+				segmentId := strings.TrimSuffix(segmentName, ".m4s")
+				initPath := dash.ExpandTemplate(as.GetInitialization(rep), dash.TemplateValues{RepresentationID: rep.ID, Bandwidth: uint64(rep.Bandwidth)})
+				if segmentName == hls.InitSegmentFilename(initPath) {
+					segmentId = "init"
+				}
+				return fmt.Sprintf("%s/%s/%s", s.ChannelID, repId, segmentId), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w '%s' in channel %s", ErrUnknownRepresentation, repId, s.ChannelID)
+}
+
+// DASHSegmentCacheKey returns the cache key of the segment or init segment that the origin serves at
+// segmentPath, relative to the manifest URL. Only init segments and segments in the current window
+// are found, and byte ranges of single-file representations, which share one path, are not.
+func (s *StreamSession) DASHSegmentCacheKey(segmentPath string) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	base, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid manifest URL '%s': %w", s.BaseURL, err)
+	}
+	reference, err := url.Parse(segmentPath)
+	if err != nil {
+		return "", fmt.Errorf("%w '%s': %v", ErrUnknownSegmentPath, segmentPath, err)
+	}
+	segmentURL := base.ResolveReference(reference).String()
+	if cacheKey, found := s.segmentPaths[segmentURL]; found {
+		return cacheKey, nil
+	}
+	for pi := range s.MPD.Periods {
+		period := &s.MPD.Periods[pi]
+		for i := range period.Sets {
+			as := &period.Sets[i]
+			for j := range as.Representations {
+				rep := &as.Representations[j]
+				initURLs, err := dash.BuildInitSegmentURLs(s.BaseURL, s.MPD, period, as, rep)
+				if err != nil || dash.InitSegmentRange(as, rep) != "" {
+					continue
+				}
+				if slices.Contains(initURLs, segmentURL) {
+					return fmt.Sprintf("%s/%s/init", s.ChannelID, rep.ID), nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("%w '%s' in channel %s", ErrUnknownSegmentPath, segmentPath, s.ChannelID)
+}
+
+// listSegmentPaths records the origin URLs of a segment added to availableSegments, so that
+// DASHSegmentCacheKey finds it. Byte ranges of single-file representations share one URL and are not
+// recorded. The caller must hold the write lock.
+func (s *StreamSession) listSegmentPaths(seg *models.Segment) {
+	if seg.ByteRange != "" {
+		return
+	}
+	cacheKey := fmt.Sprintf("%s/%s/%s", s.ChannelID, seg.RepID, seg.ID)
+	for _, segmentURL := range append([]string{seg.URL}, seg.FallbackURLs...) {
+		s.segmentPaths[segmentURL] = cacheKey
+	}
+}
+
+// unlistSegmentPaths forgets the origin URLs of segments dropped from availableSegments. The caller must
+// hold the write lock.
+func (s *StreamSession) unlistSegmentPaths(segs []*models.Segment) {
+	for _, seg := range segs {
+		cacheKey := fmt.Sprintf("%s/%s/%s", s.ChannelID, seg.RepID, seg.ID)
+		for _, segmentURL := range append([]string{seg.URL}, seg.FallbackURLs...) {
+			if s.segmentPaths[segmentURL] == cacheKey {
+				delete(s.segmentPaths, segmentURL)
+			}
+		}
+	}
+}
+
+// pinRepresentation adds the representation of an init segment built by initSegment to the downloaded set,
+// queueing the init segment the first time. Once the session has maxPinnedReps pins, the least recently used
+// one is dropped to make room.
+func (s *StreamSession) pinRepresentation(initSeg models.Segment) {
+	repId := initSeg.RepID
+	s.pinMutex.Lock()
+	if _, pinned := s.pinnedReps[repId]; pinned {
+		s.pinnedReps[repId] = time.Now()
+		s.pinMutex.Unlock()
+		return
+	}
+	if s.pinnedReps == nil {
+		s.pinnedReps = make(map[string]time.Time)
+	}
+	if len(s.pinnedReps) >= maxPinnedReps {
+		// Make room by dropping the pin that clients used least recently.
+		oldest := ""
+		for repId, lastUsed := range s.pinnedReps {
+			if oldest == "" || lastUsed.Before(s.pinnedReps[oldest]) {
+				oldest = repId
+			}
+		}
+		s.unpin(oldest)
+	}
+	s.pinnedReps[repId] = time.Now()
+	s.pinMutex.Unlock()
+
+	s.Logger.Infof("Pinning video representation %s for session %s", repId, s.ChannelID)
+	s.queueInitSegment(initSeg)
+}
 
-			// Use the first representation for time calculations, assuming all are aligned.
-			firstRep := repsToDownload[0]
-			presentationTimeOffsetInSeconds := float64(firstRep.PresentationTimeOffset) / float64(repTimescale)
-			presentationTimeInSeconds := float64(targetTime) / float64(sessionTimescale)
-			periodStartInSeconds := periodStart.Seconds()
+// touchPin records a client request for a representation, which keeps its pin, if any, from expiring.
+func (s *StreamSession) touchPin(repId string) {
+	s.pinMutex.Lock()
+	defer s.pinMutex.Unlock()
+	if _, pinned := s.pinnedReps[repId]; pinned {
+		s.pinnedReps[repId] = time.Now()
+	}
+}
 
-			mediaTimeInSeconds := presentationTimeInSeconds - periodStartInSeconds + presentationTimeOffsetInSeconds
-			targetTimeForRep := uint64(mediaTimeInSeconds * float64(repTimescale))
+// expirePins drops the pins that no client used for pinIdleTimeout and returns every representation
+// unpinned since the last call.
+func (s *StreamSession) expirePins() []string {
+	s.pinMutex.Lock()
+	defer s.pinMutex.Unlock()
+	for repId, lastUsed := range s.pinnedReps {
+		if time.Since(lastUsed) >= pinIdleTimeout {
+			s.unpin(repId)
+		}
+	}
+	unpinned := s.unpinnedReps
+	s.unpinnedReps = nil
+	return unpinned
+}
 
-			targetSegmentTime, targetSegmentDuration := findSegmentTimeForPlayhead(as.SegmentTemplate.Timeline, targetTimeForRep)
+// unpin stops downloading a pinned representation. The caller must hold pinMutex.
+func (s *StreamSession) unpin(repId string) {
+	s.Logger.Infof("Unpinning video representation %s for session %s", repId, s.ChannelID)
+	delete(s.pinnedReps, repId)
+	delete(s.prewarmedReps, repId)
+	s.unpinnedReps = append(s.unpinnedReps, repId)
+}
 
-			if targetSegmentDuration == 0 {
-				s.Logger.Debugf("No segment found for time %d in AdaptationSet %s", targetTimeForRep, as.ID)
-				continue
-			}
+// forgetPinnedRepresentation discards the segments and playlists of a representation that is no longer
+// pinned, so that clients do not get its stale playlists, unless the session now selects it
+// automatically. The caller must hold the write lock.
+func (s *StreamSession) forgetPinnedRepresentation(repId string) {
+	if _, as, rep := s.findVideoRepresentation(repId); rep != nil && slices.Contains(selectRepresentations(as, &s.channelCfg), rep) {
+		return
+	}
+	s.unlistSegmentPaths(s.availableSegments[repId])
+	delete(s.availableSegments, repId)
+	delete(s.playlistCache, repId)
+	delete(s.deltaPlaylistCache, repId)
+	delete(s.mediaSequence, repId)
+	delete(s.discontinuitySeq, repId)
+}
 
-			if as.ContentType == "video" {
-				videoSegmentDuration = targetSegmentDuration
-			}
+// GetMediaPlaylist returns a media playlist from the cache. The first request for a video representation
+// that is not downloaded starts downloading it, pre-warming its window when the channel enables it.
+// Until a representation has segments, ErrPlaylistWarmingUp is returned, or ErrUnknownRepresentation
+// when the MPD has no such representation.
+func (s *StreamSession) GetMediaPlaylist(mediaType, repId string) (string, error) {
+	playlist, err := s.GetMediaPlaylistEntry(mediaType, repId)
+	return playlist.Body, err
+}
 
-			for _, rep := range repsToDownload {
-				segmentID := fmt.Sprintf("%d", targetSegmentTime)
-				cacheKey := fmt.Sprintf("%s/%s/%s", s.ChannelID, rep.ID, segmentID)
+// GetMediaPlaylistEntry is GetMediaPlaylist with the ETag of the playlist.
+func (s *StreamSession) GetMediaPlaylistEntry(mediaType, repId string) (Playlist, error) {
+	s.Touch()
+	s.touchPin(repId)
+	s.mutex.RLock()
+	playlist, found := s.playlistCache[repId]
+	s.mutex.RUnlock()
+	if !found {
+		if !s.hasRepresentation(repId) {
+			return Playlist{}, fmt.Errorf("%w '%s' in channel %s", ErrUnknownRepresentation, repId, s.ChannelID)
+		}
+		if mediaType == "video" && s.channelCfg.PrewarmSegments > 0 {
+			s.prewarmRepresentation(repId)
+		}
+		return Playlist{}, fmt.Errorf("%w: no segments of representation %s are available yet", ErrPlaylistWarmingUp, repId)
+	}
+	return playlist, nil
+}
 
-				if _, found := s.SegCache.Get(cacheKey); found {
-					continue // Already downloaded or in queue
-				}
+// hasRepresentation reports whether the current MPD has a representation with the given ID.
+func (s *StreamSession) hasRepresentation(repId string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.representationExists(repId)
+}
 
-				segmentURL, err := dash.BuildSegmentURL(s.BaseURL, period, as, rep, targetSegmentTime)
-				if err != nil {
-					s.Logger.Warnf("Failed to build segment URL for time %d: %v", targetSegmentTime, err)
-					continue
+// representationExists is hasRepresentation for callers that hold the lock.
+func (s *StreamSession) representationExists(repId string) bool {
+	for _, period := range s.MPD.Periods {
+		for j := range period.Sets {
+			as := &period.Sets[j]
+			for k := range as.Representations {
+				if as.Representations[k].ID == repId {
+					return true
 				}
+			}
+		}
+	}
+	return false
+}
 
-				segment := models.Segment{
-					URL:      segmentURL,
-					ID:       cacheKey,
-					Time:     targetSegmentTime,
-					Duration: targetSegmentDuration,
-					RepID:    rep.ID,
-				}
+// prewarmRepresentation starts downloading a video representation a player switched to and queues, at
+// priority, the segments matching the last PrewarmSegments of the downloaded variant's window. The
+// representation's media sequence is aligned with that variant's, as players require when switching.
+func (s *StreamSession) prewarmRepresentation(repId string) {
+	if s.IsVOD() {
+		return // VOD segments are fetched when players ask for them
+	}
+	s.pinMutex.Lock()
+	if s.prewarmedReps[repId] {
+		s.pinMutex.Unlock()
+		return
+	}
+	if s.prewarmedReps == nil {
+		s.prewarmedReps = make(map[string]bool)
+	}
+	s.prewarmedReps[repId] = true
+	s.pinMutex.Unlock()
 
-				s.Logger.Debugf("Queueing media segment for rep %s, time %d", rep.ID, targetSegmentTime)
-				s.Downloader.QueueDownload(dash.DownloadTask{
-					Segment: segment,
-					Result:  s.resultsChan,
-				})
-			}
+	s.mutex.Lock()
+	period, as, rep := s.findVideoRepresentation(repId)
+	var segments []models.Segment
+	var initSeg models.Segment
+	pin := false
+	if rep != nil {
+		segments = s.prewarmSegments(period, as, rep)
+		if !slices.Contains(selectRepresentations(as, &s.channelCfg), rep) {
+			initSeg, pin = s.initSegment(period, as, rep)
 		}
 	}
+	s.mutex.Unlock()
+	if rep == nil {
+		return
+	}
 
-	if videoSegmentDuration > 0 {
-		s.mutex.Lock()
-		s.currentTargetTime += videoSegmentDuration
-		s.mutex.Unlock()
-		s.Logger.Debugf("Advanced session playhead by %d to %d", videoSegmentDuration, s.currentTargetTime)
+	if pin {
+		s.pinRepresentation(initSeg)
+	}
+	s.Logger.Infof("Pre-warming %d segments of video representation %s", len(segments), repId)
+	for _, segment := range segments {
+		s.queueMediaSegment(segment, true)
 	}
 }
 
-// selectRepresentations applies the stream selection logic from the design document.
-func selectRepresentations(as *dash.AdaptationSet) []*dash.Representation {
-	var selected []*dash.Representation
-
-	switch as.ContentType {
-	case "video":
-		var bestRep *dash.Representation
-		maxBandwidth := 0
-		for i := range as.Representations {
-			rep := &as.Representations[i]
-			// A simple way to identify and exclude trick mode tracks.
-			// A more robust method might check for specific roles or other metadata.
-			if strings.Contains(rep.ID, "TrickMode") {
+// findVideoRepresentation returns the supported, non trick mode video representation repId of the
+// current MPD, or a nil representation. The caller must hold the lock.
+func (s *StreamSession) findVideoRepresentation(repId string) (*dash.Period, *dash.AdaptationSet, *dash.Representation) {
+	for i := range s.MPD.Periods {
+		period := &s.MPD.Periods[i]
+		for j := range period.Sets {
+			as := &period.Sets[j]
+			if as.ContentType != "video" {
 				continue
 			}
-			if rep.Bandwidth > maxBandwidth {
-				maxBandwidth = rep.Bandwidth
-				bestRep = rep
+			for k := range as.Representations {
+				rep := &as.Representations[k]
+				if rep.ID == repId && !isTrickMode(rep) && dash.IsSupportedCodec(as.GetCodecs(rep)) {
+					return period, as, rep
+				}
 			}
 		}
-		if bestRep != nil {
-			selected = append(selected, bestRep)
-		}
-	case "audio", "text":
-		// Select all available audio and text tracks
-		for i := range as.Representations {
-			selected = append(selected, &as.Representations[i])
-		}
 	}
-	return selected
+	return nil, nil, nil
 }
 
-// findSegmentTimeForPlayhead finds the time and duration of the segment for the current playhead.
-func findSegmentTimeForPlayhead(timeline dash.SegmentTimeline, playheadTime uint64) (uint64, uint64) {
-	var timeCursor uint64 = 0
-	for _, s := range timeline.Segments {
-		// If a 't' attribute is present, the timeline resets to this value.
-		if s.T > 0 {
-			timeCursor = s.T
-		}
+// prewarmSegments returns the segments of rep covering the end of the window of the set's
+// automatically selected representation. The caller must hold the write lock.
+func (s *StreamSession) prewarmSegments(period *dash.Period, as *dash.AdaptationSet, rep *dash.Representation) []models.Segment {
+	selected := selectRepresentations(as, &s.channelCfg)
+	if len(selected) == 0 || selected[0] == rep {
+		return nil
+	}
+	reference := selected[0]
+	template := as.GetSegmentTemplate(rep)
+	referenceTimescale, repTimescale := uint64(as.GetSegmentTemplate(reference).Timescale), uint64(template.Timescale)
+	if referenceTimescale == 0 || repTimescale == 0 {
+		return nil
+	}
 
-		// There are s.R repeats, so s.R+1 segments in this block
-		for i := 0; i <= s.R; i++ {
-			segmentStartTime := timeCursor
-			// The playhead falls within this segment's duration
-			if playheadTime < segmentStartTime+s.D {
-				return segmentStartTime, s.D
-			}
-			timeCursor += s.D
-		}
+	window := s.availableSegments[reference.ID]
+	first := max(len(window)-s.channelCfg.PrewarmSegments, 0)
+	window = window[first:]
+	if _, found := s.mediaSequence[rep.ID]; !found && len(s.availableSegments[rep.ID]) == 0 {
+		s.mediaSequence[rep.ID] = s.mediaSequence[reference.ID] + first + hls.CountMissingSegments(s.availableSegments[reference.ID][:min(first+1, len(s.availableSegments[reference.ID]))])
 	}
 
-	// If playhead is past the known timeline, it means we are at the live edge.
-	// Return the last known segment's start time and duration.
-	if len(timeline.Segments) > 0 {
-		// The timeCursor is now at the end of the timeline, so the last segment started one duration ago.
-		lastDuration := timeline.Segments[len(timeline.Segments)-1].D
-		if timeCursor > lastDuration {
-			return timeCursor - lastDuration, lastDuration
+	var segments []models.Segment
+	for _, seg := range window {
+		if seg.PeriodID != period.ID {
+			continue
+		}
+		segmentTime, segmentDuration, ok := dash.FindSegment(template.Timeline, rescaleTime(seg.Time, referenceTimescale, repTimescale))
+		if !ok {
+			continue
 		}
+		segment, err := s.mediaSegment(s.MPD, period, as, rep, &template, segmentTime, segmentDuration)
+		if err != nil {
+			s.Logger.Warnf("%v", err)
+			continue
+		}
+		segments = append(segments, segment)
 	}
-
-	return 0, 0 // Should not happen with a valid timeline
+	return segments
 }
 
-// playlistLoop is the "publisher" goroutine.
-func (s *StreamSession) playlistLoop() {
-	ticker := time.NewTicker(1 * time.Second) // Regenerate playlist every second
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-s.ctx.Done():
-			s.Logger.Infof("Playlist loop for %s stopped.", s.ChannelID)
-			return
-		case <-ticker.C:
-			s.updatePlaylists()
+// GetIFramePlaylist returns the I-frame playlist of a trick mode representation from the cache, or
+// ErrPlaylistWarmingUp until it is generated.
+func (s *StreamSession) GetIFramePlaylist(repId string) (Playlist, error) {
+	s.Touch()
+	s.mutex.RLock()
+	playlist, found := s.iframePlaylistCache[repId]
+	s.mutex.RUnlock()
+	if !found {
+		if !s.hasRepresentation(repId) {
+			return Playlist{}, fmt.Errorf("%w '%s' in channel %s", ErrUnknownRepresentation, repId, s.ChannelID)
 		}
+		return Playlist{}, fmt.Errorf("%w: I-frame playlist for representation %s not found in cache", ErrPlaylistWarmingUp, repId)
 	}
+	return playlist, nil
 }
 
-func (s *StreamSession) updatePlaylists() {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	for _, period := range s.MPD.Periods {
-		for _, as := range period.Sets {
-			for _, rep := range as.Representations {
-				availableSegs := s.availableSegments[rep.ID]
-				if len(availableSegs) == 0 {
-					continue
-				}
-
-				// Keep only the last few segments for the live playlist
-				if len(availableSegs) > playlistLiveSegments {
-					availableSegs = availableSegs[len(availableSegs)-playlistLiveSegments:]
-				}
+// GetDeltaMediaPlaylist returns the delta update of a live media playlist from the cache,
+// falling back to the full playlist when no delta update is available.
+func (s *StreamSession) GetDeltaMediaPlaylist(mediaType, repId string) (string, error) {
+	playlist, err := s.GetDeltaMediaPlaylistEntry(mediaType, repId)
+	return playlist.Body, err
+}
 
-				playlist, err := hls.GenerateMediaPlaylist(s.MPD, s.ChannelID, as.ContentType, rep.ID, s.mediaSequence[rep.ID], availableSegs)
-				if err != nil {
-					s.Logger.Warnf("Failed to generate media playlist for rep %s: %v", rep.ID, err)
-					continue
-				}
-				s.playlistCache[rep.ID] = playlist
-			}
-		}
+// GetDeltaMediaPlaylistEntry is GetDeltaMediaPlaylist with the ETag of the playlist.
+func (s *StreamSession) GetDeltaMediaPlaylistEntry(mediaType, repId string) (Playlist, error) {
+	s.mutex.RLock()
+	delta, found := s.deltaPlaylistCache[repId]
+	s.mutex.RUnlock()
+	if found {
+		return delta, nil
 	}
+	return s.GetMediaPlaylistEntry(mediaType, repId)
 }
 
-// GetMasterPlaylist returns the master playlist.
-func (s *StreamSession) GetMasterPlaylist() (string, error) {
-	selectedReps := make(map[string][]*dash.Representation)
-	for _, period := range s.MPD.Periods {
-		for _, as := range period.Sets {
-			reps := selectRepresentations(&as)
-			if len(reps) > 0 {
-				if _, ok := selectedReps[as.ContentType]; !ok {
-					selectedReps[as.ContentType] = make([]*dash.Representation, 0)
-				}
-				selectedReps[as.ContentType] = append(selectedReps[as.ContentType], reps...)
+// GetWindow returns a snapshot of the available segments and media sequence numbers for each representation.
+func (s *StreamSession) GetWindow() map[string]RepresentationWindow {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	window := make(map[string]RepresentationWindow, len(s.availableSegments))
+	for repId, segments := range s.availableSegments {
+		mediaSequence := s.mediaSequence[repId]
+		repWindow := RepresentationWindow{
+			MediaSequence: mediaSequence,
+			Segments:      make([]WindowSegment, 0, len(segments)),
+		}
+		for i, seg := range segments {
+			if i > 0 {
+				mediaSequence += 1 + hls.MissingSegments(segments[i-1], seg) // Gaps are numbered too
 			}
+			repWindow.Segments = append(repWindow.Segments, WindowSegment{
+				Time:          seg.Time,
+				Duration:      seg.Duration,
+				MediaSequence: mediaSequence,
+			})
 		}
+		window[repId] = repWindow
 	}
-	return hls.GenerateMasterPlaylist(s.MPD, selectedReps)
+	return window
 }
 
-// GetMediaPlaylist returns a media playlist from the cache.
-func (s *StreamSession) GetMediaPlaylist(mediaType, repId string) (string, error) {
+// GetContentProtection returns the DRM signalling of each encrypted AdaptationSet of the current MPD.
+func (s *StreamSession) GetContentProtection() []ContentProtectionInfo {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	playlist, found := s.playlistCache[repId]
-	if !found {
-		return "", fmt.Errorf("playlist for representation %s not found in cache", repId)
+
+	var infos []ContentProtectionInfo
+	if s.MPD == nil {
+		return infos
 	}
-	return playlist, nil
+	for _, period := range s.MPD.Periods {
+		for i := range period.Sets {
+			as := &period.Sets[i]
+			var rep *dash.Representation
+			if len(as.Representations) > 0 {
+				rep = &as.Representations[0]
+			}
+			info := ContentProtectionInfo{
+				PeriodID:        period.ID,
+				AdaptationSetID: as.ID,
+				ContentType:     as.ContentType,
+				DefaultKID:      as.GetDefaultKID(rep),
+				PSSH:            as.GetPSSHs(rep),
+			}
+			if info.DefaultKID == "" && len(info.PSSH) == 0 {
+				continue
+			}
+			infos = append(infos, info)
+		}
+	}
+	return infos
 }
 
 // GetAllActiveSegmentKeys iterates through all sessions and collects the keys of all available segments,
-// including init segments, to prevent them from being evicted.
+// including init segments and segments still being downloaded, to prevent them from being evicted.
 func (sm *SessionManager) GetAllActiveSegmentKeys() map[string]struct{} {
 	activeKeys := make(map[string]struct{})
 	sm.mutex.RLock()
@@ -529,22 +2536,31 @@ func (sm *SessionManager) GetAllActiveSegmentKeys() map[string]struct{} {
 	for _, session := range sm.sessions {
 		session.mutex.RLock()
 
-		// Add active media segments
-		for repId, segments := range session.availableSegments {
-			for _, seg := range segments {
-				// This is the correct cache key format for media segments
-				cacheKey := fmt.Sprintf("%s/%s/%s", session.ChannelID, repId, seg.ID)
-				activeKeys[cacheKey] = struct{}{}
+		// Add active media segments. Those of a VOD session are all listed, but only fetched when players
+		// ask for them, so they are left to the cache's LRU order like any segment played before.
+		if !session.IsVOD() {
+			for repId, segments := range session.availableSegments {
+				for _, seg := range segments {
+					// This is the correct cache key format for media segments
+					cacheKey := fmt.Sprintf("%s/%s/%s", session.ChannelID, repId, seg.ID)
+					activeKeys[cacheKey] = struct{}{}
+				}
 			}
 		}
 
+		// Add queued segments, which are cached before they are listed
+		for cacheKey := range session.queuedSegments {
+			activeKeys[cacheKey] = struct{}{}
+		}
+
 		// Also add all init segments for all representations in the manifest
 		if session.MPD != nil {
 			for _, period := range session.MPD.Periods {
-				for _, as := range period.Sets {
-					for _, rep := range as.Representations {
+				for j := range period.Sets {
+					as := &period.Sets[j]
+					for k := range as.Representations {
 						// This is the standardized cache key for init segments
-						initKey := fmt.Sprintf("%s/%s/init", session.ChannelID, rep.ID)
+						initKey := fmt.Sprintf("%s/%s/init", session.ChannelID, as.Representations[k].ID)
 						activeKeys[initKey] = struct{}{}
 					}
 				}
@@ -582,34 +2598,112 @@ func (s *StreamSession) mpdRefreshLoop() {
 			return
 		case <-ticker.C:
 			s.refreshMPD()
+			if s.IsEnded() {
+				s.Logger.Infof("MPD refresh loop for %s stopped because the stream ended.", s.ChannelID)
+				s.retireAfterEnd(time.Duration(s.windowSegments) * refreshInterval)
+				return
+			}
+		}
+	}
+}
+
+// retireAfterEnd keeps serving the final playlists of an ended stream for grace, about as long as players
+// take to play their window, and then retires the session, so that a request for the channel after that
+// creates a new session should the origin serve the manifest again.
+func (s *StreamSession) retireAfterEnd(grace time.Duration) {
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-s.ctx.Done():
+		return
+	case <-timer.C:
+	}
+	if s.retire != nil {
+		s.retire()
+	}
+}
+
+// isManifestGone reports whether every origin answered the manifest request with 404 Not Found
+// or 410 Gone, which is how origins signal that a live event has ended. A single such answer may
+// also come from an origin that is briefly misconfigured, so refreshMPD requires several in a row.
+func isManifestGone(err error) bool {
+	var joined interface{ Unwrap() []error }
+	if errors.As(err, &joined) {
+		errs := joined.Unwrap()
+		for _, e := range errs {
+			if !isManifestGone(e) {
+				return false
+			}
 		}
+		return len(errs) > 0
 	}
+
+	var statusErr *dash.StatusError
+	return errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusGone)
+}
+
+// IsEnded reports whether the live stream has ended and its playlists have been finalized.
+func (s *StreamSession) IsEnded() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.ended
 }
 
 func (s *StreamSession) refreshMPD() {
-	s.Logger.Debugf("Refreshing MPD for session %s from %s", s.ChannelID, s.ManifestURL)
-	newMpd, newBaseURL, err := s.dashClient.FetchAndParseMPD(s.ManifestURL, "") // User agent is already in the client
+	s.mutex.RLock()
+	manifestIndex := s.manifestIndex
+	s.mutex.RUnlock()
+
+	s.Logger.Debugf("Refreshing MPD for session %s from %s", s.ChannelID, s.manifestURLs[manifestIndex])
+	newMpd, newBaseURL, newManifestIndex, err := fetchMPDWithFailover(s.dashClient, s.Logger, s.manifestURLs, manifestIndex, "") // User agent is already in the client
 	if err != nil {
-		s.Logger.Warnf("Failed to refresh MPD for session %s: %v", s.ChannelID, err)
+		metrics.MPDRefreshErrors.Inc()
+		if !isManifestGone(err) {
+			s.goneRefreshes = 0
+			s.Logger.Warnf("Failed to refresh MPD for session %s: %v", s.ChannelID, err)
+			return
+		}
+		s.goneRefreshes++
+		if s.goneRefreshes < manifestGoneRefreshes {
+			s.Logger.Warnf("Manifest for session %s is gone (%d of %d refreshes before the stream ends): %v",
+				s.ChannelID, s.goneRefreshes, manifestGoneRefreshes, err)
+			return
+		}
+		s.Logger.Infof("Manifest for session %s is gone, treating the live stream as ended: %v", s.ChannelID, err)
+		s.mutex.Lock()
+		s.ended = true
+		s.mutex.Unlock()
+		s.updatePlaylists()
 		return
 	}
+	s.goneRefreshes = 0
+
+	// Init segments of representations added by the refresh are built under the lock and queued once it
+	// is released, since queueing may block on a full download queue.
+	var addedInits []models.Segment
+	defer func() {
+		for _, initSeg := range addedInits {
+			s.queueInitSegment(initSeg)
+		}
+	}()
 
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// Instead of replacing the whole MPD, merge the timelines
+	// Instead of replacing the whole MPD, merge (or, if configured, replace) the timelines
 	for i := range newMpd.Periods {
 		newPeriod := &newMpd.Periods[i]
 		for j := range newPeriod.Sets {
 			newAS := &newPeriod.Sets[j]
 
 			// Find the corresponding old adaptation set
+			var oldPeriod *dash.Period
 			var oldAS *dash.AdaptationSet
 			for k := range s.MPD.Periods {
 				if s.MPD.Periods[k].ID == newPeriod.ID {
 					for l := range s.MPD.Periods[k].Sets {
 						if s.MPD.Periods[k].Sets[l].ID == newAS.ID {
-							oldAS = &s.MPD.Periods[k].Sets[l]
+							oldPeriod, oldAS = &s.MPD.Periods[k], &s.MPD.Periods[k].Sets[l]
 							break
 						}
 					}
@@ -620,10 +2714,40 @@ func (s *StreamSession) refreshMPD() {
 			}
 
 			if oldAS != nil {
-				// Merge the timelines
-				mergedTimeline := dash.MergeTimelines(oldAS.SegmentTemplate.Timeline, newAS.SegmentTemplate.Timeline)
 				// Update the timeline in the session's MPD object
-				oldAS.SegmentTemplate.Timeline = mergedTimeline
+				s.updateTimeline(&oldAS.SegmentTemplate, &newAS.SegmentTemplate)
+				s.updateSegmentList(&oldAS.SegmentList, newAS.SegmentList)
+
+				if added, changed := updateRepresentations(oldAS, newAS); changed {
+					s.Logger.Infof("Representations of AdaptationSet %s changed in refreshed MPD for session %s", oldAS.ID, s.ChannelID)
+					s.masterGeneratedAt = time.Time{} // Regenerate the master playlist on the next request
+					for _, rep := range selectRepresentations(oldAS, &s.channelCfg) {
+						if !slices.Contains(added, rep.ID) {
+							continue
+						}
+						if initSeg, ok := s.initSegment(oldPeriod, oldAS, rep); ok {
+							addedInits = append(addedInits, initSeg)
+						}
+					}
+				}
+
+				// Representation-level templates and lists carry their own timelines which need the same treatment.
+				for _, newRep := range newAS.Representations {
+					if newRep.SegmentTemplate == nil && newRep.SegmentList == nil {
+						continue
+					}
+					for k := range oldAS.Representations {
+						oldRep := &oldAS.Representations[k]
+						if oldRep.ID != newRep.ID {
+							continue
+						}
+						if oldRep.SegmentTemplate != nil && newRep.SegmentTemplate != nil {
+							s.updateTimeline(oldRep.SegmentTemplate, newRep.SegmentTemplate)
+						}
+						s.updateSegmentList(&oldRep.SegmentList, newRep.SegmentList)
+						break
+					}
+				}
 			} else {
 				// This is a new AdaptationSet, we might need to add it.
 				// For now, we'll log it. A more robust implementation would handle adding new periods/sets.
@@ -634,16 +2758,180 @@ func (s *StreamSession) refreshMPD() {
 
 	// Update other top-level attributes that might change
 	s.MPD.MinimumUpdatePeriod = newMpd.MinimumUpdatePeriod
+	s.MPD.TimeShiftBufferDepth = newMpd.TimeShiftBufferDepth
 	s.BaseURL = newBaseURL
+	s.manifestIndex = newManifestIndex
+	s.ManifestURL = s.manifestURLs[newManifestIndex]
 	s.Logger.Infof("Successfully refreshed and merged MPD for session %s", s.ChannelID)
 }
 
-// resultLoop is a background goroutine that processes download results.
+// updateRepresentations makes a session AdaptationSet list the representations of its refreshed copy.
+// Existing representations are kept, with the timelines already merged into them; new ones are added and
+// those gone from the refresh are dropped. It returns the IDs of the added representations and whether
+// the set changed at all.
+func updateRepresentations(current, refreshed *dash.AdaptationSet) (added []string, changed bool) {
+	existing := make(map[string]*dash.Representation, len(current.Representations))
+	for i := range current.Representations {
+		existing[current.Representations[i].ID] = &current.Representations[i]
+	}
+
+	updated := make([]dash.Representation, 0, len(refreshed.Representations))
+	for _, rep := range refreshed.Representations {
+		if old, found := existing[rep.ID]; found {
+			updated = append(updated, *old)
+			continue
+		}
+		updated = append(updated, rep)
+		added = append(added, rep.ID)
+	}
+	if len(added) == 0 && len(updated) == len(current.Representations) {
+		return nil, false
+	}
+	current.Representations = updated
+	return added, true
+}
+
+// updateTimeline applies a refreshed template's timeline to the session's template.
+// By default the timelines are merged; channels with ReplaceTimeline set adopt the new
+// timeline wholesale, along with its startNumber so $Number$ addressing stays aligned.
+func (s *StreamSession) updateTimeline(current, refreshed *dash.SegmentTemplate) {
+	if s.channelCfg.ReplaceTimeline {
+		current.Timeline = refreshed.Timeline
+		current.StartNumber = refreshed.StartNumber
+		return
+	}
+	current.Timeline = dash.MergeTimelines(current.Timeline, refreshed.Timeline)
+}
+
+// updateSegmentList applies a refreshed SegmentList to the session's list, merging them or, for channels
+// with ReplaceTimeline set, adopting the new list wholesale, as updateTimeline does for timelines.
+func (s *StreamSession) updateSegmentList(current **dash.SegmentList, refreshed *dash.SegmentList) {
+	if refreshed == nil {
+		return // Lists resolved from a SegmentBase are not in the refreshed MPD, and do not change
+	}
+	if s.channelCfg.ReplaceTimeline {
+		*current = refreshed
+		return
+	}
+	*current = dash.MergeSegmentLists(*current, refreshed)
+}
+
+// GetTimeline returns a copy of the effective segment timeline of a representation.
+func (s *StreamSession) GetTimeline(repId string) (dash.SegmentTimeline, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, period := range s.MPD.Periods {
+		for i := range period.Sets {
+			as := &period.Sets[i]
+			for j := range as.Representations {
+				if as.Representations[j].ID == repId {
+					timeline := as.GetSegmentTemplate(&as.Representations[j]).Timeline
+					return dash.SegmentTimeline{Segments: append([]dash.S(nil), timeline.Segments...)}, true
+				}
+			}
+		}
+	}
+	return dash.SegmentTimeline{}, false
+}
+
+// cacheEntry builds the cache entry for a successfully downloaded segment, applying the channel's init
+// box edits to init segments. A cached copy the origin reported unchanged was already edited.
+func (s *StreamSession) cacheEntry(result dash.DownloadResult) cache.Entry {
+	entry := cache.Entry{Data: result.Data, ETag: result.ETag, LastModified: result.LastModified}
+	transformInit := len(s.channelCfg.StripInitBoxes) > 0 || len(s.channelCfg.ReplaceInitBoxes) > 0
+	if result.Task.Segment.IsInit && transformInit && !result.NotModified {
+		data, err := hls.TransformInitSegment(result.Data, s.channelCfg.StripInitBoxes, s.channelCfg.ReplaceInitBoxes)
+		if err != nil {
+			s.Logger.Warnf("Caching init segment %s unedited, failed to edit its boxes: %v", result.Task.Segment.ID, err)
+		} else {
+			entry.Data = data
+		}
+	}
+	if s.channelCfg.SniffContentType {
+		entry.ContentType = hls.SniffSegmentContentType(result.Data)
+	}
+	return entry
+}
+
+// validInitSegment reports whether an init segment may be cached, which it always may unless the channel
+// validates init segments.
+func (s *StreamSession) validInitSegment(cacheKey string, data []byte) bool {
+	if !s.channelCfg.ValidateInitSegments {
+		return true
+	}
+	if err := hls.ValidateInitSegment(data); err != nil {
+		s.Logger.Warnf("Rejecting init segment %s: %v", cacheKey, err)
+		return false
+	}
+	return true
+}
+
+// refetchInitSegment queues an init segment that was malformed or failed to download again, up to
+// maxInitSegmentRefetches times. The init segment stays pending until it is downloaded intact or the
+// refetches run out.
+func (s *StreamSession) refetchInitSegment(task dash.DownloadTask) {
+	cacheKey := task.Segment.ID
+	s.mutex.Lock()
+	refetches := s.initRefetches[cacheKey]
+	if refetches < maxInitSegmentRefetches {
+		s.initRefetches[cacheKey]++
+	}
+	s.mutex.Unlock()
+
+	if refetches >= maxInitSegmentRefetches {
+		s.Logger.Errorf("Giving up on init segment %s after %d failed downloads", cacheKey, refetches+1)
+		s.pendingInits.Add(-1)
+		s.markRepresentationFailed(task.Segment.RepID)
+		return
+	}
+	s.Logger.Infof("Fetching init segment %s again (%d/%d)", cacheKey, refetches+1, maxInitSegmentRefetches)
+	task.Cached, task.QueuedAt = nil, time.Time{}
+	// Queueing may block on a full queue that only drains as this loop consumes results.
+	go s.Downloader.QueueDownload(task)
+}
+
+// observeDownloadLatency records the queue wait and transfer time of a download in the channel's
+// latency histograms, used to tune download workers and timeouts.
+func (s *StreamSession) observeDownloadLatency(result dash.DownloadResult) {
+	metrics.SegmentQueueWaitSeconds.WithLabel(s.ChannelID).Observe(result.QueueWait.Seconds())
+	metrics.SegmentTransferSeconds.WithLabel(s.ChannelID).Observe(result.TransferTime.Seconds())
+	metrics.SegmentLatencySeconds.WithLabel(s.ChannelID).Observe((result.QueueWait + result.TransferTime).Seconds())
+}
+
+// resultLoop is a background goroutine that processes download results until the session stops.
 func (s *StreamSession) resultLoop() {
 	s.Logger.Infof("Starting result processing loop for session %s", s.ChannelID)
-	for result := range s.resultsChan {
+	for {
+		var result dash.DownloadResult
+		select {
+		case <-s.ctx.Done():
+			s.Logger.Infof("Result processing loop for %s stopped.", s.ChannelID)
+			return
+		case result = <-s.resultsChan:
+		}
+
+		s.observeDownloadLatency(result)
 		if result.Error != nil {
+			if !result.Task.Segment.IsInit {
+				s.mutex.Lock()
+				delete(s.queuedSegments, result.Task.Segment.ID)
+				s.mutex.Unlock()
+			}
+			if dash.IsPermanent(result.Error) {
+				// The origin will not serve the segment, so it is skipped rather than fetched again.
+				s.Logger.Warnf("Skipping segment %s, which the origin does not serve: %v", result.Task.Segment.ID, result.Error)
+				if result.Task.Segment.IsInit {
+					s.pendingInits.Add(-1)
+				}
+				s.markRepresentationFailed(result.Task.Segment.RepID)
+				continue
+			}
 			s.Logger.Warnf("Failed to download segment %s: %v", result.Task.Segment.ID, result.Error)
+			if result.Task.Segment.IsInit {
+				// Players cannot start without the init segment, so a transient failure is retried.
+				s.refetchInitSegment(result.Task)
+			}
 			continue
 		}
 
@@ -651,12 +2939,26 @@ func (s *StreamSession) resultLoop() {
 		cacheKey := result.Task.Segment.ID
 		repID := result.Task.Segment.RepID
 
-		s.SegCache.Set(cacheKey, result.Data)
+		if result.Task.Segment.IsInit && !result.NotModified && !s.validInitSegment(cacheKey, result.Data) {
+			s.refetchInitSegment(result.Task)
+			continue
+		}
+
+		s.SegCache.SetEntry(cacheKey, s.cacheEntry(result))
 
 		if result.Task.Segment.IsInit {
+			s.pendingInits.Add(-1)
+			s.mutex.Lock()
+			delete(s.initRefetches, cacheKey)
+			s.mutex.Unlock()
 			s.Logger.Infof("Successfully downloaded and cached init segment for rep %s", repID)
+		} else if s.IsVOD() {
+			// VOD segments are all listed up front, so there is no window to update.
+			s.Logger.Debugf("Successfully downloaded and cached segment %s for rep %s", cacheKey, repID)
 		} else {
 			s.mutex.Lock()
+			delete(s.queuedSegments, cacheKey)
+			delete(s.failedReps, repID)
 			// Create a copy of the segment to store in the session
 			segCopy := result.Task.Segment
 			// The ID for availableSegments should be the time, not the cache key
@@ -671,15 +2973,22 @@ func (s *StreamSession) resultLoop() {
 				}
 			}
 			if !found {
-				s.availableSegments[repID] = append(s.availableSegments[repID], &segCopy)
-				if len(s.availableSegments[repID]) > playlistLiveSegments+2 {
+				// Prefetched segments can complete out of order, so insert in time order within the period.
+				segs := append(s.availableSegments[repID], &segCopy)
+				for i := len(segs) - 1; i > 0 && segs[i-1].PeriodID == segCopy.PeriodID && segs[i-1].Time > segCopy.Time; i-- {
+					segs[i], segs[i-1] = segs[i-1], segs[i]
+				}
+				s.availableSegments[repID] = segs
+				s.listSegmentPaths(&segCopy)
+				if len(s.availableSegments[repID]) > s.windowSegments+2 {
+					s.discontinuitySeq[repID] += countDiscontinuities(s.availableSegments[repID][:2])
+					s.mediaSequence[repID] += 1 + hls.CountMissingSegments(s.availableSegments[repID][:2])
+					s.unlistSegmentPaths(s.availableSegments[repID][:1])
 					s.availableSegments[repID] = s.availableSegments[repID][1:]
-					s.mediaSequence[repID]++
 				}
 			}
 			s.mutex.Unlock()
 			s.Logger.Infof("Successfully downloaded and cached segment %s for rep %s", cacheKey, repID)
 		}
 	}
-	s.Logger.Infof("Result processing loop for %s stopped.", s.ChannelID)
 }
@@ -0,0 +1,80 @@
+package session
+
+import (
+	"dash2hlsd/internal/channels"
+	"dash2hlsd/internal/hls"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// SteeringManifestName is the name of a channel's steering manifest, next to its master playlist.
+const SteeringManifestName = "steering.json"
+
+// ErrSteeringDisabled is returned for steering requests on a channel without steering pathways.
+var ErrSteeringDisabled = errors.New("content steering is not enabled for this channel")
+
+// contentSteering returns the EXT-X-CONTENT-STEERING of the master playlist, or nil without steering pathways.
+func (s *StreamSession) contentSteering() *hls.ContentSteering {
+	pathways := s.channelCfg.SteeringPathways
+	if len(pathways) == 0 {
+		return nil
+	}
+	// The URI is relative to the master playlist, so it reaches the server through whichever host served it.
+	return &hls.ContentSteering{ServerURI: SteeringManifestName, PathwayID: pathways[0].ID}
+}
+
+// GetSteeringManifest returns the steering manifest players poll to pick a pathway. Pathways other than the
+// master playlist's are defined as clones of it on their own host.
+func (s *StreamSession) GetSteeringManifest() (hls.SteeringManifest, error) {
+	pathways := s.channelCfg.SteeringPathways
+	if len(pathways) == 0 {
+		return hls.SteeringManifest{}, ErrSteeringDisabled
+	}
+
+	s.mutex.RLock()
+	priority := slices.Clone(s.pathwayPriority)
+	s.mutex.RUnlock()
+	if priority == nil {
+		for _, p := range pathways {
+			priority = append(priority, p.ID)
+		}
+	}
+
+	manifest := hls.SteeringManifest{
+		Version:         hls.SteeringManifestVersion,
+		TTL:             s.channelCfg.GetSteeringTTL(),
+		PathwayPriority: priority,
+	}
+	for _, p := range pathways[1:] {
+		manifest.PathwayClones = append(manifest.PathwayClones, hls.PathwayClone{
+			BaseID:         pathways[0].ID,
+			ID:             p.ID,
+			URIReplacement: hls.URIReplacement{Host: p.Host},
+		})
+	}
+	return manifest, nil
+}
+
+// SetPathwayPriority changes the pathway order of the steering manifest, shifting players to the first
+// available pathway as they reload it. Every ID must be a configured pathway; an empty order restores the config order.
+func (s *StreamSession) SetPathwayPriority(priority []string) error {
+	pathways := s.channelCfg.SteeringPathways
+	if len(pathways) == 0 {
+		return ErrSteeringDisabled
+	}
+	for _, id := range priority {
+		if !slices.ContainsFunc(pathways, func(p channels.SteeringPathway) bool { return p.ID == id }) {
+			return fmt.Errorf("unknown pathway '%s'", id)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pathwayPriority = nil
+	if len(priority) > 0 {
+		s.pathwayPriority = slices.Clone(priority)
+	}
+	s.Logger.Infof("Steering pathway priority set to %v", priority)
+	return nil
+}
@@ -1,14 +1,29 @@
 package main_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"dash2hlsd/internal/api"
+	"dash2hlsd/internal/cache"
 	"dash2hlsd/internal/channels"
+	"dash2hlsd/internal/dash"
+	"dash2hlsd/internal/hls"
 	"dash2hlsd/internal/key"
+	"dash2hlsd/internal/session"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -25,6 +40,7 @@ func TestAPI_HandleKey(t *testing.T) {
 	mockConfig := &channels.ChannelConfig{
 		Channels: []channels.Channel{
 			{Id: "channel_with_key", Key: keyBytes},
+			{Id: "aes128_channel", Key: keyBytes, EncryptionMethod: channels.EncryptionAES128},
 		},
 	}
 
@@ -32,7 +48,7 @@ func TestAPI_HandleKey(t *testing.T) {
 	require.NoError(t, err, "Failed to create key service")
 
 	// Create the API handler, passing nil for the unused dependency.
-	handler := api.New(nil, keyService)
+	handler := api.New(nil, keyService, api.Options{})
 	server := httptest.NewServer(handler)
 	defer server.Close()
 
@@ -51,6 +67,18 @@ func TestAPI_HandleKey(t *testing.T) {
 		assert.Equal(t, keyBytes, body)
 	})
 
+	// The raw key is served whatever the playlist's encryption method.
+	t.Run("Key Found For AES-128", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/key/aes128_channel")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, keyBytes, body)
+	})
+
 	// 3. Test Case: Key Not Found
 	t.Run("Key Not Found", func(t *testing.T) {
 		req, _ := http.NewRequest("GET", server.URL+"/key/unknown_channel", nil)
@@ -61,3 +89,1578 @@ func TestAPI_HandleKey(t *testing.T) {
 		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 	})
 }
+
+// TestAPI_ClearKeyLicense verifies that the license endpoint maps the requested base64url key IDs
+// to the channel's keys, leaving out unknown ones, and that licenses are always temporary.
+func TestAPI_ClearKeyLicense(t *testing.T) {
+	kid, _ := hex.DecodeString("0737b75ee8906c00bb7bb8f666da72a0")
+	keyBytes, _ := hex.DecodeString("15f515458cdb5107452f943a111cbe89")
+	otherKID, _ := hex.DecodeString("e069fc056280e4caa7d0ffb99024c05a")
+
+	keyService, err := key.NewService(&channels.ChannelConfig{
+		Channels: []channels.Channel{{Id: "cenc_channel", Key: keyBytes, KID: kid}},
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(nil, keyService, api.Options{}))
+	defer server.Close()
+
+	requestLicense := func(channelId, body string) *http.Response {
+		resp, err := http.Post(server.URL+"/license/"+channelId, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+
+	t.Run("Known And Unknown Key IDs", func(t *testing.T) {
+		resp := requestLicense("cenc_channel", fmt.Sprintf(`{"kids":["%s","%s"],"type":"persistent-license"}`, encode(kid), encode(otherKID)))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+		var license struct {
+			Keys []struct {
+				Kty string `json:"kty"`
+				K   string `json:"k"`
+				KID string `json:"kid"`
+			} `json:"keys"`
+			Type string `json:"type"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&license))
+		require.Len(t, license.Keys, 1)
+		assert.Equal(t, "oct", license.Keys[0].Kty)
+		assert.Equal(t, encode(keyBytes), license.Keys[0].K)
+		assert.Equal(t, encode(kid), license.Keys[0].KID)
+		assert.Equal(t, "temporary", license.Type)
+	})
+
+	t.Run("No Matching Key ID", func(t *testing.T) {
+		resp := requestLicense("cenc_channel", fmt.Sprintf(`{"kids":["%s"]}`, encode(otherKID)))
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Unknown Channel", func(t *testing.T) {
+		resp := requestLicense("unknown_channel", fmt.Sprintf(`{"kids":["%s"]}`, encode(kid)))
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Invalid Request", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, requestLicense("cenc_channel", `not json`).StatusCode)
+		assert.Equal(t, http.StatusBadRequest, requestLicense("cenc_channel", `{"kids":[]}`).StatusCode)
+		assert.Equal(t, http.StatusBadRequest, requestLicense("cenc_channel", `{"kids":["!!"]}`).StatusCode)
+	})
+
+	t.Run("Oversized Request", func(t *testing.T) {
+		kids := strings.Repeat(`"`+encode(kid)+`",`, 1024)
+		resp := requestLicense("cenc_channel", `{"kids":[`+kids+`"`+encode(kid)+`"]}`)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+}
+
+// testAdminToken is the admin token of the test servers that use the /admin/ routes, which are only
+// served when a token is set.
+const testAdminToken = "s3cret"
+
+// adminGet is http.Get for an /admin/ route, authenticated with testAdminToken.
+func adminGet(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return http.DefaultClient.Do(req)
+}
+
+// TestAPI_HandleSessionWindow verifies that the window endpoint reflects the session's available segments.
+func TestAPI_HandleSessionWindow(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{AdminToken: testAdminToken}))
+	defer server.Close()
+
+	t.Run("No Session", func(t *testing.T) {
+		resp, err := adminGet(server.URL + "/admin/sessions/live/window")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(sess.GetWindow()["v1"].Segments) > 0
+	}, 10*time.Second, 50*time.Millisecond, "Expected the first video segment to be downloaded")
+
+	t.Run("Active Session", func(t *testing.T) {
+		resp, err := adminGet(server.URL + "/admin/sessions/live/window")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+		var window struct {
+			ChannelID       string                                  `json:"channelId"`
+			Representations map[string]session.RepresentationWindow `json:"representations"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&window))
+		assert.Equal(t, "live", window.ChannelID)
+
+		video, ok := window.Representations["v1"]
+		require.True(t, ok, "Expected a window for rep v1")
+		require.NotEmpty(t, video.Segments)
+		// The playhead starts 4 segments behind the 20s live edge.
+		assert.Equal(t, uint64(1080000), video.Segments[0].Time)
+		assert.Equal(t, uint64(180000), video.Segments[0].Duration)
+		assert.Equal(t, video.MediaSequence, video.Segments[0].MediaSequence)
+		assert.Equal(t, sess.GetWindow()["v1"].Segments[0], video.Segments[0])
+	})
+}
+
+// TestAPI_HandleSessionMapping verifies that the mapping report resolves an example segment to an origin URL
+// and an HLS URI that both serve it.
+func TestAPI_HandleSessionMapping(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{AdminToken: testAdminToken}))
+	defer server.Close()
+
+	resp, err := adminGet(server.URL + "/admin/sessions/live/mapping")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(sess.GetWindow()["v1"].Segments) > 0
+	}, 10*time.Second, 50*time.Millisecond, "Expected the first video segment to be downloaded")
+
+	resp, err = adminGet(server.URL + "/admin/sessions/live/mapping")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var report struct {
+		ChannelID       string                          `json:"channelId"`
+		BaseURL         string                          `json:"baseUrl"`
+		Representations []session.RepresentationMapping `json:"representations"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, origin.URL("/manifest.mpd"), report.BaseURL)
+	require.Len(t, report.Representations, 2)
+
+	video := report.Representations[0]
+	assert.Equal(t, "v1", video.RepresentationID)
+	assert.True(t, video.Downloaded)
+	assert.Empty(t, video.Errors)
+	assert.Equal(t, "seg-$RepresentationID$-$Time$.m4s", video.MediaTemplate)
+	assert.Equal(t, []string{origin.URL("/init-v1.mp4")}, video.InitURL)
+	assert.Equal(t, "/live/live/video/v1/playlist.m3u8", video.PlaylistURI)
+	assert.Equal(t, "/live/live/video/v1/init-v1.m4s", video.InitURI)
+
+	// The example is the first segment of the window, so the origin and the proxy both serve it.
+	assert.Equal(t, sess.GetWindow()["v1"].Segments[0].Time, video.SegmentTime)
+	require.NotEmpty(t, video.SegmentURL)
+	for _, segmentURL := range []string{video.SegmentURL[0], server.URL + video.SegmentURI} {
+		segResp, err := http.Get(segmentURL)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(segResp.Body)
+		segResp.Body.Close()
+		assert.Equal(t, http.StatusOK, segResp.StatusCode, "Expected %s to be served", segmentURL)
+		assert.Equal(t, fmt.Sprintf("segment:/seg-v1-%d.m4s", video.SegmentTime), string(body))
+	}
+}
+
+// TestAPI_SegmentTimingAllowOrigin verifies that segments carry Timing-Allow-Origin for allowed CORS origins only.
+func TestAPI_SegmentTimingAllowOrigin(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{
+		CORSAllowedOrigins: []string{"https://player.example.com"},
+	}))
+	defer server.Close()
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(sess.GetWindow()["v1"].Segments) > 0
+	}, 10*time.Second, 50*time.Millisecond, "Expected the first video segment to be downloaded")
+
+	segmentURL := server.URL + "/live/live/video/v1/1080000.m4s"
+
+	t.Run("Allowed Origin", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", segmentURL, nil)
+		req.Header.Set("Origin", "https://player.example.com")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "https://player.example.com", resp.Header.Get("Timing-Allow-Origin"))
+	})
+
+	t.Run("Disallowed Origin", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", segmentURL, nil)
+		req.Header.Set("Origin", "https://evil.example.com")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Timing-Allow-Origin"))
+	})
+}
+
+// TestAPI_CORS verifies that player routes carry CORS headers on every status, that their preflight
+// requests are answered, and that operator routes are left out.
+func TestAPI_CORS(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyBytes, _ := hex.DecodeString("15f515458cdb5107452f943a111cbe89")
+	keyService, err := key.NewService(&channels.ChannelConfig{Channels: []channels.Channel{{Id: "live", Key: keyBytes}}})
+	require.NoError(t, err)
+	newServer := func(allowed ...string) *httptest.Server {
+		server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{CORSAllowedOrigins: allowed}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	do := func(method, url string, header map[string]string) *http.Response {
+		req, _ := http.NewRequest(method, url, nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+	sess.SegCache.Set("live/v1/ranged", []byte("0123456789"))
+
+	t.Run("Any Origin", func(t *testing.T) {
+		server := newServer("*")
+		player := map[string]string{"Origin": "https://player.example.com"}
+		for _, tc := range []struct {
+			name   string
+			url    string
+			header map[string]string
+			status int
+		}{
+			{"key", server.URL + "/key/live", player, http.StatusOK},
+			{"missing key", server.URL + "/key/unknown", player, http.StatusNotFound},
+			{"partial segment", server.URL + "/live/live/video/v1/ranged", map[string]string{"Origin": "https://player.example.com", "Range": "bytes=0-1"}, http.StatusPartialContent},
+			{"missing segment", server.URL + "/live/live/video/v1/missing.m4s", player, http.StatusNotFound},
+		} {
+			resp := do("GET", tc.url, tc.header)
+			assert.Equal(t, tc.status, resp.StatusCode, tc.name)
+			assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"), tc.name)
+			assert.Contains(t, resp.Header.Get("Access-Control-Expose-Headers"), "Content-Range", tc.name)
+		}
+
+		resp := do("OPTIONS", server.URL+"/live/live/master.m3u8", map[string]string{
+			"Origin":                         "https://player.example.com",
+			"Access-Control-Request-Method":  "GET",
+			"Access-Control-Request-Headers": "range",
+		})
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+		assert.Contains(t, resp.Header.Get("Access-Control-Allow-Methods"), "GET")
+		assert.Contains(t, resp.Header.Get("Access-Control-Allow-Headers"), "Range")
+
+		resp = do("GET", server.URL+"/healthz", player)
+		assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"), "Operator routes should not carry CORS headers")
+	})
+
+	t.Run("Locked Down Origin", func(t *testing.T) {
+		server := newServer("https://player.example.com")
+		resp := do("GET", server.URL+"/key/live", map[string]string{"Origin": "https://player.example.com"})
+		assert.Equal(t, "https://player.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+		assert.Contains(t, resp.Header.Values("Vary"), "Origin")
+
+		resp = do("GET", server.URL+"/key/live", map[string]string{"Origin": "https://evil.example.com"})
+		assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+		resp = do("OPTIONS", server.URL+"/key/live", map[string]string{"Origin": "https://evil.example.com", "Access-Control-Request-Method": "GET"})
+		assert.NotEqual(t, http.StatusNoContent, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+	})
+}
+
+// TestAPI_ContentProtection verifies that the DRM endpoint exposes the PSSH boxes of each encrypted set.
+func TestAPI_ContentProtection(t *testing.T) {
+	protected := strings.Replace(testLiveMPD, `<AdaptationSet id="1" contentType="video" mimeType="video/mp4">`,
+		`<AdaptationSet id="1" contentType="video" mimeType="video/mp4" xmlns:cenc="urn:mpeg:cenc:2013">
+			<ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="cenc" cenc:default_KID="0737b75e-e890-6c00-bb7b-b8f666da72a0"/>
+			<ContentProtection schemeIdUri="urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"><cenc:pssh>d2lkZXZpbmU=</cenc:pssh></ContentProtection>
+			<ContentProtection schemeIdUri="urn:uuid:9a04f079-9840-4286-ab92-e65be0885f95"><cenc:pssh>cGxheXJlYWR5</cenc:pssh></ContentProtection>`, 1)
+	origin := newTestOrigin(t, protected)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/live/live/drm.json")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var body struct {
+		ChannelID          string                          `json:"channelId"`
+		ContentProtections []session.ContentProtectionInfo `json:"contentProtections"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "live", body.ChannelID)
+	require.Len(t, body.ContentProtections, 1, "Only the encrypted video set should be listed")
+	info := body.ContentProtections[0]
+	assert.Equal(t, "video", info.ContentType)
+	assert.Equal(t, "0737b75e-e890-6c00-bb7b-b8f666da72a0", info.DefaultKID)
+	assert.Equal(t, map[string]string{"widevine": "d2lkZXZpbmU=", "playready": "cGxheXJlYWR5"}, info.PSSH)
+}
+
+// TestAPI_SegmentStreaming verifies that a segment larger than the write buffer is streamed intact.
+func TestAPI_SegmentStreaming(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{SegmentWriteBufferSize: 4096}))
+	defer server.Close()
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+
+	large := make([]byte, 5*1024*1024+123) // Not a multiple of the buffer size
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	sess.SegCache.Set("live/v1/large", large)
+
+	resp, err := http.Get(server.URL + "/live/live/video/v1/large.m4s")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(large)), resp.ContentLength)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(large, body), "Streamed segment differs from the cached bytes")
+}
+
+// TestAPI_SegmentRange verifies that Range requests against a segment are served as partial content.
+func TestAPI_SegmentRange(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+	sess.SegCache.Set("live/v1/ranged", []byte("0123456789"))
+
+	testCases := []struct {
+		name          string
+		rangeHeader   string
+		expectedCode  int
+		expectedBody  string
+		expectedRange string
+	}{
+		{"no range", "", http.StatusOK, "0123456789", ""},
+		{"closed range", "bytes=2-5", http.StatusPartialContent, "2345", "bytes 2-5/10"},
+		{"open range", "bytes=7-", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"suffix range", "bytes=-3", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"end past the body", "bytes=8-100", http.StatusPartialContent, "89", "bytes 8-9/10"},
+		{"multi-range falls back to the full body", "bytes=0-1,4-5", http.StatusOK, "0123456789", ""},
+		{"start past the body", "bytes=10-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"malformed", "bytes=abc", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"inverted", "bytes=5-2", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", server.URL+"/live/live/video/v1/ranged.m4s", nil)
+			require.NoError(t, err)
+			if tc.rangeHeader != "" {
+				req.Header.Set("Range", tc.rangeHeader)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tc.expectedCode, resp.StatusCode)
+			assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+			assert.Equal(t, tc.expectedRange, resp.Header.Get("Content-Range"))
+			if tc.expectedCode != http.StatusRequestedRangeNotSatisfiable {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, tc.expectedBody, string(body))
+			}
+		})
+	}
+}
+
+// TestAPI_SegmentLastModified verifies that segments are served with the time they were cached as
+// Last-Modified, and that requests made with it as If-Modified-Since are answered 304.
+func TestAPI_SegmentLastModified(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+	cachedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	sess.SegCache.SetEntry("live/v1/dated", cache.Entry{Data: []byte("0123456789"), CachedAt: cachedAt})
+
+	resp, err := http.Get(server.URL + "/live/live/video/v1/dated.m4s")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "0123456789", string(body))
+	assert.Equal(t, "10", resp.Header.Get("Content-Length"))
+	assert.Equal(t, cachedAt.Format(http.TimeFormat), resp.Header.Get("Last-Modified"))
+
+	req, err := http.NewRequest("GET", server.URL+"/live/live/video/v1/dated.m4s", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-Modified-Since", cachedAt.Format(http.TimeFormat))
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
+
+// TestAPI_Head verifies that HEAD requests are answered with the GET headers and an empty body.
+func TestAPI_Head(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	keyBytes := []byte("0123456789abcdef")
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{Channels: []channels.Channel{{Id: "live", Key: keyBytes}}})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+	sess.SegCache.Set("live/v1/probe", []byte("0123456789"))
+
+	testCases := []struct {
+		path          string
+		contentType   string
+		contentLength int64 // -1 when it depends on the generated playlist
+		acceptRanges  string
+	}{
+		{"/live/live/master.m3u8", "application/vnd.apple.mpegurl", -1, ""},
+		{"/live/live/video/v1/playlist.m3u8", "application/vnd.apple.mpegurl", -1, ""},
+		{"/live/live/video/v1/probe.m4s", "video/mp4", 10, "bytes"},
+		{"/key/live", "application/octet-stream", int64(len(keyBytes)), ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			resp, err := http.Head(server.URL + tc.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tc.contentType, resp.Header.Get("Content-Type"))
+			assert.Equal(t, tc.acceptRanges, resp.Header.Get("Accept-Ranges"))
+			if tc.contentLength >= 0 {
+				assert.Equal(t, tc.contentLength, resp.ContentLength)
+			} else {
+				assert.Positive(t, resp.ContentLength)
+			}
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Empty(t, body)
+		})
+	}
+
+	t.Run("missing segment", func(t *testing.T) {
+		resp, err := http.Head(server.URL + "/live/live/video/v1/missing.m4s")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+// TestAPI_CacheControl verifies the Cache-Control headers of live playlists and segments.
+func TestAPI_CacheControl(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+	sess.SegCache.Set("live/v1/probe", []byte("0123456789"))
+
+	testCases := []struct {
+		path         string
+		cacheControl string
+	}{
+		{"/live/live/master.m3u8", "public, max-age=60"},
+		{"/live/live/video/v1/playlist.m3u8", "public, max-age=1"}, // Half of the 2s target duration
+		{"/live/live/video/v1/init.m4s", "no-cache"},
+		{"/live/live/video/v1/probe.m4s", "public, max-age=31536000, immutable"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			resp, err := http.Get(server.URL + tc.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tc.cacheControl, resp.Header.Get("Cache-Control"))
+		})
+	}
+}
+
+// TestAPI_ETag verifies that playlists and segments carry a content-based ETag and that requests
+// presenting it are answered 304 without a body.
+func TestAPI_ETag(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{PlaylistGzipLevel: gzip.DefaultCompression}))
+	defer server.Close()
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+	sess.SegCache.Set("live/v1/probe", []byte("0123456789"))
+
+	get := func(path string, header map[string]string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Header.Set("Accept-Encoding", "identity")
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for _, path := range []string{"/live/live/master.m3u8", "/live/live/video/v1/probe.m4s"} {
+		t.Run(path, func(t *testing.T) {
+			resp := get(path, nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			etag := resp.Header.Get("ETag")
+			require.NotEmpty(t, etag)
+			assert.Equal(t, etag, get(path, nil).Header.Get("ETag"), "The ETag should be stable for the same content")
+
+			resp = get(path, map[string]string{"If-None-Match": `"other", ` + etag})
+			assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+			body, _ := io.ReadAll(resp.Body)
+			assert.Empty(t, body)
+
+			assert.Equal(t, http.StatusOK, get(path, map[string]string{"If-None-Match": `"other"`}).StatusCode)
+		})
+	}
+
+	t.Run("Media Playlist", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			_, err := sess.GetMediaPlaylist("video", "v1")
+			return err == nil
+		}, 10*time.Second, 50*time.Millisecond, "Expected the media playlist to be generated")
+
+		resp := get("/live/live/video/v1/playlist.m3u8", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, session.ContentETag(body), resp.Header.Get("ETag"), "The cached ETag should match the body")
+
+		// The live playlist changes every segment, so retry until no segment lands between both requests.
+		assert.Eventually(t, func() bool {
+			playlist, err := sess.GetMediaPlaylistEntry("video", "v1")
+			require.NoError(t, err)
+			return get("/live/live/video/v1/playlist.m3u8", map[string]string{"If-None-Match": playlist.ETag}).StatusCode == http.StatusNotModified
+		}, 10*time.Second, 50*time.Millisecond, "Expected a 304 for the current media playlist")
+	})
+
+	t.Run("Compressed Playlist", func(t *testing.T) {
+		plain := get("/live/live/master.m3u8", nil).Header.Get("ETag")
+		resp := get("/live/live/master.m3u8", map[string]string{"Accept-Encoding": "gzip"})
+		require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "W/"+plain, resp.Header.Get("ETag"), "A compressed playlist should carry a weak ETag")
+
+		resp = get("/live/live/master.m3u8", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": "W/" + plain})
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+		assert.Equal(t, "W/"+plain, resp.Header.Get("ETag"))
+	})
+}
+
+// TestAPI_DASHRoutes verifies that segments are served from the cache at their origin paths under
+// /dash/ when enabled, and that the routes are absent otherwise.
+func TestAPI_DASHRoutes(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{DASHRoutes: true}))
+	defer server.Close()
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(sess.GetWindow()["v1"].Segments) > 0
+	}, 10*time.Second, 50*time.Millisecond, "Expected the first video segment to be downloaded")
+	segmentTime := sess.GetWindow()["v1"].Segments[0].Time
+
+	get := func(url string) (int, string) {
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	segmentPath := fmt.Sprintf("/seg-v1-%d.m4s", segmentTime)
+	requestsBefore := origin.Requests(segmentPath)
+	status, body := get(server.URL + "/dash/live" + segmentPath)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "segment:"+segmentPath, body)
+	assert.Equal(t, requestsBefore, origin.Requests(segmentPath), "The segment should be served from the cache")
+
+	status, body = get(server.URL + "/dash/live/init-v1.mp4")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "segment:/init-v1.mp4", body)
+
+	status, _ = get(server.URL + "/dash/live/seg-v1-1.m4s")
+	assert.Equal(t, http.StatusNotFound, status, "A path outside the window should not be found")
+
+	hlsOnly := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer hlsOnly.Close()
+	status, _ = get(hlsOnly.URL + "/dash/live" + segmentPath)
+	assert.Equal(t, http.StatusNotFound, status, "The DASH routes should be disabled by default")
+}
+
+// TestAPI_IFramePlaylist verifies that a trick mode track is advertised in the master playlist and
+// served as an I-frame playlist whose byte ranges cover the downloaded segments, and that players cannot
+// be pinned to it with ?video=.
+func TestAPI_IFramePlaylist(t *testing.T) {
+	trickModeMPD := strings.Replace(testLiveMPD,
+		`<Representation id="v1" bandwidth="1000000" codecs="avc1.640028" width="1280" height="720" frameRate="25"/>`,
+		`<Representation id="v1" bandwidth="1000000" codecs="avc1.640028" width="1280" height="720" frameRate="25"/>
+			<Representation id="v1_TrickMode" bandwidth="100000" codecs="avc1.640028" width="1280" height="720"/>`, 1)
+	origin := newTestOrigin(t, trickModeMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	get := func(path string) string {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	master := get("/live/live/master.m3u8")
+	assert.Contains(t, master, `#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=100000,CODECS="avc1.640028",RESOLUTION=1280x720,URI="video/v1_TrickMode/iframes.m3u8"`)
+	assert.Contains(t, master, "video/v1/playlist.m3u8")
+	assert.NotContains(t, master, "video/v1_TrickMode/playlist.m3u8")
+
+	playlist := get("/live/live/video/v1_TrickMode/iframes.m3u8")
+	assert.Contains(t, playlist, "#EXT-X-I-FRAMES-ONLY\n")
+	// The test origin serves "segment:" followed by the segment's path.
+	segmentSize := len("segment:/seg-v1_TrickMode-1080000.m4s")
+	assert.Contains(t, playlist, fmt.Sprintf("#EXT-X-BYTERANGE:%d@0\n1080000.m4s\n", segmentSize))
+	assert.Equal(t, "segment:/seg-v1_TrickMode-1080000.m4s", get("/live/live/video/v1_TrickMode/1080000.m4s"))
+
+	resp, err := http.Get(server.URL + "/live/live/master.m3u8?video=v1_TrickMode")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// TestAPI_PlaylistGzip verifies that playlists are gzip-compressed for clients that accept it, and segments never are.
+func TestAPI_PlaylistGzip(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{PlaylistGzipLevel: gzip.BestSpeed}))
+	defer server.Close()
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+	sess.SegCache.Set("live/v1/raw", []byte("segment bytes"))
+
+	// Disable the transport's transparent decompression to observe the encoding on the wire.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	request := func(method, path, acceptEncoding string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		require.NoError(t, err)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	get := func(path, acceptEncoding string) *http.Response { return request("GET", path, acceptEncoding) }
+
+	t.Run("compressed playlist", func(t *testing.T) {
+		resp := get("/live/live/master.m3u8", "gzip, deflate")
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+
+		zr, err := gzip.NewReader(resp.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(body), "#EXTM3U"))
+	})
+
+	t.Run("client without gzip", func(t *testing.T) {
+		resp := get("/live/live/master.m3u8", "")
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(body), "#EXTM3U"))
+	})
+
+	t.Run("HEAD matches GET", func(t *testing.T) {
+		for _, acceptEncoding := range []string{"gzip", ""} {
+			getResp := get("/live/live/video/v1/playlist.m3u8", acceptEncoding)
+			headResp := request("HEAD", "/live/live/video/v1/playlist.m3u8", acceptEncoding)
+			require.Equal(t, http.StatusOK, headResp.StatusCode)
+			for _, header := range []string{"Content-Type", "Content-Encoding", "Vary", "ETag", "Cache-Control"} {
+				assert.Equal(t, getResp.Header.Get(header), headResp.Header.Get(header), "%s with Accept-Encoding %q", header, acceptEncoding)
+			}
+		}
+	})
+
+	t.Run("gzip refused", func(t *testing.T) {
+		resp := get("/live/live/master.m3u8", "gzip;q=0")
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	})
+
+	t.Run("segment is not compressed", func(t *testing.T) {
+		resp := get("/live/live/video/v1/raw.m4s", "gzip")
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "segment bytes", string(body))
+	})
+}
+
+// TestAPI_RecoversPanics verifies that a panicking handler answers 500 and logs a stack trace.
+func TestAPI_RecoversPanics(t *testing.T) {
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	log := &recordingLogger{}
+
+	// Without a session manager, the playlist handler dereferences a nil pointer.
+	server := httptest.NewServer(api.New(nil, keyService, api.Options{Logger: log}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/live/any/master.m3u8")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.True(t, log.Contains("Panic while handling GET /live/any/master.m3u8"), "Expected the panic to be logged")
+	assert.True(t, log.Contains("goroutine"), "Expected a stack trace in the log")
+
+	// The server keeps serving after a panic.
+	resp, err = http.Get(server.URL + "/key/unknown")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// accessLogRecorder is a recordingLogger that also keeps the access log lines logged at the info level.
+type accessLogRecorder struct {
+	recordingLogger
+	lines []string
+}
+
+func (l *accessLogRecorder) Infof(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// Count returns the number of access log lines containing substr.
+func (l *accessLogRecorder) Count(substr string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := 0
+	for _, line := range l.lines {
+		if strings.Contains(line, substr) {
+			count++
+		}
+	}
+	return count
+}
+
+// TestAPI_AccessLogSampling verifies that only one in AccessLogSampleRate successful segment requests is
+// logged, while playlist requests and error responses are always logged.
+func TestAPI_AccessLogSampling(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	log := &accessLogRecorder{}
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{AccessLog: true, AccessLogSampleRate: 3, Logger: log}))
+	defer server.Close()
+
+	get := func(path string) int {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, get("/live/live/video/v1/playlist.m3u8"))
+	require.Eventually(t, func() bool {
+		return get("/live/live/video/v1/1080000.m4s") == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+
+	for range 5 {
+		require.Equal(t, http.StatusOK, get("/live/live/video/v1/1080000.m4s"))
+		require.Equal(t, http.StatusNotFound, get("/live/live/video/v1/missing.m4s"))
+	}
+	require.Equal(t, http.StatusOK, get("/live/live/video/v1/playlist.m3u8"))
+
+	assert.Equal(t, 2, log.Count("GET /live/live/video/v1/1080000.m4s 200"), "Expected one in three of the six segment requests to be logged")
+	assert.Equal(t, 5, log.Count("GET /live/live/video/v1/missing.m4s 404"), "Expected every error response to be logged")
+	assert.Equal(t, 2, log.Count("GET /live/live/video/v1/playlist.m3u8 200"), "Expected every playlist request to be logged")
+}
+
+// TestAPI_MasterPlaylistVideoHint verifies that ?video= pins the master playlist to a single video variant,
+// which is then downloaded even though it is not the automatically selected one.
+func TestAPI_MasterPlaylistVideoHint(t *testing.T) {
+	origin := newTestOrigin(t, testQualityRankingMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "ranked", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/live/ranked/master.m3u8?video=v_high_bw")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	master := string(body)
+	assert.Equal(t, 1, strings.Count(master, "#EXT-X-STREAM-INF"))
+	assert.Contains(t, master, "video/v_high_bw/playlist.m3u8")
+	assert.NotContains(t, master, "v_best")
+	assert.Contains(t, master, "audio/a_first/playlist.m3u8")
+
+	// The pinned variant's playlist becomes available as its segments are downloaded.
+	resp, err = http.Get(server.URL + "/live/ranked/video/v_high_bw/playlist.m3u8")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Positive(t, origin.Requests("/v_high_bw/init.mp4"))
+
+	resp, err = http.Get(server.URL + "/live/ranked/master.m3u8?video=missing")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// TestAPI_HealthChecks verifies the liveness and readiness probes.
+func TestAPI_HealthChecks(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+
+	status := func(handler http.Handler, path string) int {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("liveness", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, status(api.New(nil, keyService, api.Options{}), "/healthz"))
+	})
+
+	t.Run("not started", func(t *testing.T) {
+		cfg := &channels.ChannelConfig{Channels: []channels.Channel{{Id: "live", ManifestURL: origin.URL("/manifest.mpd")}}}
+		sessionMgr := session.NewManager(&mockLogger{}, cfg, dash.NewClient(&mockLogger{}))
+		assert.Equal(t, http.StatusServiceUnavailable, status(api.New(sessionMgr, keyService, api.Options{}), "/readyz"))
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+		assert.Equal(t, http.StatusOK, status(api.New(sessionMgr, keyService, api.Options{}), "/readyz"))
+		assert.Equal(t, http.StatusOK, status(api.New(sessionMgr, keyService, api.Options{ReadinessProbesOrigin: true}), "/readyz"))
+	})
+
+	t.Run("origin unreachable", func(t *testing.T) {
+		sessionMgr := newTestManager(t, channels.Channel{Id: "down", ManifestURL: origin.URL("/missing.mpd")})
+		assert.Equal(t, http.StatusOK, status(api.New(sessionMgr, keyService, api.Options{}), "/readyz"))
+		assert.Equal(t, http.StatusServiceUnavailable, status(api.New(sessionMgr, keyService, api.Options{ReadinessProbesOrigin: true}), "/readyz"))
+	})
+}
+
+// TestAPI_SegmentUnknownRepresentation verifies that a segment of a representation missing from the MPD
+// is reported as such, distinctly from a segment that is not cached yet, and that the EXT-X-MAP
+// init segment name resolves to the cached init segment.
+func TestAPI_SegmentUnknownRepresentation(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("/live/live/video/bogus/0.m4s")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Contains(t, body, "unknown representation 'bogus'")
+
+	code, body = get("/live/live/video/v1/999999999.m4s")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.NotContains(t, body, "unknown representation")
+
+	code, body = get("/live/live/video/v1/init-v1.m4s")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "segment:/init-v1.mp4", body)
+}
+
+// TestAPI_SegmentBaseByteRanges verifies that segments of a single-file SegmentBase origin are served
+// by fetching only their byte range, located through the sidx box, when a player first asks for them.
+func TestAPI_SegmentBaseByteRanges(t *testing.T) {
+	// The media file is a 100-byte init segment, a 68-byte sidx box and three subsegments.
+	initData := bytes.Repeat([]byte("i"), 100)
+	segments := [][]byte{bytes.Repeat([]byte("a"), 50), bytes.Repeat([]byte("b"), 60), bytes.Repeat([]byte("c"), 70)}
+	sidx := []byte{0, 0, 0, 68, 's', 'i', 'd', 'x', 0, 0, 0, 0, 0, 0, 0, 1, 0, 1, 0x5f, 0x90, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3}
+	for _, segment := range segments {
+		sidx = append(sidx, 0, 0, 0, byte(len(segment)), 0, 2, 0xbf, 0x20, 0x90, 0, 0, 0)
+	}
+	file := append(append([]byte(nil), initData...), sidx...)
+	for _, segment := range segments {
+		file = append(file, segment...)
+	}
+
+	var mu sync.Mutex
+	var ranges []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/manifest.mpd" {
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT6S" maxSegmentDuration="PT2S">
+	<Period id="p0">
+		<AdaptationSet contentType="video" mimeType="video/mp4">
+			<Representation id="v1" bandwidth="1000000" codecs="avc1.640028" width="1280" height="720">
+				<BaseURL>video.mp4</BaseURL>
+				<SegmentBase indexRange="100-167"><Initialization range="0-99"/></SegmentBase>
+			</Representation>
+		</AdaptationSet>
+	</Period>
+</MPD>`))
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		if r.Header.Get("Range") == "bytes=278-347" {
+			time.Sleep(200 * time.Millisecond) // Keeps the last segment in flight while it is requested again
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(file))
+	}))
+	defer origin.Close()
+	requestedRanges := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ranges...)
+	}
+
+	sessionMgr := newTestManager(t, channels.Channel{Id: "vod", ManifestURL: origin.URL + "/manifest.mpd"})
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	var playlist string
+	require.Eventually(t, func() bool {
+		var status int
+		status, playlist = get("/live/vod/video/v1/playlist.m3u8")
+		return status == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Contains(t, playlist, `#EXT-X-MAP:URI="init.m4s"`)
+	assert.Contains(t, playlist, "#EXTINF:2.000,\n0.m4s\n#EXTINF:2.000,\n180000.m4s\n#EXTINF:2.000,\n360000.m4s\n")
+
+	status, body := get("/live/vod/video/v1/init.m4s")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, string(initData), body)
+
+	status, body = get("/live/vod/video/v1/180000.m4s")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, string(segments[1]), body)
+
+	// A second request is served from the cache.
+	status, body = get("/live/vod/video/v1/180000.m4s")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, string(segments[1]), body)
+
+	// Concurrent requests for an uncached segment share a single fetch.
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, body := get("/live/vod/video/v1/360000.m4s")
+			assert.Equal(t, http.StatusOK, status)
+			assert.Equal(t, string(segments[2]), body)
+		}()
+	}
+	wg.Wait()
+
+	assert.ElementsMatch(t, []string{"bytes=100-167", "bytes=0-99", "bytes=218-277", "bytes=278-347"}, requestedRanges(),
+		"Only the index, the init segment and the requested segments should be fetched, each once")
+}
+
+// singleFileVOD returns a single media file of a 100-byte init segment, a sidx box and segmentCount
+// 10-byte subsegments of two seconds each, along with the static MPD listing it as video.mp4 and the
+// byte range of its sidx box.
+func singleFileVOD(segmentCount int) (file []byte, manifest, indexRange string) {
+	sidx := []byte{0, 0, 0, byte(32 + 12*segmentCount), 's', 'i', 'd', 'x', 0, 0, 0, 0, 0, 0, 0, 1, 0, 1, 0x5f, 0x90, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(segmentCount)}
+	for range segmentCount {
+		sidx = append(sidx, 0, 0, 0, 10, 0, 2, 0xbf, 0x20, 0x90, 0, 0, 0)
+	}
+	file = append(bytes.Repeat([]byte("i"), 100), sidx...)
+	file = append(file, bytes.Repeat([]byte("s"), 10*segmentCount)...)
+	indexRange = fmt.Sprintf("100-%d", 100+len(sidx)-1)
+	manifest = fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT%dS" maxSegmentDuration="PT2S">
+	<Period id="p0">
+		<AdaptationSet contentType="video" mimeType="video/mp4">
+			<Representation id="v1" bandwidth="1000000" codecs="avc1.640028" width="1280" height="720">
+				<BaseURL>video.mp4</BaseURL>
+				<SegmentBase indexRange="%s"><Initialization range="0-99"/></SegmentBase>
+			</Representation>
+		</AdaptationSet>
+	</Period>
+</MPD>`, 2*segmentCount, indexRange)
+	return file, manifest, indexRange
+}
+
+// TestAPI_OnDemandFetchLimit verifies that a player asking for many uncached segments of a single-file
+// origin at once gets them all, while no more than the channel's limit are fetched from the origin at once.
+func TestAPI_OnDemandFetchLimit(t *testing.T) {
+	const segmentCount, limit = 6, 2
+	file, manifest, indexRange := singleFileVOD(segmentCount)
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/manifest.mpd" {
+			fmt.Fprint(w, manifest)
+			return
+		}
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "bytes=0-99" && rangeHeader != "bytes="+indexRange {
+			mu.Lock()
+			inFlight++
+			maxInFlight = max(maxInFlight, inFlight)
+			mu.Unlock()
+			<-release
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(file))
+	}))
+	defer origin.Close()
+	defer close(release)
+	fetching := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return inFlight
+	}
+
+	sessionMgr := newTestManager(t, channels.Channel{Id: "vod", ManifestURL: origin.URL + "/manifest.mpd", MaxOnDemandFetches: limit})
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(server.URL + "/live/vod/video/v1/playlist.m3u8")
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+
+	statuses := make(chan int, segmentCount)
+	for i := range segmentCount {
+		go func() {
+			resp, err := http.Get(fmt.Sprintf("%s/live/vod/video/v1/%d.m4s", server.URL, i*180000))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+
+	require.Eventually(t, func() bool { return fetching() == limit }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, limit, fetching(), "Fetches beyond the limit should wait for a slot")
+
+	release <- struct{}{} // Let one fetch finish, which frees a slot for a waiting one
+	require.Eventually(t, func() bool { return fetching() == limit }, 5*time.Second, 10*time.Millisecond)
+	for range segmentCount - 1 {
+		release <- struct{}{}
+	}
+	for range segmentCount {
+		assert.Equal(t, http.StatusOK, <-statuses)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, limit, maxInFlight)
+}
+
+// stalledBodyWriter sends the response headers at once but holds the body until release is closed.
+type stalledBodyWriter struct {
+	http.ResponseWriter
+	release <-chan struct{}
+}
+
+func (w stalledBodyWriter) Write(p []byte) (int, error) {
+	w.ResponseWriter.(http.Flusher).Flush()
+	<-w.release
+	return w.ResponseWriter.Write(p)
+}
+
+// TestAPI_OnDemandFetchRetryLater verifies that a segment request that finds no free on-demand fetch slot
+// in time is answered with 503 and Retry-After, and that a fetch its player gave up on keeps its slot
+// until the origin answers, and is still cached.
+func TestAPI_OnDemandFetchRetryLater(t *testing.T) {
+	file, manifest, indexRange := singleFileVOD(2)
+	release := make(chan struct{})
+	var fetching atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/manifest.mpd" {
+			fmt.Fprint(w, manifest)
+			return
+		}
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "bytes=0-99" && rangeHeader != "bytes="+indexRange {
+			fetching.Add(1)
+			defer fetching.Add(-1)
+			w = stalledBodyWriter{ResponseWriter: w, release: release}
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(file))
+	}))
+	defer origin.Close()
+	var releaseOnce sync.Once
+	releaseOrigin := func() { releaseOnce.Do(func() { close(release) }) }
+	defer releaseOrigin()
+
+	sessionMgr := newTestManager(t, channels.Channel{Id: "vod", ManifestURL: origin.URL + "/manifest.mpd", MaxOnDemandFetches: 1})
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(server.URL + "/live/vod/video/v1/playlist.m3u8")
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+
+	get := func(segment string) <-chan *http.Response {
+		responses := make(chan *http.Response, 1)
+		go func() {
+			resp, err := http.Get(server.URL + "/live/vod/video/v1/" + segment)
+			if err != nil {
+				responses <- nil
+				return
+			}
+			resp.Body.Close()
+			responses <- resp
+		}()
+		return responses
+	}
+
+	first := get("0.m4s")
+	require.Eventually(t, func() bool { return fetching.Load() > 0 }, 5*time.Second, 10*time.Millisecond)
+	// The second request starts later, so its wait for a slot outlasts the first fetch's player.
+	time.Sleep(time.Second)
+	second := get("180000.m4s")
+
+	resp := <-first
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "The first request should give up on its stalled fetch")
+	resp = <-second
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "The stalled fetch should keep its slot")
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	releaseOrigin()
+	require.Eventually(t, func() bool { return fetching.Load() == 0 }, 5*time.Second, 10*time.Millisecond)
+	sess, err := sessionMgr.GetOrCreateSession("vod")
+	require.NoError(t, err)
+	cacheKey, err := sess.SegmentCacheKey("v1", "0.m4s")
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, cached := sess.SegCache.Size(cacheKey)
+		return cached
+	}, 5*time.Second, 10*time.Millisecond, "The fetch the player gave up on should still be cached")
+}
+
+// TestAPI_MasterPlaylistWarmup verifies that the master playlist of a channel with a warm-up timeout waits
+// for its media playlists, answering 503 with Retry-After when they are not ready in time.
+func TestAPI_MasterPlaylistWarmup(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "warm", ManifestURL: origin.URL("/manifest.mpd"), WarmupTimeoutSeconds: 2})
+	downloader := &heldDownloader{release: make(chan struct{})}
+	sessionMgr.SetDownloaderFactory(func() session.Downloader { return downloader })
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Get(server.URL + "/live/warm/master.m3u8")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.GreaterOrEqual(t, time.Since(start), 2*time.Second, "Expected the master playlist to wait for the warm-up timeout")
+
+	close(downloader.release)
+	resp, err = http.Get(server.URL + "/live/warm/master.m3u8")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	sess, err := sessionMgr.GetOrCreateSession("warm")
+	require.NoError(t, err)
+	for _, playlist := range []struct{ mediaType, repId string }{{"video", "v1"}, {"audio", "a1"}} {
+		_, err := sess.GetMediaPlaylist(playlist.mediaType, playlist.repId)
+		assert.NoError(t, err, "Expected the %s playlist to be ready once the master playlist is served", playlist.repId)
+	}
+}
+
+// TestAPI_MasterPlaylistWarmupSkipsFailedRepresentation verifies that the master playlist does not wait out
+// the warm-up timeout for a representation whose segments the origin does not serve.
+func TestAPI_MasterPlaylistWarmupSkipsFailedRepresentation(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/manifest.mpd":
+			w.Write([]byte(testLiveMPD))
+		case strings.HasPrefix(r.URL.Path, "/seg-a1-"):
+			http.NotFound(w, r)
+		default:
+			w.Write([]byte("segment:" + r.URL.Path))
+		}
+	}))
+	defer origin.Close()
+	sessionMgr := newTestManager(t, channels.Channel{Id: "warm", ManifestURL: origin.URL + "/manifest.mpd", WarmupTimeoutSeconds: 30})
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Get(server.URL + "/live/warm/master.m3u8")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Less(t, time.Since(start), 10*time.Second, "Expected the master playlist not to wait for the failed audio representation")
+}
+
+func TestAPI_ContentSteering(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{
+		Id:          "live",
+		ManifestURL: origin.URL("/manifest.mpd"),
+		SteeringPathways: []channels.SteeringPathway{
+			{ID: "cdn-a"},
+			{ID: "cdn-b", Host: "cdn-b.example.com"},
+		},
+		SteeringTTL: 60,
+	})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{AdminToken: testAdminToken}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/live/live/master.m3u8")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "#EXT-X-CONTENT-STEERING:SERVER-URI=\"steering.json\",PATHWAY-ID=\"cdn-a\"\n")
+	assert.Contains(t, string(body), ",PATHWAY-ID=\"cdn-a\"\nvideo/v1/playlist.m3u8\n")
+
+	getManifest := func() hls.SteeringManifest {
+		resp, err := http.Get(server.URL + "/live/live/steering.json")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "max-age=60", resp.Header.Get("Cache-Control"))
+		var manifest hls.SteeringManifest
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&manifest))
+		return manifest
+	}
+
+	manifest := getManifest()
+	assert.Equal(t, 1, manifest.Version)
+	assert.Equal(t, 60, manifest.TTL)
+	assert.Equal(t, []string{"cdn-a", "cdn-b"}, manifest.PathwayPriority)
+	assert.Equal(t, []hls.PathwayClone{{BaseID: "cdn-a", ID: "cdn-b", URIReplacement: hls.URIReplacement{Host: "cdn-b.example.com"}}}, manifest.PathwayClones)
+
+	setPriority := func(body string) int {
+		req, err := http.NewRequest(http.MethodPut, server.URL+"/admin/sessions/live/steering", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Shifting players to the second CDN.
+	assert.Equal(t, http.StatusNoContent, setPriority(`{"pathwayPriority":["cdn-b","cdn-a"]}`))
+	assert.Equal(t, []string{"cdn-b", "cdn-a"}, getManifest().PathwayPriority)
+
+	assert.Equal(t, http.StatusBadRequest, setPriority(`{"pathwayPriority":["cdn-c"]}`))
+	assert.Equal(t, http.StatusNoContent, setPriority(`{"pathwayPriority":[]}`))
+	assert.Equal(t, []string{"cdn-a", "cdn-b"}, getManifest().PathwayPriority)
+}
+
+// TestAPI_PlaylistNotReady verifies that a request for a playlist that is warming up waits until the
+// playlist is generated, while one for a representation the MPD does not have is answered 404 at once.
+func TestAPI_PlaylistNotReady(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+	downloader := &heldDownloader{release: make(chan struct{})}
+	sessionMgr.SetDownloaderFactory(func() session.Downloader { return downloader })
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Get(server.URL + "/live/live/video/missing/playlist.m3u8")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Less(t, time.Since(start), time.Second, "Expected an unknown representation not to be waited for")
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(server.URL + "/live/live/video/v1/playlist.m3u8")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	select {
+	case code := <-status:
+		t.Fatalf("Expected the request to wait for the playlist, got status %d", code)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	close(downloader.release)
+	select {
+	case code := <-status:
+		assert.Equal(t, http.StatusOK, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the waiting request to be answered once the playlist is generated")
+	}
+}
+
+// TestAPI_MaxPlaylistWaiters verifies that requests beyond MaxPlaylistWaiters for a playlist that is not
+// ready are answered 503 at once, and that waiters leaving free their slot.
+func TestAPI_MaxPlaylistWaiters(t *testing.T) {
+	origin := newTestOrigin(t, testQualityRankingMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{MaxPlaylistWaiters: 2}))
+	defer server.Close()
+
+	// A representation that is not selected is never downloaded, so requests for its playlist wait.
+	const path = "/live/live/video/v_high_bw/playlist.m3u8"
+	ctx, cancel := context.WithCancel(context.Background())
+	var waiters sync.WaitGroup
+	for range 2 {
+		waiters.Add(1)
+		go func() {
+			defer waiters.Done()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+path, nil)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		start := time.Now()
+		resp, err = http.Get(server.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusServiceUnavailable && time.Since(start) < time.Second
+	}, 5*time.Second, 50*time.Millisecond, "Expected a fast 503 once two requests are waiting")
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// Other representations are counted separately.
+	resp, err = http.Get(server.URL + "/live/live/video/v_best/playlist.m3u8")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Once the waiters give up, new requests may wait again.
+	cancel()
+	waiters.Wait()
+	require.Eventually(t, func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return errors.Is(err, context.DeadlineExceeded) // Waiting rather than turned away
+		}
+		resp.Body.Close()
+		return false
+	}, 5*time.Second, 50*time.Millisecond, "Expected requests to wait again once the slots are free")
+}
+
+// TestAPI_AdminSessions verifies that sessions can be listed and terminated through the admin routes,
+// which require the admin token, and which are not served at all without one.
+func TestAPI_AdminSessions(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{AdminToken: testAdminToken}))
+	defer server.Close()
+	open := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer open.Close()
+
+	do := func(method, path, token string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	sess, err := sessionMgr.GetOrCreateSession("live")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(sess.GetWindow()["v1"].Segments) > 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	for _, token := range []string{"", "wrong"} {
+		resp := do(http.MethodGet, "/admin/sessions", token)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Bearer")
+	}
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/sessions/live/window", "").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodDelete, "/admin/sessions/live", "").StatusCode)
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		req, _ := http.NewRequest(method, open.URL+"/admin/sessions/live", nil)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Admin routes should not be served without a token")
+	}
+	_, found := sessionMgr.GetSession("live")
+	require.True(t, found)
+
+	resp := do(http.MethodGet, "/admin/sessions", testAdminToken)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var listing struct {
+		Sessions []session.SessionInfo `json:"sessions"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&listing))
+	require.Len(t, listing.Sessions, 1)
+	info := listing.Sessions[0]
+	assert.Equal(t, "live", info.ChannelID)
+	assert.False(t, info.CreatedAt.IsZero())
+	assert.False(t, info.LastAccess.Before(info.CreatedAt))
+	assert.GreaterOrEqual(t, info.Playhead, 12.0, "Expected the playhead to start 4 segments behind the 20s live edge")
+	assert.Positive(t, info.Segments["v1"])
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/admin/sessions/live", testAdminToken).StatusCode)
+	_, found = sessionMgr.GetSession("live")
+	assert.False(t, found, "Expected the session to be removed")
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/admin/sessions/live", testAdminToken).StatusCode)
+
+	resp = do(http.MethodGet, "/admin/sessions", testAdminToken)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&listing))
+	assert.Empty(t, listing.Sessions)
+}
@@ -2,11 +2,14 @@ package main_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"dash2hlsd/internal/channels"
 	"encoding/hex"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 const testChannelsJSON = `{
@@ -99,3 +102,515 @@ func TestLoadConfig(t *testing.T) {
 		t.Errorf("Expected Channel 2 Key to be '%x', got '%x'", expectedKey2, ch2.Key)
 	}
 }
+
+// TestLoadConfig_FailoverManifests verifies that failover manifest URLs are appended after the primary.
+func TestLoadConfig_FailoverManifests(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "ch", "Manifest": "https://a/manifest.mpd", "Manifests": ["https://b/manifest.mpd"]}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	urls := config.Channels[0].GetManifestURLs()
+	if len(urls) != 2 || urls[0] != "https://a/manifest.mpd" || urls[1] != "https://b/manifest.mpd" {
+		t.Errorf("Expected primary then failover manifest URLs, got %v", urls)
+	}
+}
+
+// TestLoadConfig_Gzip verifies that a gzip-compressed config parses identically to the plain version.
+func TestLoadConfig_Gzip(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	plainPath := filepath.Join(tmpDir, "channels.json")
+	if err := os.WriteFile(plainPath, []byte(testChannelsJSON), 0644); err != nil {
+		t.Fatalf("Failed to write plain config file: %v", err)
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(testChannelsJSON))
+	zw.Close()
+
+	// The second compressed copy has no .gz extension, so it must be detected by its magic bytes.
+	for _, name := range []string{"channels.json.gz", "channels.compressed"} {
+		t.Run(name, func(t *testing.T) {
+			gzPath := filepath.Join(tmpDir, name)
+			if err := os.WriteFile(gzPath, compressed.Bytes(), 0644); err != nil {
+				t.Fatalf("Failed to write gzipped config file: %v", err)
+			}
+
+			plain, err := channels.LoadConfig(plainPath)
+			if err != nil {
+				t.Fatalf("LoadConfig failed for plain config: %v", err)
+			}
+			gzipped, err := channels.LoadConfig(gzPath)
+			if err != nil {
+				t.Fatalf("LoadConfig failed for gzipped config: %v", err)
+			}
+			if !reflect.DeepEqual(plain, gzipped) {
+				t.Errorf("Gzipped config differs from plain config:\nplain:   %+v\ngzipped: %+v", plain, gzipped)
+			}
+		})
+	}
+}
+
+// TestLoadConfig_KeyID verifies that the key ID half of a 'kid:key' pair is kept.
+func TestLoadConfig_KeyID(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	if err := os.WriteFile(configPath, []byte(testChannelsJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	expectedKID, _ := hex.DecodeString("0737b75ee8906c00bb7bb8f666da72a0")
+	if !bytes.Equal(config.Channels[0].KID, expectedKID) {
+		t.Errorf("Expected Channel 1 KID to be '%x', got '%x'", expectedKID, config.Channels[0].KID)
+	}
+}
+
+// TestLoadConfig_StartupPolicy verifies that startup policies are parsed and unknown ones rejected.
+func TestLoadConfig_StartupPolicy(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "StartupPolicy": "latency"}, {"Id": "b", "Manifest": "https://b/m.mpd"}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.Channels[0].StartupPolicy != channels.StartupPolicyLatency {
+		t.Errorf("Expected the latency policy, got '%s'", config.Channels[0].StartupPolicy)
+	}
+	if config.Channels[1].StartupPolicy != channels.StartupPolicyDefault {
+		t.Errorf("Expected the default policy, got '%s'", config.Channels[1].StartupPolicy)
+	}
+
+	badJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "StartupPolicy": "fastest"}]}`
+	if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+	if _, err := channels.LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for an unknown startup policy")
+	}
+}
+
+// TestLoadConfig_LiveDelaySeconds verifies that the live delay is parsed and negative values rejected.
+func TestLoadConfig_LiveDelaySeconds(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "LiveDelaySeconds": 12}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.Channels[0].LiveDelaySeconds != 12 {
+		t.Errorf("Expected a live delay of 12, got %d", config.Channels[0].LiveDelaySeconds)
+	}
+
+	badJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "LiveDelaySeconds": -1}]}`
+	if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+	if _, err := channels.LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for a negative live delay")
+	}
+}
+
+// TestLoadConfig_PlaylistWindowSegments verifies the window default and the minimum of three segments.
+func TestLoadConfig_PlaylistWindowSegments(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "PlaylistWindowSegments": 10}, {"Id": "b", "Manifest": "https://b/m.mpd"}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if got := config.Channels[0].GetPlaylistWindowSegments(); got != 10 {
+		t.Errorf("Expected a window of 10 segments, got %d", got)
+	}
+	if got := config.Channels[1].GetPlaylistWindowSegments(); got != channels.DefaultPlaylistWindowSegments {
+		t.Errorf("Expected the default window of %d segments, got %d", channels.DefaultPlaylistWindowSegments, got)
+	}
+
+	badJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "PlaylistWindowSegments": 2}]}`
+	if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+	if _, err := channels.LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for a window shorter than three segments")
+	}
+}
+
+// TestLoadConfig_EncryptionMethod verifies the encryption method default, parsing and validation.
+func TestLoadConfig_EncryptionMethod(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "EncryptionMethod": "AES-128"}, {"Id": "b", "Manifest": "https://b/m.mpd"}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.Channels[0].EncryptionMethod != channels.EncryptionAES128 {
+		t.Errorf("Expected aes-128, got '%s'", config.Channels[0].EncryptionMethod)
+	}
+	if config.Channels[1].EncryptionMethod != channels.EncryptionSampleAES {
+		t.Errorf("Expected the sample-aes default, got '%s'", config.Channels[1].EncryptionMethod)
+	}
+
+	badJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "EncryptionMethod": "aes-256"}]}`
+	if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+	if _, err := channels.LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for an unknown encryption method")
+	}
+}
+
+func TestLoadConfig_IV(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "IV": "0x000102030405060708090a0b0c0d0e0f", "DeriveSegmentIV": true}, {"Id": "b", "Manifest": "https://b/m.mpd"}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	expectedIV := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	if !bytes.Equal(config.Channels[0].IV, expectedIV) {
+		t.Errorf("Expected IV %x, got %x", expectedIV, config.Channels[0].IV)
+	}
+	if !config.Channels[0].DeriveSegmentIV {
+		t.Error("Expected DeriveSegmentIV to be set")
+	}
+	if config.Channels[1].IV != nil {
+		t.Errorf("Expected no IV by default, got %x", config.Channels[1].IV)
+	}
+
+	badJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "IV": "0102"}]}`
+	if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+	if _, err := channels.LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for an IV that is not 16 bytes")
+	}
+}
+
+func TestLoadConfig_TargetDuration(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "TargetDuration": 6}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.Channels[0].TargetDuration != 6 {
+		t.Errorf("Expected a target duration of 6, got %d", config.Channels[0].TargetDuration)
+	}
+
+	badJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "TargetDuration": -1}]}`
+	if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+	if _, err := channels.LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for a negative target duration")
+	}
+}
+
+func TestLoadConfig_KeyURITemplate(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "KeyURITemplate": "https://keys/{channelId}/{kid}"}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.Channels[0].KeyURITemplate != "https://keys/{channelId}/{kid}" {
+		t.Errorf("Expected the key URI template to be loaded, got %q", config.Channels[0].KeyURITemplate)
+	}
+
+	// The template is written into a quoted EXT-X-KEY attribute, which a quote or line break would break out of.
+	for _, template := range []string{`https://keys/{kid}\",METHOD=NONE`, `https://keys/{kid}\n#EXT-X-ENDLIST`} {
+		badJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "KeyURITemplate": "` + template + `"}]}`
+		if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+			t.Fatalf("Failed to write temporary config file: %v", err)
+		}
+		if _, err := channels.LoadConfig(configPath); err == nil {
+			t.Errorf("Expected an error for the key URI template %q", template)
+		}
+	}
+}
+
+func TestLoadConfig_MasterPlaylistMaxAge(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "MasterPlaylistMaxAge": 10}, {"Id": "b", "Manifest": "https://b/m.mpd"}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if got := config.Channels[0].GetMasterPlaylistMaxAge(); got != 10*time.Second {
+		t.Errorf("Expected a max age of 10s, got %v", got)
+	}
+	if got := config.Channels[1].GetMasterPlaylistMaxAge(); got != channels.DefaultMasterPlaylistMaxAge*time.Second {
+		t.Errorf("Expected the default max age, got %v", got)
+	}
+
+	badJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "MasterPlaylistMaxAge": -5}]}`
+	if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+	if _, err := channels.LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for a negative master playlist max age")
+	}
+}
+
+func TestLoadConfig_SteeringPathways(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "SteeringPathways": [{"Id": "cdn-a"}, {"Id": "cdn-b", "Host": "b.example.com"}]}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	pathways := config.Channels[0].SteeringPathways
+	if len(pathways) != 2 || pathways[0].ID != "cdn-a" || pathways[1].Host != "b.example.com" {
+		t.Errorf("Unexpected steering pathways: %+v", pathways)
+	}
+	if got := config.Channels[0].GetSteeringTTL(); got != channels.DefaultSteeringTTL {
+		t.Errorf("Expected the default steering TTL, got %d", got)
+	}
+
+	for _, bad := range []string{
+		`[{"Id": "cdn-a"}, {"Id": "cdn-b"}]`,
+		`[{"Id": "cdn-a"}, {"Id": "cdn-a", "Host": "b.example.com"}]`,
+		`[{"Id": "cdn a"}]`,
+	} {
+		badJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "SteeringPathways": ` + bad + `}]}`
+		if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+			t.Fatalf("Failed to write temporary config file: %v", err)
+		}
+		if _, err := channels.LoadConfig(configPath); err == nil {
+			t.Errorf("Expected an error for steering pathways %s", bad)
+		}
+	}
+}
+
+func TestLoadConfig_PrewarmSegments(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	badJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "PrewarmSegments": -1}]}`
+	if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+	if _, err := channels.LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for a negative number of prewarm segments")
+	}
+}
+
+func TestLoadConfig_VideoLadder(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [
+		{"Id": "a", "Manifest": "https://a/m.mpd"},
+		{"Id": "b", "Manifest": "https://b/m.mpd", "VideoLadder": "ALL", "MaxVideoVariants": 3},
+		{"Id": "c", "Manifest": "https://c/m.mpd", "VideoLadder": "list", "VideoRepresentations": ["v1", "v2"]}
+	]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if got := config.Channels[0].VideoLadder; got != channels.VideoLadderSingleTop {
+		t.Errorf("Expected the single-top ladder by default, got '%s'", got)
+	}
+	if got := config.Channels[1]; got.VideoLadder != channels.VideoLadderAll || got.MaxVideoVariants != 3 {
+		t.Errorf("Expected the all ladder capped to 3 variants, got '%s' capped to %d", got.VideoLadder, got.MaxVideoVariants)
+	}
+	if got := config.Channels[2]; got.VideoLadder != channels.VideoLadderList || len(got.VideoRepresentations) != 2 {
+		t.Errorf("Expected the list ladder with 2 representations, got '%s' with %v", got.VideoLadder, got.VideoRepresentations)
+	}
+
+	for _, bad := range []string{
+		`"VideoLadder": "top"`,
+		`"VideoLadder": "list"`,
+		`"VideoLadder": "all", "MaxVideoVariants": -1`,
+	} {
+		badJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", ` + bad + `}]}`
+		if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+			t.Fatalf("Failed to write temporary config file: %v", err)
+		}
+		if _, err := channels.LoadConfig(configPath); err == nil {
+			t.Errorf("Expected an error for %s", bad)
+		}
+	}
+}
+
+func TestLoadConfig_QualityCaps(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "MaxWidth": 1280, "MaxHeight": 720, "MaxBandwidth": 3000000}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if got := config.Channels[0]; got.MaxWidth != 1280 || got.MaxHeight != 720 || got.MaxBandwidth != 3000000 {
+		t.Errorf("Expected caps of 1280x720 at 3000000 bps, got %dx%d at %d bps", got.MaxWidth, got.MaxHeight, got.MaxBandwidth)
+	}
+
+	badJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "MaxHeight": -720}]}`
+	if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+	if _, err := channels.LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for a negative quality cap")
+	}
+}
+
+// TestLoadConfig_SessionIdleTimeout verifies that the idle timeout is loaded and must not be negative.
+func TestLoadConfig_SessionIdleTimeout(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"SessionIdleTimeout": 300, "Channels": [{"Id": "a", "Manifest": "https://a/m.mpd"}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.SessionIdleTimeout != 300 {
+		t.Errorf("Expected a session idle timeout of 300, got %d", config.SessionIdleTimeout)
+	}
+
+	badJSON := `{"SessionIdleTimeout": -1, "Channels": [{"Id": "a", "Manifest": "https://a/m.mpd"}]}`
+	if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+	if _, err := channels.LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for a negative session idle timeout")
+	}
+}
+
+// TestLoadConfig_InitBoxEdits verifies that the init box edits are loaded with their payloads decoded,
+// and that malformed box paths and payloads are rejected.
+func TestLoadConfig_InitBoxEdits(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "StripInitBoxes": ["moov/trak/edts"], "ReplaceInitBoxes": {"moov/mvhd": "0a0b"}}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	got := config.Channels[0]
+	if len(got.StripInitBoxes) != 1 || got.StripInitBoxes[0] != "moov/trak/edts" {
+		t.Errorf("Expected to strip moov/trak/edts, got %v", got.StripInitBoxes)
+	}
+	if payload := got.ReplaceInitBoxes["moov/mvhd"]; !bytes.Equal(payload, []byte{0x0a, 0x0b}) {
+		t.Errorf("Expected the moov/mvhd payload to be 0a0b, got %x", payload)
+	}
+
+	for _, badJSON := range []string{
+		`{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "StripInitBoxes": ["moov/edits"]}]}`,
+		`{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "StripInitBoxes": ["moov//edts"]}]}`,
+		`{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "ReplaceInitBoxes": {"moov/mvhd": "xyz"}}]}`,
+	} {
+		if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+			t.Fatalf("Failed to write temporary config file: %v", err)
+		}
+		if _, err := channels.LoadConfig(configPath); err == nil {
+			t.Errorf("Expected an error for %s", badJSON)
+		}
+	}
+}
+
+// TestLoadConfig_MultipleKeysAndEnv verifies that environment references are expanded and that every
+// key pair of a channel is kept.
+func TestLoadConfig_MultipleKeysAndEnv(t *testing.T) {
+	t.Setenv("TEST_ORIGIN", "https://origin.example")
+	t.Setenv("TEST_SECOND_KEY", "d3693103f232f28b4781bbc7e499c43a")
+	configPath := filepath.Join(t.TempDir(), "channels.json")
+	configJSON := `{"Channels": [{"Id": "a", "Manifest": "${TEST_ORIGIN}/a.mpd", "Keys": [
+		"0737b75ee8906c00bb7bb8f666da72a0:15f515458cdb5107452f943a111cbe89",
+		"e069fc056280e4caa7d0ffb99024c05a:${TEST_SECOND_KEY}"
+	]}]}`
+	if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+		t.Fatalf("Failed to write temporary config file: %v", err)
+	}
+
+	config, err := channels.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	got := config.Channels[0]
+	if got.ManifestURL != "https://origin.example/a.mpd" {
+		t.Errorf("Expected the manifest URL to be expanded, got '%s'", got.ManifestURL)
+	}
+	firstKID, _ := hex.DecodeString("0737b75ee8906c00bb7bb8f666da72a0")
+	firstKey, _ := hex.DecodeString("15f515458cdb5107452f943a111cbe89")
+	secondKID, _ := hex.DecodeString("e069fc056280e4caa7d0ffb99024c05a")
+	secondKey, _ := hex.DecodeString("d3693103f232f28b4781bbc7e499c43a")
+	if !bytes.Equal(got.KID, firstKID) || !bytes.Equal(got.Key, firstKey) {
+		t.Errorf("Expected KID and Key to come from the first pair, got %x:%x", got.KID, got.Key)
+	}
+	if len(got.Keys) != 2 {
+		t.Fatalf("Expected 2 keys, got %d", len(got.Keys))
+	}
+	if key, found := got.GetKeyForKID(secondKID); !found || !bytes.Equal(key, secondKey) {
+		t.Errorf("Expected key %x for the second KID, got %x (found: %v)", secondKey, key, found)
+	}
+
+	for _, badJSON := range []string{
+		`{"Channels": [{"Id": "a", "Manifest": "${TEST_UNSET_ORIGIN}/a.mpd"}]}`,
+		`{"Channels": [{"Id": "a", "Manifest": "https://a/m.mpd", "Keys": [
+			"0737b75ee8906c00bb7bb8f666da72a0:15f515458cdb5107452f943a111cbe89",
+			"0737b75ee8906c00bb7bb8f666da72a0:d3693103f232f28b4781bbc7e499c43a"
+		]}]}`,
+	} {
+		if err := os.WriteFile(configPath, []byte(badJSON), 0644); err != nil {
+			t.Fatalf("Failed to write temporary config file: %v", err)
+		}
+		if _, err := channels.LoadConfig(configPath); err == nil {
+			t.Errorf("Expected an error for %s", badJSON)
+		}
+	}
+}
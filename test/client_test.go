@@ -0,0 +1,329 @@
+package main_test
+
+import (
+	"dash2hlsd/internal/dash"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func uint64Ptr(v uint64) *uint64 { return &v }
+
+// TestBuildSegmentURL_NumberAddressing verifies $Number$ substitution, including width formatting.
+func TestBuildSegmentURL_NumberAddressing(t *testing.T) {
+	period := &dash.Period{BaseURL: []string{"dash/"}}
+	rep := &dash.Representation{ID: "v1"}
+
+	testCases := []struct {
+		name     string
+		media    string
+		expected string
+	}{
+		{"plain number", "$RepresentationID$/seg-$Number$.m4s", "https://origin.example.com/live/dash/v1/seg-42.m4s"},
+		{"zero padded number", "$RepresentationID$/seg-$Number%05d$.m4s", "https://origin.example.com/live/dash/v1/seg-00042.m4s"},
+		{"time addressing ignores number", "$RepresentationID$/seg-$Time$.m4s", "https://origin.example.com/live/dash/v1/seg-900000.m4s"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			as := &dash.AdaptationSet{SegmentTemplate: dash.SegmentTemplate{Media: tc.media}}
+			url, err := dash.BuildSegmentURL("https://origin.example.com/live/manifest.mpd", period, as, rep, 900000, 42)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, url)
+		})
+	}
+}
+
+// TestSegmentNumber verifies that segment numbers are derived from the timeline index and startNumber.
+func TestSegmentNumber(t *testing.T) {
+	timeline := dash.SegmentTimeline{
+		Segments: []dash.S{
+			{T: 1000, D: 100, R: 2}, // 1000, 1100, 1200
+			{D: 50},                 // 1300
+		},
+	}
+
+	t.Run("default start number", func(t *testing.T) {
+		template := &dash.SegmentTemplate{Timeline: timeline}
+		number, ok := dash.SegmentNumber(template, 1000)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(1), number)
+
+		number, ok = dash.SegmentNumber(template, 1300)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(4), number)
+	})
+
+	t.Run("explicit start number", func(t *testing.T) {
+		template := &dash.SegmentTemplate{Timeline: timeline, StartNumber: uint64Ptr(500)}
+		number, ok := dash.SegmentNumber(template, 1200)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(502), number)
+	})
+
+	t.Run("merged overlapping timeline", func(t *testing.T) {
+		old := dash.SegmentTimeline{Segments: []dash.S{{T: 1000, D: 100, R: 2}}}
+		merged := dash.MergeTimelines(old, dash.SegmentTimeline{Segments: []dash.S{{T: 1100, D: 100, R: 1}, {T: 1300, D: 50}}})
+		template := &dash.SegmentTemplate{Timeline: merged, StartNumber: uint64Ptr(0)}
+		number, ok := dash.SegmentNumber(template, 1300)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(3), number)
+	})
+
+	t.Run("unknown time", func(t *testing.T) {
+		_, ok := dash.SegmentNumber(&dash.SegmentTemplate{Timeline: timeline}, 1050)
+		assert.False(t, ok)
+	})
+}
+
+// TestBuildURLs_SegmentList verifies that SegmentList entries are addressed by segment number.
+func TestBuildURLs_SegmentList(t *testing.T) {
+	period := &dash.Period{}
+	rep := &dash.Representation{ID: "v1"}
+	as := &dash.AdaptationSet{
+		SegmentList: &dash.SegmentList{
+			Timescale:      1000,
+			Duration:       2000,
+			Initialization: &dash.URLType{SourceURL: "v1/init.mp4"},
+			SegmentURLs:    []dash.SegmentURL{{Media: "v1/a.m4s"}, {Media: "v1/b.m4s"}, {Media: "v1/c.m4s"}},
+		},
+	}
+
+	initURL, err := dash.BuildInitSegmentURL("https://origin.example.com/vod/manifest.mpd", period, as, rep)
+	require.NoError(t, err)
+	assert.Equal(t, "https://origin.example.com/vod/v1/init.mp4", initURL)
+
+	template := as.GetSegmentTemplate(rep)
+	assert.Equal(t, 1000, template.Timescale)
+	number, ok := dash.SegmentNumber(&template, 4000)
+	require.True(t, ok, "The synthesized timeline should contain a segment at t=4000")
+
+	segmentURL, err := dash.BuildSegmentURL("https://origin.example.com/vod/manifest.mpd", period, as, rep, 4000, number)
+	require.NoError(t, err)
+	assert.Equal(t, "https://origin.example.com/vod/v1/c.m4s", segmentURL)
+
+	_, err = dash.BuildSegmentURL("https://origin.example.com/vod/manifest.mpd", period, as, rep, 6000, number+1)
+	assert.Error(t, err, "A number past the end of the list should be rejected")
+}
+
+// TestBuildSegmentURLs_BaseURLFailover verifies that multiple BaseURLs at each level yield ordered candidates.
+func TestBuildSegmentURLs_BaseURLFailover(t *testing.T) {
+	mpd := &dash.MPD{BaseURL: []string{"https://cdn-a.example.com/live/", "https://cdn-b.example.com/live/"}}
+	period := &dash.Period{BaseURL: []string{"p0/"}}
+	as := &dash.AdaptationSet{
+		BaseURL:         []string{"video/"},
+		SegmentTemplate: dash.SegmentTemplate{Media: "$RepresentationID$-$Time$.m4s", Initialization: "$RepresentationID$-init.mp4"},
+	}
+	rep := &dash.Representation{ID: "v1"}
+
+	urls, err := dash.BuildSegmentURLs("https://origin.example.com/manifest.mpd", mpd, period, as, rep, 1000, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"https://cdn-a.example.com/live/p0/video/v1-1000.m4s",
+		"https://cdn-b.example.com/live/p0/video/v1-1000.m4s",
+	}, urls)
+
+	initURLs, err := dash.BuildInitSegmentURLs("https://origin.example.com/manifest.mpd", mpd, period, as, rep)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"https://cdn-a.example.com/live/p0/video/v1-init.mp4",
+		"https://cdn-b.example.com/live/p0/video/v1-init.mp4",
+	}, initURLs)
+
+	// Without an MPD the primary candidate is resolved against the manifest location.
+	url, err := dash.BuildSegmentURL("https://origin.example.com/manifest.mpd", period, as, rep, 1000, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "https://origin.example.com/p0/video/v1-1000.m4s", url)
+}
+
+// TestExpandTemplate verifies identifier substitution and printf-style width formatting.
+func TestExpandTemplate(t *testing.T) {
+	values := dash.TemplateValues{RepresentationID: "v1", Bandwidth: 128000, Time: 90000, Number: 7}
+
+	testCases := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"all identifiers", "$RepresentationID$/$Bandwidth$/$Time$/$Number$.m4s", "v1/128000/90000/7.m4s"},
+		{"padded number", "seg-$Number%04d$.m4s", "seg-0007.m4s"},
+		{"padded time", "seg-$Time%09d$.m4s", "seg-000090000.m4s"},
+		{"padded bandwidth", "$Bandwidth%08d$", "00128000"},
+		{"repeated identifiers", "$Number$-$Number%03d$", "7-007"},
+		{"unknown identifier kept", "$SubNumber$-$Number$", "$SubNumber$-7"},
+		{"no identifiers", "init.mp4", "init.mp4"},
+		{"escaped dollar", "seg$$-$Number$.m4s", "seg$-7.m4s"},
+		{"escape before identifier name", "$$Number$", "$Number$"},
+		{"bandwidth and escape", "$RepresentationID$_$Bandwidth$$$$Time$.m4s", "v1_128000$90000.m4s"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, dash.ExpandTemplate(tc.template, values))
+		})
+	}
+}
+
+// TestBuildSegmentURL_BandwidthIdentifier verifies that $Bandwidth$ and $$ are substituted in init and media URLs.
+func TestBuildSegmentURL_BandwidthIdentifier(t *testing.T) {
+	period := &dash.Period{}
+	as := &dash.AdaptationSet{SegmentTemplate: dash.SegmentTemplate{
+		Initialization: "$Bandwidth$/init$$.mp4",
+		Media:          "$Bandwidth$/$Time$.m4s",
+	}}
+	rep := &dash.Representation{ID: "a1", Bandwidth: 96000}
+
+	initURL, err := dash.BuildInitSegmentURL("https://origin.example.com/live/manifest.mpd", period, as, rep)
+	require.NoError(t, err)
+	assert.Equal(t, "https://origin.example.com/live/96000/init$.mp4", initURL)
+
+	mediaURL, err := dash.BuildSegmentURL("https://origin.example.com/live/manifest.mpd", period, as, rep, 48000, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "https://origin.example.com/live/96000/48000.m4s", mediaURL)
+}
+
+// TestFetchAndParseMPD_MaxManifestBytes verifies that oversized manifests are rejected with a size error.
+func TestFetchAndParseMPD_MaxManifestBytes(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	client := dash.NewClient(&mockLogger{})
+
+	client.MaxManifestBytes = int64(len(testLiveMPD))
+	mpd, _, err := client.FetchAndParseMPD(origin.URL("/manifest.mpd"), "")
+	require.NoError(t, err, "A manifest of exactly the maximum size should be accepted")
+	assert.Equal(t, "dynamic", mpd.Type)
+
+	client.MaxManifestBytes = int64(len(testLiveMPD)) - 1
+	_, _, err = client.FetchAndParseMPD(origin.URL("/manifest.mpd"), "")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, dash.ErrManifestTooLarge), "Expected ErrManifestTooLarge, got: %v", err)
+}
+
+// TestFetchAndParseMPD_HostPolicy verifies that the host policy refuses loopback origins by default
+// and permits them once allowed.
+func TestFetchAndParseMPD_HostPolicy(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	// A fresh client per policy, as pooled connections are not checked again.
+	fetch := func(allow, deny []string) error {
+		policy, err := dash.NewHostPolicy(allow, deny)
+		require.NoError(t, err)
+		client := dash.NewClient(&mockLogger{})
+		client.HostPolicy = policy
+		_, _, err = client.FetchAndParseMPD(origin.URL("/manifest.mpd"), "")
+		return err
+	}
+
+	err := fetch(nil, nil)
+	assert.True(t, errors.Is(err, dash.ErrHostNotAllowed), "Expected ErrHostNotAllowed, got: %v", err)
+	assert.NoError(t, fetch([]string{"127.0.0.0/8"}, nil), "An allowed prefix should be fetched even though it is private")
+	err = fetch([]string{"127.0.0.0/8"}, []string{"127.0.0.1"})
+	assert.True(t, errors.Is(err, dash.ErrHostNotAllowed), "A denied address should win over an allowed prefix, got: %v", err)
+	err = fetch([]string{"cdn.example.com"}, nil)
+	assert.True(t, errors.Is(err, dash.ErrHostNotAllowed), "A host outside the allowlist should be refused, got: %v", err)
+
+	_, err = dash.NewHostPolicy([]string{"10.0.0.0/33"}, nil)
+	assert.Error(t, err)
+}
+
+// TestFetchAndParseMPD_UTCTiming verifies that the server clock offset is read from the first usable
+// UTCTiming source, following redirects, and that unusable sources are skipped.
+func TestFetchAndParseMPD_UTCTiming(t *testing.T) {
+	serverTime := time.Now().Add(-time.Hour).UTC()
+	timeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+			return
+		case "/moved":
+			http.Redirect(w, r, "/iso", http.StatusFound)
+			return
+		case "/iso":
+			fmt.Fprint(w, serverTime.Format(time.RFC3339))
+			return
+		}
+		w.Header().Set("Date", serverTime.Format(http.TimeFormat))
+	}))
+	defer timeServer.Close()
+
+	testCases := []struct {
+		name    string
+		timings string
+		offset  time.Duration
+	}{
+		{"none", ``, 0},
+		{"direct", `<UTCTiming schemeIdUri="urn:mpeg:dash:utc:direct:2014" value="` + serverTime.Format(time.RFC3339) + `"/>`, -time.Hour},
+		{"http-head after failed sources", `<UTCTiming schemeIdUri="urn:mpeg:dash:utc:ntp:2014" value="ntp.example.com"/>` +
+			`<UTCTiming schemeIdUri="urn:mpeg:dash:utc:http-head:2014" value="` + timeServer.URL + `/missing ` + timeServer.URL + `/time"/>`, -time.Hour},
+		{"redirected http-iso", `<UTCTiming schemeIdUri="urn:mpeg:dash:utc:http-iso:2014" value="` + timeServer.URL + `/moved"/>`, -time.Hour},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			origin := newTestOrigin(t, strings.Replace(testLiveMPD, "</MPD>", tc.timings+"</MPD>", 1))
+			mpd, _, err := dash.NewClient(&mockLogger{}).FetchAndParseMPD(origin.URL("/manifest.mpd"), "")
+			require.NoError(t, err)
+			assert.InDelta(t, tc.offset.Seconds(), mpd.ClockOffset.Seconds(), 2)
+		})
+	}
+}
+
+// TestBuildSegmentURLs_AbsolutePeriodBaseURL verifies that an absolute Period BaseURL on another host
+// replaces the MPD location and MPD-level BaseURLs, with relative AdaptationSet BaseURLs and media
+// templates resolved against it.
+func TestBuildSegmentURLs_AbsolutePeriodBaseURL(t *testing.T) {
+	const mpdURL = "https://origin.example.com/live/manifest.mpd"
+	as := &dash.AdaptationSet{SegmentTemplate: dash.SegmentTemplate{Media: "$RepresentationID$/$Time$.m4s", Initialization: "$RepresentationID$/init.mp4"}}
+	rep := &dash.Representation{ID: "v1"}
+
+	testCases := []struct {
+		name     string
+		mpd      *dash.MPD
+		period   *dash.Period
+		as       *dash.AdaptationSet
+		expected []string
+	}{
+		{
+			name:     "absolute period BaseURL",
+			period:   &dash.Period{BaseURL: []string{"https://cdn.example.net/ads/p1/"}},
+			as:       as,
+			expected: []string{"https://cdn.example.net/ads/p1/v1/1000.m4s"},
+		},
+		{
+			name:     "relative AdaptationSet BaseURL below it",
+			period:   &dash.Period{BaseURL: []string{"https://cdn.example.net/ads/p1/"}},
+			as:       &dash.AdaptationSet{BaseURL: []string{"video/"}, SegmentTemplate: as.SegmentTemplate},
+			expected: []string{"https://cdn.example.net/ads/p1/video/v1/1000.m4s"},
+		},
+		{
+			name:     "scheme-relative period BaseURL",
+			period:   &dash.Period{BaseURL: []string{"//cdn.example.net/ads/p1/"}},
+			as:       as,
+			expected: []string{"https://cdn.example.net/ads/p1/v1/1000.m4s"},
+		},
+		{
+			name:     "several MPD BaseURLs collapse into one candidate",
+			mpd:      &dash.MPD{BaseURL: []string{"https://cdn-a.example.com/live/", "https://cdn-b.example.com/live/"}},
+			period:   &dash.Period{BaseURL: []string{"https://cdn.example.net/ads/p1/"}},
+			as:       as,
+			expected: []string{"https://cdn.example.net/ads/p1/v1/1000.m4s"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			urls, err := dash.BuildSegmentURLs(mpdURL, tc.mpd, tc.period, tc.as, rep, 1000, 1)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, urls)
+
+			initURLs, err := dash.BuildInitSegmentURLs(mpdURL, tc.mpd, tc.period, tc.as, rep)
+			require.NoError(t, err)
+			require.Len(t, initURLs, 1)
+			assert.Equal(t, strings.Replace(tc.expected[0], "1000.m4s", "init.mp4", 1), initURLs[0])
+		})
+	}
+}
@@ -1,11 +1,15 @@
 package main_test
 
 import (
+	"context"
 	"dash2hlsd/internal/dash"
 	"dash2hlsd/internal/models"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -42,6 +46,32 @@ func TestDownloader_Success(t *testing.T) {
 	assert.Equal(t, "segment data", string(result.Data))
 }
 
+// TestDownloader_BlockedHost verifies that a segment on a host refused by the host policy fails
+// at once, without reaching the origin or being retried.
+func TestDownloader_BlockedHost(t *testing.T) {
+	var requestCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		fmt.Fprint(w, "internal data")
+	}))
+	defer server.Close()
+
+	client := dash.NewClient(&downloaderMockLogger{})
+	policy, err := dash.NewHostPolicy(nil, nil)
+	assert.NoError(t, err)
+	client.HostPolicy = policy
+	downloader := dash.NewDownloader(client.HttpClient(), &downloaderMockLogger{}, "test-agent", 1)
+	defer downloader.Stop()
+
+	results := make(chan dash.DownloadResult, 1)
+	downloader.QueueDownload(dash.DownloadTask{Segment: models.Segment{URL: server.URL, ID: "blocked"}, Result: results})
+
+	result := <-results
+	assert.True(t, errors.Is(result.Error, dash.ErrHostNotAllowed), "Expected ErrHostNotAllowed, got: %v", result.Error)
+	assert.Nil(t, result.Data)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requestCount), "The blocked host should not be contacted")
+}
+
 // TestDownloader_RetryThenSuccess verifies that the downloader retries on failure and succeeds.
 func TestDownloader_RetryThenSuccess(t *testing.T) {
 	var requestCount int32
@@ -70,6 +100,45 @@ func TestDownloader_RetryThenSuccess(t *testing.T) {
 	assert.Equal(t, int32(3), requestCount, "Expected exactly 3 attempts")
 }
 
+// TestDownloader_ExponentialBackoff verifies that the wait between attempts grows with every failure.
+func TestDownloader_ExponentialBackoff(t *testing.T) {
+	var mu sync.Mutex
+	var attempts []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts = append(attempts, time.Now())
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := dash.NewClient(&downloaderMockLogger{})
+	downloader := dash.NewDownloader(client.HttpClient(), &downloaderMockLogger{}, "test-agent", 1)
+	downloader.MaxRetries = 4
+	downloader.RetryDelay = 40 * time.Millisecond
+	downloader.RetryMultiplier = 2
+	defer downloader.Stop()
+
+	results := make(chan dash.DownloadResult, 1)
+	downloader.QueueDownload(dash.DownloadTask{Segment: models.Segment{URL: server.URL, ID: "backoff"}, Result: results})
+	result := <-results
+	assert.Error(t, result.Error)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !assert.Len(t, attempts, 4) {
+		return
+	}
+	for i := 1; i < len(attempts); i++ {
+		gap := attempts[i].Sub(attempts[i-1])
+		minGap := downloader.RetryDelay << (i - 1)
+		assert.GreaterOrEqual(t, gap, minGap, "Attempt %d came too early", i+1)
+		if i > 1 {
+			assert.Greater(t, gap, attempts[i-1].Sub(attempts[i-2]), "The wait before attempt %d should grow", i+1)
+		}
+	}
+}
+
 // TestDownloader_Timeout verifies that the per-request timeout is respected.
 func TestDownloader_Timeout(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -121,3 +190,285 @@ func TestDownloader_FailureAfterRetries(t *testing.T) {
 	assert.Equal(t, int32(3), atomic.LoadInt32(&requestCount), "Expected exactly 3 attempts")
 	assert.Contains(t, result.Error.Error(), "failed to download segment 4 after 3 attempts")
 }
+
+// TestDownloader_PermanentStatusFailsFast verifies that statuses that will not change, such as 404,
+// are not retried and are reported as permanent, unlike server errors.
+func TestDownloader_PermanentStatusFailsFast(t *testing.T) {
+	for _, tc := range []struct {
+		status    int
+		attempts  int32
+		permanent bool
+	}{
+		{http.StatusNotFound, 1, true},
+		{http.StatusForbidden, 1, true},
+		{http.StatusGone, 1, true},
+		{http.StatusTooManyRequests, 3, false},
+		{http.StatusBadGateway, 3, false},
+	} {
+		t.Run(http.StatusText(tc.status), func(t *testing.T) {
+			var requestCount int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requestCount, 1)
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			client := dash.NewClient(&downloaderMockLogger{})
+			downloader := dash.NewDownloader(client.HttpClient(), &downloaderMockLogger{}, "test-agent", 1)
+			downloader.RetryDelay = time.Millisecond
+			defer downloader.Stop()
+
+			results := make(chan dash.DownloadResult, 1)
+			downloader.QueueDownload(dash.DownloadTask{Segment: models.Segment{URL: server.URL, ID: "status"}, Result: results})
+			result := <-results
+
+			var statusErr *dash.StatusError
+			if assert.True(t, errors.As(result.Error, &statusErr), "Expected a *dash.StatusError, got: %v", result.Error) {
+				assert.Equal(t, tc.status, statusErr.StatusCode)
+			}
+			assert.Equal(t, tc.attempts, atomic.LoadInt32(&requestCount))
+			assert.Equal(t, tc.permanent, dash.IsPermanent(result.Error))
+		})
+	}
+}
+
+// TestDownloader_RetryAfter verifies that the wait asked for by a 503's Retry-After header replaces the backoff.
+func TestDownloader_RetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	var attempts []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "segment data")
+	}))
+	defer server.Close()
+
+	client := dash.NewClient(&downloaderMockLogger{})
+	downloader := dash.NewDownloader(client.HttpClient(), &downloaderMockLogger{}, "test-agent", 1)
+	downloader.RetryDelay = 10 * time.Millisecond
+	defer downloader.Stop()
+
+	results := make(chan dash.DownloadResult, 1)
+	downloader.QueueDownload(dash.DownloadTask{Segment: models.Segment{URL: server.URL, ID: "retry-after"}, Result: results})
+	result := <-results
+	assert.NoError(t, result.Error)
+	assert.Equal(t, "segment data", string(result.Data))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, attempts, 2) {
+		assert.GreaterOrEqual(t, attempts[1].Sub(attempts[0]), time.Second, "The retry should wait for the Retry-After delay")
+	}
+}
+
+// TestDownloader_RetryAfterCancelled verifies that a worker waiting out a Retry-After gives up as soon as
+// the task's context is cancelled, and is free for the next task.
+func TestDownloader_RetryAfterCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/busy" {
+			w.Header().Set("Retry-After", "10")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "segment data")
+	}))
+	defer server.Close()
+
+	client := dash.NewClient(&downloaderMockLogger{})
+	downloader := dash.NewDownloader(client.HttpClient(), &downloaderMockLogger{}, "test-agent", 1)
+	defer downloader.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	downloader.QueueDownload(dash.DownloadTask{Segment: models.Segment{URL: server.URL + "/busy", ID: "busy"}, Result: make(chan dash.DownloadResult, 1), Ctx: ctx})
+	time.Sleep(200 * time.Millisecond) // Let the worker reach the Retry-After wait
+	cancel()
+
+	results := make(chan dash.DownloadResult, 1)
+	downloader.QueueDownload(dash.DownloadTask{Segment: models.Segment{URL: server.URL + "/free", ID: "free"}, Result: results})
+	select {
+	case result := <-results:
+		assert.NoError(t, result.Error)
+	case <-time.After(2 * time.Second):
+		t.Fatal("The worker should stop waiting for a cancelled task's Retry-After")
+	}
+}
+
+// TestDownloader_RateLimiter verifies that a rate limiter shared by two downloaders caps their aggregate
+// bandwidth, and that downloads without a limiter are not throttled.
+func TestDownloader_RateLimiter(t *testing.T) {
+	body := strings.Repeat("x", 132*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	download := func(limiter *dash.RateLimiter, count int) time.Duration {
+		client := dash.NewClient(&downloaderMockLogger{})
+		results := make(chan dash.DownloadResult, count)
+		start := time.Now()
+		for i := range count {
+			downloader := dash.NewDownloader(client.HttpClient(), &downloaderMockLogger{}, "test-agent", 1)
+			downloader.RateLimiter = limiter
+			defer downloader.Stop()
+			downloader.QueueDownload(dash.DownloadTask{Segment: models.Segment{URL: server.URL, ID: fmt.Sprint(i)}, Result: results})
+		}
+		for range count {
+			result := <-results
+			assert.NoError(t, result.Error)
+			assert.Len(t, result.Data, len(body))
+		}
+		return time.Since(start)
+	}
+
+	assert.Nil(t, dash.NewRateLimiter(0), "A zero rate should not limit")
+	assert.Less(t, download(nil, 2), 500*time.Millisecond, "Downloads without a limiter should not be throttled")
+
+	// 264 KiB at 200 KiB/s, less the initial 32 KiB burst, takes at least 1.16s.
+	elapsed := download(dash.NewRateLimiter(200*1024), 2)
+	assert.GreaterOrEqual(t, elapsed, 1100*time.Millisecond, "The shared limiter should cap the aggregate bandwidth")
+}
+
+// TestDownloader_NotModifiedReusesCachedCopy verifies conditional requests and 304 handling.
+func TestDownloader_NotModifiedReusesCachedCopy(t *testing.T) {
+	const etag = `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		fmt.Fprint(w, "fresh data")
+	}))
+	defer server.Close()
+
+	client := dash.NewClient(&downloaderMockLogger{})
+	downloader := dash.NewDownloader(client.HttpClient(), &downloaderMockLogger{}, "test-agent", 1)
+	defer downloader.Stop()
+
+	results := make(chan dash.DownloadResult, 1)
+	segment := models.Segment{URL: server.URL, ID: "init"}
+
+	downloader.QueueDownload(dash.DownloadTask{Segment: segment, Result: results})
+	first := <-results
+	assert.NoError(t, first.Error)
+	assert.Equal(t, "fresh data", string(first.Data))
+	assert.Equal(t, etag, first.ETag)
+	assert.Equal(t, "Mon, 02 Jan 2006 15:04:05 GMT", first.LastModified)
+	assert.False(t, first.NotModified)
+
+	cached := &dash.CachedCopy{Data: []byte("cached data"), ETag: first.ETag, LastModified: first.LastModified}
+	downloader.QueueDownload(dash.DownloadTask{Segment: segment, Result: results, Cached: cached})
+	second := <-results
+	assert.NoError(t, second.Error)
+	assert.True(t, second.NotModified)
+	assert.Equal(t, "cached data", string(second.Data), "A 304 should reuse the cached bytes")
+	assert.Equal(t, etag, second.ETag)
+}
+
+// TestDownloader_FallbackURLs verifies that the downloader fails over to the next candidate URL.
+func TestDownloader_FallbackURLs(t *testing.T) {
+	var primaryRequests int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryRequests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secondary data")
+	}))
+	defer secondary.Close()
+
+	client := dash.NewClient(&downloaderMockLogger{})
+	downloader := dash.NewDownloader(client.HttpClient(), &downloaderMockLogger{}, "test-agent", 1)
+	defer downloader.Stop()
+
+	results := make(chan dash.DownloadResult, 1)
+	segment := models.Segment{URL: primary.URL, FallbackURLs: []string{secondary.URL}, ID: "failover"}
+	downloader.QueueDownload(dash.DownloadTask{Segment: segment, Result: results})
+
+	result := <-results
+	assert.NoError(t, result.Error)
+	assert.Equal(t, "secondary data", string(result.Data))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&primaryRequests), "The primary should be retried before failing over")
+}
+
+// TestDownloader_FollowsRedirects verifies that a redirected segment is fetched from its final location,
+// while the DASH client itself still leaves redirects to be handled manually.
+func TestDownloader_FollowsRedirects(t *testing.T) {
+	var userAgent string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/segment.m4s", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/edge/segment.m4s", http.StatusFound)
+	})
+	mux.HandleFunc("/edge/segment.m4s", func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		fmt.Fprint(w, "redirected segment data")
+	})
+	mux.HandleFunc("/loop.m4s", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop.m4s", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := dash.NewClient(&downloaderMockLogger{})
+	downloader := dash.NewDownloader(client.HttpClient(), &downloaderMockLogger{}, "test-agent", 1)
+	defer downloader.Stop()
+
+	results := make(chan dash.DownloadResult, 1)
+	downloader.QueueDownload(dash.DownloadTask{Segment: models.Segment{URL: server.URL + "/segment.m4s", ID: "7"}, Result: results})
+	result := <-results
+	assert.NoError(t, result.Error)
+	assert.Equal(t, "redirected segment data", string(result.Data))
+	assert.Equal(t, "test-agent", userAgent)
+
+	downloader.QueueDownload(dash.DownloadTask{Segment: models.Segment{URL: server.URL + "/loop.m4s", ID: "8"}, Result: results})
+	result = <-results
+	assert.ErrorContains(t, result.Error, "redirects")
+
+	resp, err := client.HttpClient().Get(server.URL + "/segment.m4s")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+}
+
+// TestDownloader_AbandonedTask verifies that a task whose context is done is cancelled and its result is not
+// delivered, so that a requester that stopped reading its results does not block the worker.
+func TestDownloader_AbandonedTask(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			requested <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, "segment data")
+	}))
+	defer server.Close()
+
+	client := dash.NewClient(&downloaderMockLogger{})
+	downloader := dash.NewDownloader(client.HttpClient(), &downloaderMockLogger{}, "test-agent", 1)
+	defer downloader.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := make(chan dash.DownloadResult) // Never read
+	downloader.QueueDownload(dash.DownloadTask{Segment: models.Segment{URL: server.URL + "/slow", ID: "abandoned"}, Result: abandoned, Ctx: ctx})
+	<-requested
+	cancel()
+
+	results := make(chan dash.DownloadResult, 1)
+	downloader.QueueDownload(dash.DownloadTask{Segment: models.Segment{URL: server.URL + "/fast", ID: "wanted"}, Result: results})
+	select {
+	case result := <-results:
+		assert.NoError(t, result.Error)
+		assert.Equal(t, "segment data", string(result.Data))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the worker to move on from the abandoned task")
+	}
+}
@@ -2,10 +2,14 @@ package main_test
 
 import (
 	"bytes"
+	"context"
 	"dash2hlsd/internal/channels"
 	"dash2hlsd/internal/key"
 	"encoding/hex"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 // TestKeyService_NewServiceAndGetKey verifies the creation of the service and key retrieval.
@@ -105,3 +109,167 @@ func TestKeyService_NewServiceWithDuplicateID(t *testing.T) {
 		t.Errorf("Expected error message '%s', got '%s'", expectedError, err.Error())
 	}
 }
+
+// TestKeyService_GetKeyForKID verifies that a key is only returned for its configured key ID.
+func TestKeyService_GetKeyForKID(t *testing.T) {
+	kid, _ := hex.DecodeString("0737b75ee8906c00bb7bb8f666da72a0")
+	otherKID, _ := hex.DecodeString("e069fc056280e4caa7d0ffb99024c05a")
+	keyBytes, _ := hex.DecodeString("15f515458cdb5107452f943a111cbe89")
+
+	service, err := key.NewService(&channels.ChannelConfig{
+		Channels: []channels.Channel{{Id: "channel1", Key: keyBytes, KID: kid}},
+	})
+	if err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+
+	if got, found := service.GetKeyForKID("channel1", kid); !found || !bytes.Equal(got, keyBytes) {
+		t.Errorf("Expected key %x for matching KID, got %x (found=%v)", keyBytes, got, found)
+	}
+	if _, found := service.GetKeyForKID("channel1", otherKID); found {
+		t.Error("Expected no key for a KID that does not match the configured one")
+	}
+	if _, found := service.GetKeyForKID("unknown", kid); found {
+		t.Error("Expected no key for an unknown channel")
+	}
+}
+
+// TestKeyService_GetKeyForKID_MultipleKeys verifies that each KID of a channel with several keys
+// resolves to its own key.
+func TestKeyService_GetKeyForKID_MultipleKeys(t *testing.T) {
+	videoKID, _ := hex.DecodeString("0737b75ee8906c00bb7bb8f666da72a0")
+	videoKey, _ := hex.DecodeString("15f515458cdb5107452f943a111cbe89")
+	audioKID, _ := hex.DecodeString("e069fc056280e4caa7d0ffb99024c05a")
+	audioKey, _ := hex.DecodeString("d3693103f232f28b4781bbc7e499c43a")
+
+	service, err := key.NewService(&channels.ChannelConfig{
+		Channels: []channels.Channel{{
+			Id:  "channel1",
+			Key: videoKey,
+			KID: videoKID,
+			Keys: map[string][]byte{
+				hex.EncodeToString(videoKID): videoKey,
+				hex.EncodeToString(audioKID): audioKey,
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+
+	if got, found := service.GetKeyForKID("channel1", videoKID); !found || !bytes.Equal(got, videoKey) {
+		t.Errorf("Expected key %x for the video KID, got %x (found=%v)", videoKey, got, found)
+	}
+	if got, found := service.GetKeyForKID("channel1", audioKID); !found || !bytes.Equal(got, audioKey) {
+		t.Errorf("Expected key %x for the audio KID, got %x (found=%v)", audioKey, got, found)
+	}
+}
+
+// TestKeyService_Update verifies that an update replaces the keys, and that an invalid configuration
+// leaves the current keys in place.
+func TestKeyService_Update(t *testing.T) {
+	oldKey, _ := hex.DecodeString("15f515458cdb5107452f943a111cbe89")
+	newKey, _ := hex.DecodeString("d3693103f232f28b4781bbc7e499c43a")
+
+	service, err := key.NewService(&channels.ChannelConfig{Channels: []channels.Channel{{Id: "a", Key: oldKey}, {Id: "b", Key: oldKey}}})
+	if err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+
+	if err := service.Update(&channels.ChannelConfig{Channels: []channels.Channel{{Id: "a", Key: newKey}, {Id: "c", Key: newKey}}}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if got, found := service.GetKeyForChannel("a"); !found || !bytes.Equal(got, newKey) {
+		t.Errorf("Expected the updated key for channel a, got %x (found: %v)", got, found)
+	}
+	if _, found := service.GetKeyForChannel("b"); found {
+		t.Error("Expected no key for the removed channel b")
+	}
+	if _, found := service.GetKeyForChannel("c"); !found {
+		t.Error("Expected a key for the added channel c")
+	}
+
+	duplicate := &channels.ChannelConfig{Channels: []channels.Channel{{Id: "a", Key: oldKey}, {Id: "a", Key: oldKey}}}
+	if err := service.Update(duplicate); err == nil {
+		t.Error("Expected an error for duplicate channel IDs")
+	}
+	if got, _ := service.GetKeyForChannel("a"); !bytes.Equal(got, newKey) {
+		t.Errorf("Expected the key to be kept after a failed update, got %x", got)
+	}
+}
+
+// TestKeyService_WatchKeysFile verifies that keys from a keys file override the configured ones, that a
+// change to the file is picked up without a reload, and that an invalid file leaves the current keys in place.
+func TestKeyService_WatchKeysFile(t *testing.T) {
+	configuredKey, _ := hex.DecodeString("15f515458cdb5107452f943a111cbe89")
+	firstKey, _ := hex.DecodeString("d3693103f232f28b4781bbc7e499c43a")
+	rotatedKey, _ := hex.DecodeString("0123456789abcdef0123456789abcdef")
+	kid, _ := hex.DecodeString("0737b75ee8906c00bb7bb8f666da72a0")
+
+	service, err := key.NewService(&channels.ChannelConfig{Channels: []channels.Channel{{Id: "a", Key: configuredKey}, {Id: "b", Key: configuredKey}}})
+	if err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+
+	keysPath := filepath.Join(t.TempDir(), "keys.json")
+	modTime := time.Now()
+	writeKeys := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(keysPath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write keys file: %v", err)
+		}
+		// Coarse file system timestamps must not hide the change from the watcher.
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(keysPath, modTime, modTime); err != nil {
+			t.Fatalf("Failed to touch keys file: %v", err)
+		}
+	}
+	waitForKey := func(want []byte) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if got, _ := service.GetKeyForChannel("a"); bytes.Equal(got, want) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		got, _ := service.GetKeyForChannel("a")
+		t.Fatalf("Expected key %x for channel a, got %x", want, got)
+	}
+
+	writeKeys(`{"a": ["0737b75ee8906c00bb7bb8f666da72a0:d3693103f232f28b4781bbc7e499c43a"], "unknown": ["0737b75ee8906c00bb7bb8f666da72a0:d3693103f232f28b4781bbc7e499c43a"]}`)
+	if err := service.LoadKeysFile(keysPath); err != nil {
+		t.Fatalf("LoadKeysFile failed: %v", err)
+	}
+	waitForKey(firstKey)
+	if got, found := service.GetKeyForKID("a", kid); !found || !bytes.Equal(got, firstKey) {
+		t.Errorf("Expected key %x for the KID of the keys file, got %x (found: %v)", firstKey, got, found)
+	}
+	if got, _ := service.GetKeyForChannel("b"); !bytes.Equal(got, configuredKey) {
+		t.Errorf("Expected channel b to keep its configured key, got %x", got)
+	}
+	if _, found := service.GetKeyForChannel("unknown"); found {
+		t.Error("Expected no key for a channel that is only in the keys file")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.WatchKeysFile(ctx, keysPath, 10*time.Millisecond, &mockLogger{})
+
+	writeKeys(`{"a": ["0737b75ee8906c00bb7bb8f666da72a0:0123456789abcdef0123456789abcdef"]}`)
+	waitForKey(rotatedKey)
+
+	// The keys survive a configuration reload.
+	if err := service.Update(&channels.ChannelConfig{Channels: []channels.Channel{{Id: "a", Key: configuredKey}}}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	waitForKey(rotatedKey)
+
+	writeKeys(`{"a": ["not a key"]}`)
+	time.Sleep(100 * time.Millisecond)
+	waitForKey(rotatedKey)
+
+	// Dropping the channel from the keys file restores its configured key.
+	writeKeys(`{}`)
+	waitForKey(configuredKey)
+}
@@ -0,0 +1,46 @@
+package main_test
+
+import (
+	"bytes"
+	"dash2hlsd/internal/logger"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLogger_Output verifies that log records go to the configured writer, filtered by level.
+func TestLogger_Output(t *testing.T) {
+	var out bytes.Buffer
+	log := logger.NewLoggerWithOutput("warn", &out)
+
+	log.Infof("not logged")
+	log.Warnf("logged %d", 1)
+
+	assert.NotContains(t, out.String(), "not logged")
+	assert.Contains(t, out.String(), `"msg":"logged 1"`)
+	assert.Contains(t, out.String(), `"level":"WARN"`)
+}
+
+// TestLogger_RotatingFile verifies that a log file is rotated once it would exceed its size limit.
+func TestLogger_RotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	file, err := logger.OpenRotatingFile(path, 100)
+	require.NoError(t, err)
+	defer file.Close()
+
+	_, err = file.Write([]byte(strings.Repeat("a", 60) + "\n"))
+	require.NoError(t, err)
+	_, err = file.Write([]byte(strings.Repeat("b", 60) + "\n"))
+	require.NoError(t, err)
+
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("b", 60)+"\n", string(current))
+	rotated, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", 60)+"\n", string(rotated))
+}
@@ -0,0 +1,105 @@
+package main_test
+
+import (
+	"bytes"
+	"dash2hlsd/internal/api"
+	"dash2hlsd/internal/channels"
+	"dash2hlsd/internal/key"
+	"dash2hlsd/internal/metrics"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMetrics_WriteText verifies the Prometheus text exposition of each metric kind.
+func TestMetrics_WriteText(t *testing.T) {
+	counter := metrics.NewCounter("test_events_total", "Test events.")
+	counter.Add(3)
+	gauge := metrics.NewGauge("test_level", "Test level.")
+	gauge.Set(5)
+	gauge.Dec()
+	vec := metrics.NewCounterVec("test_results_total", "Test results.", "result")
+	vec.WithLabel("ok").Inc()
+	vec.WithLabel("error").Add(2)
+	summary := metrics.NewSummary("test_latency_seconds", "Test latency.")
+	summary.Observe(0.5)
+	summary.Observe(1.5)
+
+	var buf bytes.Buffer
+	metrics.WriteText(&buf)
+	text := buf.String()
+
+	assert.Contains(t, text, "# HELP test_events_total Test events.\n# TYPE test_events_total counter\ntest_events_total 3\n")
+	assert.Contains(t, text, "# TYPE test_level gauge\ntest_level 4\n")
+	assert.Contains(t, text, "test_results_total{result=\"error\"} 2\ntest_results_total{result=\"ok\"} 1\n")
+	assert.Contains(t, text, "# TYPE test_latency_seconds summary\ntest_latency_seconds_sum 2\ntest_latency_seconds_count 2\n")
+}
+
+// TestMetrics_HistogramVec verifies the cumulative buckets, sum and count of a labelled histogram.
+func TestMetrics_HistogramVec(t *testing.T) {
+	hv := metrics.NewHistogramVec("test_wait_seconds", "Test wait.", "channel", []float64{0.1, 1})
+	h := hv.WithLabel("a")
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	assert.Equal(t, []float64{1, 2}, h.CumulativeCounts())
+	assert.Equal(t, 3.0, h.Count())
+	assert.Equal(t, 2.55, h.Sum())
+
+	var buf bytes.Buffer
+	metrics.WriteText(&buf)
+	assert.Contains(t, buf.String(), "# TYPE test_wait_seconds histogram\n"+
+		"test_wait_seconds_bucket{channel=\"a\",le=\"0.1\"} 1\n"+
+		"test_wait_seconds_bucket{channel=\"a\",le=\"1\"} 2\n"+
+		"test_wait_seconds_bucket{channel=\"a\",le=\"+Inf\"} 3\n"+
+		"test_wait_seconds_sum{channel=\"a\"} 2.55\n"+
+		"test_wait_seconds_count{channel=\"a\"} 3\n")
+}
+
+// TestAPI_Metrics verifies that sessions, downloads and playlist requests are reflected on /metrics.
+func TestAPI_Metrics(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sessionMgr := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+
+	keyService, err := key.NewService(&channels.ChannelConfig{})
+	require.NoError(t, err)
+	server := httptest.NewServer(api.New(sessionMgr, keyService, api.Options{}))
+	defer server.Close()
+
+	sessionsBefore := metrics.ActiveSessions.Value()
+	downloadsBefore := metrics.SegmentDownloads.WithLabel("success").Value()
+	masterBefore := metrics.PlaylistRequests.WithLabel("master").Value()
+
+	resp, err := http.Get(server.URL + "/live/live/master.m3u8")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, sessionsBefore+1, metrics.ActiveSessions.Value())
+	assert.Equal(t, masterBefore+1, metrics.PlaylistRequests.WithLabel("master").Value())
+	assert.Eventually(t, func() bool {
+		return metrics.SegmentDownloads.WithLabel("success").Value() > downloadsBefore
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Positive(t, metrics.CacheSegments.Value())
+	assert.Positive(t, metrics.CacheBytes.Value())
+
+	resp, err = http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	for _, name := range []string{
+		"dash2hlsd_active_sessions", "dash2hlsd_cache_bytes", "dash2hlsd_cache_segments", "dash2hlsd_cache_lookups_total",
+		"dash2hlsd_segment_downloads_total", "dash2hlsd_segment_download_seconds_count",
+		"dash2hlsd_mpd_refresh_errors_total", "dash2hlsd_playlist_requests_total{type=\"master\"}",
+	} {
+		assert.Contains(t, string(body), name)
+	}
+}
@@ -1,13 +1,16 @@
 package main_test
 
 import (
+	"encoding/hex"
 	"encoding/xml"
 	"io/ioutil"
 	"testing"
 
 	"dash2hlsd/internal/dash"
+	"dash2hlsd/internal/hls"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParsePearlMPD(t *testing.T) {
@@ -31,7 +34,7 @@ func TestParsePearlMPD(t *testing.T) {
 	period := mpd.Periods[0]
 	assert.Equal(t, "p_3_0", period.ID)
 	assert.Equal(t, "PT0S", period.Start)
-	assert.Equal(t, "3/", period.BaseURL)
+	assert.Equal(t, []string{"3/"}, period.BaseURL)
 
 	assert.Len(t, period.Sets, 7)
 
@@ -68,3 +71,204 @@ func TestParsePearlMPD(t *testing.T) {
 	assert.Equal(t, "s10000_chi", subtitleSetZh.Representations[0].ID)
 	assert.Equal(t, 10000, subtitleSetZh.Representations[0].Bandwidth)
 }
+
+// TestParseSegmentTemplateStartNumber verifies that startNumber is parsed and defaults to 1 when absent.
+func TestParseSegmentTemplateStartNumber(t *testing.T) {
+	var withStart dash.SegmentTemplate
+	err := xml.Unmarshal([]byte(`<SegmentTemplate timescale="90000" media="seg-$Number$.m4s" startNumber="0"/>`), &withStart)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), withStart.GetStartNumber())
+
+	var withoutStart dash.SegmentTemplate
+	err = xml.Unmarshal([]byte(`<SegmentTemplate timescale="90000" media="seg-$Number$.m4s"/>`), &withoutStart)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), withoutStart.GetStartNumber())
+}
+
+// TestAdaptationSet_GetSegmentTemplate verifies that representation-level templates override the AdaptationSet's.
+func TestAdaptationSet_GetSegmentTemplate(t *testing.T) {
+	const setXML = `<AdaptationSet id="1" contentType="video">
+		<SegmentTemplate timescale="90000" initialization="init-$RepresentationID$.mp4" media="$RepresentationID$/$Time$.m4s">
+			<SegmentTimeline><S t="0" d="180000" r="4"/></SegmentTimeline>
+		</SegmentTemplate>
+		<Representation id="v1" bandwidth="1000000"/>
+		<Representation id="v2" bandwidth="2000000">
+			<SegmentTemplate timescale="1000" media="v2/$Number$.m4s" startNumber="10">
+				<SegmentTimeline><S t="0" d="2000" r="4"/></SegmentTimeline>
+			</SegmentTemplate>
+		</Representation>
+	</AdaptationSet>`
+
+	var as dash.AdaptationSet
+	err := xml.Unmarshal([]byte(setXML), &as)
+	assert.NoError(t, err)
+
+	inherited := as.GetSegmentTemplate(&as.Representations[0])
+	assert.Nil(t, as.Representations[0].SegmentTemplate)
+	assert.Equal(t, 90000, inherited.Timescale)
+	assert.Equal(t, "$RepresentationID$/$Time$.m4s", inherited.Media)
+
+	overridden := as.GetSegmentTemplate(&as.Representations[1])
+	assert.Equal(t, 1000, overridden.Timescale, "Timescale should come from the most specific template")
+	assert.Equal(t, "v2/$Number$.m4s", overridden.Media)
+	assert.Equal(t, "init-$RepresentationID$.mp4", overridden.Initialization, "Unset attributes should be inherited")
+	assert.Equal(t, uint64(10), overridden.GetStartNumber())
+	assert.Equal(t, uint64(2000), overridden.Timeline.Segments[0].D)
+}
+
+// TestParseSegmentList verifies parsing of SegmentList addressing and its synthesized timeline.
+func TestParseSegmentList(t *testing.T) {
+	const repXML = `<Representation id="a1" bandwidth="128000">
+		<SegmentList timescale="48000" duration="96000">
+			<Initialization sourceURL="a1/init.mp4"/>
+			<SegmentURL media="a1/1.m4s"/>
+			<SegmentURL media="a1/2.m4s"/>
+		</SegmentList>
+	</Representation>`
+
+	var rep dash.Representation
+	err := xml.Unmarshal([]byte(repXML), &rep)
+	assert.NoError(t, err)
+
+	if assert.NotNil(t, rep.SegmentList) {
+		assert.Equal(t, "a1/init.mp4", rep.SegmentList.Initialization.SourceURL)
+		assert.Len(t, rep.SegmentList.SegmentURLs, 2)
+		assert.Equal(t, "a1/2.m4s", rep.SegmentList.SegmentURLs[1].Media)
+		assert.Equal(t, []dash.S{{T: 0, D: 96000, R: 1}}, rep.SegmentList.GetTimeline().Segments)
+	}
+
+	as := dash.AdaptationSet{Representations: []dash.Representation{rep}}
+	assert.Equal(t, 48000, as.GetSegmentTemplate(&as.Representations[0]).Timescale)
+	assert.Equal(t, "a1/init.mp4", as.GetInitialization(&as.Representations[0]))
+}
+
+// TestUnsupportedCodecs verifies codec string validation.
+func TestUnsupportedCodecs(t *testing.T) {
+	assert.Empty(t, dash.UnsupportedCodecs("avc1.640028,mp4a.40.2"))
+	assert.Empty(t, dash.UnsupportedCodecs(""))
+	assert.Equal(t, []string{"tx3g"}, dash.UnsupportedCodecs("tx3g"))
+	assert.Equal(t, []string{"vp08.00.10.08"}, dash.UnsupportedCodecs("vp08.00.10.08, opus"))
+	assert.True(t, dash.IsSupportedCodec("HVC1.1.6.L93.B0"))
+}
+
+// TestParseContentProtection verifies parsing of the CENC default_KID and PSSH payload.
+func TestParseContentProtection(t *testing.T) {
+	const setXML = `<AdaptationSet id="1" contentType="video" xmlns:cenc="urn:mpeg:cenc:2013">
+		<ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="cenc" cenc:default_KID="0737b75e-e890-6c00-bb7b-b8f666da72a0"/>
+		<ContentProtection schemeIdUri="urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed">
+			<cenc:pssh>AAAAAXBzc2g=</cenc:pssh>
+		</ContentProtection>
+		<Representation id="v1" bandwidth="1000000"/>
+	</AdaptationSet>`
+
+	var as dash.AdaptationSet
+	err := xml.Unmarshal([]byte(setXML), &as)
+	assert.NoError(t, err)
+	assert.Len(t, as.ContentProtections, 2)
+
+	assert.Equal(t, "0737b75e-e890-6c00-bb7b-b8f666da72a0", as.GetDefaultKID(&as.Representations[0]))
+	kid, err := as.ContentProtections[0].GetKID()
+	assert.NoError(t, err)
+	assert.Equal(t, "0737b75ee8906c00bb7bb8f666da72a0", hex.EncodeToString(kid))
+
+	pssh, err := as.ContentProtections[1].GetPSSH()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x00\x00\x00\x01pssh"), pssh)
+
+	mpd := dash.MPD{Periods: []dash.Period{{Sets: []dash.AdaptationSet{as, as}}}}
+	assert.Equal(t, [][]byte{kid}, mpd.GetDefaultKIDs(), "Duplicate KIDs should be reported once")
+}
+
+// TestParseContentProtection_MultipleSchemes verifies that the PSSH boxes of several DRM systems are
+// mapped by system name, with a representation's descriptors overriding the set's.
+func TestParseContentProtection_MultipleSchemes(t *testing.T) {
+	const setXML = `<AdaptationSet id="1" contentType="video" xmlns:cenc="urn:mpeg:cenc:2013">
+		<ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="cenc" cenc:default_KID="0737b75e-e890-6c00-bb7b-b8f666da72a0"/>
+		<ContentProtection schemeIdUri="urn:uuid:EDEF8BA9-79D6-4ACE-A3C8-27DCD51D21ED"><cenc:pssh>d2lkZXZpbmU=</cenc:pssh></ContentProtection>
+		<ContentProtection schemeIdUri="urn:uuid:9a04f079-9840-4286-ab92-e65be0885f95" value="MSPR 2.0"><cenc:pssh>cGxheXJlYWR5</cenc:pssh></ContentProtection>
+		<ContentProtection schemeIdUri="urn:uuid:94ce86fb-07ff-4f43-adb8-93d2fa968ca2"><cenc:pssh>ZmFpcnBsYXk=</cenc:pssh></ContentProtection>
+		<Representation id="v1" bandwidth="1000000"/>
+		<Representation id="v2" bandwidth="2000000">
+			<ContentProtection schemeIdUri="urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"><cenc:pssh>b3ZlcnJpZGU=</cenc:pssh></ContentProtection>
+		</Representation>
+	</AdaptationSet>`
+
+	var as dash.AdaptationSet
+	require.NoError(t, xml.Unmarshal([]byte(setXML), &as))
+	require.Len(t, as.ContentProtections, 4)
+
+	assert.Equal(t, "cenc", as.ContentProtections[0].SystemName())
+	assert.Equal(t, "widevine", as.ContentProtections[1].SystemName(), "System IDs should match regardless of case")
+	assert.Equal(t, "playready", as.ContentProtections[2].SystemName())
+	assert.Equal(t, "urn:uuid:94ce86fb-07ff-4f43-adb8-93d2fa968ca2", as.ContentProtections[3].SystemName())
+
+	assert.Equal(t, map[string]string{
+		"widevine":  "d2lkZXZpbmU=",
+		"playready": "cGxheXJlYWR5",
+		"urn:uuid:94ce86fb-07ff-4f43-adb8-93d2fa968ca2": "ZmFpcnBsYXk=",
+	}, as.GetPSSHs(&as.Representations[0]))
+	assert.Equal(t, "b3ZlcnJpZGU=", as.GetPSSHs(&as.Representations[1])["widevine"])
+	assert.Equal(t, "d2lkZXZpbmU=", as.GetPSSHs(&as.Representations[0])["widevine"], "The set's descriptors should not be modified")
+
+	pssh, err := as.ContentProtections[2].GetPSSH()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("playready"), pssh)
+}
+
+// TestParseRepresentationSar verifies that the sample aspect ratio is parsed and exposed.
+func TestParseRepresentationSar(t *testing.T) {
+	const setXML = `<AdaptationSet id="1" contentType="video">
+		<Representation id="sd" bandwidth="1500000" width="1440" height="1080" sar="4:3"/>
+		<Representation id="hd" bandwidth="5000000" width="1920" height="1080" sar="1:1"/>
+		<Representation id="none" bandwidth="800000" width="640" height="360"/>
+	</AdaptationSet>`
+
+	var as dash.AdaptationSet
+	err := xml.Unmarshal([]byte(setXML), &as)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "4:3", as.Representations[0].Sar)
+	w, h, ok := as.Representations[0].GetSAR()
+	assert.True(t, ok)
+	assert.Equal(t, 4, w)
+	assert.Equal(t, 3, h)
+
+	_, _, ok = as.Representations[2].GetSAR()
+	assert.False(t, ok)
+
+	mpd := &dash.MPD{Periods: []dash.Period{{Sets: []dash.AdaptationSet{as}}}}
+	reps := mpd.Periods[0].Sets[0].Representations
+	playlist, err := hls.GenerateMasterPlaylist(mpd, map[string][]*dash.Representation{"video": {&reps[0], &reps[1]}}, hls.MasterPlaylistOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, playlist, "RESOLUTION=1920x1080\nvideo/sd/playlist.m3u8", "Anamorphic content should report its display resolution")
+	assert.Contains(t, playlist, "RESOLUTION=1920x1080\nvideo/hd/playlist.m3u8")
+}
+
+// TestParseRepresentationQualityRanking verifies that qualityRanking is parsed, that its absence is detectable
+// even next to a ranking of zero, and that ranked representations rank before unranked ones.
+func TestParseRepresentationQualityRanking(t *testing.T) {
+	const setXML = `<AdaptationSet id="1" contentType="video">
+		<Representation id="ranked" bandwidth="1500000" qualityRanking="2"/>
+		<Representation id="unranked" bandwidth="800000"/>
+		<Representation id="zero" bandwidth="400000" qualityRanking="0"/>
+	</AdaptationSet>`
+
+	var as dash.AdaptationSet
+	err := xml.Unmarshal([]byte(setXML), &as)
+	assert.NoError(t, err)
+
+	ranked, unranked, zero := &as.Representations[0], &as.Representations[1], &as.Representations[2]
+	if assert.True(t, ranked.HasQualityRanking()) {
+		assert.Equal(t, 2, *ranked.QualityRanking)
+	}
+	assert.False(t, unranked.HasQualityRanking())
+	if assert.True(t, zero.HasQualityRanking(), "qualityRanking=\"0\" is a ranking") {
+		assert.Equal(t, 0, *zero.QualityRanking)
+	}
+
+	assert.True(t, zero.RanksBefore(ranked))
+	assert.True(t, ranked.RanksBefore(unranked))
+	assert.False(t, unranked.RanksBefore(ranked))
+	assert.False(t, unranked.RanksBefore(unranked))
+	assert.False(t, ranked.RanksBefore(ranked))
+}
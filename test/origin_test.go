@@ -0,0 +1,162 @@
+package main_test
+
+import (
+	"dash2hlsd/internal/channels"
+	"dash2hlsd/internal/dash"
+	"dash2hlsd/internal/logger"
+	"dash2hlsd/internal/session"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps warnings and errors so tests can assert on them.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Debugf(format string, v ...interface{}) {}
+func (l *recordingLogger) Infof(format string, v ...interface{})  {}
+func (l *recordingLogger) Warnf(format string, v ...interface{})  { l.record("WARN", format, v...) }
+func (l *recordingLogger) Errorf(format string, v ...interface{}) { l.record("ERROR", format, v...) }
+
+func (l *recordingLogger) record(level, format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, level+" "+fmt.Sprintf(format, v...))
+}
+
+// Contains reports whether any recorded message contains substr.
+func (l *recordingLogger) Contains(substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, msg := range l.messages {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// testLiveMPD is a minimal live manifest with one video and one audio AdaptationSet.
+// Each timeline holds ten 2-second segments, so a new session starts its playhead at 12s.
+const testLiveMPD = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" profiles="urn:mpeg:dash:profile:isoff-live:2011" minimumUpdatePeriod="PT2S" maxSegmentDuration="PT2S" availabilityStartTime="1970-01-01T00:00:00Z">
+	<Period id="p0" start="PT0S">
+		<AdaptationSet id="1" contentType="video" mimeType="video/mp4">
+			<SegmentTemplate timescale="90000" initialization="init-$RepresentationID$.mp4" media="seg-$RepresentationID$-$Time$.m4s">
+				<SegmentTimeline>
+					<S t="0" d="180000" r="9"/>
+				</SegmentTimeline>
+			</SegmentTemplate>
+			<Representation id="v1" bandwidth="1000000" codecs="avc1.640028" width="1280" height="720" frameRate="25"/>
+		</AdaptationSet>
+		<AdaptationSet id="2" contentType="audio" lang="en" mimeType="audio/mp4">
+			<SegmentTemplate timescale="48000" initialization="init-$RepresentationID$.mp4" media="seg-$RepresentationID$-$Time$.m4s">
+				<SegmentTimeline>
+					<S t="0" d="96000" r="9"/>
+				</SegmentTimeline>
+			</SegmentTemplate>
+			<Representation id="a1" bandwidth="128000" codecs="mp4a.40.2"/>
+		</AdaptationSet>
+	</Period>
+</MPD>`
+
+// testOrigin is a fake DASH origin serving a manifest at /manifest.mpd and
+// deterministic bytes for every other path.
+type testOrigin struct {
+	server *httptest.Server
+
+	mu             sync.Mutex
+	manifest       string
+	manifestStatus int
+	segmentDelay   time.Duration
+	requests       map[string]int
+}
+
+func newTestOrigin(t *testing.T, manifest string) *testOrigin {
+	o := &testOrigin{
+		manifest:       manifest,
+		manifestStatus: http.StatusOK,
+		requests:       make(map[string]int),
+	}
+	o.server = httptest.NewServer(http.HandlerFunc(o.serveHTTP))
+	t.Cleanup(o.server.Close)
+	return o
+}
+
+func (o *testOrigin) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	o.requests[r.URL.Path]++
+	manifest, status, delay := o.manifest, o.manifestStatus, o.segmentDelay
+	o.mu.Unlock()
+
+	if r.URL.Path == "/manifest.mpd" {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Write([]byte(manifest))
+		return
+	}
+	time.Sleep(delay)
+	w.Write([]byte("segment:" + r.URL.Path))
+}
+
+// URL returns the absolute URL of a path on the origin.
+func (o *testOrigin) URL(path string) string {
+	return o.server.URL + path
+}
+
+// SetManifest replaces the manifest served on subsequent requests.
+func (o *testOrigin) SetManifest(manifest string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.manifest = manifest
+}
+
+// SetManifestStatus makes subsequent manifest requests fail with the given status.
+func (o *testOrigin) SetManifestStatus(status int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.manifestStatus = status
+}
+
+// SetSegmentDelay makes the origin wait before answering every non-manifest request.
+func (o *testOrigin) SetSegmentDelay(delay time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.segmentDelay = delay
+}
+
+// Requests returns how many times a path has been requested.
+func (o *testOrigin) Requests(path string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.requests[path]
+}
+
+// newTestManager creates and starts a session manager for the given channels.
+// The manager is stopped when the test finishes.
+func newTestManager(t *testing.T, chans ...channels.Channel) *session.SessionManager {
+	return newTestManagerWithConfig(t, &channels.ChannelConfig{Name: "test", Id: "test", Channels: chans})
+}
+
+// newTestManagerWithConfig is like newTestManager but accepts a full configuration.
+func newTestManagerWithConfig(t *testing.T, cfg *channels.ChannelConfig) *session.SessionManager {
+	return newTestManagerWithLogger(t, &mockLogger{}, cfg)
+}
+
+// newTestManagerWithLogger is like newTestManagerWithConfig but logs to the given logger.
+func newTestManagerWithLogger(t *testing.T, log logger.Logger, cfg *channels.ChannelConfig) *session.SessionManager {
+	sm := session.NewManager(log, cfg, dash.NewClient(log))
+	sm.Start()
+	t.Cleanup(sm.Stop)
+	return sm
+}
@@ -1,13 +1,19 @@
 package main_test
 
 import (
+	"bytes"
+	"dash2hlsd/internal/channels"
 	"dash2hlsd/internal/dash"
 	"dash2hlsd/internal/hls"
 	"dash2hlsd/internal/models"
+	"encoding/binary"
+	"encoding/xml"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGenerateMasterPlaylist(t *testing.T) {
@@ -37,7 +43,7 @@ func TestGenerateMasterPlaylist(t *testing.T) {
 		"video": {&mpd.Periods[0].Sets[0].Representations[0], &mpd.Periods[0].Sets[0].Representations[1]},
 		"audio": {&mpd.Periods[0].Sets[1].Representations[0]},
 	}
-	playlist, err := hls.GenerateMasterPlaylist(mpd, selectedReps)
+	playlist, err := hls.GenerateMasterPlaylist(mpd, selectedReps, hls.MasterPlaylistOptions{})
 	assert.NoError(t, err)
 
 	// Check for video stream 1
@@ -49,7 +55,7 @@ func TestGenerateMasterPlaylist(t *testing.T) {
 	assert.Contains(t, playlist, "video/v2/playlist.m3u8")
 
 	// Check for audio stream
-	assert.Contains(t, playlist, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"a1\",DEFAULT=YES,AUTOSELECT=YES,LANGUAGE=\"a1\",URI=\"audio/a1/playlist.m3u8\"")
+	assert.Contains(t, playlist, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"a1\",DEFAULT=YES,AUTOSELECT=YES,CHANNELS=\"2\",URI=\"audio/a1/playlist.m3u8\"")
 }
 
 func TestGenerateMediaPlaylist(t *testing.T) {
@@ -78,7 +84,7 @@ func TestGenerateMediaPlaylist(t *testing.T) {
 		{ID: "12351", Duration: 540000},
 	}
 
-	playlist, err := hls.GenerateMediaPlaylist(mpd, "test_channel", "video", "v1", 101, segments)
+	playlist, err := hls.GenerateMediaPlaylist(mpd, "test_channel", "video", "v1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{MediaSequence: 101})
 	assert.NoError(t, err)
 
 	lines := strings.Split(strings.TrimSpace(playlist), "\n")
@@ -98,3 +104,670 @@ func TestGenerateMediaPlaylist(t *testing.T) {
 	assert.Equal(t, "#EXTINF:6.000,", lines[8])
 	assert.Equal(t, "12351.m4s", lines[9])
 }
+
+// TestGenerateMediaPlaylist_Discontinuity verifies that period boundaries are marked as discontinuities.
+func TestGenerateMediaPlaylist_Discontinuity(t *testing.T) {
+	mpd := &dash.MPD{
+		MaxSegmentDuration: "PT2S",
+		Periods: []dash.Period{
+			{ID: "p0", Sets: []dash.AdaptationSet{{
+				ContentType:     "video",
+				SegmentTemplate: dash.SegmentTemplate{Timescale: 90000, Initialization: "init-$RepresentationID$.mp4"},
+				Representations: []dash.Representation{{ID: "v1"}},
+			}}},
+			{ID: "p1", Start: "PT10S", Sets: []dash.AdaptationSet{{
+				ContentType:     "video",
+				SegmentTemplate: dash.SegmentTemplate{Timescale: 90000, Initialization: "init-$RepresentationID$.mp4"},
+				Representations: []dash.Representation{{ID: "v1"}},
+			}}},
+		},
+	}
+
+	segments := []*models.Segment{
+		{ID: "720000", Duration: 180000, PeriodID: "p0"},
+		{ID: "900000", Duration: 180000, PeriodID: "p0"},
+		{ID: "0", Duration: 180000, PeriodID: "p1"},
+		{ID: "180000", Duration: 180000, PeriodID: "p1"},
+	}
+
+	playlist, err := hls.GenerateMediaPlaylist(mpd, "test_channel", "video", "v1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{MediaSequence: 40, DiscontinuitySequence: 2})
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(playlist), "\n")
+	assert.Equal(t, "#EXT-X-MEDIA-SEQUENCE:40", lines[3])
+	assert.Equal(t, "#EXT-X-DISCONTINUITY-SEQUENCE:2", lines[4])
+	assert.Equal(t, 1, strings.Count(playlist, "#EXT-X-DISCONTINUITY\n"))
+	assert.Contains(t, playlist, "900000.m4s\n#EXT-X-DISCONTINUITY\n#EXTINF:2.000,\n0.m4s\n")
+
+	// Without a preceding discontinuity the sequence tag is omitted.
+	playlist, err = hls.GenerateMediaPlaylist(mpd, "test_channel", "video", "v1", hls.KeyInfo{}, segments[:2], hls.MediaPlaylistOptions{MediaSequence: 40})
+	require.NoError(t, err)
+	assert.NotContains(t, playlist, "#EXT-X-DISCONTINUITY")
+}
+
+// TestGenerateMediaPlaylist_MissingSegment verifies that a segment missing from the middle of the
+// window is listed as a gap, keeping the numbering of the segments after it, while contiguous segments
+// and timeline jitter are not.
+func TestGenerateMediaPlaylist_MissingSegment(t *testing.T) {
+	mpd := &dash.MPD{
+		MaxSegmentDuration: "PT2S",
+		Periods: []dash.Period{{ID: "p0", Sets: []dash.AdaptationSet{{
+			ContentType:     "video",
+			SegmentTemplate: dash.SegmentTemplate{Timescale: 90000, Initialization: "init-$RepresentationID$.mp4"},
+			Representations: []dash.Representation{{ID: "v1"}},
+		}}}},
+	}
+
+	segments := []*models.Segment{
+		{ID: "0", Time: 0, Duration: 180000, PeriodID: "p0"},
+		{ID: "180000", Time: 180000, Duration: 180000, PeriodID: "p0"},
+		// The segment at 360000 failed to download.
+		{ID: "540000", Time: 540000, Duration: 180000, PeriodID: "p0"},
+		{ID: "720001", Time: 720001, Duration: 180000, PeriodID: "p0"},
+	}
+
+	playlist, err := hls.GenerateMediaPlaylist(mpd, "test_channel", "video", "v1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{MediaSequence: 10})
+	require.NoError(t, err)
+	assert.NotContains(t, playlist, "#EXT-X-DISCONTINUITY", "A missing segment is not a discontinuity")
+	assert.Equal(t, 1, strings.Count(playlist, "#EXT-X-GAP\n"), "Only the missing segment should be a gap")
+	assert.Contains(t, playlist, "180000.m4s\n#EXT-X-GAP\n#EXTINF:2.000,\n360000.m4s\n#EXTINF:2.000,\n540000.m4s\n")
+
+	assert.Equal(t, 1, hls.MissingSegments(segments[1], segments[2]))
+	assert.Zero(t, hls.MissingSegments(segments[2], segments[3]), "One tick of jitter is not a missing segment")
+	assert.Equal(t, 1, hls.CountMissingSegments(segments))
+
+	// Skipped segments of a delta update count the gaps among them.
+	live := *mpd
+	live.Type = "dynamic"
+	var window []*models.Segment
+	for _, start := range []uint64{0, 180000, 540000, 720000, 900000, 1080000, 1260000, 1440000, 1620000, 1800000, 1980000, 2160000, 2340000} {
+		window = append(window, &models.Segment{ID: strconv.FormatUint(start, 10), Time: start, Duration: 180000, PeriodID: "p0"})
+	}
+	delta, err := hls.GenerateMediaPlaylist(&live, "test_channel", "video", "v1", hls.KeyInfo{}, window, hls.MediaPlaylistOptions{MediaSequence: 10, DeltaUpdate: true})
+	require.NoError(t, err)
+	require.Contains(t, delta, "#EXT-X-SKIP:")
+	skipped := strings.Count(strings.Split(delta, "#EXT-X-SKIP:")[1], ".m4s")
+	assert.Contains(t, delta, "#EXT-X-SKIP:SKIPPED-SEGMENTS="+strconv.Itoa(14-skipped)+"\n", "The 13 segments and the gap make 14")
+}
+
+// TestSniffSegmentContentType verifies that fMP4 and MPEG-TS segments are detected from their first bytes.
+func TestSniffSegmentContentType(t *testing.T) {
+	fmp4Init := append([]byte{0x00, 0x00, 0x00, 0x18}, []byte("ftypiso6\x00\x00\x00\x00iso6dash")...)
+	fmp4Media := append([]byte{0x00, 0x00, 0x00, 0x18}, []byte("stypmsdh\x00\x00\x00\x00msdhmsix")...)
+
+	ts := make([]byte, 2*188)
+	ts[0], ts[188] = 0x47, 0x47
+
+	notTS := make([]byte, 2*188)
+	notTS[0] = 0x47
+
+	assert.Equal(t, "video/mp4", hls.SniffSegmentContentType(fmp4Init))
+	assert.Equal(t, "video/mp4", hls.SniffSegmentContentType(fmp4Media))
+	assert.Equal(t, "video/mp2t", hls.SniffSegmentContentType(ts))
+	assert.Equal(t, "", hls.SniffSegmentContentType(notTS), "A lone sync byte without a second packet should not be treated as TS")
+	assert.Equal(t, "text/vtt", hls.SniffSegmentContentType([]byte("WEBVTT\n\n00:00.000 --> 00:01.000\nhello")))
+	assert.Equal(t, "", hls.SniffSegmentContentType([]byte("garbage")))
+}
+
+// TestGenerateMediaPlaylist_ProgramDateTime verifies wall-clock timestamps derived from availabilityStartTime.
+func TestGenerateMediaPlaylist_ProgramDateTime(t *testing.T) {
+	newMPD := func(ast string) *dash.MPD {
+		return &dash.MPD{
+			AvailabilityStartTime: ast,
+			MaxSegmentDuration:    "PT2S",
+			Periods: []dash.Period{
+				{ID: "p0", Start: "PT10S", Sets: []dash.AdaptationSet{{
+					ContentType:     "audio",
+					SegmentTemplate: dash.SegmentTemplate{Timescale: 48000, Initialization: "init-$RepresentationID$.mp4"},
+					Representations: []dash.Representation{{ID: "a1", PresentationTimeOffset: 48000}},
+				}}},
+				{ID: "p1", Start: "PT100S", Sets: []dash.AdaptationSet{{
+					ContentType:     "audio",
+					SegmentTemplate: dash.SegmentTemplate{Timescale: 48000, Initialization: "init-$RepresentationID$.mp4"},
+					Representations: []dash.Representation{{ID: "a1", PresentationTimeOffset: 48000}},
+				}}},
+			},
+		}
+	}
+
+	segments := []*models.Segment{
+		{ID: "120000", Time: 120000, Duration: 96000, PeriodID: "p0"}, // 2.5s media time, 1.5s past the offset
+		{ID: "216000", Time: 216000, Duration: 96000, PeriodID: "p0"},
+		{ID: "48000", Time: 48000, Duration: 96000, PeriodID: "p1"},
+	}
+
+	t.Run("availabilityStartTime", func(t *testing.T) {
+		playlist, err := hls.GenerateMediaPlaylist(newMPD("2025-07-09T15:00:00Z"), "ch", "audio", "a1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{})
+		require.NoError(t, err)
+		assert.Contains(t, playlist, "#EXT-X-PROGRAM-DATE-TIME:2025-07-09T15:00:11.500Z\n#EXTINF")
+		assert.Contains(t, playlist, "#EXT-X-DISCONTINUITY\n#EXT-X-PROGRAM-DATE-TIME:2025-07-09T15:01:40.000Z\n")
+		assert.Equal(t, 2, strings.Count(playlist, "#EXT-X-PROGRAM-DATE-TIME"))
+	})
+
+	t.Run("epoch availabilityStartTime", func(t *testing.T) {
+		playlist, err := hls.GenerateMediaPlaylist(newMPD("1970-01-01T00:00:00Z"), "ch", "audio", "a1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{})
+		require.NoError(t, err)
+		assert.Contains(t, playlist, "#EXT-X-PROGRAM-DATE-TIME:1970-01-01T00:00:11.500Z\n")
+	})
+
+	t.Run("missing availabilityStartTime", func(t *testing.T) {
+		playlist, err := hls.GenerateMediaPlaylist(newMPD(""), "ch", "audio", "a1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{})
+		require.NoError(t, err)
+		assert.NotContains(t, playlist, "#EXT-X-PROGRAM-DATE-TIME")
+	})
+}
+
+// TestGenerateMediaPlaylist_EncryptionMethod verifies the EXT-X-KEY line for each encryption method.
+func TestGenerateMediaPlaylist_EncryptionMethod(t *testing.T) {
+	mpd := &dash.MPD{
+		MaxSegmentDuration: "PT2S",
+		Periods: []dash.Period{{Sets: []dash.AdaptationSet{{
+			ContentType:     "video",
+			SegmentTemplate: dash.SegmentTemplate{Timescale: 90000, Initialization: "init-$RepresentationID$.mp4"},
+			Representations: []dash.Representation{{ID: "v1"}},
+		}}}},
+	}
+	segments := []*models.Segment{{ID: "0", Duration: 180000}}
+
+	testCases := []struct {
+		method   channels.EncryptionMethod
+		expected string
+	}{
+		{"", "#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"/key/ch\"\n"},
+		{channels.EncryptionSampleAES, "#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"/key/ch\"\n"},
+		{channels.EncryptionAES128, "#EXT-X-KEY:METHOD=AES-128,URI=\"/key/ch\"\n"},
+	}
+	for _, tc := range testCases {
+		playlist, err := hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{Method: tc.method}, segments, hls.MediaPlaylistOptions{MediaSequence: 42})
+		require.NoError(t, err)
+		assert.Contains(t, playlist, tc.expected, "method %q", tc.method)
+	}
+
+	playlist, err := hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{Method: channels.EncryptionNone}, segments, hls.MediaPlaylistOptions{MediaSequence: 42})
+	require.NoError(t, err)
+	assert.NotContains(t, playlist, "#EXT-X-KEY")
+}
+
+func TestGenerateMediaPlaylist_KeyURITemplate(t *testing.T) {
+	mpd := &dash.MPD{
+		MaxSegmentDuration: "PT2S",
+		Periods: []dash.Period{{Sets: []dash.AdaptationSet{{
+			ContentType:     "video",
+			SegmentTemplate: dash.SegmentTemplate{Timescale: 90000, Initialization: "init-$RepresentationID$.mp4"},
+			Representations: []dash.Representation{{ID: "v1"}},
+		}}}},
+	}
+	segments := []*models.Segment{{ID: "0", Time: 0, Duration: 180000}}
+	kid := []byte{0x07, 0x37, 0xb7, 0x5e, 0xe8, 0x90, 0x6c, 0x00, 0xbb, 0x7b, 0xb8, 0xf6, 0x66, 0xda, 0x72, 0xa0}
+
+	keyInfo := hls.KeyInfo{KID: kid, URITemplate: "https://keys.example.com/{channelId}/{kid}?token=abc"}
+	playlist, err := hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", keyInfo, segments, hls.MediaPlaylistOptions{MediaSequence: 42})
+	require.NoError(t, err)
+	assert.Contains(t, playlist, "#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"https://keys.example.com/ch/0737b75ee8906c00bb7bb8f666da72a0?token=abc\"\n")
+
+	// A single-key channel does not select its key by representation, so {kid} is the channel's key ID.
+	singleKey := hls.KeyInfo{ChannelKID: kid, URITemplate: keyInfo.URITemplate}
+	playlist, err = hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", singleKey, segments, hls.MediaPlaylistOptions{MediaSequence: 42})
+	require.NoError(t, err)
+	assert.Contains(t, playlist, "#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"https://keys.example.com/ch/0737b75ee8906c00bb7bb8f666da72a0?token=abc\"\n")
+
+	// Without a template, the key is served by this server.
+	keyInfo.URITemplate = ""
+	playlist, err = hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", keyInfo, segments, hls.MediaPlaylistOptions{MediaSequence: 42})
+	require.NoError(t, err)
+	assert.Contains(t, playlist, "#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"/key/ch?kid=0737b75ee8906c00bb7bb8f666da72a0\"\n")
+}
+
+func TestGenerateMediaPlaylist_IV(t *testing.T) {
+	mpd := &dash.MPD{
+		MaxSegmentDuration: "PT2S",
+		Periods: []dash.Period{{Sets: []dash.AdaptationSet{{
+			ContentType:     "video",
+			SegmentTemplate: dash.SegmentTemplate{Timescale: 90000, Initialization: "init-$RepresentationID$.mp4"},
+			Representations: []dash.Representation{{ID: "v1"}},
+		}}}},
+	}
+	segments := []*models.Segment{{ID: "0", Time: 0, Duration: 180000}, {ID: "180000", Time: 180000, Duration: 180000}}
+	iv := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+	t.Run("configured IV", func(t *testing.T) {
+		for _, method := range []channels.EncryptionMethod{channels.EncryptionSampleAES, channels.EncryptionAES128} {
+			playlist, err := hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{Method: method, IV: iv}, segments, hls.MediaPlaylistOptions{MediaSequence: 42})
+			require.NoError(t, err)
+			assert.Contains(t, playlist, `URI="/key/ch",IV=0x000102030405060708090a0b0c0d0e0f`+"\n", "method %q", method)
+			assert.Equal(t, 1, strings.Count(playlist, "#EXT-X-KEY"))
+		}
+	})
+
+	t.Run("per-segment IV", func(t *testing.T) {
+		playlist, err := hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{Method: channels.EncryptionSampleAES, PerSegmentIV: true}, segments, hls.MediaPlaylistOptions{MediaSequence: 42})
+		require.NoError(t, err)
+		assert.Contains(t, playlist, "#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"/key/ch\",IV=0x00000000000000000000000000000000\n#EXTINF:2.000,\n0.m4s\n")
+		assert.Contains(t, playlist, "#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"/key/ch\",IV=0x0000000000000000000000000002bf20\n#EXTINF:2.000,\n180000.m4s\n")
+	})
+}
+
+func TestGenerateMediaPlaylist_TargetDuration(t *testing.T) {
+	mpd := &dash.MPD{
+		MaxSegmentDuration: "PT2S",
+		Periods: []dash.Period{{Sets: []dash.AdaptationSet{{
+			ContentType:     "video",
+			SegmentTemplate: dash.SegmentTemplate{Timescale: 90000, Initialization: "init-$RepresentationID$.mp4"},
+			Representations: []dash.Representation{{ID: "v1"}},
+		}}}},
+	}
+	segments := []*models.Segment{{ID: "0", Duration: 180000}, {ID: "180000", Time: 180000, Duration: 270000}}
+
+	t.Run("derived", func(t *testing.T) {
+		playlist, err := hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{}, segments[:1], hls.MediaPlaylistOptions{})
+		require.NoError(t, err)
+		assert.Contains(t, playlist, "#EXT-X-TARGETDURATION:2\n")
+	})
+
+	t.Run("override", func(t *testing.T) {
+		playlist, err := hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{TargetDuration: 6})
+		require.NoError(t, err)
+		assert.Contains(t, playlist, "#EXT-X-TARGETDURATION:6\n")
+	})
+
+	t.Run("too small override is bumped", func(t *testing.T) {
+		// The 3-second segment does not fit a 2-second target duration.
+		playlist, err := hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{TargetDuration: 2})
+		require.NoError(t, err)
+		assert.Contains(t, playlist, "#EXT-X-TARGETDURATION:3\n")
+	})
+}
+
+// TestGenerateMediaPlaylist_AllowCache verifies that the legacy EXT-X-ALLOW-CACHE tag is only emitted when enabled,
+// allowing caching once the playlist is final.
+func TestGenerateMediaPlaylist_AllowCache(t *testing.T) {
+	mpd := &dash.MPD{
+		MaxSegmentDuration: "PT2S",
+		Periods: []dash.Period{{Sets: []dash.AdaptationSet{{
+			ContentType:     "video",
+			SegmentTemplate: dash.SegmentTemplate{Timescale: 90000, Initialization: "init-$RepresentationID$.mp4"},
+			Representations: []dash.Representation{{ID: "v1"}},
+		}}}},
+	}
+	segments := []*models.Segment{{ID: "0", Duration: 180000}}
+
+	playlist, err := hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, playlist, "#EXT-X-ALLOW-CACHE")
+
+	playlist, err = hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{AllowCache: true})
+	require.NoError(t, err)
+	assert.Contains(t, playlist, "#EXT-X-ALLOW-CACHE:NO\n")
+
+	playlist, err = hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{Ended: true, AllowCache: true})
+	require.NoError(t, err)
+	assert.Contains(t, playlist, "#EXT-X-ALLOW-CACHE:YES\n")
+}
+
+// TestGenerateMediaPlaylist_PerSetTimescale verifies that EXTINF durations use the timescale of the
+// representation's own AdaptationSet, or of its own SegmentTemplate when it has one.
+func TestGenerateMediaPlaylist_PerSetTimescale(t *testing.T) {
+	mpd := &dash.MPD{
+		MaxSegmentDuration: "PT2S",
+		Periods: []dash.Period{{Sets: []dash.AdaptationSet{
+			{
+				ContentType:     "video",
+				SegmentTemplate: dash.SegmentTemplate{Timescale: 90000, Initialization: "init-$RepresentationID$.mp4"},
+				Representations: []dash.Representation{{ID: "v1"}},
+			},
+			{
+				ContentType:     "audio",
+				SegmentTemplate: dash.SegmentTemplate{Timescale: 48000, Initialization: "init-$RepresentationID$.mp4"},
+				Representations: []dash.Representation{
+					{ID: "a1"},
+					{ID: "a2", SegmentTemplate: &dash.SegmentTemplate{Timescale: 44100}},
+				},
+			},
+		}}},
+	}
+
+	testCases := []struct {
+		mediaType, repId string
+		duration         uint64
+	}{
+		{"video", "v1", 180000},
+		{"audio", "a1", 96000},
+		{"audio", "a2", 88200},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.repId, func(t *testing.T) {
+			segments := []*models.Segment{{ID: "0", Duration: tc.duration}}
+			playlist, err := hls.GenerateMediaPlaylist(mpd, "ch", tc.mediaType, tc.repId, hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{})
+			require.NoError(t, err)
+			assert.Contains(t, playlist, "#EXTINF:2.000,\n")
+			assert.Contains(t, playlist, "#EXT-X-TARGETDURATION:2\n")
+		})
+	}
+}
+
+// TestGenerateIFramePlaylist verifies the master playlist entry and the I-frame playlist of a trick mode track.
+func TestGenerateIFramePlaylist(t *testing.T) {
+	mpd := &dash.MPD{
+		Type:               "dynamic",
+		MaxSegmentDuration: "PT4S",
+		Periods: []dash.Period{{Sets: []dash.AdaptationSet{{
+			ContentType:     "video",
+			SegmentTemplate: dash.SegmentTemplate{Timescale: 90000, Initialization: "init-$RepresentationID$.mp4"},
+			Representations: []dash.Representation{
+				{ID: "v1", Bandwidth: 5000000, Codecs: "avc1.640028", Width: 1920, Height: 1080},
+				{ID: "v1_TrickMode", Bandwidth: 200000, Codecs: "avc1.640028", Width: 1920, Height: 1080},
+			},
+		}}}},
+	}
+
+	master, err := hls.GenerateMasterPlaylist(mpd, map[string][]*dash.Representation{
+		"video":             {&mpd.Periods[0].Sets[0].Representations[0]},
+		hls.IFrameMediaType: {&mpd.Periods[0].Sets[0].Representations[1]},
+	}, hls.MasterPlaylistOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, master, "#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=200000,CODECS=\"avc1.640028\",RESOLUTION=1920x1080,URI=\"video/v1_TrickMode/iframes.m3u8\"\n")
+	assert.NotContains(t, master, "video/v1_TrickMode/playlist.m3u8")
+
+	segments := []*models.Segment{{ID: "0", Duration: 360000}, {ID: "360000", Time: 360000, Duration: 360000}}
+	playlist, err := hls.GenerateIFramePlaylist(mpd, "ch", "v1_TrickMode", hls.KeyInfo{}, 0, 7, 0, false, segments, map[string]int{"0": 1234})
+	require.NoError(t, err)
+	assert.Contains(t, playlist, "#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:7\n")
+	assert.Contains(t, playlist, "#EXT-X-I-FRAMES-ONLY\n")
+	assert.Contains(t, playlist, `#EXT-X-MAP:URI="init-v1_TrickMode.m4s"`)
+	assert.Contains(t, playlist, "#EXTINF:4.000,\n#EXT-X-BYTERANGE:1234@0\n0.m4s\n")
+	assert.Contains(t, playlist, "#EXTINF:4.000,\n360000.m4s\n", "A segment of unknown size has no byte range")
+	assert.NotContains(t, playlist, "#EXT-X-ENDLIST")
+}
+
+func TestGenerateMediaPlaylist_DeltaUpdate(t *testing.T) {
+	mpd := &dash.MPD{
+		Type:               "dynamic",
+		MaxSegmentDuration: "PT2S",
+		Periods: []dash.Period{{Sets: []dash.AdaptationSet{{
+			ContentType:     "video",
+			SegmentTemplate: dash.SegmentTemplate{Timescale: 90000, Initialization: "init-$RepresentationID$.mp4"},
+			Representations: []dash.Representation{{ID: "v1"}},
+		}}}},
+	}
+	// Twenty 2-second segments, of which the last six fit in the 12-second CAN-SKIP-UNTIL.
+	var segments []*models.Segment
+	for i := 0; i < 20; i++ {
+		start := uint64(i) * 180000
+		segments = append(segments, &models.Segment{ID: strconv.FormatUint(start, 10), Time: start, Duration: 180000})
+	}
+
+	full, err := hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{MediaSequence: 100})
+	require.NoError(t, err)
+	assert.Contains(t, full, "#EXT-X-SERVER-CONTROL:CAN-SKIP-UNTIL=12.0\n")
+	assert.NotContains(t, full, "#EXT-X-SKIP")
+	assert.Equal(t, 20, strings.Count(full, "#EXTINF"))
+
+	delta, err := hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{MediaSequence: 100, DeltaUpdate: true})
+	require.NoError(t, err)
+	assert.Contains(t, delta, "#EXT-X-VERSION:9\n")
+	assert.Contains(t, delta, "#EXT-X-MEDIA-SEQUENCE:100\n")
+	assert.Contains(t, delta, "#EXT-X-SKIP:SKIPPED-SEGMENTS=14\n#EXTINF:2.000,\n2520000.m4s\n")
+	assert.Equal(t, 6, strings.Count(delta, "#EXTINF"))
+
+	// A playlist shorter than CAN-SKIP-UNTIL has nothing to skip, so delta updates are not advertised.
+	delta, err = hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{}, segments[:5], hls.MediaPlaylistOptions{MediaSequence: 100, DeltaUpdate: true})
+	require.NoError(t, err)
+	assert.NotContains(t, delta, "#EXT-X-SERVER-CONTROL")
+	assert.NotContains(t, delta, "#EXT-X-SKIP")
+	assert.Equal(t, 5, strings.Count(delta, "#EXTINF"))
+}
+
+func TestGenerateMasterPlaylist_RolesAndLabels(t *testing.T) {
+	const manifest = `<MPD><Period>
+		<AdaptationSet contentType="video"><Representation id="v1" bandwidth="1000000" codecs="avc1.640028"/></AdaptationSet>
+		<AdaptationSet contentType="audio" lang="de">
+			<Role schemeIdUri="urn:mpeg:dash:role:2011" value="alternate"/>
+			<Label>Deutsch</Label>
+			<Representation id="a-de" bandwidth="128000" codecs="mp4a.40.2"/>
+		</AdaptationSet>
+		<AdaptationSet contentType="audio" lang="en">
+			<Role schemeIdUri="urn:mpeg:dash:role:2011" value="main"/>
+			<Label>English</Label>
+			<Representation id="a-en" bandwidth="128000" codecs="mp4a.40.2"/>
+		</AdaptationSet>
+		<AdaptationSet contentType="audio" lang="en">
+			<Role schemeIdUri="urn:mpeg:dash:role:2011" value="commentary"/>
+			<Representation id="a-en-commentary" bandwidth="64000" codecs="mp4a.40.2"/>
+		</AdaptationSet>
+		<AdaptationSet contentType="audio" lang="en">
+			<Accessibility schemeIdUri="urn:tva:metadata:cs:AudioPurposeCS:2007" value="1"/>
+			<Label>English (described)</Label>
+			<Representation id="a-en-ad" bandwidth="64000" codecs="mp4a.40.2"/>
+		</AdaptationSet>
+		<AdaptationSet contentType="text" lang="en">
+			<Role schemeIdUri="urn:mpeg:dash:role:2011" value="main"/>
+			<Representation id="t-en" bandwidth="1000" codecs="wvtt"/>
+		</AdaptationSet>
+		<AdaptationSet contentType="text" lang="en">
+			<Accessibility schemeIdUri="urn:mpeg:dash:role:2011" value="caption"/>
+			<Representation id="t-en-cc" bandwidth="1000" codecs="wvtt"/>
+		</AdaptationSet>
+	</Period></MPD>`
+	var mpd dash.MPD
+	require.NoError(t, xml.Unmarshal([]byte(manifest), &mpd))
+
+	sets := mpd.Periods[0].Sets
+	selectedReps := map[string][]*dash.Representation{
+		"video": {&sets[0].Representations[0]},
+		"audio": {&sets[1].Representations[0], &sets[2].Representations[0], &sets[3].Representations[0], &sets[4].Representations[0]},
+		"text":  {&sets[5].Representations[0], &sets[6].Representations[0]},
+	}
+	playlist, err := hls.GenerateMasterPlaylist(&mpd, selectedReps, hls.MasterPlaylistOptions{})
+	require.NoError(t, err)
+
+	assert.Contains(t, playlist, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"Deutsch\",DEFAULT=NO,AUTOSELECT=YES,LANGUAGE=\"de\",CHANNELS=\"2\",URI=\"audio/a-de/playlist.m3u8\"\n")
+	assert.Contains(t, playlist, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"English\",DEFAULT=YES,AUTOSELECT=YES,LANGUAGE=\"en\",CHANNELS=\"2\",URI=\"audio/a-en/playlist.m3u8\"\n")
+	assert.Contains(t, playlist, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"en\",DEFAULT=NO,AUTOSELECT=NO,LANGUAGE=\"en\",CHANNELS=\"2\",URI=\"audio/a-en-commentary/playlist.m3u8\"\n")
+	assert.Contains(t, playlist, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"English (described)\",DEFAULT=NO,AUTOSELECT=YES,LANGUAGE=\"en\",CHARACTERISTICS=\"public.accessibility.describes-video\",CHANNELS=\"2\",URI=\"audio/a-en-ad/playlist.m3u8\"\n")
+	assert.Contains(t, playlist, "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subtitles\",NAME=\"en\",DEFAULT=YES,AUTOSELECT=YES,LANGUAGE=\"en\",URI=\"text/t-en/playlist.m3u8\"\n")
+	assert.Contains(t, playlist, "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subtitles\",NAME=\"en (t-en-cc)\",DEFAULT=NO,AUTOSELECT=YES,LANGUAGE=\"en\",CHARACTERISTICS=\"public.accessibility.transcribes-spoken-dialog,public.accessibility.describes-music-and-sound\",URI=\"text/t-en-cc/playlist.m3u8\"\n")
+	assert.Equal(t, 1, strings.Count(playlist, "TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"English\",DEFAULT=YES"))
+}
+
+// TestGenerateMasterPlaylist_ClosedCaptions verifies that CEA-608 and CEA-708 captions signalled on the video
+// adaptation set are advertised as CLOSED-CAPTIONS renditions referenced by the video variants.
+func TestGenerateMasterPlaylist_ClosedCaptions(t *testing.T) {
+	const manifest = `<MPD><Period>
+		<AdaptationSet contentType="video">
+			<Accessibility schemeIdUri="urn:scte:dash:cc:cea-608:2015" value="CC1=eng;CC3=deu"/>
+			<Accessibility schemeIdUri="urn:scte:dash:cc:cea-708:2015" value="1=lang:eng,war:1;2=lang:fra"/>
+			<Representation id="v1" bandwidth="1000000" codecs="avc1.640028"/>
+			<Representation id="v2" bandwidth="500000" codecs="avc1.640028"/>
+		</AdaptationSet>
+		<AdaptationSet contentType="audio">
+			<Representation id="a1" bandwidth="128000" codecs="mp4a.40.2"/>
+		</AdaptationSet>
+	</Period></MPD>`
+	var mpd dash.MPD
+	require.NoError(t, xml.Unmarshal([]byte(manifest), &mpd))
+	sets := mpd.Periods[0].Sets
+
+	playlist, err := hls.GenerateMasterPlaylist(&mpd, map[string][]*dash.Representation{
+		"video": {&sets[0].Representations[0], &sets[0].Representations[1]},
+		"audio": {&sets[1].Representations[0]},
+	}, hls.MasterPlaylistOptions{})
+	require.NoError(t, err)
+
+	assert.Contains(t, playlist, "#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID=\"cc\",NAME=\"eng\",DEFAULT=NO,AUTOSELECT=YES,LANGUAGE=\"eng\",INSTREAM-ID=\"CC1\"\n")
+	assert.Contains(t, playlist, "#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID=\"cc\",NAME=\"deu\",DEFAULT=NO,AUTOSELECT=YES,LANGUAGE=\"deu\",INSTREAM-ID=\"CC3\"\n")
+	assert.Contains(t, playlist, "#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID=\"cc\",NAME=\"eng (SERVICE1)\",DEFAULT=NO,AUTOSELECT=YES,LANGUAGE=\"eng\",INSTREAM-ID=\"SERVICE1\"\n")
+	assert.Contains(t, playlist, "#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID=\"cc\",NAME=\"fra\",DEFAULT=NO,AUTOSELECT=YES,LANGUAGE=\"fra\",INSTREAM-ID=\"SERVICE2\"\n")
+	assert.Equal(t, 4, strings.Count(playlist, "TYPE=CLOSED-CAPTIONS"), "Each service should be advertised once")
+	assert.Contains(t, playlist, "#EXT-X-STREAM-INF:BANDWIDTH=1000000,CODECS=\"avc1.640028\",AUDIO=\"audio\",CLOSED-CAPTIONS=\"cc\"\nvideo/v1/playlist.m3u8\n")
+	assert.Contains(t, playlist, "#EXT-X-STREAM-INF:BANDWIDTH=500000,CODECS=\"avc1.640028\",AUDIO=\"audio\",CLOSED-CAPTIONS=\"cc\"\nvideo/v2/playlist.m3u8\n")
+
+	t.Run("without captions", func(t *testing.T) {
+		sets[0].Accessibility = nil
+		playlist, err := hls.GenerateMasterPlaylist(&mpd, map[string][]*dash.Representation{"video": {&sets[0].Representations[0]}}, hls.MasterPlaylistOptions{})
+		require.NoError(t, err)
+		assert.NotContains(t, playlist, "CLOSED-CAPTIONS")
+	})
+
+	t.Run("declaring no captions", func(t *testing.T) {
+		sets[0].Accessibility = nil
+		playlist, err := hls.GenerateMasterPlaylist(&mpd, map[string][]*dash.Representation{
+			"video": {&sets[0].Representations[0]},
+			"audio": {&sets[1].Representations[0]},
+		}, hls.MasterPlaylistOptions{DeclareNoCaptions: true})
+		require.NoError(t, err)
+		assert.Contains(t, playlist, "#EXT-X-STREAM-INF:BANDWIDTH=1000000,CODECS=\"avc1.640028\",AUDIO=\"audio\",CLOSED-CAPTIONS=NONE\nvideo/v1/playlist.m3u8\n")
+		assert.NotContains(t, playlist, "TYPE=CLOSED-CAPTIONS")
+	})
+}
+
+// TestGenerateMasterPlaylist_AudioOnly verifies that a master playlist without video advertises its audio
+// as a variant stream with the audio codec, so that players requiring a variant can play it.
+func TestGenerateMasterPlaylist_AudioOnly(t *testing.T) {
+	const manifest = `<MPD><Period>
+		<AdaptationSet contentType="audio" codecs="mp4a.40.2" lang="en">
+			<Representation id="a1" bandwidth="96000"/>
+		</AdaptationSet>
+	</Period></MPD>`
+	var mpd dash.MPD
+	require.NoError(t, xml.Unmarshal([]byte(manifest), &mpd))
+
+	playlist, err := hls.GenerateMasterPlaylist(&mpd, map[string][]*dash.Representation{
+		"audio": {&mpd.Periods[0].Sets[0].Representations[0]},
+	}, hls.MasterPlaylistOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, strings.Count(playlist, "#EXT-X-STREAM-INF:"), "Expected exactly one variant")
+	assert.Contains(t, playlist, "#EXT-X-STREAM-INF:BANDWIDTH=96000,CODECS=\"mp4a.40.2\",AUDIO=\"audio\"\naudio/a1/playlist.m3u8\n")
+	assert.NotContains(t, playlist, "CLOSED-CAPTIONS")
+}
+
+// TestCaptionServices verifies the parsing of caption descriptor values.
+func TestCaptionServices(t *testing.T) {
+	for _, tc := range []struct {
+		scheme, value string
+		want          []dash.CaptionService
+	}{
+		{dash.CEA608Scheme, "", []dash.CaptionService{{InstreamID: "CC1"}}},
+		{dash.CEA608Scheme, "eng;spa", []dash.CaptionService{{InstreamID: "CC1", Lang: "eng"}, {InstreamID: "CC2", Lang: "spa"}}},
+		{dash.CEA608Scheme, "CC2=eng;CC5=deu", []dash.CaptionService{{InstreamID: "CC2", Lang: "eng"}}},
+		{dash.CEA708Scheme, "3=eng", []dash.CaptionService{{InstreamID: "SERVICE3", Lang: "eng"}}},
+		{dash.CEA708Scheme, "1=lang:spa,er:1;64=lang:eng", []dash.CaptionService{{InstreamID: "SERVICE1", Lang: "spa"}}},
+		{dash.RoleScheme, "caption", nil},
+	} {
+		as := dash.AdaptationSet{Accessibility: []dash.Descriptor{{SchemeIdUri: tc.scheme, Value: tc.value}}}
+		assert.Equal(t, tc.want, as.CaptionServices(), "%s %q", tc.scheme, tc.value)
+	}
+}
+
+func TestGenerateMasterPlaylist_AudioChannels(t *testing.T) {
+	const manifest = `<MPD><Period>
+		<AdaptationSet contentType="audio" codecs="ec-3">
+			<AudioChannelConfiguration schemeIdUri="tag:dolby.com,2014:dash:audio_channel_configuration:2011" value="F801"/>
+			<Representation id="ec3-51" bandwidth="384000"/>
+			<Representation id="ec3-71" bandwidth="768000">
+				<AudioChannelConfiguration schemeIdUri="tag:dolby.com,2014:dash:audio_channel_configuration:2011" value="FA01"/>
+			</Representation>
+		</AdaptationSet>
+		<AdaptationSet contentType="audio" codecs="mp4a.40.2">
+			<AudioChannelConfiguration schemeIdUri="urn:mpeg:mpegB:cicp:ChannelConfiguration" value="6"/>
+			<Representation id="aac-cicp" bandwidth="256000"/>
+		</AdaptationSet>
+		<AdaptationSet contentType="audio" codecs="mp4a.40.2">
+			<AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="1"/>
+			<Representation id="aac-mono" bandwidth="64000"/>
+			<Representation id="aac-stereo" bandwidth="128000">
+				<AudioChannelConfiguration schemeIdUri="urn:unknown" value="x"/>
+			</Representation>
+		</AdaptationSet>
+		<AdaptationSet contentType="audio" codecs="mp4a.40.5">
+			<Representation id="aac-default" bandwidth="64000"/>
+		</AdaptationSet>
+		<AdaptationSet contentType="audio" codecs="ac-3">
+			<Representation id="ac3-unknown" bandwidth="384000"/>
+		</AdaptationSet>
+	</Period></MPD>`
+	var mpd dash.MPD
+	require.NoError(t, xml.Unmarshal([]byte(manifest), &mpd))
+
+	sets := mpd.Periods[0].Sets
+	testCases := map[string]struct {
+		rep      *dash.Representation
+		channels string
+	}{
+		"ec3-51":      {&sets[0].Representations[0], ",CHANNELS=\"6\","},
+		"ec3-71":      {&sets[0].Representations[1], ",CHANNELS=\"8\","},
+		"aac-cicp":    {&sets[1].Representations[0], ",CHANNELS=\"6\","},
+		"aac-mono":    {&sets[2].Representations[0], ",CHANNELS=\"1\","},
+		"aac-stereo":  {&sets[2].Representations[1], ",CHANNELS=\"2\","},
+		"aac-default": {&sets[3].Representations[0], ",CHANNELS=\"2\","},
+		"ac3-unknown": {&sets[4].Representations[0], ""},
+	}
+	for repId, tc := range testCases {
+		t.Run(repId, func(t *testing.T) {
+			playlist, err := hls.GenerateMasterPlaylist(&mpd, map[string][]*dash.Representation{"audio": {tc.rep}}, hls.MasterPlaylistOptions{})
+			require.NoError(t, err)
+			if tc.channels == "" {
+				assert.NotContains(t, playlist, "CHANNELS=")
+			} else {
+				assert.Contains(t, playlist, tc.channels+"URI=\"audio/"+repId+"/playlist.m3u8\"")
+			}
+		})
+	}
+}
+
+// mp4Box builds an ISO BMFF box of the given type around a payload.
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(len(body)+8))
+	return append(append(box, boxType...), body...)
+}
+
+// TestTransformInitSegment verifies that boxes are stripped and replaced at their paths, and that the
+// sizes of their enclosing boxes are updated.
+func TestTransformInitSegment(t *testing.T) {
+	ftyp := mp4Box("ftyp", []byte("iso6\x00\x00\x00\x00"))
+	tkhd := mp4Box("tkhd", []byte{1, 2, 3, 4})
+	elst := mp4Box("elst", []byte{0, 0, 0, 0, 0, 0, 0, 1})
+	mdia := mp4Box("mdia", mp4Box("mdhd", []byte{5, 6}))
+	init := bytes.Join([][]byte{ftyp, mp4Box("moov", mp4Box("mvhd", []byte{9}), mp4Box("trak", tkhd, mp4Box("edts", elst), mdia)), mp4Box("sidx", []byte{7})}, nil)
+
+	t.Run("strip", func(t *testing.T) {
+		out, err := hls.TransformInitSegment(init, []string{"moov/trak/edts", "sidx"}, nil)
+		require.NoError(t, err)
+		want := bytes.Join([][]byte{ftyp, mp4Box("moov", mp4Box("mvhd", []byte{9}), mp4Box("trak", tkhd, mdia))}, nil)
+		assert.Equal(t, want, out)
+		assert.NotContains(t, string(out), "edts")
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		out, err := hls.TransformInitSegment(init, nil, map[string][]byte{"moov/mvhd": {8, 8, 8}})
+		require.NoError(t, err)
+		want := bytes.Join([][]byte{ftyp, mp4Box("moov", mp4Box("mvhd", []byte{8, 8, 8}), mp4Box("trak", tkhd, mp4Box("edts", elst), mdia)), mp4Box("sidx", []byte{7})}, nil)
+		assert.Equal(t, want, out)
+	})
+
+	t.Run("unmatched paths leave the segment unchanged", func(t *testing.T) {
+		out, err := hls.TransformInitSegment(init, []string{"edts", "moov/trak/udta"}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, init, out)
+	})
+
+	t.Run("truncated box", func(t *testing.T) {
+		_, err := hls.TransformInitSegment(init[:len(init)-2], []string{"sidx"}, nil)
+		assert.Error(t, err)
+	})
+}
+
+// TestValidateInitSegment verifies that only well-formed init segments with both an ftyp and a moov box are accepted.
+func TestValidateInitSegment(t *testing.T) {
+	ftyp := mp4Box("ftyp", []byte("iso6\x00\x00\x00\x00"))
+	moov := mp4Box("moov", mp4Box("mvhd", []byte{9}))
+	init := append(append([]byte{}, ftyp...), moov...)
+
+	assert.NoError(t, hls.ValidateInitSegment(init))
+	assert.Error(t, hls.ValidateInitSegment(init[:len(init)-2]), "A truncated init segment should be rejected")
+	assert.Error(t, hls.ValidateInitSegment(ftyp), "An init segment without a moov box should be rejected")
+	assert.Error(t, hls.ValidateInitSegment(moov), "An init segment without an ftyp box should be rejected")
+	assert.Error(t, hls.ValidateInitSegment([]byte("<html>error</html>")), "A non-MP4 body should be rejected")
+	assert.Error(t, hls.ValidateInitSegment(nil), "An empty init segment should be rejected")
+}
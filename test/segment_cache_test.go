@@ -2,9 +2,12 @@ package main_test
 
 import (
 	"dash2hlsd/internal/cache"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 // mockLogger is a no-op logger for testing purposes.
@@ -157,3 +160,215 @@ func TestSegmentCache_ConcurrentAccess(t *testing.T) {
 
 	wg.Wait()
 }
+
+// TestSegmentCache_EntryContentType verifies that a sniffed content type and the ETag computed from
+// the data are stored alongside the segment.
+func TestSegmentCache_EntryContentType(t *testing.T) {
+	sc := cache.New(&mockLogger{}, func() map[string]struct{} { return nil })
+
+	sc.SetEntry("ts_segment", cache.Entry{Data: []byte{0x47}, ContentType: "video/mp2t"})
+	sc.Set("plain_segment", []byte("data"))
+
+	entry, found := sc.GetEntry("ts_segment")
+	if !found {
+		t.Fatal("Expected ts_segment to be found")
+	}
+	if entry.ContentType != "video/mp2t" {
+		t.Errorf("Expected content type 'video/mp2t', got '%s'", entry.ContentType)
+	}
+	if entry.ContentETag != cache.ContentETag([]byte{0x47}) {
+		t.Errorf("Expected the ETag computed from the data, got '%s'", entry.ContentETag)
+	}
+
+	entry, found = sc.GetEntry("plain_segment")
+	if !found {
+		t.Fatal("Expected plain_segment to be found")
+	}
+	if entry.ContentType != "" {
+		t.Errorf("Expected no content type for an unsniffed segment, got '%s'", entry.ContentType)
+	}
+}
+
+// TestSegmentCache_MaxBytesLRU verifies that exceeding MaxBytes immediately evicts inactive segments,
+// least recently used first, while active segments are kept.
+func TestSegmentCache_MaxBytesLRU(t *testing.T) {
+	provider := func() map[string]struct{} {
+		return map[string]struct{}{"active": {}}
+	}
+	sc := cache.New(&mockLogger{}, provider)
+	sc.MaxBytes = 40
+	sc.Start()
+	defer sc.Stop()
+
+	sc.Set("active", make([]byte, 10))
+	sc.Set("old", make([]byte, 10))
+	time.Sleep(time.Millisecond)
+	sc.Set("recent", make([]byte, 10))
+	time.Sleep(time.Millisecond)
+	// Reading "old" makes "recent" the least recently used inactive segment.
+	if _, found := sc.Get("old"); !found {
+		t.Fatal("Expected 'old' to be cached")
+	}
+	if sc.Bytes() != 30 {
+		t.Fatalf("Expected 30 bytes cached, got %d", sc.Bytes())
+	}
+
+	sc.Set("new", make([]byte, 20)) // 50 bytes, over the 40 byte limit
+
+	deadline := time.Now().Add(2 * time.Second)
+	for sc.Bytes() > 40 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sc.Bytes() != 40 {
+		t.Fatalf("Expected the cache to shrink to 40 bytes, got %d", sc.Bytes())
+	}
+	if _, found := sc.Get("recent"); found {
+		t.Error("Expected the least recently used segment 'recent' to be evicted")
+	}
+	for _, key := range []string{"active", "old", "new"} {
+		if _, found := sc.Get(key); !found {
+			t.Errorf("Expected '%s' to be kept", key)
+		}
+	}
+}
+
+// TestSegmentCache_DiskTier verifies that segments over MaxBytes are spilled to the disk directory,
+// promoted back to memory when read, and that stale files are purged from the directory.
+func TestSegmentCache_DiskTier(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "stale.seg")
+	if err := os.WriteFile(stale, []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	unrelated := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(unrelated, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every segment is in the window, yet the disk tier lets the cache stay within its limit.
+	provider := func() map[string]struct{} {
+		return map[string]struct{}{"ch/v1/1": {}, "ch/v1/2": {}, "ch/v1/3": {}}
+	}
+	sc := cache.New(&mockLogger{}, provider)
+	sc.MaxBytes = 20
+	if err := sc.SetDiskDir(dir); err != nil {
+		t.Fatalf("SetDiskDir failed: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("Expected the stale segment file to be purged")
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Error("Expected files that are not segments to be left alone")
+	}
+	sc.Start()
+	defer sc.Stop()
+
+	sc.SetEntry("ch/v1/1", cache.Entry{Data: []byte("0123456789"), ContentType: "video/mp4"})
+	time.Sleep(time.Millisecond)
+	sc.Set("ch/v1/2", []byte("abcdefghij"))
+	time.Sleep(time.Millisecond)
+	sc.Set("ch/v1/3", []byte("ABCDEFGHIJ")) // 30 bytes, over the 20 byte limit
+
+	deadline := time.Now().Add(2 * time.Second)
+	for sc.Bytes() > 20 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sc.Bytes() != 20 || sc.DiskBytes() != 10 {
+		t.Fatalf("Expected 20 bytes in memory and 10 on disk, got %d and %d", sc.Bytes(), sc.DiskBytes())
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(files) != 1 {
+		t.Fatalf("Expected the least recently used segment to be spilled to one file, got %v", files)
+	}
+
+	// Reading the spilled segment promotes it back to memory with its metadata.
+	entry, found := sc.GetEntry("ch/v1/1")
+	if !found || string(entry.Data) != "0123456789" || entry.ContentType != "video/mp4" {
+		t.Fatalf("Expected the spilled segment to be read back, got %q (%q), found=%v", entry.Data, entry.ContentType, found)
+	}
+	if entry.ContentETag != cache.ContentETag(entry.Data) {
+		t.Errorf("Expected the spilled segment to keep its ETag, got '%s'", entry.ContentETag)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for sc.Bytes() > 20 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if data, found := sc.Get("ch/v1/2"); !found || string(data) != "abcdefghij" {
+		t.Errorf("Expected 'ch/v1/2' to be served from disk after being spilled, got %q", data)
+	}
+
+}
+
+// TestSegmentCache_DiskTierConcurrentAccess verifies that segments being spilled to and read back from disk
+// while they are also replaced and read concurrently are never served with another segment's data.
+func TestSegmentCache_DiskTierConcurrentAccess(t *testing.T) {
+	numKeys := 20
+	provider := func() map[string]struct{} {
+		active := make(map[string]struct{}, numKeys)
+		for i := 0; i < numKeys; i++ {
+			active["ch/v1/"+strconv.Itoa(i)] = struct{}{}
+		}
+		return active
+	}
+	sc := cache.New(&mockLogger{}, provider)
+	sc.MaxBytes = 50
+	if err := sc.SetDiskDir(t.TempDir()); err != nil {
+		t.Fatalf("SetDiskDir failed: %v", err)
+	}
+	sc.Start()
+	defer sc.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < numKeys; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "ch/v1/" + strconv.Itoa(i)
+			want := "segment-" + strconv.Itoa(i)
+			for round := 0; round < 50; round++ {
+				sc.Set(key, []byte(want))
+				if data, found := sc.Get(key); found && string(data) != want {
+					t.Errorf("Expected %q for %s, got %q", want, key, data)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < numKeys; i++ {
+		key := "ch/v1/" + strconv.Itoa(i)
+		if data, found := sc.Get(key); !found || string(data) != "segment-"+strconv.Itoa(i) {
+			t.Errorf("Expected %s to be cached in memory or on disk, got %q (found=%v)", key, data, found)
+		}
+	}
+}
+
+// TestSegmentCache_MaxBytesActiveOnly verifies that a cache over MaxBytes with only active segments keeps
+// them, warns about it, and does not log an eviction that evicted nothing.
+func TestSegmentCache_MaxBytesActiveOnly(t *testing.T) {
+	log := &accessLogRecorder{}
+	sc := cache.New(log, func() map[string]struct{} {
+		return map[string]struct{}{"a": {}, "b": {}}
+	})
+	sc.MaxBytes = 10
+	sc.Start()
+	defer sc.Stop()
+
+	sc.Set("a", make([]byte, 10))
+	sc.Set("b", make([]byte, 10))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !log.Contains("above its 10 byte limit") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !log.Contains("above its 10 byte limit") {
+		t.Fatal("Expected a warning that active segments exceed the limit")
+	}
+	if log.Count("Evicted") != 0 {
+		t.Error("Expected no eviction to be logged when nothing was evicted")
+	}
+	if sc.Bytes() != 20 {
+		t.Errorf("Expected the active segments to be kept, got %d bytes", sc.Bytes())
+	}
+}
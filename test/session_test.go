@@ -0,0 +1,1624 @@
+package main_test
+
+import (
+	"context"
+	"dash2hlsd/internal/channels"
+	"dash2hlsd/internal/dash"
+	"dash2hlsd/internal/key"
+	"dash2hlsd/internal/metrics"
+	"dash2hlsd/internal/models"
+	"dash2hlsd/internal/session"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSession_ManifestFailover verifies that a session falls back to the next origin when the primary fails.
+func TestSession_ManifestFailover(t *testing.T) {
+	primary := newTestOrigin(t, testLiveMPD)
+	primary.SetManifestStatus(http.StatusInternalServerError)
+	secondary := newTestOrigin(t, testLiveMPD)
+
+	sm := newTestManager(t, channels.Channel{
+		Id:           "failover",
+		ManifestURLs: []string{primary.URL("/manifest.mpd"), secondary.URL("/manifest.mpd")},
+	})
+
+	sess, err := sm.GetOrCreateSession("failover")
+	require.NoError(t, err)
+
+	assert.Equal(t, secondary.URL("/manifest.mpd"), sess.ActiveManifestURL())
+	assert.Equal(t, 1, primary.Requests("/manifest.mpd"))
+	assert.Equal(t, 1, secondary.Requests("/manifest.mpd"))
+}
+
+// TestSession_ManifestFailoverAllOriginsFail verifies that the typed status error is surfaced when every origin fails.
+func TestSession_ManifestFailoverAllOriginsFail(t *testing.T) {
+	primary := newTestOrigin(t, testLiveMPD)
+	primary.SetManifestStatus(http.StatusInternalServerError)
+	secondary := newTestOrigin(t, testLiveMPD)
+	secondary.SetManifestStatus(http.StatusNotFound)
+
+	sm := newTestManager(t, channels.Channel{
+		Id:           "failover",
+		ManifestURLs: []string{primary.URL("/manifest.mpd"), secondary.URL("/manifest.mpd")},
+	})
+
+	_, err := sm.GetOrCreateSession("failover")
+	require.Error(t, err)
+
+	var statusErr *dash.StatusError
+	require.True(t, errors.As(err, &statusErr), "Expected a *dash.StatusError in the chain, got: %v", err)
+	assert.Contains(t, err.Error(), "all 2 manifest origins failed")
+}
+
+// countDownloadWorkers returns the number of running downloader worker goroutines.
+func countDownloadWorkers() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return strings.Count(string(buf[:n]), "created by dash2hlsd/internal/dash.NewDownloader")
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// TestSession_SharedDownloadPool verifies that the number of download workers does not grow with the session count.
+func TestSession_SharedDownloadPool(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	baseline := countDownloadWorkers()
+
+	cfg := &channels.ChannelConfig{SharedDownloadWorkers: 4}
+	for i := 0; i < 8; i++ {
+		cfg.Channels = append(cfg.Channels, channels.Channel{Id: fmt.Sprintf("ch%d", i), ManifestURL: origin.URL("/manifest.mpd")})
+	}
+	sm := newTestManagerWithConfig(t, cfg)
+	assert.Equal(t, baseline+4, countDownloadWorkers())
+
+	sessions := make([]*session.StreamSession, 0, len(cfg.Channels))
+	for _, ch := range cfg.Channels {
+		sess, err := sm.GetOrCreateSession(ch.Id)
+		require.NoError(t, err)
+		sessions = append(sessions, sess)
+	}
+	assert.Equal(t, baseline+4, countDownloadWorkers(), "Workers should stay bounded regardless of session count")
+
+	// Every session must still receive its own results through the shared pool.
+	for _, sess := range sessions {
+		sess := sess
+		assert.Eventually(t, func() bool {
+			return len(sess.GetWindow()["v1"].Segments) > 0
+		}, 10*time.Second, 50*time.Millisecond, "Expected session %s to receive its segments", sess.ChannelID)
+	}
+}
+
+// testRepTemplateMPD places the SegmentTemplate inside the Representation instead of the AdaptationSet.
+const testRepTemplateMPD = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" minimumUpdatePeriod="PT2S" maxSegmentDuration="PT2S">
+	<Period id="p0" start="PT0S">
+		<AdaptationSet id="1" contentType="video" mimeType="video/mp4">
+			<Representation id="v1" bandwidth="1000000" codecs="avc1.640028">
+				<SegmentTemplate timescale="1000" initialization="v1/init.mp4" media="v1/$Number$.m4s" startNumber="100">
+					<SegmentTimeline>
+						<S t="0" d="2000" r="9"/>
+					</SegmentTimeline>
+				</SegmentTemplate>
+			</Representation>
+		</AdaptationSet>
+	</Period>
+</MPD>`
+
+// TestSession_RepresentationSegmentTemplate verifies that a representation-level template drives timing and URLs.
+func TestSession_RepresentationSegmentTemplate(t *testing.T) {
+	origin := newTestOrigin(t, testRepTemplateMPD)
+	sm := newTestManager(t, channels.Channel{Id: "rep", ManifestURL: origin.URL("/manifest.mpd")})
+
+	sess, err := sm.GetOrCreateSession("rep")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(sess.GetWindow()["v1"].Segments) > 0
+	}, 10*time.Second, 50*time.Millisecond, "Expected the first segment to be downloaded")
+
+	// The playhead starts 4 segments behind the 20s live edge, i.e. the 7th segment (number 106).
+	first := sess.GetWindow()["v1"].Segments[0]
+	assert.Equal(t, uint64(12000), first.Time)
+	assert.Equal(t, uint64(2000), first.Duration)
+	assert.Equal(t, 1, origin.Requests("/v1/init.mp4"))
+	assert.Equal(t, 1, origin.Requests("/v1/106.m4s"))
+}
+
+// testMixedTimescaleMPD has two audio representations in one AdaptationSet, each with its own
+// timescale and segment duration.
+const testMixedTimescaleMPD = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" minimumUpdatePeriod="PT2S" maxSegmentDuration="PT2S">
+	<Period id="p0" start="PT0S">
+		<AdaptationSet id="1" contentType="video" mimeType="video/mp4">
+			<SegmentTemplate timescale="90000" initialization="init-$RepresentationID$.mp4" media="seg-$RepresentationID$-$Time$.m4s">
+				<SegmentTimeline>
+					<S t="0" d="180000" r="9"/>
+				</SegmentTimeline>
+			</SegmentTemplate>
+			<Representation id="v1" bandwidth="1000000" codecs="avc1.640028"/>
+		</AdaptationSet>
+		<AdaptationSet id="2" contentType="audio" lang="en" mimeType="audio/mp4">
+			<Representation id="a48" bandwidth="128000" codecs="mp4a.40.2">
+				<SegmentTemplate timescale="48000" initialization="init-$RepresentationID$.mp4" media="seg-$RepresentationID$-$Time$.m4s">
+					<SegmentTimeline>
+						<S t="0" d="96000" r="9"/>
+					</SegmentTimeline>
+				</SegmentTemplate>
+			</Representation>
+			<Representation id="a1k" bandwidth="64000" codecs="mp4a.40.2">
+				<SegmentTemplate timescale="1000" initialization="init-$RepresentationID$.mp4" media="seg-$RepresentationID$-$Time$.m4s">
+					<SegmentTimeline>
+						<S t="0" d="1920" r="10"/>
+					</SegmentTimeline>
+				</SegmentTemplate>
+			</Representation>
+		</AdaptationSet>
+	</Period>
+</MPD>`
+
+// TestSession_MixedTimescales verifies that each representation of an AdaptationSet locates the
+// segment under the playhead in its own timescale.
+func TestSession_MixedTimescales(t *testing.T) {
+	origin := newTestOrigin(t, testMixedTimescaleMPD)
+	sm := newTestManager(t, channels.Channel{Id: "mixed", ManifestURL: origin.URL("/manifest.mpd")})
+
+	sess, err := sm.GetOrCreateSession("mixed")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		window := sess.GetWindow()
+		return len(window["a48"].Segments) > 0 && len(window["a1k"].Segments) > 0
+	}, 10*time.Second, 50*time.Millisecond, "Expected the first audio segments to be downloaded")
+
+	// The playhead starts at 12s: exactly on a 2s segment boundary at 48kHz, and within the
+	// 1.92s segment starting at 11.52s at the 1000 timescale.
+	window := sess.GetWindow()
+	assert.Equal(t, uint64(576000), window["a48"].Segments[0].Time)
+	assert.Equal(t, uint64(11520), window["a1k"].Segments[0].Time)
+	assert.Equal(t, 1, origin.Requests("/seg-a48-576000.m4s"))
+	assert.Equal(t, 1, origin.Requests("/seg-a1k-11520.m4s"))
+}
+
+// testSegmentListMPD uses explicit SegmentURL entries instead of a SegmentTemplate.
+const testSegmentListMPD = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" minimumUpdatePeriod="PT2S" maxSegmentDuration="PT2S">
+	<Period id="p0" start="PT0S">
+		<AdaptationSet id="1" contentType="video" mimeType="video/mp4">
+			<SegmentList timescale="1000" duration="2000">
+				<Initialization sourceURL="list/init.mp4"/>
+				<SegmentURL media="list/s0.m4s"/>
+				<SegmentURL media="list/s1.m4s"/>
+				<SegmentURL media="list/s2.m4s"/>
+				<SegmentURL media="list/s3.m4s"/>
+				<SegmentURL media="list/s4.m4s"/>
+				<SegmentURL media="list/s5.m4s"/>
+			</SegmentList>
+			<Representation id="v1" bandwidth="1000000" codecs="avc1.640028"/>
+		</AdaptationSet>
+	</Period>
+</MPD>`
+
+// TestSession_SegmentList verifies that SegmentList manifests produce downloads of the listed URLs, and
+// that the entries a refreshed manifest adds to the list are picked up.
+func TestSession_SegmentList(t *testing.T) {
+	origin := newTestOrigin(t, testSegmentListMPD)
+	sm := newTestManager(t, channels.Channel{Id: "list", ManifestURL: origin.URL("/manifest.mpd")})
+
+	sess, err := sm.GetOrCreateSession("list")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(sess.GetWindow()["v1"].Segments) > 0
+	}, 10*time.Second, 50*time.Millisecond, "Expected the first segment to be downloaded")
+
+	// Six 2s segments end at 12s; the playhead starts 8s behind at the third entry.
+	assert.Equal(t, uint64(4000), sess.GetWindow()["v1"].Segments[0].Time)
+	assert.Equal(t, 1, origin.Requests("/list/init.mp4"))
+	assert.Equal(t, 1, origin.Requests("/list/s2.m4s"))
+
+	// The live list slides forward: the first two entries drop out and two new ones are added.
+	refreshed := strings.Replace(testSegmentListMPD, `duration="2000">`, `duration="2000" startNumber="3">`, 1)
+	refreshed = strings.Replace(refreshed, `<SegmentURL media="list/s0.m4s"/>
+				<SegmentURL media="list/s1.m4s"/>`, "", 1)
+	refreshed = strings.Replace(refreshed, `<SegmentURL media="list/s5.m4s"/>`, `<SegmentURL media="list/s5.m4s"/>
+				<SegmentURL media="list/s6.m4s"/>
+				<SegmentURL media="list/s7.m4s"/>`, 1)
+	origin.SetManifest(refreshed)
+
+	require.Eventually(t, func() bool {
+		timeline, found := sess.GetTimeline("v1")
+		return found && len(dash.ExpandTimeline(timeline)) == 8
+	}, 10*time.Second, 50*time.Millisecond, "Expected the refreshed entries to be merged into the list")
+	require.Eventually(t, func() bool {
+		return origin.Requests("/list/s7.m4s") == 1
+	}, 10*time.Second, 50*time.Millisecond, "Expected a segment added by the refresh to be downloaded")
+	assert.Equal(t, 1, origin.Requests("/list/s2.m4s"), "Expected merged entries to keep their segment numbers")
+}
+
+// testUnsupportedCodecMPD contains a subtitle track whose codec cannot be carried in HLS.
+const testUnsupportedCodecMPD = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" minimumUpdatePeriod="PT2S" maxSegmentDuration="PT2S">
+	<Period id="p0" start="PT0S">
+		<AdaptationSet id="1" contentType="video" mimeType="video/mp4" segmentProfiles="dash">
+			<SegmentTemplate timescale="1000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Time$.m4s">
+				<SegmentTimeline><S t="0" d="2000" r="9"/></SegmentTimeline>
+			</SegmentTemplate>
+			<Representation id="v1" bandwidth="1000000" codecs="avc1.640028"/>
+		</AdaptationSet>
+		<AdaptationSet id="2" contentType="text" mimeType="application/mp4" codecs="tx3g">
+			<SegmentTemplate timescale="1000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Time$.m4s">
+				<SegmentTimeline><S t="0" d="2000" r="9"/></SegmentTimeline>
+			</SegmentTemplate>
+			<Representation id="sub_tx3g" bandwidth="1000"/>
+		</AdaptationSet>
+	</Period>
+</MPD>`
+
+// TestSession_UnsupportedCodecExcluded verifies that a representation with an unsupported codec is
+// left out of the master playlist and its downloads, and that a warning explains why.
+func TestSession_UnsupportedCodecExcluded(t *testing.T) {
+	origin := newTestOrigin(t, testUnsupportedCodecMPD)
+	log := &recordingLogger{}
+	sm := newTestManagerWithLogger(t, log, &channels.ChannelConfig{
+		Channels: []channels.Channel{{Id: "codec", ManifestURL: origin.URL("/manifest.mpd")}},
+	})
+
+	sess, err := sm.GetOrCreateSession("codec")
+	require.NoError(t, err)
+
+	master, err := sess.GetMasterPlaylist()
+	require.NoError(t, err)
+	assert.Contains(t, master, "video/v1/playlist.m3u8")
+	assert.NotContains(t, master, "sub_tx3g")
+	assert.True(t, log.Contains("Excluding representation sub_tx3g"), "Expected a warning for the excluded representation")
+
+	assert.Equal(t, 0, origin.Requests("/sub_tx3g/init.mp4"))
+}
+
+// TestSession_ReplaceTimeline verifies that replace mode drops segments missing from the refreshed MPD,
+// while the default merge mode keeps them.
+func TestSession_ReplaceTimeline(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t,
+		channels.Channel{Id: "merge", ManifestURL: origin.URL("/manifest.mpd")},
+		channels.Channel{Id: "replace", ManifestURL: origin.URL("/manifest.mpd"), ReplaceTimeline: true},
+	)
+
+	mergeSess, err := sm.GetOrCreateSession("merge")
+	require.NoError(t, err)
+	replaceSess, err := sm.GetOrCreateSession("replace")
+	require.NoError(t, err)
+
+	// The origin rewrites its timeline so that it starts 5 segments later.
+	origin.SetManifest(strings.Replace(testLiveMPD, `<S t="0" d="180000" r="9"/>`, `<S t="900000" d="180000" r="9"/>`, 1))
+
+	require.Eventually(t, func() bool {
+		timeline, _ := replaceSess.GetTimeline("v1")
+		return len(timeline.Segments) > 0 && timeline.Segments[0].T == 900000
+	}, 10*time.Second, 50*time.Millisecond, "Expected the replace-mode timeline to adopt the refreshed MPD")
+
+	timeline, ok := replaceSess.GetTimeline("v1")
+	require.True(t, ok)
+	assert.Equal(t, []dash.S{{T: 900000, HasT: true, D: 180000, R: 9}}, timeline.Segments, "Dropped segments should no longer appear")
+
+	require.Eventually(t, func() bool {
+		timeline, _ := mergeSess.GetTimeline("v1")
+		return len(timeline.Segments) == 2
+	}, 10*time.Second, 50*time.Millisecond, "Expected the merge-mode timeline to combine both MPDs")
+
+	timeline, _ = mergeSess.GetTimeline("v1")
+	assert.Equal(t, uint64(0), timeline.Segments[0].T, "Merge mode should keep the original segments")
+}
+
+// TestSession_KeyIDMismatchWarning verifies that a configured KID that does not match the manifest is reported.
+func TestSession_KeyIDMismatchWarning(t *testing.T) {
+	protected := strings.Replace(testLiveMPD, `<AdaptationSet id="1" contentType="video" mimeType="video/mp4">`,
+		`<AdaptationSet id="1" contentType="video" mimeType="video/mp4">
+			<ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="cenc" xmlns:cenc="urn:mpeg:cenc:2013" cenc:default_KID="0737b75e-e890-6c00-bb7b-b8f666da72a0"/>`, 1)
+	origin := newTestOrigin(t, protected)
+
+	matchingKID, _ := hex.DecodeString("0737b75ee8906c00bb7bb8f666da72a0")
+	otherKID, _ := hex.DecodeString("e069fc056280e4caa7d0ffb99024c05a")
+
+	log := &recordingLogger{}
+	sm := newTestManagerWithLogger(t, log, &channels.ChannelConfig{
+		Channels: []channels.Channel{
+			{Id: "match", ManifestURL: origin.URL("/manifest.mpd"), KID: matchingKID},
+			{Id: "mismatch", ManifestURL: origin.URL("/manifest.mpd"), KID: otherKID},
+		},
+	})
+
+	_, err := sm.GetOrCreateSession("match")
+	require.NoError(t, err)
+	assert.False(t, log.Contains("does not match any default_KID"))
+
+	_, err = sm.GetOrCreateSession("mismatch")
+	require.NoError(t, err)
+	assert.True(t, log.Contains("Configured key ID e069fc056280e4caa7d0ffb99024c05a for session mismatch does not match"))
+}
+
+// TestSession_KeyIDFollowsKeyStore verifies that playlists request the key IDs of the key store, so that a
+// rotated keys file takes effect without restarting the session.
+func TestSession_KeyIDFollowsKeyStore(t *testing.T) {
+	protected := strings.Replace(testLiveMPD, `<AdaptationSet id="1" contentType="video" mimeType="video/mp4">`,
+		`<AdaptationSet id="1" contentType="video" mimeType="video/mp4">
+			<ContentProtection schemeIdUri="urn:mpeg:dash:mp4protection:2011" value="cenc" xmlns:cenc="urn:mpeg:cenc:2013" cenc:default_KID="0737b75e-e890-6c00-bb7b-b8f666da72a0"/>`, 1)
+	origin := newTestOrigin(t, protected)
+
+	videoKID, _ := hex.DecodeString("0737b75ee8906c00bb7bb8f666da72a0")
+	otherKID, _ := hex.DecodeString("e069fc056280e4caa7d0ffb99024c05a")
+	thirdKID, _ := hex.DecodeString("9a04f07998404286ab92e65be0885f95")
+	someKey, _ := hex.DecodeString("15f515458cdb5107452f943a111cbe89")
+
+	channel := channels.Channel{Id: "rotated", ManifestURL: origin.URL("/manifest.mpd"), Key: someKey, KID: otherKID,
+		Keys: map[string][]byte{hex.EncodeToString(otherKID): someKey, hex.EncodeToString(thirdKID): someKey}}
+	cfg := &channels.ChannelConfig{Channels: []channels.Channel{channel}}
+	keyService, err := key.NewService(cfg)
+	require.NoError(t, err)
+	sm := newTestManagerWithConfig(t, cfg)
+	sm.SetKeyStore(keyService)
+
+	sess, err := sm.GetOrCreateSession("rotated")
+	require.NoError(t, err)
+	var playlist string
+	require.Eventually(t, func() bool {
+		playlist, err = sess.GetMediaPlaylist("video", "v1")
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Contains(t, playlist, "#EXT-X-KEY:")
+	assert.NotContains(t, playlist, "?kid=", "No key is configured for the manifest's default_KID yet")
+
+	keyService.UpdateKeys([]channels.Channel{{Id: "rotated", Key: someKey, KID: videoKID,
+		Keys: map[string][]byte{hex.EncodeToString(videoKID): someKey, hex.EncodeToString(otherKID): someKey}}})
+	assert.Eventually(t, func() bool {
+		playlist, _ := sess.GetMediaPlaylist("video", "v1")
+		return strings.Contains(playlist, "/key/rotated?kid=0737b75ee8906c00bb7bb8f666da72a0")
+	}, 10*time.Second, 50*time.Millisecond, "Expected the playlist to request the rotated key ID")
+}
+
+// TestSession_InitSegmentsReadyBeforePlaylist verifies that a new session waits for its init
+// segments, so they are cached before the first media playlist is served.
+func TestSession_InitSegmentsReadyBeforePlaylist(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	origin.SetSegmentDelay(200 * time.Millisecond)
+
+	sm := newTestManager(t, channels.Channel{Id: "init", ManifestURL: origin.URL("/manifest.mpd")})
+	sess, err := sm.GetOrCreateSession("init")
+	require.NoError(t, err)
+
+	for _, repID := range []string{"v1", "a1"} {
+		data, found := sess.SegCache.Get("init/" + repID + "/init")
+		require.True(t, found, "Init segment for %s should be cached when the session is returned", repID)
+		assert.Equal(t, "segment:/init-"+repID+".mp4", string(data))
+	}
+}
+
+// TestSession_ConditionalRequestsReuseCachedInit verifies end to end that a session revalidating a cached
+// init segment sends its validators, and keeps serving the cached bytes when the origin answers 304.
+func TestSession_ConditionalRequestsReuseCachedInit(t *testing.T) {
+	var mu sync.Mutex
+	full, notModified := 0, 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/manifest.mpd" {
+			w.Write([]byte(testLiveMPD))
+			return
+		}
+		if r.URL.Path != "/init-v1.mp4" {
+			w.Write([]byte("segment:" + r.URL.Path))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("ETag", `"init-v1"`)
+		if r.Header.Get("If-None-Match") == `"init-v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Write([]byte("init data"))
+	}))
+	defer origin.Close()
+
+	sm := newTestManager(t, channels.Channel{Id: "cond", ManifestURL: origin.URL + "/manifest.mpd", ConditionalRequests: true})
+	sess, err := sm.GetOrCreateSession("cond")
+	require.NoError(t, err)
+	entry, found := sess.SegCache.GetEntry("cond/v1/init")
+	require.True(t, found, "Expected the init segment to be cached")
+	require.Equal(t, `"init-v1"`, entry.ETag)
+
+	// A new session for the channel revalidates the init segment it finds in the shared cache.
+	require.True(t, sm.StopSession("cond"))
+	sess, err = sm.GetOrCreateSession("cond")
+	require.NoError(t, err)
+
+	mu.Lock()
+	assert.Equal(t, 1, full, "Expected the init segment to be downloaded once")
+	assert.Equal(t, 1, notModified, "Expected the cached init segment to be revalidated")
+	mu.Unlock()
+	entry, found = sess.SegCache.GetEntry("cond/v1/init")
+	require.True(t, found, "Expected the init segment to stay cached after a 304")
+	assert.Equal(t, "init data", string(entry.Data), "Expected the 304 to reuse the cached bytes")
+	assert.Equal(t, `"init-v1"`, entry.ETag)
+}
+
+// TestSession_VOD verifies that a static MPD is served as a complete VOD playlist and not refreshed, and
+// that its segments are fetched when requested along with a bounded prefetch window.
+func TestSession_VOD(t *testing.T) {
+	vodMPD := strings.Replace(testLiveMPD, `type="dynamic"`, `type="static"`, 1)
+	vodMPD = strings.Replace(vodMPD, ` minimumUpdatePeriod="PT2S"`, "", 1)
+	origin := newTestOrigin(t, vodMPD)
+
+	// Without LookAheadSegments, the reliability policy prefetches two segments after a requested one.
+	sm := newTestManager(t, channels.Channel{Id: "vod", ManifestURL: origin.URL("/manifest.mpd"), StartupPolicy: channels.StartupPolicyReliability})
+	sess, err := sm.GetOrCreateSession("vod")
+	require.NoError(t, err)
+	assert.True(t, sess.IsVOD())
+
+	var playlist string
+	require.Eventually(t, func() bool {
+		playlist, err = sess.GetMediaPlaylist("video", "v1")
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	assert.Contains(t, playlist, "#EXT-X-PLAYLIST-TYPE:VOD\n")
+	assert.True(t, strings.HasSuffix(playlist, "#EXT-X-ENDLIST\n"))
+	assert.Equal(t, 10, strings.Count(playlist, "#EXTINF:2.000,"), "Every segment of the asset should be listed")
+	assert.Contains(t, playlist, "#EXTINF:2.000,\n0.m4s\n")
+	assert.Contains(t, playlist, "#EXTINF:2.000,\n1620000.m4s\n#EXT-X-ENDLIST")
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Zero(t, origin.Requests("/seg-v1-0.m4s"), "Segments should not be downloaded before players ask for them")
+
+	// A requested segment is fetched, and the look-ahead segments after it are prefetched.
+	entry, err := sess.FetchSegment("vod/v1/180000")
+	require.NoError(t, err)
+	assert.Equal(t, "segment:/seg-v1-180000.m4s", string(entry.Data))
+	sess.PrefetchAfter("vod/v1/180000")
+	require.Eventually(t, func() bool {
+		_, first := sess.SegCache.Size("vod/v1/360000")
+		_, second := sess.SegCache.Size("vod/v1/540000")
+		return first && second
+	}, 5*time.Second, 20*time.Millisecond, "Expected the following segments to be prefetched")
+	time.Sleep(200 * time.Millisecond)
+	assert.Zero(t, origin.Requests("/seg-v1-720000.m4s"), "Only the prefetch window should be fetched")
+	assert.Zero(t, origin.Requests("/seg-v1-0.m4s"))
+	assert.NotContains(t, sm.GetAllActiveSegmentKeys(), "vod/v1/180000", "Played VOD segments should be evictable")
+	assert.Equal(t, 1, origin.Requests("/manifest.mpd"), "A static MPD should not be refreshed")
+}
+
+// TestSession_StartupPolicy verifies the initial playhead and buffering of each startup preset.
+// The test timeline ends at 20s with 2-second segments.
+func TestSession_StartupPolicy(t *testing.T) {
+	testCases := []struct {
+		policy            channels.StartupPolicy
+		firstSegmentTime  uint64
+		minBufferSegments int
+	}{
+		{channels.StartupPolicyDefault, 1080000, 1},    // 4 segments behind the edge
+		{channels.StartupPolicyLatency, 1440000, 1},    // 2 segments behind the edge
+		{channels.StartupPolicyReliability, 720000, 3}, // 6 segments behind, buffering 3
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			t.Parallel()
+			origin := newTestOrigin(t, testLiveMPD)
+			sm := newTestManager(t, channels.Channel{Id: "startup", ManifestURL: origin.URL("/manifest.mpd"), StartupPolicy: tc.policy})
+			sess, err := sm.GetOrCreateSession("startup")
+			require.NoError(t, err)
+
+			var playlist string
+			require.Eventually(t, func() bool {
+				playlist, err = sess.GetMediaPlaylist("video", "v1")
+				return err == nil
+			}, 10*time.Second, 20*time.Millisecond)
+
+			window := sess.GetWindow()["v1"]
+			require.NotEmpty(t, window.Segments)
+			assert.Equal(t, tc.firstSegmentTime, window.Segments[0].Time)
+			assert.GreaterOrEqual(t, strings.Count(playlist, "#EXTINF:"), tc.minBufferSegments)
+			assert.Contains(t, playlist, fmt.Sprintf("\n%d.m4s\n", tc.firstSegmentTime))
+		})
+	}
+}
+
+// TestSession_LiveDelaySeconds verifies that a configured live delay positions the initial playhead,
+// and that any delay is clamped to the time shift buffer. The test timeline ends at 20s.
+func TestSession_LiveDelaySeconds(t *testing.T) {
+	testCases := []struct {
+		name             string
+		liveDelay        int
+		timeShiftBuffer  string
+		firstSegmentTime uint64
+	}{
+		{"configured", 10, "", 900000},
+		{"default clamped", 0, "PT8S", 1260000}, // 8s of policy delay, clamped to one segment less than 8s
+		{"configured clamped", 30, "PT12S", 900000},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			mpd := testLiveMPD
+			if tc.timeShiftBuffer != "" {
+				mpd = strings.Replace(mpd, `availabilityStartTime=`, `timeShiftBufferDepth="`+tc.timeShiftBuffer+`" availabilityStartTime=`, 1)
+			}
+			origin := newTestOrigin(t, mpd)
+			sm := newTestManager(t, channels.Channel{Id: "delay", ManifestURL: origin.URL("/manifest.mpd"), LiveDelaySeconds: tc.liveDelay})
+			sess, err := sm.GetOrCreateSession("delay")
+			require.NoError(t, err)
+
+			require.Eventually(t, func() bool {
+				return len(sess.GetWindow()["v1"].Segments) > 0
+			}, 10*time.Second, 20*time.Millisecond)
+			assert.Equal(t, tc.firstSegmentTime, sess.GetWindow()["v1"].Segments[0].Time)
+		})
+	}
+}
+
+// TestSession_EndOfStream verifies that the playlist is finalized once the manifest keeps 404ing, but not
+// on a single 404, and that the ended session is replaced by a new one once its final window has played.
+func TestSession_EndOfStream(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t, channels.Channel{Id: "ending", ManifestURL: origin.URL("/manifest.mpd"), PlaylistWindowSegments: channels.MinPlaylistWindowSegments})
+	sess, err := sm.GetOrCreateSession("ending")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := sess.GetMediaPlaylist("video", "v1")
+		return err == nil
+	}, 10*time.Second, 20*time.Millisecond)
+
+	// A single 404 is a blip, not the end of the stream.
+	refreshes := origin.Requests("/manifest.mpd")
+	origin.SetManifestStatus(http.StatusNotFound)
+	require.Eventually(t, func() bool { return origin.Requests("/manifest.mpd") > refreshes }, 10*time.Second, 20*time.Millisecond)
+	origin.SetManifestStatus(http.StatusOK)
+	refreshes = origin.Requests("/manifest.mpd")
+	require.Eventually(t, func() bool { return origin.Requests("/manifest.mpd") > refreshes+1 }, 10*time.Second, 20*time.Millisecond)
+	assert.False(t, sess.IsEnded(), "A single 404 should not end the stream")
+
+	origin.SetManifestStatus(http.StatusNotFound)
+	var playlist string
+	require.Eventually(t, func() bool {
+		playlist, _ = sess.GetMediaPlaylist("video", "v1")
+		return strings.Contains(playlist, "#EXT-X-ENDLIST")
+	}, 20*time.Second, 50*time.Millisecond, "Expected the playlist to gain an EXT-X-ENDLIST")
+
+	assert.True(t, sess.IsEnded())
+	assert.True(t, strings.HasSuffix(playlist, ".m4s\n#EXT-X-ENDLIST\n"))
+	assert.NotContains(t, playlist, "#EXT-X-PLAYLIST-TYPE:VOD", "A finished live stream is not a complete VOD asset")
+
+	// The ended session keeps serving its final playlists for a while, and is then replaced.
+	same, err := sm.GetOrCreateSession("ending")
+	require.NoError(t, err)
+	assert.Same(t, sess, same)
+	origin.SetManifestStatus(http.StatusOK)
+	require.Eventually(t, func() bool {
+		next, err := sm.GetOrCreateSession("ending")
+		return err == nil && next != sess
+	}, 20*time.Second, 100*time.Millisecond, "Expected a new session once the ended one was retired")
+}
+
+// TestSession_TransientManifestErrorDoesNotEnd verifies that server errors do not end the stream.
+func TestSession_TransientManifestErrorDoesNotEnd(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t, channels.Channel{Id: "flaky", ManifestURL: origin.URL("/manifest.mpd")})
+	sess, err := sm.GetOrCreateSession("flaky")
+	require.NoError(t, err)
+
+	origin.SetManifestStatus(http.StatusServiceUnavailable)
+	require.Eventually(t, func() bool {
+		return origin.Requests("/manifest.mpd") >= 2
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.False(t, sess.IsEnded())
+}
+
+// TestSession_PlaylistWindowSegments verifies that the live playlist is trimmed to the channel's window.
+func TestSession_PlaylistWindowSegments(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t, channels.Channel{
+		Id:                     "window",
+		ManifestURL:            origin.URL("/manifest.mpd"),
+		StartupPolicy:          channels.StartupPolicyReliability, // Prefetches three segments per tick
+		PlaylistWindowSegments: 3,
+	})
+	sess, err := sm.GetOrCreateSession("window")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(sess.GetWindow()["v1"].Segments) > 3
+	}, 10*time.Second, 20*time.Millisecond, "Expected more segments than fit in the window")
+
+	var playlist string
+	require.Eventually(t, func() bool {
+		playlist, err = sess.GetMediaPlaylist("video", "v1")
+		return err == nil && !strings.Contains(playlist, "\n720000.m4s\n")
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, 3, strings.Count(playlist, "#EXTINF:"))
+}
+
+const testQualityRankingMPD = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" minimumUpdatePeriod="PT2S" maxSegmentDuration="PT2S">
+	<Period id="p0" start="PT0S">
+		<AdaptationSet id="1" contentType="video" mimeType="video/mp4" codecs="avc1.640028">
+			<SegmentTemplate timescale="1000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Time$.m4s">
+				<SegmentTimeline><S t="0" d="2000" r="9"/></SegmentTimeline>
+			</SegmentTemplate>
+			<Representation id="v_high_bw" bandwidth="5000000" qualityRanking="2"/>
+			<Representation id="v_best" bandwidth="3000000" qualityRanking="1"/>
+		</AdaptationSet>
+		<AdaptationSet id="2" contentType="audio" mimeType="audio/mp4" codecs="mp4a.40.2">
+			<SegmentTemplate timescale="1000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Time$.m4s">
+				<SegmentTimeline><S t="0" d="2000" r="9"/></SegmentTimeline>
+			</SegmentTemplate>
+			<Representation id="a_third" bandwidth="128000" qualityRanking="3"/>
+			<Representation id="a_first" bandwidth="64000" qualityRanking="1"/>
+			<Representation id="a_second" bandwidth="96000" qualityRanking="2"/>
+		</AdaptationSet>
+	</Period>
+</MPD>`
+
+// TestSession_QualityRanking verifies that qualityRanking takes precedence over bandwidth when
+// selecting the video representation, and orders the audio renditions in the master playlist, with
+// a ranking of zero counting as the best and unranked renditions after the ranked ones.
+func TestSession_QualityRanking(t *testing.T) {
+	origin := newTestOrigin(t, testQualityRankingMPD)
+	sm := newTestManager(t, channels.Channel{Id: "ranked", ManifestURL: origin.URL("/manifest.mpd")})
+
+	sess, err := sm.GetOrCreateSession("ranked")
+	require.NoError(t, err)
+
+	master, err := sess.GetMasterPlaylist()
+	require.NoError(t, err)
+	assert.Contains(t, master, "video/v_best/playlist.m3u8")
+	assert.NotContains(t, master, "v_high_bw")
+
+	first := strings.Index(master, "audio/a_first/")
+	second := strings.Index(master, "audio/a_second/")
+	third := strings.Index(master, "audio/a_third/")
+	require.True(t, first >= 0 && second >= 0 && third >= 0, "Expected every audio rendition in the master playlist")
+	assert.True(t, first < second && second < third, "Expected audio renditions ordered by qualityRanking:\n%s", master)
+
+	mixed := strings.Replace(testQualityRankingMPD, `<Representation id="a_third"`,
+		`<Representation id="a_unranked" bandwidth="256000"/><Representation id="a_zero" bandwidth="32000" qualityRanking="0"/><Representation id="a_third"`, 1)
+	mixedOrigin := newTestOrigin(t, mixed)
+	sm = newTestManager(t, channels.Channel{Id: "mixed", ManifestURL: mixedOrigin.URL("/manifest.mpd")})
+	sess, err = sm.GetOrCreateSession("mixed")
+	require.NoError(t, err)
+	master, err = sess.GetMasterPlaylist()
+	require.NoError(t, err)
+	zero := strings.Index(master, "audio/a_zero/")
+	first = strings.Index(master, "audio/a_first/")
+	third = strings.Index(master, "audio/a_third/")
+	unranked := strings.Index(master, "audio/a_unranked/")
+	require.True(t, zero >= 0 && unranked >= 0, "Expected every audio rendition in the master playlist")
+	assert.True(t, zero < first && third < unranked, "Expected a_zero first and a_unranked last:\n%s", master)
+}
+
+// TestSession_PinLimit verifies that a session keeps a bounded number of pinned representations, dropping
+// the least recently used pin, along with its playlist, to make room for a new one.
+func TestSession_PinLimit(t *testing.T) {
+	var extra strings.Builder
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(&extra, `<Representation id="v_pin%d" bandwidth="%d" qualityRanking="%d"/>`, i, 1000000-i*100000, 2+i)
+	}
+	manifest := strings.Replace(testQualityRankingMPD, `<Representation id="v_best"`, extra.String()+`<Representation id="v_best"`, 1)
+	origin := newTestOrigin(t, manifest)
+	sm := newTestManager(t, channels.Channel{Id: "pins", ManifestURL: origin.URL("/manifest.mpd")})
+	sess, err := sm.GetOrCreateSession("pins")
+	require.NoError(t, err)
+
+	_, err = sess.GetPinnedMasterPlaylist("v_pin1")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := sess.GetMediaPlaylist("video", "v_pin1")
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond, "Expected the pinned representation to be downloaded")
+
+	for i := 2; i <= 5; i++ {
+		time.Sleep(10 * time.Millisecond) // Orders the pins by last use
+		_, err = sess.GetPinnedMasterPlaylist(fmt.Sprintf("v_pin%d", i))
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		_, err := sess.GetMediaPlaylist("video", "v_pin1")
+		return errors.Is(err, session.ErrPlaylistWarmingUp)
+	}, 10*time.Second, 50*time.Millisecond, "Expected the least recently used pin to be dropped")
+	require.Eventually(t, func() bool {
+		_, err := sess.GetMediaPlaylist("video", "v_pin5")
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond, "Expected the newest pin to be downloaded")
+}
+
+// TestSession_MasterPlaylistDuringRefresh verifies that master playlists can be generated while MPD refreshes
+// add and drop representations. Run it with -race to check that the session's MPD is read under its lock.
+func TestSession_MasterPlaylistDuringRefresh(t *testing.T) {
+	origin := newTestOrigin(t, testQualityRankingMPD)
+	sm := newTestManager(t, channels.Channel{Id: "refresh", ManifestURL: origin.URL("/manifest.mpd"), MasterPlaylistMaxAge: 1})
+	sess, err := sm.GetOrCreateSession("refresh")
+	require.NoError(t, err)
+
+	withExtraAudio := strings.Replace(testQualityRankingMPD, `<Representation id="a_second"`,
+		`<Representation id="a_fourth" bandwidth="48000" qualityRanking="4"/><Representation id="a_second"`, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	var wg sync.WaitGroup
+	for _, get := range []func() (string, error){
+		sess.GetMasterPlaylist,
+		func() (string, error) { return sess.GetPinnedMasterPlaylist("v_high_bw") },
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				master, err := get()
+				if !assert.NoError(t, err) || !assert.Contains(t, master, "#EXT-X-STREAM-INF:") {
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; time.Now().Before(deadline); i++ {
+		if i%2 == 0 {
+			origin.SetManifest(withExtraAudio)
+		} else {
+			origin.SetManifest(testQualityRankingMPD)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	wg.Wait()
+	assert.GreaterOrEqual(t, origin.Requests("/manifest.mpd"), 3, "Expected the MPD to be refreshed during the test")
+}
+
+// TestSession_MasterPlaylistRegeneratedOnRepresentationChange verifies that the cached master playlist
+// is regenerated once an MPD refresh adds a representation, and that the new one is downloaded.
+func TestSession_MasterPlaylistRegeneratedOnRepresentationChange(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd"), MasterPlaylistMaxAge: 3600})
+
+	sess, err := sm.GetOrCreateSession("live")
+	require.NoError(t, err)
+
+	master, err := sess.GetMasterPlaylist()
+	require.NoError(t, err)
+	assert.NotContains(t, master, "audio/a2/")
+
+	origin.SetManifest(strings.Replace(testLiveMPD,
+		`<Representation id="a1" bandwidth="128000" codecs="mp4a.40.2"/>`,
+		`<Representation id="a1" bandwidth="128000" codecs="mp4a.40.2"/><Representation id="a2" bandwidth="64000" codecs="mp4a.40.2"/>`, 1))
+
+	// The max age is an hour, so only the representation change can trigger the regeneration.
+	assert.Eventually(t, func() bool {
+		master, err := sess.GetMasterPlaylist()
+		return err == nil && strings.Contains(master, "audio/a2/playlist.m3u8")
+	}, 6*time.Second, 100*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return origin.Requests("/init-a2.mp4") > 0
+	}, 2*time.Second, 50*time.Millisecond)
+}
+
+// TestSession_PrewarmOnSwitch verifies that the first playlist request for a video representation that is not
+// downloaded fetches the end of the current window for it, with a media sequence aligned to the selected variant.
+func TestSession_PrewarmOnSwitch(t *testing.T) {
+	origin := newTestOrigin(t, testQualityRankingMPD)
+	sm := newTestManager(t, channels.Channel{Id: "ranked", ManifestURL: origin.URL("/manifest.mpd"), PrewarmSegments: 2})
+
+	sess, err := sm.GetOrCreateSession("ranked")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(sess.GetWindow()["v_best"].Segments) >= 2
+	}, 10*time.Second, 50*time.Millisecond, "Expected the selected variant to download a window")
+
+	reference := sess.GetWindow()["v_best"]
+	prewarmed := reference.Segments[len(reference.Segments)-2:]
+	_, err = sess.GetMediaPlaylist("video", "v_high_bw")
+	assert.Error(t, err, "Expected no playlist before the switch")
+
+	require.Eventually(t, func() bool {
+		for _, seg := range prewarmed {
+			if origin.Requests(fmt.Sprintf("/v_high_bw/%d.m4s", seg.Time)) == 0 {
+				return false
+			}
+		}
+		return len(sess.GetWindow()["v_high_bw"].Segments) >= 2
+	}, 5*time.Second, 50*time.Millisecond, "Expected the window of the new variant to be pre-warmed")
+
+	window := sess.GetWindow()["v_high_bw"]
+	assert.Equal(t, prewarmed[0].Time, window.Segments[0].Time)
+	assert.Equal(t, prewarmed[0].MediaSequence, window.Segments[0].MediaSequence)
+
+	// Later requests do not pre-warm again.
+	_, _ = sess.GetMediaPlaylist("video", "v_high_bw")
+	assert.Equal(t, 1, origin.Requests(fmt.Sprintf("/v_high_bw/%d.m4s", prewarmed[0].Time)))
+}
+
+// testUTCTimingMPD is a live manifest whose timeline repeats until the live edge, which can only be
+// placed correctly from the server clock. TIME_URL is replaced with the time source.
+const testUTCTimingMPD = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" minimumUpdatePeriod="PT2S" maxSegmentDuration="PT2S" availabilityStartTime="1970-01-01T00:00:00Z">
+	<Period id="p0" start="PT0S">
+		<AdaptationSet id="1" contentType="video" mimeType="video/mp4" codecs="avc1.640028">
+			<SegmentTemplate timescale="1000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Time$.m4s">
+				<SegmentTimeline><S t="0" d="2000" r="-1"/></SegmentTimeline>
+			</SegmentTemplate>
+			<Representation id="v1" bandwidth="1000000"/>
+		</AdaptationSet>
+	</Period>
+	<UTCTiming schemeIdUri="urn:mpeg:dash:utc:ntp:2014" value="ntp.example.com"/>
+	<UTCTiming schemeIdUri="urn:mpeg:dash:utc:http-iso:2014" value="TIME_URL"/>
+</MPD>`
+
+// TestSession_UTCTimingCalibratesPlayhead verifies that the live edge, and so the initial playhead,
+// follows the server clock read from UTCTiming rather than the local clock.
+func TestSession_UTCTimingCalibratesPlayhead(t *testing.T) {
+	timeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "1970-01-01T00:01:01.000Z")
+	}))
+	defer timeServer.Close()
+
+	origin := newTestOrigin(t, strings.Replace(testUTCTimingMPD, "TIME_URL", timeServer.URL, 1))
+	sm := newTestManager(t, channels.Channel{Id: "utc", ManifestURL: origin.URL("/manifest.mpd")})
+
+	sess, err := sm.GetOrCreateSession("utc")
+	require.NoError(t, err)
+
+	// At 61s on the server clock, 30 segments of 2s are complete.
+	timeline, found := sess.GetTimeline("v1")
+	require.True(t, found)
+	require.Len(t, timeline.Segments, 1)
+	assert.Equal(t, 29, timeline.Segments[0].R)
+
+	// The default startup policy starts 4 segments behind the live edge.
+	require.Eventually(t, func() bool {
+		return len(sess.GetWindow()["v1"].Segments) > 0
+	}, 10*time.Second, 50*time.Millisecond, "Expected the first segment to be downloaded")
+	assert.Equal(t, uint64(52000), sess.GetWindow()["v1"].Segments[0].Time)
+}
+
+// TestSession_VideoLadder verifies that the channel's video ladder selects the variants of the master
+// playlist, and that every variant gets its own media playlist.
+func TestSession_VideoLadder(t *testing.T) {
+	testCases := []struct {
+		name     string
+		channel  channels.Channel
+		variants []string
+	}{
+		{"single-top by default", channels.Channel{}, []string{"v_best"}},
+		{"all", channels.Channel{VideoLadder: channels.VideoLadderAll}, []string{"v_best", "v_high_bw"}},
+		{"all capped", channels.Channel{VideoLadder: channels.VideoLadderAll, MaxVideoVariants: 1}, []string{"v_best"}},
+		{"list", channels.Channel{VideoLadder: channels.VideoLadderList, VideoRepresentations: []string{"v_high_bw"}}, []string{"v_high_bw"}},
+		{"list without a match", channels.Channel{VideoLadder: channels.VideoLadderList, VideoRepresentations: []string{"missing"}}, []string{"v_best"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			origin := newTestOrigin(t, testQualityRankingMPD)
+			tc.channel.Id, tc.channel.ManifestURL = "ranked", origin.URL("/manifest.mpd")
+			sm := newTestManager(t, tc.channel)
+
+			sess, err := sm.GetOrCreateSession("ranked")
+			require.NoError(t, err)
+			master, err := sess.GetMasterPlaylist()
+			require.NoError(t, err)
+
+			assert.Equal(t, len(tc.variants), strings.Count(master, "#EXT-X-STREAM-INF"))
+			// Variants are listed best first.
+			var lastIndex int
+			for _, repId := range tc.variants {
+				index := strings.Index(master, "video/"+repId+"/playlist.m3u8")
+				require.Positive(t, index, "Expected variant %s in the master playlist:\n%s", repId, master)
+				assert.Greater(t, index, lastIndex)
+				lastIndex = index
+			}
+
+			require.Eventually(t, func() bool {
+				for _, repId := range tc.variants {
+					if _, err := sess.GetMediaPlaylist("video", repId); err != nil {
+						return false
+					}
+				}
+				return true
+			}, 10*time.Second, 50*time.Millisecond, "Expected a media playlist for every variant")
+		})
+	}
+}
+
+// fakeDownloader answers every queued task at once with canned bytes, recording the segments it was asked for.
+type fakeDownloader struct {
+	mu       sync.Mutex
+	segments []models.Segment
+	stopped  bool
+}
+
+func (d *fakeDownloader) QueueDownload(task dash.DownloadTask) {
+	d.mu.Lock()
+	d.segments = append(d.segments, task.Segment)
+	d.mu.Unlock()
+	go func() {
+		task.Result <- dash.DownloadResult{Task: task, Data: []byte("fake:" + task.Segment.ID)}
+	}()
+}
+
+func (d *fakeDownloader) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = true
+}
+
+// Queued returns the IDs of the segments queued so far.
+func (d *fakeDownloader) Queued() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ids := make([]string, 0, len(d.segments))
+	for _, seg := range d.segments {
+		ids = append(ids, seg.ID)
+	}
+	return ids
+}
+
+// TestSession_FakeDownloader verifies, without fetching any segment over HTTP, that downloaded segments
+// populate the cache and the media playlists as the playhead advances.
+func TestSession_FakeDownloader(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+	downloader := &fakeDownloader{}
+	sm.SetDownloaderFactory(func() session.Downloader { return downloader })
+
+	sess, err := sm.GetOrCreateSession("live")
+	require.NoError(t, err)
+
+	// The playhead starts 4 segments behind the live edge at 20s and advances one segment per tick.
+	require.Eventually(t, func() bool {
+		playlist, err := sess.GetMediaPlaylist("video", "v1")
+		return err == nil && strings.Contains(playlist, "\n1260000.m4s\n")
+	}, 10*time.Second, 50*time.Millisecond, "Expected the playlist to grow as the playhead advances")
+
+	playlist, err := sess.GetMediaPlaylist("video", "v1")
+	require.NoError(t, err)
+	assert.Contains(t, playlist, "#EXT-X-MEDIA-SEQUENCE:0\n")
+	assert.Contains(t, playlist, "#EXTINF:2.000,\n1080000.m4s\n")
+
+	entry, found := sess.SegCache.Get("live/v1/1080000")
+	require.True(t, found)
+	assert.Equal(t, "fake:live/v1/1080000", string(entry))
+	assert.Contains(t, downloader.Queued(), "live/a1/576000")
+	assert.Contains(t, downloader.Queued(), "live/v1/init")
+
+	assert.Zero(t, origin.Requests("/seg-v1-1080000.m4s"), "Expected no segment to be fetched over HTTP")
+
+	sess.Stop()
+	downloader.mu.Lock()
+	defer downloader.mu.Unlock()
+	assert.True(t, downloader.stopped, "Expected the session to stop the downloader it owns")
+}
+
+// testQualityCapsMPD offers a video ladder with one representation that does not declare its dimensions.
+const testQualityCapsMPD = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" minimumUpdatePeriod="PT2S" maxSegmentDuration="PT2S">
+	<Period id="p0" start="PT0S">
+		<AdaptationSet id="1" contentType="video" mimeType="video/mp4" codecs="avc1.640028">
+			<SegmentTemplate timescale="1000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Time$.m4s">
+				<SegmentTimeline><S t="0" d="2000" r="9"/></SegmentTimeline>
+			</SegmentTemplate>
+			<Representation id="v1080" bandwidth="6000000" width="1920" height="1080"/>
+			<Representation id="v720" bandwidth="3000000" width="1280" height="720"/>
+			<Representation id="v480" bandwidth="1500000" width="854" height="480"/>
+			<Representation id="v_nodims" bandwidth="2000000"/>
+		</AdaptationSet>
+	</Period>
+</MPD>`
+
+// TestSession_QualityCaps verifies that MaxWidth, MaxHeight and MaxBandwidth filter the video representations
+// before the ladder is chosen, that representations without dimensions are only capped by bandwidth, and that
+// the representation with the lowest bandwidth is kept when every one exceeds the caps, whatever its ranking.
+func TestSession_QualityCaps(t *testing.T) {
+	testCases := []struct {
+		name     string
+		channel  channels.Channel
+		variants []string
+		manifest string // testQualityCapsMPD when empty
+	}{
+		{"no caps", channels.Channel{}, []string{"v1080"}, ""},
+		{"max height", channels.Channel{MaxHeight: 720}, []string{"v720"}, ""},
+		{"max width with all variants", channels.Channel{MaxWidth: 1280, VideoLadder: channels.VideoLadderAll}, []string{"v720", "v_nodims", "v480"}, ""},
+		{"max bandwidth", channels.Channel{MaxBandwidth: 2500000}, []string{"v_nodims"}, ""},
+		{"tiny height keeps undeclared dimensions", channels.Channel{MaxHeight: 100}, []string{"v_nodims"}, ""},
+		{"every representation exceeds the caps", channels.Channel{MaxBandwidth: 1000000}, []string{"v480"}, ""},
+		{"every ranked representation exceeds the caps", channels.Channel{MaxBandwidth: 1000000}, []string{"v_best"}, testQualityRankingMPD},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.manifest == "" {
+				tc.manifest = testQualityCapsMPD
+			}
+			origin := newTestOrigin(t, tc.manifest)
+			tc.channel.Id, tc.channel.ManifestURL = "capped", origin.URL("/manifest.mpd")
+			sm := newTestManager(t, tc.channel)
+
+			sess, err := sm.GetOrCreateSession("capped")
+			require.NoError(t, err)
+			master, err := sess.GetMasterPlaylist()
+			require.NoError(t, err)
+
+			assert.Equal(t, len(tc.variants), strings.Count(master, "#EXT-X-STREAM-INF"), master)
+			for _, repId := range tc.variants {
+				assert.Contains(t, master, "video/"+repId+"/playlist.m3u8")
+			}
+		})
+	}
+}
+
+// testAudioOnlyMPD is a radio-style live stream without any video adaptation set.
+const testAudioOnlyMPD = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" minimumUpdatePeriod="PT2S" maxSegmentDuration="PT2S" availabilityStartTime="1970-01-01T00:00:00Z">
+	<Period id="p0" start="PT0S">
+		<AdaptationSet id="1" contentType="audio" lang="en" mimeType="audio/mp4">
+			<SegmentTemplate timescale="48000" initialization="init-$RepresentationID$.mp4" media="seg-$RepresentationID$-$Time$.m4s">
+				<SegmentTimeline>
+					<S t="0" d="96000" r="9"/>
+				</SegmentTimeline>
+			</SegmentTemplate>
+			<Representation id="a1" bandwidth="128000" codecs="mp4a.40.2"/>
+		</AdaptationSet>
+	</Period>
+</MPD>`
+
+// TestSession_AudioOnly verifies that an audio-only channel is clocked by its audio adaptation set and that
+// its master playlist advertises the audio as a variant stream.
+func TestSession_AudioOnly(t *testing.T) {
+	origin := newTestOrigin(t, testAudioOnlyMPD)
+	sm := newTestManager(t, channels.Channel{Id: "radio", ManifestURL: origin.URL("/manifest.mpd")})
+
+	sess, err := sm.GetOrCreateSession("radio")
+	require.NoError(t, err)
+
+	master, err := sess.GetMasterPlaylist()
+	require.NoError(t, err)
+	assert.Contains(t, master, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"en\",DEFAULT=YES")
+	assert.Contains(t, master, "#EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS=\"mp4a.40.2\",AUDIO=\"audio\"\naudio/a1/playlist.m3u8\n")
+
+	// The playhead starts 4 segments behind the live edge at 12s and advances with the audio segments.
+	require.Eventually(t, func() bool {
+		playlist, err := sess.GetMediaPlaylist("audio", "a1")
+		return err == nil && strings.Contains(playlist, "\n672000.m4s\n")
+	}, 10*time.Second, 50*time.Millisecond, "Expected the audio playlist to grow as the playhead advances")
+
+	playlist, err := sess.GetMediaPlaylist("audio", "a1")
+	require.NoError(t, err)
+	assert.Contains(t, playlist, "#EXTINF:2.000,\n576000.m4s\n")
+}
+
+// TestSession_IdleTeardown verifies that a session without requests is stopped and removed once the idle
+// timeout passes, releasing its segments, while a session that keeps being requested stays up.
+func TestSession_IdleTeardown(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManagerWithConfig(t, &channels.ChannelConfig{
+		Name:               "test",
+		Id:                 "test",
+		SessionIdleTimeout: 1,
+		Channels: []channels.Channel{
+			{Id: "idle", ManifestURL: origin.URL("/manifest.mpd")},
+			{Id: "watched", ManifestURL: origin.URL("/manifest.mpd")},
+		},
+	})
+
+	idle, err := sm.GetOrCreateSession("idle")
+	require.NoError(t, err)
+	watched, err := sm.GetOrCreateSession("watched")
+	require.NoError(t, err)
+	assert.Contains(t, sm.GetAllActiveSegmentKeys(), "idle/v1/init")
+
+	deadline := time.Now().Add(2500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		_, err := watched.GetMasterPlaylist()
+		require.NoError(t, err)
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	_, found := sm.GetSession("idle")
+	assert.False(t, found, "Expected the idle session to be removed")
+	for key := range sm.GetAllActiveSegmentKeys() {
+		assert.False(t, strings.HasPrefix(key, "idle/"), "Expected no active segments of the idle session, got %s", key)
+	}
+	current, found := sm.GetSession("watched")
+	require.True(t, found, "Expected the requested session to stay up")
+	assert.Same(t, watched, current)
+
+	// A new request for the channel starts a fresh session.
+	recreated, err := sm.GetOrCreateSession("idle")
+	require.NoError(t, err)
+	assert.NotSame(t, idle, recreated)
+}
+
+// TestSession_PlaylistWarmingUp verifies that the playlist of a valid representation without segments yet
+// reports that it is warming up, while an unknown representation is reported as such.
+func TestSession_PlaylistWarmingUp(t *testing.T) {
+	origin := newTestOrigin(t, testQualityRankingMPD)
+	sm := newTestManager(t, channels.Channel{Id: "ranked", ManifestURL: origin.URL("/manifest.mpd")})
+
+	sess, err := sm.GetOrCreateSession("ranked")
+	require.NoError(t, err)
+
+	// v_high_bw is in the MPD but not downloaded, since only the best video variant is selected.
+	_, err = sess.GetMediaPlaylist("video", "v_high_bw")
+	assert.ErrorIs(t, err, session.ErrPlaylistWarmingUp)
+	assert.NotErrorIs(t, err, session.ErrUnknownRepresentation)
+
+	_, err = sess.GetMediaPlaylist("video", "missing")
+	assert.ErrorIs(t, err, session.ErrUnknownRepresentation)
+	assert.NotErrorIs(t, err, session.ErrPlaylistWarmingUp)
+}
+
+// heldDownloader is a fakeDownloader that delivers init segments at once but holds media segment
+// results until release is closed, so that they stay in flight.
+type heldDownloader struct {
+	fakeDownloader
+	release chan struct{}
+}
+
+func (d *heldDownloader) QueueDownload(task dash.DownloadTask) {
+	d.mu.Lock()
+	d.segments = append(d.segments, task.Segment)
+	d.mu.Unlock()
+	go func() {
+		if !task.Segment.IsInit {
+			<-d.release
+		}
+		task.Result <- dash.DownloadResult{Task: task, Data: []byte("fake:" + task.Segment.ID)}
+	}()
+}
+
+// TestSession_LookAheadSegments verifies that a session queues the configured number of segments after
+// the playhead, that segments still in flight are neither queued again nor evictable, and that they
+// are listed once downloaded.
+func TestSession_LookAheadSegments(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t, channels.Channel{Id: "ahead", ManifestURL: origin.URL("/manifest.mpd"), LookAheadSegments: 2})
+	downloader := &heldDownloader{release: make(chan struct{})}
+	sm.SetDownloaderFactory(func() session.Downloader { return downloader })
+
+	sess, err := sm.GetOrCreateSession("ahead")
+	require.NoError(t, err)
+
+	// The playhead starts at 1080000; the next tick moves it to 1260000 and looks ahead to 1620000.
+	require.Eventually(t, func() bool {
+		for _, id := range downloader.Queued() {
+			if id == "ahead/v1/1620000" {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 20*time.Millisecond)
+
+	counts := make(map[string]int)
+	for _, id := range downloader.Queued() {
+		counts[id]++
+	}
+	for _, id := range []string{"ahead/v1/1080000", "ahead/v1/1260000", "ahead/v1/1440000"} {
+		assert.Equal(t, 1, counts[id], "Expected %s to be queued once", id)
+	}
+	active := sm.GetAllActiveSegmentKeys()
+	assert.Contains(t, active, "ahead/v1/1440000", "Expected a segment in flight to be kept in the cache")
+
+	close(downloader.release)
+	require.Eventually(t, func() bool {
+		window := sess.GetWindow()["v1"].Segments
+		return len(window) >= 4 && window[len(window)-1].Time == 1620000
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Without LookAheadSegments, the StartupPolicy's prefetch depth applies, which for the default policy
+	// is the segment under the playhead alone.
+	policyDownloader := &heldDownloader{release: make(chan struct{})}
+	defer close(policyDownloader.release)
+	sm = newTestManager(t, channels.Channel{Id: "policy", ManifestURL: origin.URL("/manifest.mpd")})
+	sm.SetDownloaderFactory(func() session.Downloader { return policyDownloader })
+	_, err = sm.GetOrCreateSession("policy")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return slices.Contains(policyDownloader.Queued(), "policy/v1/1260000")
+	}, 10*time.Second, 20*time.Millisecond)
+	assert.NotContains(t, policyDownloader.Queued(), "policy/v1/1440000", "Expected no segments queued ahead of the playhead")
+}
+
+// stalledDownloader is a fakeDownloader that never answers, so that a session waits for its init segments
+// for as long as it allows.
+type stalledDownloader struct {
+	fakeDownloader
+}
+
+func (d *stalledDownloader) QueueDownload(task dash.DownloadTask) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.segments = append(d.segments, task.Segment)
+}
+
+// slowStopDownloader is a fakeDownloader whose Stop blocks until release is closed, like a downloader
+// waiting for its workers to finish.
+type slowStopDownloader struct {
+	fakeDownloader
+	stopping chan struct{}
+	release  chan struct{}
+}
+
+func (d *slowStopDownloader) Stop() {
+	close(d.stopping)
+	<-d.release
+	d.fakeDownloader.Stop()
+}
+
+// TestSessionManager_StopOutsideLock verifies that stopping the manager does not hold its lock while the
+// sessions wait for their downloads.
+func TestSessionManager_StopOutsideLock(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t, channels.Channel{Id: "live", ManifestURL: origin.URL("/manifest.mpd")})
+	downloader := &slowStopDownloader{stopping: make(chan struct{}), release: make(chan struct{})}
+	var releaseOnce sync.Once
+	release := func() { releaseOnce.Do(func() { close(downloader.release) }) }
+	t.Cleanup(release) // Runs before the manager's cleanup, which would otherwise wait on a failed test
+	sm.SetDownloaderFactory(func() session.Downloader { return downloader })
+	_, err := sm.GetOrCreateSession("live")
+	require.NoError(t, err)
+
+	stopped := make(chan struct{})
+	go func() {
+		sm.Stop()
+		close(stopped)
+	}()
+	<-downloader.stopping
+
+	listed := make(chan []session.SessionInfo, 1)
+	go func() { listed <- sm.ListSessions() }()
+	select {
+	case infos := <-listed:
+		assert.Empty(t, infos, "A stopping session should no longer be listed")
+	case <-time.After(time.Second):
+		t.Fatal("The manager's lock should not be held while sessions stop")
+	}
+
+	release()
+	<-stopped
+}
+
+// TestSessionManager_StartOutsideLock verifies that a new session waiting for its init segments does not
+// hold up the manager, while requests for the same channel wait for the session to start.
+func TestSessionManager_StartOutsideLock(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t, channels.Channel{Id: "slow", ManifestURL: origin.URL("/manifest.mpd")})
+	sm.SetDownloaderFactory(func() session.Downloader { return &stalledDownloader{} })
+
+	created := make(chan *session.StreamSession, 1)
+	go func() {
+		sess, err := sm.GetOrCreateSession("slow")
+		assert.NoError(t, err)
+		created <- sess
+	}()
+	require.Eventually(t, func() bool {
+		_, found := sm.GetSession("slow")
+		return found
+	}, 5*time.Second, 10*time.Millisecond)
+
+	start := time.Now()
+	assert.Len(t, sm.ListSessions(), 1)
+	assert.Contains(t, sm.GetAllActiveSegmentKeys(), "slow/v1/init")
+	assert.Less(t, time.Since(start), time.Second, "Expected the manager not to wait for the session to start")
+
+	// The init segments are waited for up to 3s.
+	sess, err := sm.GetOrCreateSession("slow")
+	require.NoError(t, err)
+	assert.Greater(t, time.Since(start), 2*time.Second, "Expected a request for a starting session to wait for it to start")
+	assert.Same(t, <-created, sess)
+}
+
+// TestSession_WaitForPlaylist verifies that WaitForPlaylist blocks while a playlist is warming up, giving up
+// with ErrPlaylistWarmingUp once its context is done, and returns the playlist as soon as it is generated.
+func TestSession_WaitForPlaylist(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t, channels.Channel{Id: "wait", ManifestURL: origin.URL("/manifest.mpd")})
+	downloader := &heldDownloader{release: make(chan struct{})}
+	sm.SetDownloaderFactory(func() session.Downloader { return downloader })
+
+	sess, err := sm.GetOrCreateSession("wait")
+	require.NoError(t, err)
+	getVideo := func() (session.Playlist, error) { return sess.GetMediaPlaylistEntry("video", "v1") }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = sess.WaitForPlaylist(ctx, "v1", getVideo)
+	assert.ErrorIs(t, err, session.ErrPlaylistWarmingUp)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, "Expected the wait to last until the deadline")
+
+	_, err = sess.WaitForPlaylist(context.Background(), "missing", func() (session.Playlist, error) {
+		return sess.GetMediaPlaylistEntry("video", "missing")
+	})
+	assert.ErrorIs(t, err, session.ErrUnknownRepresentation, "Expected an unknown representation not to be waited for")
+
+	start = time.Now()
+	_, err = sess.WaitForPlaylist(context.Background(), "missing", func() (session.Playlist, error) {
+		return session.Playlist{}, session.ErrPlaylistWarmingUp
+	})
+	assert.ErrorIs(t, err, session.ErrPlaylistWarmingUp)
+	assert.Less(t, time.Since(start), time.Second, "Expected no wait for a representation the MPD does not have")
+
+	close(downloader.release)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	playlist, err := sess.WaitForPlaylist(ctx, "v1", getVideo)
+	require.NoError(t, err)
+	assert.Contains(t, playlist.Body, "#EXTINF:")
+}
+
+// latencyDownloader is a fakeDownloader whose downloads report a fixed queue wait and transfer time.
+type latencyDownloader struct {
+	fakeDownloader
+	queueWait, transferTime time.Duration
+}
+
+func (d *latencyDownloader) QueueDownload(task dash.DownloadTask) {
+	go func() {
+		task.Result <- dash.DownloadResult{Task: task, Data: []byte("fake:" + task.Segment.ID), QueueWait: d.queueWait, TransferTime: d.transferTime}
+	}()
+}
+
+// TestSession_DownloadLatencyHistograms verifies that the queue wait, transfer time and total latency of
+// the channel's downloads populate the matching histogram buckets.
+func TestSession_DownloadLatencyHistograms(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t, channels.Channel{Id: "latency", ManifestURL: origin.URL("/manifest.mpd")})
+	sm.SetDownloaderFactory(func() session.Downloader {
+		return &latencyDownloader{queueWait: 30 * time.Millisecond, transferTime: 700 * time.Millisecond}
+	})
+
+	_, err := sm.GetOrCreateSession("latency")
+	require.NoError(t, err)
+
+	queueWait := metrics.SegmentQueueWaitSeconds.WithLabel("latency")
+	transfer := metrics.SegmentTransferSeconds.WithLabel("latency")
+	total := metrics.SegmentLatencySeconds.WithLabel("latency")
+	require.Eventually(t, func() bool { return total.Count() >= 2 }, 5*time.Second, 50*time.Millisecond)
+
+	// The buckets of 0.025s, 0.05s, 0.5s and 1s are at indexes 2, 3, 6 and 7 of the latency buckets.
+	require.Equal(t, []float64{0.025, 0.05, 0.5, 1}, []float64{metrics.LatencyBuckets[2], metrics.LatencyBuckets[3], metrics.LatencyBuckets[6], metrics.LatencyBuckets[7]})
+	counts := queueWait.CumulativeCounts()
+	assert.Zero(t, counts[2])
+	assert.Equal(t, queueWait.Count(), counts[3], "Expected every queue wait of 30ms in the 0.05s bucket")
+	counts = transfer.CumulativeCounts()
+	assert.Zero(t, counts[6])
+	assert.Equal(t, transfer.Count(), counts[7], "Expected every transfer of 700ms in the 1s bucket")
+	counts = total.CumulativeCounts()
+	assert.Zero(t, counts[6])
+	assert.Equal(t, total.Count(), counts[7], "Expected every latency of 730ms in the 1s bucket")
+	assert.InDelta(t, 0.73*total.Count(), total.Sum(), 1e-6)
+}
+
+// TestSessionManager_Reload verifies that a reloaded configuration stops the sessions of changed and removed
+// channels, keeps those of unchanged channels, and makes added channels available.
+func TestSessionManager_Reload(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	newOrigin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t,
+		channels.Channel{Id: "kept", ManifestURL: origin.URL("/manifest.mpd")},
+		channels.Channel{Id: "changed", ManifestURL: origin.URL("/manifest.mpd")},
+		channels.Channel{Id: "removed", ManifestURL: origin.URL("/manifest.mpd")},
+	)
+
+	kept, err := sm.GetOrCreateSession("kept")
+	require.NoError(t, err)
+	_, err = sm.GetOrCreateSession("changed")
+	require.NoError(t, err)
+	_, err = sm.GetOrCreateSession("removed")
+	require.NoError(t, err)
+	_, err = sm.GetOrCreateSession("added")
+	require.Error(t, err)
+
+	sm.Reload(&channels.ChannelConfig{Name: "test", Id: "test", Channels: []channels.Channel{
+		{Id: "kept", ManifestURL: origin.URL("/manifest.mpd")},
+		{Id: "changed", ManifestURL: newOrigin.URL("/manifest.mpd")},
+		{Id: "added", ManifestURL: newOrigin.URL("/manifest.mpd")},
+	}})
+
+	current, found := sm.GetSession("kept")
+	require.True(t, found, "Expected the session of an unchanged channel to be kept")
+	assert.Same(t, kept, current)
+	_, found = sm.GetSession("changed")
+	assert.False(t, found, "Expected the session of a changed channel to be stopped")
+	_, found = sm.GetSession("removed")
+	assert.False(t, found, "Expected the session of a removed channel to be stopped")
+
+	changed, err := sm.GetOrCreateSession("changed")
+	require.NoError(t, err)
+	assert.Equal(t, newOrigin.URL("/manifest.mpd"), changed.ManifestURL)
+	_, err = sm.GetOrCreateSession("removed")
+	assert.Error(t, err)
+	_, err = sm.GetOrCreateSession("added")
+	assert.NoError(t, err)
+}
+
+// TestSession_TimelineDurations verifies that with TimelineDurations a playlist reflects a segment duration
+// corrected by an MPD refresh, while by default it keeps the duration recorded at download time.
+func TestSession_TimelineDurations(t *testing.T) {
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t,
+		channels.Channel{Id: "stored", ManifestURL: origin.URL("/manifest.mpd")},
+		channels.Channel{Id: "timeline", ManifestURL: origin.URL("/manifest.mpd"), TimelineDurations: true},
+	)
+
+	storedSess, err := sm.GetOrCreateSession("stored")
+	require.NoError(t, err)
+	timelineSess, err := sm.GetOrCreateSession("timeline")
+	require.NoError(t, err)
+	for _, sess := range []*session.StreamSession{storedSess, timelineSess} {
+		require.Eventually(t, func() bool {
+			playlist, err := sess.GetMediaPlaylist("video", "v1")
+			return err == nil && strings.Contains(playlist, "#EXTINF:2.000,\n1080000.m4s")
+		}, 10*time.Second, 20*time.Millisecond)
+	}
+
+	// The refreshed MPD shortens the segment at 12s, which was already downloaded as a 2s segment.
+	origin.SetManifest(strings.Replace(testLiveMPD, `<S t="0" d="180000" r="9"/>`,
+		`<S t="0" d="180000" r="5"/><S t="1080000" d="171000"/><S t="1251000" d="180000" r="3"/>`, 1))
+
+	require.Eventually(t, func() bool {
+		playlist, _ := timelineSess.GetMediaPlaylist("video", "v1")
+		return strings.Contains(playlist, "#EXTINF:1.900,\n1080000.m4s")
+	}, 10*time.Second, 50*time.Millisecond, "Expected the corrected duration in the playlist")
+
+	require.Eventually(t, func() bool {
+		timeline, _ := storedSess.GetTimeline("v1")
+		return len(timeline.Segments) == 3
+	}, 10*time.Second, 50*time.Millisecond, "Expected the refreshed timeline to be merged")
+	time.Sleep(1100 * time.Millisecond) // Let the playlist loop run after the merge
+	playlist, err := storedSess.GetMediaPlaylist("video", "v1")
+	require.NoError(t, err)
+	assert.Contains(t, playlist, "#EXTINF:2.000,\n1080000.m4s", "The recorded duration should be kept by default")
+}
+
+// TestSession_TimeShiftBufferDepth verifies that a playhead left behind the MPD's timeShiftBufferDepth skips
+// ahead instead of requesting segments the origin no longer serves, and that expired segments leave the window.
+func TestSession_TimeShiftBufferDepth(t *testing.T) {
+	mpd := strings.Replace(testLiveMPD, `availabilityStartTime=`, `timeShiftBufferDepth="PT8S" availabilityStartTime=`, 1)
+	origin := newTestOrigin(t, mpd)
+	sm := newTestManager(t, channels.Channel{Id: "dvr", ManifestURL: origin.URL("/manifest.mpd")})
+	sess, err := sm.GetOrCreateSession("dvr")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(sess.GetWindow()["v1"].Segments) > 0
+	}, 10*time.Second, 20*time.Millisecond)
+
+	// The origin's live edge jumps 20s ahead, to 40s, so its buffer now starts at 32s.
+	origin.SetManifest(strings.Replace(mpd, `<S t="0" d="180000" r="9"/>`, `<S t="1800000" d="180000" r="9"/>`, 1))
+
+	require.Eventually(t, func() bool {
+		segments := sess.GetWindow()["v1"].Segments
+		return len(segments) > 0 && segments[0].Time >= 2880000
+	}, 15*time.Second, 50*time.Millisecond, "Expected the window to only hold segments within the time shift buffer")
+
+	for segmentTime := uint64(1800000); segmentTime < 2700000; segmentTime += 180000 {
+		assert.Zero(t, origin.Requests(fmt.Sprintf("/seg-v1-%d.m4s", segmentTime)), "Segment %d left the buffer before it was reached", segmentTime)
+	}
+	playlist, err := sess.GetMediaPlaylist("video", "v1")
+	require.NoError(t, err)
+	assert.NotContains(t, playlist, "\n1080000.m4s")
+}
+
+// truncatingDownloader is a fakeDownloader that answers the first download of every init segment with a
+// truncated body, as an origin having a transient error might, and later downloads with a valid init segment.
+type truncatingDownloader struct {
+	fakeDownloader
+	validInit []byte
+}
+
+func (d *truncatingDownloader) QueueDownload(task dash.DownloadTask) {
+	d.mu.Lock()
+	attempts := 0
+	for _, seg := range d.segments {
+		if seg.ID == task.Segment.ID {
+			attempts++
+		}
+	}
+	d.segments = append(d.segments, task.Segment)
+	d.mu.Unlock()
+
+	data := []byte("fake:" + task.Segment.ID)
+	if task.Segment.IsInit {
+		data = d.validInit
+		if attempts == 0 {
+			data = d.validInit[:len(d.validInit)-4]
+		}
+	}
+	go func() {
+		task.Result <- dash.DownloadResult{Task: task, Data: data}
+	}()
+}
+
+// TestSession_ValidateInitSegments verifies that a malformed init segment is rejected rather than cached,
+// and fetched again until a valid copy is cached.
+func TestSession_ValidateInitSegments(t *testing.T) {
+	validInit := append(mp4Box("ftyp", []byte("iso6\x00\x00\x00\x00")), mp4Box("moov", mp4Box("mvhd", []byte{1, 2, 3, 4}))...)
+	origin := newTestOrigin(t, testLiveMPD)
+	sm := newTestManager(t, channels.Channel{Id: "validate", ManifestURL: origin.URL("/manifest.mpd"), ValidateInitSegments: true})
+	downloader := &truncatingDownloader{validInit: validInit}
+	sm.SetDownloaderFactory(func() session.Downloader { return downloader })
+
+	sess, err := sm.GetOrCreateSession("validate")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		data, found := sess.SegCache.Get("validate/v1/init")
+		return found && assert.Equal(t, validInit, data, "A malformed init segment was cached")
+	}, 5*time.Second, 20*time.Millisecond)
+	queued := 0
+	for _, id := range downloader.Queued() {
+		if id == "validate/v1/init" {
+			queued++
+		}
+	}
+	assert.Equal(t, 2, queued, "Expected the malformed init segment to be fetched again once")
+}
+
+// TestSession_FirstPeriodStartOffset verifies that a first period starting later than the presentation, or
+// a timeline offset by presentationTimeOffset, starts the session at the same segment as a plain timeline:
+// the initial playhead and the downloads agree on how media time maps to presentation time.
+func TestSession_FirstPeriodStartOffset(t *testing.T) {
+	for _, tc := range []struct {
+		name, start, pto, firstTime string
+		wantPlayhead                float64
+		wantSegment                 string
+	}{
+		{"no offset", "PT0S", "0", "0", 12, "1080000"},
+		{"period start", "PT30S", "0", "0", 42, "1080000"},
+		{"presentation time offset", "PT0S", "900000", "900000", 12, "1980000"},
+		{"both", "PT30S", "900000", "900000", 42, "1980000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			manifest := strings.NewReplacer(
+				`start="PT0S"`, fmt.Sprintf(`start="%s"`, tc.start),
+				`<Representation id="v1"`, fmt.Sprintf(`<Representation id="v1" presentationTimeOffset="%s"`, tc.pto),
+				`<S t="0" d="180000" r="9"/>`, fmt.Sprintf(`<S t="%s" d="180000" r="9"/>`, tc.firstTime),
+			).Replace(testLiveMPD)
+			origin := newTestOrigin(t, manifest)
+			sm := newTestManager(t, channels.Channel{Id: "offset", ManifestURL: origin.URL("/manifest.mpd")})
+			downloader := &fakeDownloader{}
+			sm.SetDownloaderFactory(func() session.Downloader { return downloader })
+
+			_, err := sm.GetOrCreateSession("offset")
+			require.NoError(t, err)
+			infos := sm.ListSessions()
+			require.Len(t, infos, 1)
+			assert.InDelta(t, tc.wantPlayhead, infos[0].Playhead, 2, "The playhead should start 4 segments behind the live edge in presentation time")
+
+			require.Eventually(t, func() bool {
+				for _, id := range downloader.Queued() {
+					if strings.HasPrefix(id, "offset/v1/") && id != "offset/v1/init" {
+						return true
+					}
+				}
+				return false
+			}, 5*time.Second, 20*time.Millisecond)
+			var first string
+			for _, id := range downloader.Queued() {
+				if strings.HasPrefix(id, "offset/v1/") && id != "offset/v1/init" {
+					first = id
+					break
+				}
+			}
+			assert.Equal(t, "offset/v1/"+tc.wantSegment, first, "The first download should be the segment under the initial playhead")
+		})
+	}
+}
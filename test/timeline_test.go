@@ -2,9 +2,16 @@ package main_test
 
 import (
 	"dash2hlsd/internal/dash"
+	"dash2hlsd/internal/hls"
+	"dash2hlsd/internal/models"
+	"encoding/xml"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMergeTimelines(t *testing.T) {
@@ -94,3 +101,216 @@ func TestMergeTimelines(t *testing.T) {
 		assert.Equal(t, uint64(10), merged.Segments[0].T)
 	})
 }
+
+// TestMergeSegmentLists verifies that a refreshed SegmentList is merged by segment number, and adopted as is
+// when it cannot be numbered consistently with the current list.
+func TestMergeSegmentLists(t *testing.T) {
+	list := func(start uint64, timeline []dash.S, media ...string) *dash.SegmentList {
+		l := &dash.SegmentList{Timescale: 1000, StartNumber: &start, Timeline: dash.SegmentTimeline{Segments: timeline}}
+		for _, m := range media {
+			l.SegmentURLs = append(l.SegmentURLs, dash.SegmentURL{Media: m})
+		}
+		return l
+	}
+	medias := func(l *dash.SegmentList) []string {
+		var media []string
+		for _, u := range l.SegmentURLs {
+			media = append(media, u.Media)
+		}
+		return media
+	}
+
+	t.Run("sliding", func(t *testing.T) {
+		current := list(1, []dash.S{{T: 0, D: 2000, R: 2}}, "s1", "s2", "s3")
+		refreshed := list(3, []dash.S{{T: 4000, D: 2000, R: 2}}, "s3", "s4", "s5")
+		merged := dash.MergeSegmentLists(current, refreshed)
+		assert.Equal(t, uint64(1), merged.GetStartNumber())
+		assert.Equal(t, []string{"s1", "s2", "s3", "s4", "s5"}, medias(merged))
+		assert.Len(t, dash.ExpandTimeline(merged.Timeline), 5)
+	})
+
+	t.Run("duration only", func(t *testing.T) {
+		current := list(1, nil, "s1", "s2")
+		refreshed := list(2, nil, "s2", "s3")
+		merged := dash.MergeSegmentLists(current, refreshed)
+		assert.Equal(t, []string{"s1", "s2", "s3"}, medias(merged))
+	})
+
+	t.Run("gap", func(t *testing.T) {
+		current := list(1, nil, "s1", "s2")
+		refreshed := list(5, nil, "s5")
+		assert.Same(t, refreshed, dash.MergeSegmentLists(current, refreshed))
+	})
+
+	t.Run("misaligned timeline", func(t *testing.T) {
+		current := list(1, []dash.S{{T: 0, D: 2000, R: 1}}, "s1", "s2")
+		refreshed := list(2, []dash.S{{T: 9000, D: 2000}}, "s2")
+		assert.Same(t, refreshed, dash.MergeSegmentLists(current, refreshed))
+	})
+}
+
+// TestFindSegment_MixedDurations verifies that each segment gets its true duration from the timeline,
+// including after a merge in which the origin revised the duration of already-announced segments.
+func TestFindSegment_MixedDurations(t *testing.T) {
+	timeline := dash.MergeTimelines(
+		dash.SegmentTimeline{Segments: []dash.S{{T: 0, D: 180000, R: 4}}},                              // 0..900000 in 2s segments
+		dash.SegmentTimeline{Segments: []dash.S{{T: 720000, D: 270000, R: 1}, {T: 1260000, D: 90000}}}, // revised tail
+	)
+
+	testCases := []struct {
+		time             uint64
+		expectedStart    uint64
+		expectedDuration uint64
+	}{
+		{0, 0, 180000},
+		{200000, 180000, 180000},
+		{800000, 720000, 270000}, // The old 2s segment at 720000 is superseded by the 3s one
+		{1000000, 990000, 270000},
+		{1300000, 1260000, 90000},
+		{5000000, 1260000, 90000}, // Past the live edge
+	}
+	for _, tc := range testCases {
+		start, duration, ok := dash.FindSegment(timeline, tc.time)
+		assert.True(t, ok)
+		assert.Equal(t, tc.expectedStart, start, "start for time %d", tc.time)
+		assert.Equal(t, tc.expectedDuration, duration, "duration for time %d", tc.time)
+	}
+
+	// The playlist reports each segment's own duration.
+	mpd := &dash.MPD{
+		MaxSegmentDuration: "PT3S",
+		Periods: []dash.Period{{Sets: []dash.AdaptationSet{{
+			ContentType:     "video",
+			SegmentTemplate: dash.SegmentTemplate{Timescale: 90000, Initialization: "init-$RepresentationID$.mp4"},
+			Representations: []dash.Representation{{ID: "v1"}},
+		}}}},
+	}
+	var segments []*models.Segment
+	for _, playhead := range []uint64{540000, 720000, 990000, 1260000} {
+		start, duration, ok := dash.FindSegment(timeline, playhead)
+		assert.True(t, ok)
+		segments = append(segments, &models.Segment{ID: fmt.Sprintf("%d", start), Time: start, Duration: duration})
+	}
+
+	playlist, err := hls.GenerateMediaPlaylist(mpd, "ch", "video", "v1", hls.KeyInfo{}, segments, hls.MediaPlaylistOptions{})
+	assert.NoError(t, err)
+	var extinfs []string
+	for _, line := range strings.Split(playlist, "\n") {
+		if strings.HasPrefix(line, "#EXTINF:") {
+			extinfs = append(extinfs, line)
+		}
+	}
+	assert.Equal(t, []string{"#EXTINF:2.000,", "#EXTINF:3.000,", "#EXTINF:3.000,", "#EXTINF:1.000,"}, extinfs)
+}
+
+// TestResolveOpenRepeats verifies that r="-1" is materialized up to the next S element, the period end
+// or, for a live presentation, the last segment completed at the live edge.
+func TestResolveOpenRepeats(t *testing.T) {
+	parse := func(t *testing.T, mpdType, mpdAttrs, periodAttrs, timeline string) *dash.MPD {
+		var mpd dash.MPD
+		data := fmt.Sprintf(`<MPD type="%s" %s><Period id="p0" start="PT0S" %s><AdaptationSet contentType="video">
+			<SegmentTemplate timescale="1000"><SegmentTimeline>%s</SegmentTimeline></SegmentTemplate>
+			<Representation id="v1"/></AdaptationSet></Period></MPD>`, mpdType, mpdAttrs, periodAttrs, timeline)
+		require.NoError(t, xml.Unmarshal([]byte(data), &mpd))
+		return &mpd
+	}
+	now := time.Date(2025, 1, 1, 0, 1, 0, 500_000_000, time.UTC)
+
+	t.Run("until the next S element", func(t *testing.T) {
+		mpd := parse(t, "static", "", "", `<S t="0" d="2000" r="-1"/><S t="10000" d="3000"/>`)
+		mpd.ResolveOpenRepeats(now)
+		segments := mpd.Periods[0].Sets[0].SegmentTemplate.Timeline.Segments
+		assert.Equal(t, 4, segments[0].R)
+		assert.Len(t, dash.ExpandTimeline(mpd.Periods[0].Sets[0].SegmentTemplate.Timeline), 6)
+	})
+
+	t.Run("until the presentation end", func(t *testing.T) {
+		mpd := parse(t, "static", `mediaPresentationDuration="PT9S"`, "", `<S t="0" d="2000" r="-1"/>`)
+		mpd.ResolveOpenRepeats(now)
+		// The last segment starts before the end, so it is listed even though it is cut short.
+		assert.Equal(t, 4, mpd.Periods[0].Sets[0].SegmentTemplate.Timeline.Segments[0].R)
+	})
+
+	t.Run("until the period duration", func(t *testing.T) {
+		mpd := parse(t, "dynamic", `availabilityStartTime="2025-01-01T00:00:00Z"`, `duration="PT8S"`, `<S t="0" d="2000" r="-1"/>`)
+		mpd.ResolveOpenRepeats(now)
+		assert.Equal(t, 3, mpd.Periods[0].Sets[0].SegmentTemplate.Timeline.Segments[0].R)
+	})
+
+	t.Run("until the live edge", func(t *testing.T) {
+		mpd := parse(t, "dynamic", `availabilityStartTime="2025-01-01T00:00:00Z"`, "", `<S t="0" d="2000" r="-1"/>`)
+		mpd.ResolveOpenRepeats(now)
+		// 60.5s have elapsed, so 30 segments are complete.
+		timeline := mpd.Periods[0].Sets[0].SegmentTemplate.Timeline
+		assert.Equal(t, 29, timeline.Segments[0].R)
+		start, duration, ok := dash.FindSegment(timeline, 59000)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(58000), start)
+		assert.Equal(t, uint64(2000), duration)
+	})
+
+	t.Run("unknown end", func(t *testing.T) {
+		mpd := parse(t, "static", "", "", `<S t="0" d="2000" r="-1"/>`)
+		mpd.ResolveOpenRepeats(now)
+		assert.Equal(t, 0, mpd.Periods[0].Sets[0].SegmentTemplate.Timeline.Segments[0].R)
+	})
+
+	t.Run("merges with a later manifest", func(t *testing.T) {
+		mpd := parse(t, "dynamic", `availabilityStartTime="2025-01-01T00:00:00Z"`, "", `<S t="0" d="2000" r="-1"/>`)
+		mpd.ResolveOpenRepeats(now)
+		later := parse(t, "dynamic", `availabilityStartTime="2025-01-01T00:00:00Z"`, "", `<S t="0" d="2000" r="-1"/>`)
+		later.ResolveOpenRepeats(now.Add(4 * time.Second))
+		merged := dash.MergeTimelines(mpd.Periods[0].Sets[0].SegmentTemplate.Timeline, later.Periods[0].Sets[0].SegmentTemplate.Timeline)
+		assert.Len(t, dash.ExpandTimeline(merged), 32)
+	})
+}
+
+// TestSegmentTimeline_ImplicitStart verifies that S elements without a t attribute continue from the end of
+// the previous element, while an explicit t="0" is told apart from a missing t.
+func TestSegmentTimeline_ImplicitStart(t *testing.T) {
+	var timeline dash.SegmentTimeline
+	require.NoError(t, xml.Unmarshal([]byte(`<SegmentTimeline>
+		<S t="1000" d="100" r="2"/>
+		<S d="50"/>
+		<S d="100" r="1"/>
+	</SegmentTimeline>`), &timeline))
+
+	var starts []uint64
+	for _, s := range dash.ExpandTimeline(timeline) {
+		starts = append(starts, s.T)
+	}
+	assert.Equal(t, []uint64{1000, 1100, 1200, 1300, 1350, 1450}, starts)
+	assert.Equal(t, uint64(1550), dash.TimelineEnd(timeline))
+
+	start, duration, ok := dash.FindSegment(timeline, 1360)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1350), start)
+	assert.Equal(t, uint64(100), duration)
+
+	number, ok := dash.SegmentNumber(&dash.SegmentTemplate{Timeline: timeline}, 1450)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(6), number)
+
+	// A refresh announcing the next segment keeps the implicit entries at their own start times.
+	merged := dash.MergeTimelines(timeline, dash.SegmentTimeline{Segments: []dash.S{{T: 1550, D: 100}}})
+	assert.Len(t, dash.ExpandTimeline(merged), 7)
+	assert.Equal(t, uint64(1650), dash.TimelineEnd(merged))
+
+	// The end is computed from the entries, so a long-running repeat is not expanded.
+	long := dash.SegmentTimeline{Segments: []dash.S{{T: 1000, D: 100, R: 1 << 40}}}
+	assert.Equal(t, uint64(1000+(1<<40+1)*100), dash.TimelineEnd(long))
+	// A revision that ends before an entry it overlaps does not move the end back.
+	revised := dash.SegmentTimeline{Segments: []dash.S{{T: 0, D: 10, R: 5}, {T: 20, D: 10}}}
+	assert.Equal(t, uint64(60), dash.TimelineEnd(revised))
+
+	t.Run("explicit zero", func(t *testing.T) {
+		var timeline dash.SegmentTimeline
+		require.NoError(t, xml.Unmarshal([]byte(`<SegmentTimeline><S t="0" d="100"/><S d="100"/></SegmentTimeline>`), &timeline))
+		start, explicit := timeline.Segments[0].Start()
+		assert.True(t, explicit)
+		assert.Zero(t, start)
+		start, explicit = timeline.Segments[1].Start()
+		assert.False(t, explicit)
+		assert.Zero(t, start)
+	})
+}